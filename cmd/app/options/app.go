@@ -2,11 +2,18 @@
 package options
 
 import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
 	cliflag "k8s.io/component-base/cli/flag"
 
+	"github.com/Improwised/kube-oidc-proxy/pkg/probe"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/resolver"
 	"github.com/Improwised/kube-oidc-proxy/pkg/util/flags"
 )
 
@@ -16,10 +23,22 @@ type KubeOIDCProxyOptions struct {
 	ReadinessProbePort   int
 	MaxGoroutines        int
 
-	FlushInterval time.Duration
+	FlushInterval     time.Duration
+	DiscoveryCacheTTL time.Duration
 
 	ExtraHeaderOptions ExtraHeaderOptions
 	TokenPassthrough   TokenPassthroughOptions
+	ClusterRouting     ClusterRoutingOptions
+	Kubeconfig         KubeconfigOptions
+	RateLimit          RateLimitOptions
+	ExecPolicy         ExecPolicyOptions
+	DenyRules          DenyRulesOptions
+	AccessRequests     AccessRequestOptions
+	MaxInFlight        MaxInFlightOptions
+	CircuitBreaker     CircuitBreakerOptions
+	ClusterHealth      ClusterHealthOptions
+	SessionRecording   SessionRecordingOptions
+	BreakGlass         BreakGlassOptions
 }
 
 type TokenPassthroughOptions struct {
@@ -38,6 +57,85 @@ type Cluster struct {
 	RoleConfig string
 }
 
+type KubeconfigOptions struct {
+	ServerAddress string
+	CAFile        string
+}
+
+type RateLimitOptions struct {
+	Config string
+}
+
+type ExecPolicyOptions struct {
+	Config string
+}
+
+// DenyRulesOptions configure the deny rules evaluated before RBAC.
+type DenyRulesOptions struct {
+	Config     string
+	CRDEnabled bool
+}
+
+// AccessRequestOptions configure the AccessRequest approval workflow.
+type AccessRequestOptions struct {
+	Enabled        bool
+	ApproverGroups []string
+	MaxDuration    time.Duration
+}
+
+// MaxInFlightOptions limit the requests in flight to each cluster, and by each
+// user to a cluster. Zero means unlimited.
+type MaxInFlightOptions struct {
+	NonMutating int
+	Mutating    int
+	LongRunning int
+
+	NonMutatingPerUser int
+	MutatingPerUser    int
+	LongRunningPerUser int
+}
+
+// CircuitBreakerOptions configure the circuit breaker of each cluster.
+type CircuitBreakerOptions struct {
+	FailureThreshold int
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+}
+
+// ClusterHealthOptions configure the background health checks of the
+// clusters and their effect on readiness.
+type ClusterHealthOptions struct {
+	Interval        time.Duration
+	Timeout         time.Duration
+	ReadinessPolicy string
+}
+
+// SessionRecordingOptions configure the recording of exec and attach
+// sessions.
+type SessionRecordingOptions struct {
+	Dir          string
+	Retention    time.Duration
+	RecordInput  bool
+	Clusters     []string
+	ViewerGroups []string
+}
+
+// BreakGlassOptions configure the break-glass group, whose privileges only
+// apply to requests with a justification.
+type BreakGlassOptions struct {
+	Group               string
+	SessionDuration     time.Duration
+	MaxSessions         int
+	Window              time.Duration
+	NotificationWebhook string
+}
+
+type ClusterRoutingOptions struct {
+	Mode         string
+	HostTemplate string
+	HostCertDir  string
+}
+
 func NewKubeOIDCProxyOptions(nfs *cliflag.NamedFlagSets) *KubeOIDCProxyOptions {
 	return new(KubeOIDCProxyOptions).AddFlags(nfs.FlagSet("Kube-OIDC-Proxy"))
 }
@@ -59,9 +157,25 @@ func (k *KubeOIDCProxyOptions) AddFlags(fs *pflag.FlagSet) *KubeOIDCProxyOptions
 			"immediately after each write. Streaming requests such as 'kubectl exec' "+
 			"will ignore this option and flush immediately.")
 
+	fs.DurationVar(&k.DiscoveryCacheTTL, "discovery-cache-ttl", k.DiscoveryCacheTTL,
+		"How long discovery and OpenAPI responses of a cluster (/api, /apis, /openapi/v2 "+
+			"and /openapi/v3) are served from an in-memory cache before being revalidated "+
+			"with their ETag. If 0, responses are not cached.")
+
 	k.TokenPassthrough.AddFlags(fs)
 	k.ExtraHeaderOptions.AddFlags(fs)
 	k.Cluster.AddFlags(fs)
+	k.ClusterRouting.AddFlags(fs)
+	k.Kubeconfig.AddFlags(fs)
+	k.RateLimit.AddFlags(fs)
+	k.ExecPolicy.AddFlags(fs)
+	k.DenyRules.AddFlags(fs)
+	k.AccessRequests.AddFlags(fs)
+	k.MaxInFlight.AddFlags(fs)
+	k.CircuitBreaker.AddFlags(fs)
+	k.ClusterHealth.AddFlags(fs)
+	k.SessionRecording.AddFlags(fs)
+	k.BreakGlass.AddFlags(fs)
 
 	return k
 }
@@ -101,3 +215,314 @@ func (k *Cluster) AddFlags(fs *pflag.FlagSet) {
 		`path to the role configuration file which contain role,roleBinding,clusterRole and clusterRoleBinding 
 		with additional field clusterName and The clusterName must match the name specified in the cluster-config file.`)
 }
+
+func (r *RateLimitOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&r.Config, "rate-limit-config", r.Config, ""+
+		"Optional path to a YAML file of token bucket rate limits keyed by user, group "+
+		"or cluster. Requests exceeding a limit are rejected with 429 Too Many Requests.")
+}
+
+func (e *ExecPolicyOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&e.Config, "exec-policy-config", e.Config, ""+
+		"Optional path to a YAML file of rules allowing or denying the commands run with "+
+		"pods/exec per group and cluster. Denied commands are rejected with 403 Forbidden.")
+}
+
+func (d *DenyRulesOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&d.Config, "deny-rules-config", d.Config, ""+
+		"Optional path to a YAML file of rules denying requests by cluster, user, group, verb, "+
+		"API group, resource, namespace and name before they are authorized by RBAC. The file "+
+		"is reloaded when it changes.")
+
+	fs.BoolVar(&d.CRDEnabled, "deny-rules-crd-enabled", d.CRDEnabled, ""+
+		"Load deny rules from the CAPIDenyRule resources of the cluster the proxy runs in, "+
+		"in addition to the deny rules file.")
+}
+
+func (a *AccessRequestOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&a.Enabled, "access-requests-enabled", a.Enabled, ""+
+		"Grant temporary bindings for the approved AccessRequest resources of the cluster "+
+		"the proxy runs in, and serve the /_accessrequests endpoints to create, approve and "+
+		"deny them.")
+
+	fs.StringSliceVar(&a.ApproverGroups, "access-request-approver-groups", a.ApproverGroups, ""+
+		"Groups allowed to approve and deny access requests through the /_accessrequests "+
+		"endpoints. Users can't decide their own requests.")
+
+	fs.DurationVar(&a.MaxDuration, "access-request-max-duration", time.Hour*8, ""+
+		"Longest duration of access that can be requested. Longer requests are rejected, "+
+		"and ignored if approved through the status subresource.")
+}
+
+func (a *AccessRequestOptions) Validate() error {
+	if a.MaxDuration <= 0 {
+		return fmt.Errorf("--access-request-max-duration must be greater than 0, got %s", a.MaxDuration)
+	}
+
+	return nil
+}
+
+func (m *MaxInFlightOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.IntVar(&m.NonMutating, "max-requests-inflight", m.NonMutating, ""+
+		"Maximum number of non-mutating requests in flight to each cluster. "+
+		"Long-running requests are limited separately. Zero means unlimited.")
+
+	fs.IntVar(&m.Mutating, "max-mutating-requests-inflight", m.Mutating, ""+
+		"Maximum number of mutating requests in flight to each cluster. Zero means unlimited.")
+
+	fs.IntVar(&m.LongRunning, "max-long-running-requests-inflight", m.LongRunning, ""+
+		"Maximum number of long-running requests, such as watch, exec, port-forward "+
+		"and logs, in flight to each cluster. Zero means unlimited.")
+
+	fs.IntVar(&m.NonMutatingPerUser, "max-requests-inflight-per-user", m.NonMutatingPerUser, ""+
+		"Maximum number of non-mutating requests in flight by each user to a cluster. Zero means unlimited.")
+
+	fs.IntVar(&m.MutatingPerUser, "max-mutating-requests-inflight-per-user", m.MutatingPerUser, ""+
+		"Maximum number of mutating requests in flight by each user to a cluster. Zero means unlimited.")
+
+	fs.IntVar(&m.LongRunningPerUser, "max-long-running-requests-inflight-per-user", m.LongRunningPerUser, ""+
+		"Maximum number of long-running requests in flight by each user to a cluster. Zero means unlimited.")
+}
+
+func (m *MaxInFlightOptions) Validate() error {
+	for _, limit := range []struct {
+		flag  string
+		value int
+	}{
+		{"max-requests-inflight", m.NonMutating},
+		{"max-mutating-requests-inflight", m.Mutating},
+		{"max-long-running-requests-inflight", m.LongRunning},
+		{"max-requests-inflight-per-user", m.NonMutatingPerUser},
+		{"max-mutating-requests-inflight-per-user", m.MutatingPerUser},
+		{"max-long-running-requests-inflight-per-user", m.LongRunningPerUser},
+	} {
+		if limit.value < 0 {
+			return fmt.Errorf("--%s must not be negative, got %d", limit.flag, limit.value)
+		}
+	}
+
+	return nil
+}
+
+func (c *CircuitBreakerOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.IntVar(&c.FailureThreshold, "circuit-breaker-failure-threshold", c.FailureThreshold, ""+
+		"Number of consecutive dial, TLS or 5xx failures of a cluster's API server after which "+
+		"requests to the cluster fail fast with 503 Service Unavailable. Zero disables the "+
+		"circuit breaker.")
+
+	fs.DurationVar(&c.OpenTimeout, "circuit-breaker-open-timeout", time.Second*30, ""+
+		"How long requests to a cluster fail fast before probe requests are let through "+
+		"to check whether its API server has recovered.")
+
+	fs.IntVar(&c.HalfOpenRequests, "circuit-breaker-half-open-requests", 1, ""+
+		"Number of probe requests let through at a time to a cluster whose API server is "+
+		"recovering.")
+}
+
+func (c *CircuitBreakerOptions) Validate() error {
+	if c.FailureThreshold < 0 {
+		return fmt.Errorf("--circuit-breaker-failure-threshold must not be negative, got %d", c.FailureThreshold)
+	}
+
+	if c.OpenTimeout <= 0 {
+		return fmt.Errorf("--circuit-breaker-open-timeout must be greater than 0, got %s", c.OpenTimeout)
+	}
+
+	if c.HalfOpenRequests < 1 {
+		return fmt.Errorf("--circuit-breaker-half-open-requests must be at least 1, got %d", c.HalfOpenRequests)
+	}
+
+	return nil
+}
+
+func (c *ClusterHealthOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(&c.Interval, "cluster-health-check-interval", time.Second*30, ""+
+		"Interval at which the /readyz endpoint of every cluster is checked. The results "+
+		"are served at "+probe.ClusterHealthPath+" on the readiness probe port.")
+
+	fs.DurationVar(&c.Timeout, "cluster-health-check-timeout", time.Second*5, ""+
+		"Timeout of a cluster health check.")
+
+	fs.StringVar(&c.ReadinessPolicy, "cluster-readiness-policy", probe.ReadinessPolicyIgnore, ""+
+		"Whether unhealthy clusters make the proxy unready. 'ignore' keeps the proxy ready, "+
+		"'any' requires at least one healthy cluster and 'all' requires every cluster to be healthy.")
+}
+
+func (c *ClusterHealthOptions) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("--cluster-health-check-interval must be greater than 0, got %s", c.Interval)
+	}
+
+	if c.Timeout <= 0 {
+		return fmt.Errorf("--cluster-health-check-timeout must be greater than 0, got %s", c.Timeout)
+	}
+
+	for _, policy := range probe.ReadinessPolicies {
+		if c.ReadinessPolicy == policy {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown --cluster-readiness-policy %q, must be one of %s",
+		c.ReadinessPolicy, strings.Join(probe.ReadinessPolicies, ", "))
+}
+
+func (s *SessionRecordingOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&s.Dir, "session-recording-dir", s.Dir, ""+
+		"Directory where exec and attach sessions are recorded as asciicast v2 files. "+
+		"Sessions are not recorded if empty. Sessions that can't be recorded are rejected.")
+
+	fs.DurationVar(&s.Retention, "session-recording-retention", time.Hour*24*30, ""+
+		"How long session recordings are kept. If 0, recordings are kept forever.")
+
+	fs.BoolVar(&s.RecordInput, "session-recording-input", s.RecordInput, ""+
+		"Record the input of sessions as well as their output. Input may include "+
+		"passwords typed without echo.")
+
+	fs.StringSliceVar(&s.Clusters, "session-recording-clusters", s.Clusters, ""+
+		"Clusters whose sessions are recorded. If empty, sessions of all clusters are recorded.")
+
+	fs.StringSliceVar(&s.ViewerGroups, "session-recording-viewer-groups", s.ViewerGroups, ""+
+		"Groups allowed to list and download session recordings at /_recordings.")
+}
+
+func (s *SessionRecordingOptions) Validate() error {
+	if s.Retention < 0 {
+		return fmt.Errorf("--session-recording-retention must not be negative, got %s", s.Retention)
+	}
+
+	return nil
+}
+
+func (b *BreakGlassOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&b.Group, "break-glass-group", b.Group, ""+
+		"Group whose privileges only apply to requests with a justification in the "+
+		"X-Break-Glass-Reason header or the break-glass-reason user extra. Break-glass "+
+		"access is disabled if empty.")
+
+	fs.DurationVar(&b.SessionDuration, "break-glass-session-duration", time.Hour, ""+
+		"How long a break-glass session lasts from its first request.")
+
+	fs.IntVar(&b.MaxSessions, "break-glass-max-sessions", 3, ""+
+		"Number of break-glass sessions a user may start per --break-glass-window. "+
+		"Zero means unlimited.")
+
+	fs.DurationVar(&b.Window, "break-glass-window", time.Hour*24, ""+
+		"Window in which --break-glass-max-sessions sessions may be started.")
+
+	fs.StringVar(&b.NotificationWebhook, "break-glass-notification-webhook", b.NotificationWebhook, ""+
+		"URL to which a JSON notification is posted when a break-glass session starts.")
+}
+
+func (b *BreakGlassOptions) Validate() error {
+	if len(b.Group) == 0 {
+		return nil
+	}
+
+	if b.SessionDuration <= 0 {
+		return fmt.Errorf("--break-glass-session-duration must be greater than 0, got %s", b.SessionDuration)
+	}
+
+	if b.MaxSessions < 0 {
+		return fmt.Errorf("--break-glass-max-sessions must not be negative, got %d", b.MaxSessions)
+	}
+
+	if b.MaxSessions > 0 && b.Window <= 0 {
+		return fmt.Errorf("--break-glass-window must be greater than 0, got %s", b.Window)
+	}
+
+	return nil
+}
+
+func (c *ClusterRoutingOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.Mode, "cluster-routing-mode", resolver.ModePath, ""+
+		"How the target cluster of a request is determined. 'path' takes the cluster "+
+		"from the first path segment (https://<proxy>/<cluster>/...). 'host' takes the "+
+		"cluster from the TLS SNI or Host header using --cluster-host-template.")
+
+	fs.StringVar(&c.HostTemplate, "cluster-host-template", c.HostTemplate, ""+
+		"Hostname template used when --cluster-routing-mode=host, containing the "+
+		"placeholder {cluster} exactly once, e.g. '{cluster}.k8s-proxy.example.com'.")
+
+	fs.StringVar(&c.HostCertDir, "cluster-host-cert-dir", c.HostCertDir, ""+
+		"Optional directory containing per-cluster serving certificates named "+
+		"<cluster>.crt and <cluster>.key. Each pair is served for the hostname "+
+		"rendered from --cluster-host-template. Only used when --cluster-routing-mode=host.")
+}
+
+func (k *KubeconfigOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&k.ServerAddress, "kubeconfig-server-address", k.ServerAddress, ""+
+		"External address of the proxy written to kubeconfigs generated by the "+
+		"/_kubeconfig endpoint, e.g. 'https://k8s-proxy.example.com:6443'. If "+
+		"empty, the address the request was sent to is used.")
+
+	fs.StringVar(&k.CAFile, "kubeconfig-ca-file", k.CAFile, ""+
+		"Certificate authority embedded in kubeconfigs generated by the /_kubeconfig "+
+		"endpoint. If empty, the last certificate of the certificate chain served for "+
+		"each cluster is embedded, or the serving certificate itself if it is self-signed. "+
+		"Required if the serving certificate chain doesn't include its CA.")
+}
+
+func (k *KubeconfigOptions) Validate() error {
+	if len(k.ServerAddress) == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(k.ServerAddress)
+	if err != nil {
+		return fmt.Errorf("invalid --kubeconfig-server-address: %w", err)
+	}
+	if u.Scheme != "https" || len(u.Host) == 0 {
+		return fmt.Errorf("--kubeconfig-server-address must be an https URL, got %q", k.ServerAddress)
+	}
+
+	return nil
+}
+
+func (c *ClusterRoutingOptions) Validate() error {
+	switch c.Mode {
+	case resolver.ModePath:
+		if len(c.HostCertDir) > 0 {
+			return fmt.Errorf("--cluster-host-cert-dir requires --cluster-routing-mode=%s", resolver.ModeHost)
+		}
+	case resolver.ModeHost:
+		if err := resolver.ValidateHostTemplate(c.HostTemplate); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown --cluster-routing-mode %q, must be one of %q or %q",
+			c.Mode, resolver.ModePath, resolver.ModeHost)
+	}
+
+	return nil
+}
+
+// SNICertKeys returns a named certificate for every <cluster>.crt and
+// <cluster>.key pair found in the cluster host certificate directory.
+func (c *ClusterRoutingOptions) SNICertKeys() ([]cliflag.NamedCertKey, error) {
+	if len(c.HostCertDir) == 0 {
+		return nil, nil
+	}
+
+	certFiles, err := filepath.Glob(filepath.Join(c.HostCertDir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	var namedCertKeys []cliflag.NamedCertKey
+	for _, certFile := range certFiles {
+		clusterName := strings.TrimSuffix(filepath.Base(certFile), ".crt")
+		keyFile := filepath.Join(c.HostCertDir, clusterName+".key")
+		if _, err := os.Stat(keyFile); err != nil {
+			return nil, fmt.Errorf("missing private key for cluster certificate %q: %w", certFile, err)
+		}
+
+		namedCertKeys = append(namedCertKeys, cliflag.NamedCertKey{
+			Names:    []string{resolver.Hostname(c.HostTemplate, clusterName)},
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		})
+	}
+
+	return namedCertKeys, nil
+}
@@ -0,0 +1,58 @@
+package options
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	cliflag "k8s.io/component-base/cli/flag"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/clientcert"
+)
+
+type ClientCertAuthenticationOptions struct {
+	// ClientCAFile verifies client certificates. Client certificates are not
+	// requested if empty.
+	ClientCAFile string
+	UserMapping  string
+}
+
+func NewClientCertAuthenticationOptions(nfs *cliflag.NamedFlagSets) *ClientCertAuthenticationOptions {
+	return new(ClientCertAuthenticationOptions).AddFlags(nfs.FlagSet("Client Certificate Authentication"))
+}
+
+func (c *ClientCertAuthenticationOptions) AddFlags(fs *pflag.FlagSet) *ClientCertAuthenticationOptions {
+	fs.StringVar(&c.ClientCAFile, "client-ca-file", c.ClientCAFile, ""+
+		"If set, requests presenting a client certificate signed by one of the authorities "+
+		"in the client-ca-file are authenticated by the certificate, unless they carry an "+
+		"Authorization header. The file is reloaded when it changes.")
+
+	fs.StringVar(&c.UserMapping, "client-cert-user-mapping", clientcert.UserMappingSubject, ""+
+		"How client certificates are mapped to users. 'subject' takes the user name from "+
+		"the common name, 'uri' from the first URI SAN, such as a SPIFFE ID. Groups are "+
+		"taken from the organizations of the subject.")
+
+	return c
+}
+
+func (c *ClientCertAuthenticationOptions) Validate() error {
+	for _, mapping := range clientcert.UserMappings {
+		if c.UserMapping == mapping {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown --client-cert-user-mapping %q, must be one of %s",
+		c.UserMapping, strings.Join(clientcert.UserMappings, ", "))
+}
+
+// ClientCA returns the provider of the client CA bundle, or nil if client
+// certificates are disabled.
+func (c *ClientCertAuthenticationOptions) ClientCA() (dynamiccertificates.CAContentProvider, error) {
+	if len(c.ClientCAFile) == 0 {
+		return nil, nil
+	}
+
+	return dynamiccertificates.NewDynamicCAContentFromFile("client-ca", c.ClientCAFile)
+}
@@ -11,6 +11,7 @@ import (
 
 type OIDCAuthenticationOptions struct {
 	CAFile         string
+	JWKSFile       string
 	ClientID       string
 	IssuerURL      string
 	UsernameClaim  string
@@ -19,6 +20,9 @@ type OIDCAuthenticationOptions struct {
 	GroupsPrefix   string
 	SigningAlgs    []string
 	RequiredClaims map[string]string
+
+	IssuersConfigFile         string
+	ClusterRequiredClaimsFile string
 }
 
 func NewOIDCAuthenticationOptions(nfs *cliflag.NamedFlagSets) *OIDCAuthenticationOptions {
@@ -42,7 +46,13 @@ func (o *OIDCAuthenticationOptions) AddFlags(fs *pflag.FlagSet) *OIDCAuthenticat
 
 	fs.StringVar(&o.CAFile, "oidc-ca-file", o.CAFile, ""+
 		"The OpenID server's certificate will be verified by one of the authorities "+
-		"in the oidc-ca-file, otherwise the host's root CA set will be used")
+		"in the oidc-ca-file, otherwise the host's root CA set will be used. The file "+
+		"is reloaded when it changes.")
+
+	fs.StringVar(&o.JWKSFile, "oidc-jwks-file", o.JWKSFile, ""+
+		"Path to a JSON Web Key Set used to verify tokens instead of the keys "+
+		"published by the OpenID issuer. Discovery is skipped, so the issuer does "+
+		"not need to be reachable. The file is reloaded when it changes.")
 
 	fs.StringVar(&o.UsernameClaim, "oidc-username-claim", "sub", ""+
 		"The OpenID claim to use as the username. Note that claims other than the default ('sub') "+
@@ -71,5 +81,16 @@ func (o *OIDCAuthenticationOptions) AddFlags(fs *pflag.FlagSet) *OIDCAuthenticat
 		"If set, the claim is verified to be present in the ID Token with a matching value. "+
 		"Repeat this flag to specify multiple claims.")
 
+	fs.StringVar(&o.IssuersConfigFile, "oidc-issuers-config", o.IssuersConfigFile, ""+
+		"Path to a YAML file listing additional OpenID issuers, each with its own "+
+		"audiences, CA, claims, prefixes and optional list of cluster name patterns "+
+		"the issuer is restricted to. Tokens are authenticated by the issuer matching "+
+		"their 'iss' claim.")
+
+	fs.StringVar(&o.ClusterRequiredClaimsFile, "oidc-cluster-required-claims-config", o.ClusterRequiredClaimsFile, ""+
+		"Path to a YAML file of rules requiring token claims for clusters matching "+
+		"name patterns, e.g. 'acr=mfa' for 'prod-*' clusters. Requests with tokens "+
+		"missing a required claim are rejected and audited.")
+
 	return o
 }
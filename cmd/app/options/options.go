@@ -19,8 +19,11 @@ const (
 type Options struct {
 	App                *KubeOIDCProxyOptions
 	OIDCAuthentication *OIDCAuthenticationOptions
+	ClientCert         *ClientCertAuthenticationOptions
+	RequestHeader      *RequestHeaderAuthenticationOptions
 	SecureServing      *SecureServingOptions
 	Audit              *AuditOptions
+	Tracing            *TracingOptions
 	Client             *ClientOptions
 	Misc               *MiscOptions
 	SecretNamespace    string
@@ -36,8 +39,11 @@ func New() *Options {
 	return &Options{
 		App:                NewKubeOIDCProxyOptions(nfs),
 		OIDCAuthentication: NewOIDCAuthenticationOptions(nfs),
+		ClientCert:         NewClientCertAuthenticationOptions(nfs),
+		RequestHeader:      NewRequestHeaderAuthenticationOptions(nfs),
 		SecureServing:      NewSecureServingOptions(nfs),
 		Audit:              NewAuditOptions(nfs),
+		Tracing:            NewTracingOptions(nfs),
 		Client:             NewClientOptions(nfs),
 		Misc:               NewMiscOptions(nfs),
 
@@ -82,6 +88,14 @@ func (o *Options) Validate(cmd *cobra.Command) error {
 		errs = append(errs, err)
 	}
 
+	if err := o.ClientCert.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := o.RequestHeader.Validate(); len(err) > 0 {
+		errs = append(errs, err...)
+	}
+
 	if err := o.SecureServing.Validate(); len(err) > 0 {
 		errs = append(errs, err...)
 	}
@@ -90,10 +104,50 @@ func (o *Options) Validate(cmd *cobra.Command) error {
 		errs = append(errs, errors.New("unable to securely serve on port 8080 (used by readiness probe)"))
 	}
 
+	if o.App.DiscoveryCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("--discovery-cache-ttl must not be negative, got %s", o.App.DiscoveryCacheTTL))
+	}
+
+	if err := o.App.ClusterRouting.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := o.App.Kubeconfig.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := o.App.MaxInFlight.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := o.App.CircuitBreaker.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := o.App.ClusterHealth.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := o.App.SessionRecording.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := o.App.AccessRequests.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := o.App.BreakGlass.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
 	if err := o.Audit.Validate(); len(err) > 0 {
 		errs = append(errs, err...)
 	}
 
+	if err := o.Tracing.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
 	if o.App.DisableImpersonation &&
 		(o.App.ExtraHeaderOptions.EnableClientIPExtraUserHeader || len(o.App.ExtraHeaderOptions.ExtraUserHeaders) > 0) {
 		errs = append(errs, errors.New("cannot add extra user headers when impersonation disabled"))
@@ -0,0 +1,30 @@
+package options
+
+import (
+	"github.com/spf13/pflag"
+	apiserveroptions "k8s.io/apiserver/pkg/server/options"
+	cliflag "k8s.io/component-base/cli/flag"
+)
+
+// RequestHeaderAuthenticationOptions configure the authentication of requests
+// of a front proxy by their headers, as for the kube-apiserver.
+type RequestHeaderAuthenticationOptions struct {
+	*apiserveroptions.RequestHeaderAuthenticationOptions
+}
+
+func NewRequestHeaderAuthenticationOptions(nfs *cliflag.NamedFlagSets) *RequestHeaderAuthenticationOptions {
+	r := &RequestHeaderAuthenticationOptions{
+		RequestHeaderAuthenticationOptions: &apiserveroptions.RequestHeaderAuthenticationOptions{
+			UsernameHeaders:     []string{"X-Remote-User"},
+			GroupHeaders:        []string{"X-Remote-Group"},
+			ExtraHeaderPrefixes: []string{"X-Remote-Extra-"},
+		},
+	}
+
+	return r.AddFlags(nfs.FlagSet("Request Header Authentication"))
+}
+
+func (r *RequestHeaderAuthenticationOptions) AddFlags(fs *pflag.FlagSet) *RequestHeaderAuthenticationOptions {
+	r.RequestHeaderAuthenticationOptions.AddFlags(fs)
+	return r
+}
@@ -0,0 +1,46 @@
+package options
+
+import (
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	cliflag "k8s.io/component-base/cli/flag"
+	tracingapi "k8s.io/component-base/tracing/api/v1"
+)
+
+type TracingOptions struct {
+	// Endpoint of the OTLP gRPC collector. Tracing is disabled if empty.
+	Endpoint               string
+	SamplingRatePerMillion int32
+}
+
+func NewTracingOptions(nfs *cliflag.NamedFlagSets) *TracingOptions {
+	return new(TracingOptions).AddFlags(nfs.FlagSet("Tracing"))
+}
+
+func (t *TracingOptions) AddFlags(fs *pflag.FlagSet) *TracingOptions {
+	fs.StringVar(&t.Endpoint, "tracing-endpoint", t.Endpoint,
+		"Address of an OpenTelemetry collector to export OTLP traces to over gRPC, "+
+			"e.g. localhost:4317. Tracing is disabled if empty.")
+
+	fs.Int32Var(&t.SamplingRatePerMillion, "tracing-sampling-rate-per-million", t.SamplingRatePerMillion,
+		"Number of requests to trace per million. Requests carrying a sampled W3C "+
+			"traceparent header are always traced.")
+
+	return t
+}
+
+func (t *TracingOptions) Validate() error {
+	return tracingapi.ValidateTracingConfiguration(t.Config(), nil, field.NewPath("tracing")).ToAggregate()
+}
+
+// Config returns the tracing configuration, or nil if tracing is disabled.
+func (t *TracingOptions) Config() *tracingapi.TracingConfiguration {
+	if len(t.Endpoint) == 0 {
+		return nil
+	}
+
+	return &tracingapi.TracingConfiguration{
+		Endpoint:               &t.Endpoint,
+		SamplingRatePerMillion: &t.SamplingRatePerMillion,
+	}
+}
@@ -9,19 +9,28 @@ import (
 	"sync"
 
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
 	"gopkg.in/yaml.v3"
 	"k8s.io/apiserver/pkg/server"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/component-base/tracing"
 	"k8s.io/klog/v2"
 
 	"github.com/Improwised/kube-oidc-proxy/cmd/app/options"
 	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
 	"github.com/Improwised/kube-oidc-proxy/pkg/clustermanager"
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
 	"github.com/Improwised/kube-oidc-proxy/pkg/probe"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/breaker"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/breakglass"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/crd"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/denyrules"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/maxinflight"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/recording"
 	"github.com/Improwised/kube-oidc-proxy/pkg/util"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -51,6 +60,9 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				return fmt.Errorf("options validation failed: %w", err)
 			}
 
+			// Register metrics before the clusters record any
+			metrics.Register()
+
 			// Load and parse cluster configuration
 			clusterConfigs, err := LoadClusterConfig(opts.App.Cluster.Config)
 			if err != nil {
@@ -101,12 +113,48 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				capiRBACWatcher.ProcessExistingRBACObjects()
 			}
 
+			// Serve per-cluster certificates for host based routing
+			clusterCertKeys, err := opts.App.ClusterRouting.SNICertKeys()
+			if err != nil {
+				return fmt.Errorf("failed to load cluster host certificates: %w", err)
+			}
+			opts.SecureServing.SNICertKeys = append(opts.SecureServing.SNICertKeys, clusterCertKeys...)
+
 			// Configure secure serving for the proxy
 			secureServingInfo := new(server.SecureServingInfo)
 			if err := opts.SecureServing.ApplyTo(&secureServingInfo); err != nil {
 				return fmt.Errorf("failed to configure secure serving: %w", err)
 			}
 
+			// Request client certificates verified by the client CA or the
+			// front proxy CA, if configured. The server reloads the CA
+			// bundles as they change.
+			clientCA, err := opts.ClientCert.ClientCA()
+			if err != nil {
+				return fmt.Errorf("failed to load client CA: %w", err)
+			}
+			requestHeaderConfig, err := opts.RequestHeader.ToAuthenticationRequestHeaderConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load request header CA: %w", err)
+			}
+
+			var authenticationInfo server.AuthenticationInfo
+			if err := authenticationInfo.ApplyClientCert(clientCA, secureServingInfo); err != nil {
+				return fmt.Errorf("failed to configure client CA: %w", err)
+			}
+			if requestHeaderConfig != nil {
+				if err := authenticationInfo.ApplyClientCert(requestHeaderConfig.CAContentProvider, secureServingInfo); err != nil {
+					return fmt.Errorf("failed to configure request header CA: %w", err)
+				}
+			}
+
+			// Export traces to the OTLP collector, if configured
+			tracerProvider, err := tracing.NewProvider(context.Background(), opts.Tracing.Config(), nil,
+				[]resource.Option{resource.WithAttributes(semconv.ServiceName(options.AppName))})
+			if err != nil {
+				return fmt.Errorf("failed to create tracer provider: %w", err)
+			}
+
 			// Create proxy configuration
 			proxyConfig := &proxy.Config{
 				TokenReview:                     opts.App.TokenPassthrough.Enabled,
@@ -115,6 +163,73 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				ExternalAddress:                 opts.SecureServing.BindAddress.String(),
 				ExtraUserHeaders:                opts.App.ExtraHeaderOptions.ExtraUserHeaders,
 				ExtraUserHeadersClientIPEnabled: opts.App.ExtraHeaderOptions.EnableClientIPExtraUserHeader,
+				ClusterRoutingMode:              opts.App.ClusterRouting.Mode,
+				ClusterHostTemplate:             opts.App.ClusterRouting.HostTemplate,
+				KubeconfigServerAddress:         opts.App.Kubeconfig.ServerAddress,
+				KubeconfigCAFile:                opts.App.Kubeconfig.CAFile,
+				ClientCA:                        clientCA,
+				ClientCertUserMapping:           opts.ClientCert.UserMapping,
+				RequestHeader:                   requestHeaderConfig,
+				TracerProvider:                  tracerProvider,
+				RateLimitConfig:                 opts.App.RateLimit.Config,
+				ExecPolicyConfig:                opts.App.ExecPolicy.Config,
+				DenyRulesConfig:                 opts.App.DenyRules.Config,
+				DiscoveryCacheTTL:               opts.App.DiscoveryCacheTTL,
+				MaxInFlightPerCluster: maxinflight.Limits{
+					NonMutating: opts.App.MaxInFlight.NonMutating,
+					Mutating:    opts.App.MaxInFlight.Mutating,
+					LongRunning: opts.App.MaxInFlight.LongRunning,
+				},
+				MaxInFlightPerUser: maxinflight.Limits{
+					NonMutating: opts.App.MaxInFlight.NonMutatingPerUser,
+					Mutating:    opts.App.MaxInFlight.MutatingPerUser,
+					LongRunning: opts.App.MaxInFlight.LongRunningPerUser,
+				},
+				CircuitBreaker: breaker.Config{
+					FailureThreshold: opts.App.CircuitBreaker.FailureThreshold,
+					OpenTimeout:      opts.App.CircuitBreaker.OpenTimeout,
+					HalfOpenRequests: opts.App.CircuitBreaker.HalfOpenRequests,
+				},
+				SessionRecordingClusters:     opts.App.SessionRecording.Clusters,
+				SessionRecordingViewerGroups: opts.App.SessionRecording.ViewerGroups,
+				AccessRequestApproverGroups:  opts.App.AccessRequests.ApproverGroups,
+				BreakGlass: breakglass.Config{
+					Group:       opts.App.BreakGlass.Group,
+					Duration:    opts.App.BreakGlass.SessionDuration,
+					MaxSessions: opts.App.BreakGlass.MaxSessions,
+					Window:      opts.App.BreakGlass.Window,
+				},
+				BreakGlassNotificationWebhook: opts.App.BreakGlass.NotificationWebhook,
+			}
+
+			if opts.App.AccessRequests.Enabled {
+				if capiRBACWatcher == nil {
+					return fmt.Errorf("access requests require the CAPI RBAC watcher")
+				}
+				proxyConfig.AccessRequests = capiRBACWatcher.AccessRequests(opts.App.AccessRequests.MaxDuration)
+			}
+
+			if opts.App.SessionRecording.Dir != "" {
+				store, err := recording.NewLocalStore(opts.App.SessionRecording.Dir)
+				if err != nil {
+					return err
+				}
+				proxyConfig.SessionRecorder = recording.New(store, recording.Config{
+					Retention:   opts.App.SessionRecording.Retention,
+					RecordInput: opts.App.SessionRecording.RecordInput,
+				})
+			}
+
+			// Load deny rules from CAPIDenyRules. Requests are not served
+			// until they are synced.
+			if opts.App.DenyRules.CRDEnabled {
+				proxyConfig.DenyRules = denyrules.NewSet()
+				denyRuleWatcher, err := crd.NewDenyRuleWatcher(proxyConfig.DenyRules)
+				if err != nil {
+					return fmt.Errorf("failed to initialize deny rule watcher: %w", err)
+				}
+				klog.V(5).Info("Starting deny rule watcher")
+				denyRuleWatcher.Start(stopCh)
 			}
 
 			// Initialize the proxy with OIDC authentication
@@ -129,8 +244,17 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				return fmt.Errorf("failed to initialize proxy: %w", err)
 			}
 
+			// Grant the bindings of approved AccessRequests. Their transitions
+			// are audited by the proxy, so they are watched once it exists.
+			if opts.App.AccessRequests.Enabled {
+				klog.V(5).Info("Starting AccessRequest watcher")
+				capiRBACWatcher.WatchAccessRequests(stopCh, opts.App.AccessRequests.MaxDuration,
+					proxyInstance.AuditAccessRequest)
+			}
+
 			// Configure cluster manager to use proxy for dynamic clusters
 			clusterManager.SetupFunc = proxyInstance.SetupClusterProxy
+			clusterManager.InvalidateFunc = proxyInstance.InvalidateDiscoveryCache
 
 			// Start watching for dynamic clusters using the new controller pattern
 			if opts.SecretNamespace == "" {
@@ -150,19 +274,44 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 			}
 
 			// Generate fake JWT for readiness probe
-			fakeJWT, err := util.FakeJWT(opts.OIDCAuthentication.IssuerURL)
+			fakeJWT, err := util.FakeJWT(proxyInstance.OIDCIssuerURL())
 			if err != nil {
 				return fmt.Errorf("failed to generate fake JWT: %w", err)
 			}
 
 			// Start readiness probe server
-			if err := probe.Run(
+			healthCheck, err := probe.Run(
 				strconv.Itoa(opts.App.ReadinessProbePort),
 				fakeJWT,
 				proxyInstance.OIDCTokenAuthenticator(),
-			); err != nil {
+			)
+			if err != nil {
 				return fmt.Errorf("failed to start readiness probe: %w", err)
 			}
+			healthCheck.AddReadinessCheck("oidc issuers", proxyInstance.OIDCReady)
+			if opts.App.CircuitBreaker.FailureThreshold > 0 {
+				healthCheck.AddReadinessCheck("circuit breakers", proxyInstance.CircuitBreakersReady)
+			}
+
+			// Check the health of every cluster in the background
+			clusterChecker := probe.NewClusterChecker(clusterManager,
+				opts.App.ClusterHealth.Interval,
+				opts.App.ClusterHealth.Timeout,
+				opts.App.ClusterHealth.ReadinessPolicy,
+			)
+			healthCheck.AddClusterChecker(clusterChecker)
+
+			// Serving certificates are reloaded on change, surface failures
+			if certKey := opts.SecureServing.ServerCert.CertKey; len(certKey.CertFile) > 0 {
+				checker := probe.NewCertKeyChecker(certKey.CertFile, certKey.KeyFile)
+				checker.Run(stopCh)
+				healthCheck.AddReadinessCheck("serving certificate", checker.Check)
+			}
+			for _, sniCertKey := range opts.SecureServing.SNICertKeys {
+				checker := probe.NewCertKeyChecker(sniCertKey.CertFile, sniCertKey.KeyFile)
+				checker.Run(stopCh)
+				healthCheck.AddReadinessCheck("serving certificate "+sniCertKey.CertFile, checker.Check)
+			}
 
 			// Run the proxy and wait for shutdown signals
 			waitCh, listenerStoppedCh, err := proxyInstance.Run(stopCh)
@@ -170,6 +319,9 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				return fmt.Errorf("proxy run failed: %w", err)
 			}
 
+			// Clusters can only be checked once the proxy has set up their transports
+			clusterChecker.Run(stopCh)
+
 			// Wait for shutdown signals
 			<-waitCh
 			<-listenerStoppedCh
@@ -179,6 +331,11 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				return fmt.Errorf("pre-shutdown hooks failed: %w", err)
 			}
 
+			// Flush any remaining spans
+			if err := tracerProvider.Shutdown(context.Background()); err != nil {
+				klog.Errorf("failed to shut down tracer provider: %v", err)
+			}
+
 			return nil
 		},
 	}
@@ -194,8 +351,9 @@ func LoadClusterConfig(path string) ([]*cluster.Cluster, error) {
 	var clustersList []*cluster.Cluster
 	var config struct {
 		Clusters []struct {
-			Name       string `yaml:"name"`
-			Kubeconfig string `yaml:"kubeconfig"`
+			Name       string            `yaml:"name"`
+			Kubeconfig string            `yaml:"kubeconfig"`
+			Labels     map[string]string `yaml:"labels"`
 		} `yaml:"clusters"`
 	}
 
@@ -224,8 +382,9 @@ func LoadClusterConfig(path string) ([]*cluster.Cluster, error) {
 		}
 
 		clustersList = append(clustersList, &cluster.Cluster{
-			Name: clusterConfig.Name,
-			Path: clusterConfig.Kubeconfig,
+			Name:   clusterConfig.Name,
+			Path:   clusterConfig.Kubeconfig,
+			Labels: clusterConfig.Labels,
 		})
 		clusterNames[clusterConfig.Name] = true
 	}
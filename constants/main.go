@@ -7,6 +7,8 @@ var (
 	CAPIClusterRoleBindingKind = "capiclusterrolebindings"
 	CAPIRoleKind               = "capiroles"
 	CAPIRoleBindingKind        = "capirolebindings"
+	CAPIDenyRuleKind           = "capidenyrules"
+	AccessRequestKind          = "accessrequests"
 )
 
 // test constants
@@ -1,17 +1,34 @@
 package cluster
 
 import (
+	"bytes"
+	ctx "context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/breaker"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/context"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/logging"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/subjectaccessreview"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/tokenreview"
 	"github.com/Improwised/kube-oidc-proxy/pkg/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/component-base/tracing"
 	"k8s.io/kubernetes/plugin/pkg/auth/authorizer/rbac"
 )
 
@@ -28,15 +45,140 @@ type Cluster struct {
 	ProxyHandler          *httputil.ReverseProxy                   // Reverse proxy handler for forwarding requests
 	ClientTransport       http.RoundTripper                        // Transport for authenticated requests
 	NoAuthClientTransport http.RoundTripper                        // Transport for unauthenticated requests
+	Breaker               *breaker.Breaker                         // Circuit breaker failing requests fast while the API server fails, if enabled
 	IsStatic              bool                                     // Indicates if the cluster is statically configured
+	Labels                map[string]string                        // Labels selecting the cluster in fleet requests
+
+	health Health // Result of the latest background health check, guarded by healthLock
+}
+
+// HealthStatus is the health of a cluster's API server.
+type HealthStatus string
+
+const (
+	HealthUnknown   HealthStatus = "Unknown"
+	HealthHealthy   HealthStatus = "Healthy"
+	HealthUnhealthy HealthStatus = "Unhealthy"
+)
+
+// Health is the result of the latest health check of a cluster.
+type Health struct {
+	Status    HealthStatus
+	Latency   time.Duration
+	LastCheck time.Time
+	// LastError is the error of the latest failed check, which is kept after
+	// the cluster has recovered.
+	LastError     string
+	LastErrorTime time.Time
 }
 
+// healthLock guards the health of all clusters. Clusters are copied by value
+// when updated, so the lock can't be a field.
+var healthLock sync.RWMutex
+
 var (
 	ErrNoImpersonationConfig = errors.New("no impersonation configuration in context")
+	ErrNoClientTransport     = errors.New("cluster has no client transport")
 )
 
 // RoundTrip is called last and is used to manipulate the forwarded request using context.
 func (c *Cluster) RoundTrip(req *http.Request) (*http.Response, error) {
+	traceCtx, span := tracing.Start(req.Context(), "RoundTrip", attribute.String("cluster", c.Name))
+	defer span.End(util.TraceLogThreshold)
+
+	// Propagate the trace context to the API server
+	req = req.WithContext(traceCtx)
+	tracing.Propagators().Inject(traceCtx, propagation.HeaderCarrier(req.Header))
+
+	var done func(success bool)
+	if c.Breaker != nil {
+		var (
+			retryAfter time.Duration
+			ok         bool
+		)
+		done, retryAfter, ok = c.Breaker.Allow()
+		if !ok {
+			metrics.CircuitBreakerRejections.WithLabelValues(c.Name).Inc()
+			err := errCircuitOpen(c.Name, retryAfter)
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	if done != nil {
+		done(!isUpstreamFailure(req, resp, err))
+	}
+
+	return resp, err
+}
+
+// maxStatusBodySize bounds the body read to tell whether an error response
+// was written by the API server.
+const maxStatusBodySize = 64 * 1024
+
+// isUpstreamFailure returns whether the result of a request counts as a
+// failure of the API server: a dial, TLS or other transport error, or a 502,
+// 503 or 504 response not written by the API server itself. Requests
+// cancelled by the client are not failures, and neither are errors the API
+// server returns as a Status, such as a 503 for an unavailable aggregated API
+// or a 500 for a single object.
+func isUpstreamFailure(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil && !errors.Is(err, ErrNoImpersonationConfig)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return !isAPIServerStatus(resp)
+	}
+
+	return false
+}
+
+// isAPIServerStatus returns whether the body of the response is a Status
+// written by the API server. The body read is put back in front of the rest.
+func isAPIServerStatus(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case mediaType == runtime.ContentTypeProtobuf:
+		return true
+	case mediaType != runtime.ContentTypeJSON, len(resp.Header.Get("Content-Encoding")) > 0:
+		return false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxStatusBodySize))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if err != nil {
+		return false
+	}
+
+	var status metav1.Status
+	return json.Unmarshal(body, &status) == nil && status.Kind == "Status"
+}
+
+// errCircuitOpen returns the error of a request rejected by an open circuit
+// breaker.
+func errCircuitOpen(name string, retryAfter time.Duration) error {
+	err := apierrors.NewServiceUnavailable(fmt.Sprintf(
+		"cluster %q is unavailable: requests are failing fast after repeated failures of its API server", name))
+	err.ErrStatus.Details = &metav1.StatusDetails{
+		Name:              name,
+		Kind:              "clusters",
+		RetryAfterSeconds: int32(max(1, (retryAfter+time.Second-1)/time.Second)),
+	}
+
+	return err
+}
+
+func (c *Cluster) roundTrip(req *http.Request) (*http.Response, error) {
 	// Here we have successfully authenticated so now need to determine whether
 	// we need use impersonation or not.
 
@@ -44,7 +186,7 @@ func (c *Cluster) RoundTrip(req *http.Request) (*http.Response, error) {
 	// header but re-introduce the token we removed.
 	if context.NoImpersonation(req) {
 		token := context.BearerToken(req)
-		req.Header.Add("Authorization", token)
+		req.Header.Set("Authorization", token)
 		return c.NoAuthClientTransport.RoundTrip(req)
 	}
 
@@ -60,3 +202,71 @@ func (c *Cluster) RoundTrip(req *http.Request) (*http.Response, error) {
 	// Push request as admin through round trippers to the API server.
 	return c.ClientTransport.RoundTrip(req)
 }
+
+// Health returns the result of the latest health check of the cluster.
+func (c *Cluster) Health() Health {
+	healthLock.RLock()
+	defer healthLock.RUnlock()
+
+	health := c.health
+	if len(health.Status) == 0 {
+		health.Status = HealthUnknown
+	}
+
+	return health
+}
+
+// Update replaces the configuration of the cluster with that of the given
+// cluster. The result of the latest health check is kept until the next check
+// of the updated cluster.
+func (c *Cluster) Update(update *Cluster) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	health := c.health
+	*c = *update
+	c.health = health
+}
+
+// RecordHealth records the result of a health check of the cluster, which
+// took the given latency.
+func (c *Cluster) RecordHealth(err error, latency time.Duration, now time.Time) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	c.health.Status = HealthHealthy
+	c.health.Latency = latency
+	c.health.LastCheck = now
+
+	if err != nil {
+		c.health.Status = HealthUnhealthy
+		c.health.LastError = err.Error()
+		c.health.LastErrorTime = now
+	}
+}
+
+// CheckHealth queries the /readyz endpoint of the cluster's API server using
+// the proxy's own credentials.
+func (c *Cluster) CheckHealth(checkCtx ctx.Context) error {
+	if c.ClientTransport == nil || c.RestConfig == nil {
+		return ErrNoClientTransport
+	}
+
+	req, err := http.NewRequestWithContext(checkCtx, http.MethodGet,
+		strings.TrimSuffix(c.RestConfig.Host, "/")+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.ClientTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("readyz returned status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
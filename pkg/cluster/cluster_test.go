@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsUpstreamFailure(t *testing.T) {
+	const status = `{"kind":"Status","apiVersion":"v1","status":"Failure","code":503,` +
+		`"message":"the server is currently unable to handle the request"}`
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := map[string]struct {
+		ctx         context.Context
+		err         error
+		code        int
+		contentType string
+		body        string
+		expFailure  bool
+	}{
+		"transport error should fail": {
+			err:        errors.New("connection refused"),
+			expFailure: true,
+		},
+		"request cancelled by the client should not fail": {
+			ctx: cancelled,
+			err: context.Canceled,
+		},
+		"missing impersonation config should not fail": {
+			err: ErrNoImpersonationConfig,
+		},
+		"success should not fail": {
+			code: http.StatusOK,
+		},
+		"internal server error of the API server should not fail": {
+			code:        http.StatusInternalServerError,
+			contentType: "application/json",
+			body:        status,
+		},
+		"unavailable aggregated API should not fail": {
+			code:        http.StatusServiceUnavailable,
+			contentType: "application/json; charset=utf-8",
+			body:        status,
+		},
+		"protobuf status should not fail": {
+			code:        http.StatusServiceUnavailable,
+			contentType: "application/vnd.kubernetes.protobuf",
+			body:        "k8s\x00",
+		},
+		"bad gateway from a load balancer should fail": {
+			code:        http.StatusBadGateway,
+			contentType: "text/html",
+			body:        "<html>502 Bad Gateway</html>",
+			expFailure:  true,
+		},
+		"gateway timeout without a body should fail": {
+			code:       http.StatusGatewayTimeout,
+			expFailure: true,
+		},
+		"json that is not a status should fail": {
+			code:        http.StatusServiceUnavailable,
+			contentType: "application/json",
+			body:        `{"error":"unavailable"}`,
+			expFailure:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := test.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://cluster/apis/metrics.k8s.io/v1beta1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var resp *http.Response
+			if test.err == nil {
+				resp = &http.Response{
+					StatusCode: test.code,
+					Header:     http.Header{"Content-Type": []string{test.contentType}},
+					Body:       io.NopCloser(strings.NewReader(test.body)),
+				}
+			}
+
+			assert.Equal(t, test.expFailure, isUpstreamFailure(req, resp, test.err))
+
+			// The body is still forwarded in full
+			if resp != nil {
+				body, err := io.ReadAll(resp.Body)
+				assert.NoError(t, err)
+				assert.Equal(t, test.body, string(body))
+			}
+		})
+	}
+}
@@ -4,11 +4,15 @@ package clustermanager
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"sync"
 	"time"
 
+	"github.com/Improwised/kube-oidc-proxy/constants"
 	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/crd"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/rbac"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/subjectaccessreview"
@@ -19,12 +23,18 @@ import (
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 )
 
+// ClusterLabelsAnnotation on a cluster secret holds the labels of its
+// clusters as a JSON object mapping cluster names to labels, e.g.
+// {"prod-eu": {"env": "prod", "region": "eu"}}.
+var ClusterLabelsAnnotation = constants.Group + "/cluster-labels"
+
 // ClusterManager manages a collection of Kubernetes clusters, providing functionality
 // for adding, updating, removing, and retrieving clusters. It also handles dynamic
 // cluster discovery through Kubernetes secrets and configures RBAC for each cluster.
@@ -60,6 +70,11 @@ type ClusterManager struct {
 	// to perform additional configuration
 	SetupFunc func(*cluster.Cluster) error
 
+	// InvalidateFunc is an optional function called with the name of a
+	// cluster that was removed or whose RestConfig changed, to drop state
+	// derived from the old cluster
+	InvalidateFunc func(name string)
+
 	// secretController is the controller that watches for secret changes
 	secretController *SecretController
 }
@@ -153,8 +168,9 @@ func NewSecretController(clusterManager *ClusterManager, namespace, secretName s
 	controller := &SecretController{
 		secretsInformer: secretInformer,
 		secretsSynced:   secretInformer.HasSynced,
-		queue: workqueue.NewTypedRateLimitingQueue(
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
 			workqueue.DefaultTypedControllerRateLimiter[*corev1.Secret](),
+			workqueue.TypedRateLimitingQueueConfig[*corev1.Secret]{Name: "secret_controller"},
 		),
 		clusterManager: clusterManager,
 		namespace:      namespace,
@@ -402,6 +418,8 @@ func (cm *ClusterManager) updateDynamicClusters(secret *corev1.Secret) error {
 		}
 	}
 
+	clusterLabels := secretClusterLabels(secret)
+
 	// Process each cluster configuration in the secret
 	var wg sync.WaitGroup
 	sem := make(chan struct{}, cm.maxGoroutines)
@@ -424,6 +442,7 @@ func (cm *ClusterManager) updateDynamicClusters(secret *corev1.Secret) error {
 				Name:       clusterName,
 				RestConfig: restConfig,
 				IsStatic:   false, // Mark as dynamic cluster
+				Labels:     clusterLabels[clusterName],
 			}
 
 			// Set up the cluster with necessary components
@@ -458,6 +477,23 @@ func (cm *ClusterManager) updateDynamicClusters(secret *corev1.Secret) error {
 	return nil
 }
 
+// secretClusterLabels returns the labels of the secret's clusters from its
+// ClusterLabelsAnnotation. Clusters are unlabeled if it is invalid.
+func secretClusterLabels(secret *corev1.Secret) map[string]map[string]string {
+	value, ok := secret.Annotations[ClusterLabelsAnnotation]
+	if !ok {
+		return nil
+	}
+
+	var clusterLabels map[string]map[string]string
+	if err := json.Unmarshal([]byte(value), &clusterLabels); err != nil {
+		klog.Errorf("Invalid %s annotation on secret %s/%s: %v", ClusterLabelsAnnotation, secret.Namespace, secret.Name, err)
+		return nil
+	}
+
+	return clusterLabels
+}
+
 // removeDynamicClusters removes all clusters specified in the given secret.
 // This is typically called when a secret containing cluster configurations is deleted.
 //
@@ -488,14 +524,46 @@ func (cm *ClusterManager) AddOrUpdateCluster(cluster *cluster.Cluster) {
 
 	// Check if the cluster already exists
 	if existing, exists := cm.clusters[cluster.Name]; exists {
+		// Drop state derived from the old config before updating
+		configChanged := restConfigChanged(existing.RestConfig, cluster.RestConfig)
+		if cm.InvalidateFunc != nil && configChanged {
+			cm.InvalidateFunc(cluster.Name)
+		}
+
+		// Keep the breaker of an unchanged API server, so a resync doesn't
+		// close it and in-flight requests still report to the one in use
+		if !configChanged && existing.Breaker != nil && cluster.Breaker != nil {
+			cluster.Breaker = existing.Breaker
+			metrics.CircuitBreakerState.WithLabelValues(cluster.Name).Set(float64(existing.Breaker.State()))
+		}
+
 		// Update existing cluster
-		*existing = *cluster
+		existing.Update(cluster)
 		klog.Infof("Updated cluster: %s", cluster.Name)
 	} else {
 		// Add new cluster
 		cm.clusters[cluster.Name] = cluster
 		klog.Infof("Added cluster: %s", cluster.Name)
 	}
+
+	metrics.Clusters.Set(float64(len(cm.clusters)))
+}
+
+// restConfigChanged returns whether the configs differ in the API server or
+// the credentials used to reach it.
+func restConfigChanged(old, new *rest.Config) bool {
+	if old == nil || new == nil {
+		return old != new
+	}
+
+	return old.Host != new.Host ||
+		old.APIPath != new.APIPath ||
+		old.BearerToken != new.BearerToken ||
+		old.BearerTokenFile != new.BearerTokenFile ||
+		old.Username != new.Username ||
+		old.Password != new.Password ||
+		!reflect.DeepEqual(old.Impersonate, new.Impersonate) ||
+		!reflect.DeepEqual(old.TLSClientConfig, new.TLSClientConfig)
 }
 
 // RemoveCluster removes a cluster from the manager by name.
@@ -511,6 +579,14 @@ func (cm *ClusterManager) RemoveCluster(name string) {
 	// Check if the cluster exists before removing
 	if _, exists := cm.clusters[name]; exists {
 		delete(cm.clusters, name)
+		metrics.Clusters.Set(float64(len(cm.clusters)))
+		labels := map[string]string{"cluster": name}
+		metrics.ClusterHealthy.Delete(labels)
+		metrics.CircuitBreakerState.Delete(labels)
+		metrics.CircuitBreakerRejections.Delete(labels)
+		if cm.InvalidateFunc != nil {
+			cm.InvalidateFunc(name)
+		}
 		klog.Infof("Removed cluster: %s", name)
 	} else {
 		klog.V(5).Infof("Attempted to remove non-existent cluster: %s", name)
@@ -2,14 +2,18 @@
 package clustermanager
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/breaker"
 	"github.com/Improwised/kube-oidc-proxy/pkg/util"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
 )
 
 // TestAddAndRetrieveCluster tests adding a cluster and retrieving it
@@ -71,6 +75,57 @@ func TestUpdateExistingCluster(t *testing.T) {
 	assert.Equal(t, updatedCluster.Path, retrievedCluster.Path)
 }
 
+// TestUpdateKeepsHealth tests that updates keep the latest health check
+func TestUpdateKeepsHealth(t *testing.T) {
+	cm := &ClusterManager{
+		clusters: make(map[string]*cluster.Cluster),
+	}
+
+	cm.AddOrUpdateCluster(&cluster.Cluster{Name: "test-cluster", Path: "/original/path"})
+	now := time.Now()
+	cm.GetCluster("test-cluster").RecordHealth(errors.New("readyz returned status code 500"), time.Second, now)
+
+	cm.AddOrUpdateCluster(&cluster.Cluster{Name: "test-cluster", Path: "/updated/path"})
+
+	updated := cm.GetCluster("test-cluster")
+	assert.Equal(t, "/updated/path", updated.Path)
+	assert.Equal(t, cluster.HealthUnhealthy, updated.Health().Status)
+	assert.Equal(t, now, updated.Health().LastCheck)
+}
+
+// TestUpdateKeepsBreaker tests that updates only replace the circuit breaker
+// when the cluster points to another API server
+func TestUpdateKeepsBreaker(t *testing.T) {
+	cm := &ClusterManager{
+		clusters: make(map[string]*cluster.Cluster),
+	}
+
+	newCluster := func(host string) *cluster.Cluster {
+		return &cluster.Cluster{
+			Name:       "test-cluster",
+			RestConfig: &rest.Config{Host: host},
+			Breaker:    breaker.New(breaker.Config{FailureThreshold: 1, OpenTimeout: time.Minute}, nil),
+		}
+	}
+
+	cm.AddOrUpdateCluster(newCluster("https://a"))
+	open := cm.GetCluster("test-cluster").Breaker
+	done, _, ok := open.Allow()
+	if assert.True(t, ok) {
+		done(false)
+	}
+	assert.Equal(t, breaker.Open, open.State())
+
+	// A resync of the same config keeps the open breaker
+	cm.AddOrUpdateCluster(newCluster("https://a"))
+	assert.Same(t, open, cm.GetCluster("test-cluster").Breaker)
+
+	// Another API server starts with a closed breaker
+	cm.AddOrUpdateCluster(newCluster("https://b"))
+	assert.NotSame(t, open, cm.GetCluster("test-cluster").Breaker)
+	assert.Equal(t, breaker.Closed, cm.GetCluster("test-cluster").Breaker.State())
+}
+
 // TestRemoveCluster tests removing a cluster
 func TestRemoveCluster(t *testing.T) {
 	// Create a ClusterManager
@@ -305,3 +360,50 @@ func TestNewSecretController(t *testing.T) {
 	assert.NotNil(t, controller.secretsInformer)
 	assert.NotNil(t, controller.queue)
 }
+
+// TestInvalidateCluster tests that state derived from a cluster is dropped
+// when its RestConfig changes or it is removed
+func TestInvalidateCluster(t *testing.T) {
+	var invalidated []string
+	cm := &ClusterManager{
+		clusters:       make(map[string]*cluster.Cluster),
+		InvalidateFunc: func(name string) { invalidated = append(invalidated, name) },
+	}
+
+	newCluster := func(host string) *cluster.Cluster {
+		return &cluster.Cluster{
+			Name:       "test-cluster",
+			RestConfig: &rest.Config{Host: host},
+		}
+	}
+
+	cm.AddOrUpdateCluster(newCluster("https://a"))
+	assert.Empty(t, invalidated)
+
+	// An equal config is not a change
+	cm.AddOrUpdateCluster(newCluster("https://a"))
+	assert.Empty(t, invalidated)
+
+	cm.AddOrUpdateCluster(newCluster("https://b"))
+	assert.Equal(t, []string{"test-cluster"}, invalidated)
+
+	cm.RemoveCluster("test-cluster")
+	assert.Equal(t, []string{"test-cluster", "test-cluster"}, invalidated)
+}
+
+// TestSecretClusterLabels tests parsing the cluster labels annotation
+func TestSecretClusterLabels(t *testing.T) {
+	newSecret := func(annotations map[string]string) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+	}
+
+	assert.Nil(t, secretClusterLabels(newSecret(nil)))
+	assert.Nil(t, secretClusterLabels(newSecret(map[string]string{
+		ClusterLabelsAnnotation: "env=prod",
+	})))
+	assert.Equal(t, map[string]map[string]string{
+		"cluster1": {"env": "prod", "region": "eu"},
+	}, secretClusterLabels(newSecret(map[string]string{
+		ClusterLabelsAnnotation: `{"cluster1": {"env": "prod", "region": "eu"}}`,
+	})))
+}
@@ -0,0 +1,237 @@
+// Package metrics defines the Prometheus metrics exposed by the proxy.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+
+	// Register the workqueue metrics provider, exposing the depth of named
+	// queues such as the secret controller's.
+	_ "k8s.io/component-base/metrics/prometheus/workqueue"
+)
+
+const namespace = "kube_oidc_proxy"
+
+// Authentication paths of a request.
+const (
+	// AuthPathNone is used for requests that failed authentication.
+	AuthPathNone = "none"
+	// AuthPathOIDC is used for OIDC authenticated requests forwarded with
+	// impersonation.
+	AuthPathOIDC = "oidc"
+	// AuthPathTokenPassthrough is used for requests whose token was
+	// validated with a TokenReview and forwarded as is.
+	AuthPathTokenPassthrough = "token_passthrough"
+	// AuthPathNoImpersonation is used for OIDC authenticated requests
+	// forwarded without impersonation.
+	AuthPathNoImpersonation = "no_impersonation"
+)
+
+// Reasons a request was denied by the proxy.
+const (
+	ReasonImpersonation  = "impersonation"
+	ReasonRBAC           = "rbac"
+	ReasonRequiredClaims = "required_claims"
+	ReasonNoUsername     = "no_username"
+	ReasonExecPolicy     = "exec_policy"
+	ReasonDenyRule       = "deny_rule"
+	ReasonBreakGlass     = "break_glass"
+)
+
+// Results of a discovery cache lookup.
+const (
+	CacheHit         = "hit"
+	CacheMiss        = "miss"
+	CacheRevalidated = "revalidated"
+)
+
+// UnknownCluster is the cluster label of requests to clusters that are not
+// managed by the proxy, bounding the cardinality of the label.
+const UnknownCluster = "unknown"
+
+// OtherVerb is the verb label of non-resource requests with a method that is
+// not a standard HTTP method, bounding the cardinality of the label.
+const OtherVerb = "other"
+
+// nonResourceVerbs are the verbs of non-resource requests with a standard
+// HTTP method.
+var nonResourceVerbs = map[string]bool{
+	"get":     true,
+	"head":    true,
+	"post":    true,
+	"put":     true,
+	"patch":   true,
+	"delete":  true,
+	"options": true,
+}
+
+// NonResourceVerb returns the verb label of a non-resource request, whose verb
+// is its lower-cased HTTP method.
+func NonResourceVerb(verb string) string {
+	if nonResourceVerbs[verb] {
+		return verb
+	}
+
+	return OtherVerb
+}
+
+var (
+	// Requests counts requests by their cluster, verb, resource, response
+	// code and authentication path.
+	Requests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "requests_total",
+			Help:           "Number of requests handled by the proxy, by cluster, verb, resource, response code and authentication path.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"cluster", "verb", "resource", "code", "auth_path"},
+	)
+
+	// RequestDuration observes the latency of requests. Watch requests are
+	// long-running and not observed.
+	RequestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of requests handled by the proxy in seconds, by cluster, verb, resource, response code and authentication path. Watch requests are not observed.",
+			Buckets: []float64{0.005, 0.025, 0.05, 0.1, 0.2, 0.4, 0.6, 0.8, 1.0, 1.25, 1.5, 2, 3,
+				4, 5, 6, 8, 10, 15, 20, 30, 45, 60},
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"cluster", "verb", "resource", "code", "auth_path"},
+	)
+
+	// AuthenticationFailures counts requests rejected as unauthenticated.
+	AuthenticationFailures = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "authentication_failures_total",
+			Help:           "Number of requests that failed authentication, by cluster.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"cluster"},
+	)
+
+	// AuthorizationFailures counts authenticated requests denied by the
+	// proxy.
+	AuthorizationFailures = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "authorization_failures_total",
+			Help:           "Number of authenticated requests denied by the proxy, by cluster and reason.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"cluster", "reason"},
+	)
+
+	// AuditSendFailures counts audit logs that could not be sent to the
+	// webhook.
+	AuditSendFailures = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "audit_send_failures_total",
+			Help:           "Number of audit logs that failed to be sent to the audit webhook.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	// Clusters is the number of clusters managed by the proxy.
+	Clusters = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace:      namespace,
+			Name:           "clusters",
+			Help:           "Number of clusters managed by the proxy.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	// ClusterHealthy is whether the latest health check of each cluster
+	// passed.
+	ClusterHealthy = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      namespace,
+			Name:           "cluster_healthy",
+			Help:           "Whether the latest /readyz check of each cluster passed: 1 healthy, 0 unhealthy.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"cluster"},
+	)
+
+	// CircuitBreakerState is the state of each cluster's circuit breaker.
+	CircuitBreakerState = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      namespace,
+			Name:           "circuit_breaker_state",
+			Help:           "State of the circuit breaker of each cluster: 0 closed, 1 open, 2 half-open.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"cluster"},
+	)
+
+	// CircuitBreakerRejections counts requests failed fast by an open circuit
+	// breaker.
+	CircuitBreakerRejections = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "circuit_breaker_rejections_total",
+			Help:           "Number of requests rejected by the circuit breaker of a cluster, by cluster.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"cluster"},
+	)
+
+	// DiscoveryCacheRequests counts discovery and OpenAPI requests by
+	// whether they were served from the cache.
+	DiscoveryCacheRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "discovery_cache_requests_total",
+			Help:           "Number of discovery and OpenAPI requests, by cluster and cache result: hit, miss or revalidated.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"cluster", "result"},
+	)
+
+	// RebuildAuthorizersDuration observes the time taken to rebuild the RBAC
+	// authorizers of every cluster.
+	RebuildAuthorizersDuration = metrics.NewHistogram(
+		&metrics.HistogramOpts{
+			Namespace:      namespace,
+			Name:           "rebuild_authorizers_duration_seconds",
+			Help:           "Time taken to rebuild the RBAC authorizers of all clusters in seconds.",
+			Buckets:        metrics.ExponentialBuckets(0.001, 2, 15),
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+)
+
+var registerOnce sync.Once
+
+// Register registers the proxy metrics with the legacy registry. Metrics are
+// not recorded until registered.
+func Register() {
+	registerOnce.Do(func() {
+		legacyregistry.MustRegister(
+			Requests,
+			RequestDuration,
+			AuthenticationFailures,
+			AuthorizationFailures,
+			AuditSendFailures,
+			Clusters,
+			ClusterHealthy,
+			CircuitBreakerState,
+			CircuitBreakerRejections,
+			DiscoveryCacheRequests,
+			RebuildAuthorizersDuration,
+		)
+	})
+}
+
+// Handler serves the registered metrics.
+func Handler() http.Handler {
+	return legacyregistry.Handler()
+}
@@ -0,0 +1,232 @@
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
+)
+
+// ClusterHealthPath serves the health of every cluster on the probe port.
+const ClusterHealthPath = "/healthz/clusters"
+
+// Policies for whether unhealthy clusters make the proxy unready.
+const (
+	// ReadinessPolicyIgnore keeps the proxy ready regardless of cluster
+	// health.
+	ReadinessPolicyIgnore = "ignore"
+	// ReadinessPolicyAny makes the proxy unready unless at least one cluster
+	// is healthy.
+	ReadinessPolicyAny = "any"
+	// ReadinessPolicyAll makes the proxy unready unless every cluster is
+	// healthy.
+	ReadinessPolicyAll = "all"
+)
+
+// ReadinessPolicies are the valid readiness policies.
+var ReadinessPolicies = []string{ReadinessPolicyIgnore, ReadinessPolicyAny, ReadinessPolicyAll}
+
+// ClusterLister lists the clusters to check.
+type ClusterLister interface {
+	GetAllClusters() []*cluster.Cluster
+}
+
+// ClusterChecker polls the /readyz endpoint of every cluster in the
+// background and records the result on the cluster.
+type ClusterChecker struct {
+	clusters ClusterLister
+	interval time.Duration
+	timeout  time.Duration
+	policy   string
+	now      func() time.Time
+
+	mu sync.Mutex
+	// lastRound is when the latest round of checks completed, or when the
+	// checker was started
+	lastRound time.Time
+}
+
+// ClusterHealth is the health of a cluster served at ClusterHealthPath.
+type ClusterHealth struct {
+	Name           string               `json:"name"`
+	Status         cluster.HealthStatus `json:"status"`
+	Latency        string               `json:"latency,omitempty"`
+	LastCheck      *time.Time           `json:"lastCheck,omitempty"`
+	LastError      string               `json:"lastError,omitempty"`
+	LastErrorTime  *time.Time           `json:"lastErrorTime,omitempty"`
+	CircuitBreaker string               `json:"circuitBreaker,omitempty"`
+}
+
+// ClusterHealthList is the response body of ClusterHealthPath.
+type ClusterHealthList struct {
+	Clusters []ClusterHealth `json:"clusters"`
+}
+
+// NewClusterChecker returns a ClusterChecker checking the clusters every
+// interval, with the readiness policy applied to the results.
+func NewClusterChecker(clusters ClusterLister, interval, timeout time.Duration, policy string) *ClusterChecker {
+	return &ClusterChecker{
+		clusters: clusters,
+		interval: interval,
+		timeout:  timeout,
+		policy:   policy,
+		now:      time.Now,
+	}
+}
+
+// Run checks the clusters every interval until stopCh is closed.
+func (c *ClusterChecker) Run(stopCh <-chan struct{}) {
+	c.mu.Lock()
+	c.lastRound = c.now()
+	c.mu.Unlock()
+
+	go wait.Until(c.checkAll, c.interval, stopCh)
+}
+
+func (c *ClusterChecker) checkAll() {
+	var wg sync.WaitGroup
+	for _, cl := range c.clusters.GetAllClusters() {
+		wg.Add(1)
+		go func(cl *cluster.Cluster) {
+			defer wg.Done()
+			c.check(cl)
+		}(cl)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	c.lastRound = c.now()
+	c.mu.Unlock()
+}
+
+func (c *ClusterChecker) check(cl *cluster.Cluster) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	before := cl.Health().Status
+
+	start := c.now()
+	err := cl.CheckHealth(ctx)
+	cl.RecordHealth(err, c.now().Sub(start), c.now())
+
+	healthy := 0.0
+	if err == nil {
+		healthy = 1
+	}
+	metrics.ClusterHealthy.WithLabelValues(cl.Name).Set(healthy)
+
+	switch after := cl.Health().Status; {
+	case after == before:
+	case err != nil:
+		klog.Warningf("cluster %q is unhealthy: %s", cl.Name, err)
+	default:
+		klog.Infof("cluster %q is healthy", cl.Name)
+	}
+}
+
+// Live returns an error if the checks have stalled, e.g. on a deadlock.
+func (c *ClusterChecker) Live() error {
+	c.mu.Lock()
+	lastRound := c.lastRound
+	c.mu.Unlock()
+
+	// Not running
+	if lastRound.IsZero() {
+		return nil
+	}
+
+	// Checks run in parallel, so a round takes at most the timeout
+	if stalled := c.now().Sub(lastRound); stalled > 3*(c.interval+c.timeout) {
+		return fmt.Errorf("cluster health checks have not completed for %s", stalled.Round(time.Second))
+	}
+
+	return nil
+}
+
+// Ready returns an error if the clusters' health fails the readiness policy.
+// Clusters not yet checked are not healthy.
+func (c *ClusterChecker) Ready() error {
+	if c.policy == ReadinessPolicyIgnore {
+		return nil
+	}
+
+	clusters := c.clusters.GetAllClusters()
+	if len(clusters) == 0 {
+		return nil
+	}
+
+	var unhealthy []string
+	for _, cl := range clusters {
+		if cl.Health().Status != cluster.HealthHealthy {
+			unhealthy = append(unhealthy, cl.Name)
+		}
+	}
+	sort.Strings(unhealthy)
+
+	switch {
+	case c.policy == ReadinessPolicyAll && len(unhealthy) > 0:
+		return fmt.Errorf("clusters are not healthy: %s", strings.Join(unhealthy, ", "))
+	case c.policy == ReadinessPolicyAny && len(unhealthy) == len(clusters):
+		return fmt.Errorf("no cluster is healthy: %s", strings.Join(unhealthy, ", "))
+	}
+
+	return nil
+}
+
+// ServeHTTP writes the health of every cluster.
+func (c *ClusterChecker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clusters := c.clusters.GetAllClusters()
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+
+	list := ClusterHealthList{Clusters: make([]ClusterHealth, len(clusters))}
+	for i, cl := range clusters {
+		list.Clusters[i] = newClusterHealth(cl)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(list); err != nil {
+		klog.Errorf("failed to write cluster health: %s", err)
+	}
+}
+
+func newClusterHealth(cl *cluster.Cluster) ClusterHealth {
+	health := cl.Health()
+
+	info := ClusterHealth{
+		Name:      cl.Name,
+		Status:    health.Status,
+		LastError: health.LastError,
+	}
+
+	if !health.LastCheck.IsZero() {
+		info.Latency = health.Latency.Round(time.Millisecond).String()
+		info.LastCheck = &health.LastCheck
+	}
+
+	if !health.LastErrorTime.IsZero() {
+		info.LastErrorTime = &health.LastErrorTime
+	}
+
+	if cl.Breaker != nil {
+		info.CircuitBreaker = cl.Breaker.State().String()
+	}
+
+	return info
+}
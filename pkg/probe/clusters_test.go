@@ -0,0 +1,119 @@
+package probe
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+)
+
+type fakeClusterLister []*cluster.Cluster
+
+func (f fakeClusterLister) GetAllClusters() []*cluster.Cluster {
+	return append([]*cluster.Cluster{}, f...)
+}
+
+// fakeReadyzRT responds to /readyz with the status code, or fails if zero.
+type fakeReadyzRT struct {
+	code int
+}
+
+func (f *fakeReadyzRT) RoundTrip(req *http.Request) (*http.Response, error) {
+	if f.code == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: f.code, Body: http.NoBody}, nil
+}
+
+func newFakeCluster(name string, rt http.RoundTripper) *cluster.Cluster {
+	return &cluster.Cluster{
+		Name:            name,
+		RestConfig:      &rest.Config{Host: "https://" + name},
+		ClientTransport: rt,
+	}
+}
+
+func TestClusterChecker(t *testing.T) {
+	healthyRT := &fakeReadyzRT{code: http.StatusOK}
+	failingRT := &fakeReadyzRT{}
+
+	clusters := fakeClusterLister{
+		newFakeCluster("a", healthyRT),
+		newFakeCluster("b", failingRT),
+	}
+
+	policy := func(policy string) *ClusterChecker {
+		return NewClusterChecker(clusters, time.Second, time.Second, policy)
+	}
+
+	// Clusters not yet checked are not healthy
+	assert.NoError(t, policy(ReadinessPolicyIgnore).Ready())
+	assert.Error(t, policy(ReadinessPolicyAny).Ready())
+
+	policy(ReadinessPolicyIgnore).checkAll()
+
+	assert.Equal(t, cluster.HealthHealthy, clusters[0].Health().Status)
+	health := clusters[1].Health()
+	assert.Equal(t, cluster.HealthUnhealthy, health.Status)
+	assert.Equal(t, "connection refused", health.LastError)
+
+	assert.NoError(t, policy(ReadinessPolicyIgnore).Ready())
+	assert.NoError(t, policy(ReadinessPolicyAny).Ready())
+	assert.EqualError(t, policy(ReadinessPolicyAll).Ready(), "clusters are not healthy: b")
+
+	// The last error is kept once the cluster recovers
+	failingRT.code = http.StatusOK
+	healthyRT.code = http.StatusInternalServerError
+	policy(ReadinessPolicyIgnore).checkAll()
+
+	health = clusters[1].Health()
+	assert.Equal(t, cluster.HealthHealthy, health.Status)
+	assert.Equal(t, "connection refused", health.LastError)
+	assert.Equal(t, "readyz returned status code 500", clusters[0].Health().LastError)
+
+	// The health is served on the probe port
+	w := httptest.NewRecorder()
+	policy(ReadinessPolicyIgnore).ServeHTTP(w, httptest.NewRequest(http.MethodGet, ClusterHealthPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var list ClusterHealthList
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode cluster health: %s", err)
+	}
+	if assert.Len(t, list.Clusters, 2) {
+		assert.Equal(t, "a", list.Clusters[0].Name)
+		assert.Equal(t, cluster.HealthUnhealthy, list.Clusters[0].Status)
+		assert.Equal(t, "b", list.Clusters[1].Name)
+		assert.Equal(t, cluster.HealthHealthy, list.Clusters[1].Status)
+		assert.NotEmpty(t, list.Clusters[1].Latency)
+	}
+}
+
+func TestClusterCheckerLive(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	c := NewClusterChecker(fakeClusterLister{}, time.Second, time.Second, ReadinessPolicyIgnore)
+	c.now = func() time.Time { return now }
+
+	// Not running
+	now = now.Add(time.Hour)
+	assert.NoError(t, c.Live())
+
+	c.lastRound = now
+	now = now.Add(6 * time.Second)
+	assert.NoError(t, c.Live())
+
+	// Checks have stalled
+	now = now.Add(time.Second)
+	assert.Error(t, c.Live())
+
+	c.checkAll()
+	assert.NoError(t, c.Live())
+}
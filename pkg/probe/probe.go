@@ -3,15 +3,20 @@ package probe
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/heptiolabs/healthcheck"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
 	"k8s.io/klog/v2"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
+	"github.com/Improwised/kube-oidc-proxy/pkg/util"
 )
 
 const (
@@ -20,25 +25,28 @@ const (
 
 type HealthCheck struct {
 	handler healthcheck.Handler
+	mux     *http.ServeMux
 
 	oidcAuther authenticator.Token
 	fakeJWT    string
-
-	ready bool
 }
 
-func Run(port, fakeJWT string, oidcAuther authenticator.Token) error {
+func Run(port, fakeJWT string, oidcAuther authenticator.Token) (*HealthCheck, error) {
 	h := &HealthCheck{
 		handler:    healthcheck.NewHandler(),
+		mux:        http.NewServeMux(),
 		oidcAuther: oidcAuther,
 		fakeJWT:    fakeJWT,
 	}
 
 	h.handler.AddReadinessCheck("secure serving", h.Check)
 
+	h.mux.Handle("/metrics", metrics.Handler())
+	h.mux.Handle("/", h.handler)
+
 	go func() {
 		for {
-			err := http.ListenAndServe(net.JoinHostPort("0.0.0.0", port), h.handler)
+			err := http.ListenAndServe(net.JoinHostPort("0.0.0.0", port), h.mux)
 			if err != nil {
 				klog.Errorf("ready probe listener failed: %s", err)
 			}
@@ -46,14 +54,102 @@ func Run(port, fakeJWT string, oidcAuther authenticator.Token) error {
 		}
 	}()
 
-	return nil
+	return h, nil
 }
 
-func (h *HealthCheck) Check() error {
-	if h.ready {
-		return nil
+// CertKeyChecker reports whether a certificate and key file can be loaded as a
+// pair. The serving certificates are reloaded when they change, so a broken
+// rotation is surfaced on readiness instead of only being logged. The pair is
+// only loaded again when either file changes.
+type CertKeyChecker struct {
+	certFile string
+	keyFile  string
+	watchers []*util.FileWatcher
+
+	mu  sync.RWMutex
+	err error
+}
+
+// NewCertKeyChecker returns a checker of the certificate and key files, which
+// are loaded once immediately.
+func NewCertKeyChecker(certFile, keyFile string) *CertKeyChecker {
+	c := &CertKeyChecker{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	c.watchers = []*util.FileWatcher{
+		util.NewFileWatcher(certFile, c.onChange),
+		util.NewFileWatcher(keyFile, c.onChange),
+	}
+
+	return c
+}
+
+// Run watches the files for changes until stopCh is closed.
+func (c *CertKeyChecker) Run(stopCh <-chan struct{}) {
+	for _, w := range c.watchers {
+		w.Run(util.DefaultFileWatchInterval, stopCh)
+	}
+}
+
+// Check returns the result of the last load of the pair.
+func (c *CertKeyChecker) Check() error {
+	for _, w := range c.watchers {
+		if err := w.Err(); err != nil {
+			return err
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.err
+}
+
+func (c *CertKeyChecker) onChange([]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		err = fmt.Errorf("failed to load certificate %q and key %q: %s", c.certFile, c.keyFile, err)
 	}
 
+	// Only log changes, the pair is checked again on every file change.
+	switch {
+	case err != nil && (c.err == nil || c.err.Error() != err.Error()):
+		klog.Error(err)
+	case err == nil && c.err != nil:
+		klog.Infof("loaded certificate %q and key %q", c.certFile, c.keyFile)
+	}
+	c.err = err
+
+	return nil
+}
+
+// AddReadinessCheck adds a check that must pass for the proxy to be ready.
+func (h *HealthCheck) AddReadinessCheck(name string, check func() error) {
+	h.handler.AddReadinessCheck(name, check)
+}
+
+// AddLivenessCheck adds a check that must pass for the proxy to be live. The
+// proxy is restarted if it fails, so it should only fail if the proxy can't
+// recover by itself.
+func (h *HealthCheck) AddLivenessCheck(name string, check func() error) {
+	h.handler.AddLivenessCheck(name, check)
+}
+
+// AddClusterChecker serves the health of every cluster at ClusterHealthPath,
+// and adds the checker's liveness and readiness checks.
+func (h *HealthCheck) AddClusterChecker(checker *ClusterChecker) {
+	h.mux.Handle(ClusterHealthPath, checker)
+	h.handler.AddLivenessCheck("cluster health checker", checker.Live)
+	h.handler.AddReadinessCheck("cluster health", checker.Ready)
+}
+
+// Check returns an error while the OIDC authenticator is not initialized. It
+// is not cached, so the proxy becomes unready again if the authenticator
+// breaks later.
+func (h *HealthCheck) Check() error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
@@ -64,8 +160,6 @@ func (h *HealthCheck) Check() error {
 		return err
 	}
 
-	h.ready = true
-
 	klog.V(4).Info("OIDC provider initialized.")
 
 	return nil
@@ -6,9 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"k8s.io/apiserver/pkg/authentication/authenticator"
+	certutil "k8s.io/client-go/util/cert"
 
 	"github.com/Improwised/kube-oidc-proxy/pkg/util"
 )
@@ -44,7 +47,7 @@ func TestRun(t *testing.T) {
 		t.FailNow()
 	}
 
-	if err := Run(port, fakeJWT, f); err != nil {
+	if _, err := Run(port, fakeJWT, f); err != nil {
 		t.Error(err.Error())
 		t.FailNow()
 	}
@@ -84,8 +87,8 @@ func TestRun(t *testing.T) {
 			200, resp.StatusCode)
 	}
 
-	// Once the authenticator has returned with an non-initialised error, then
-	// should always return ready
+	// Readiness is not cached, so the probe becomes unready again if the
+	// authenticator breaks later
 
 	f.returnErr = true
 
@@ -94,8 +97,87 @@ func TestRun(t *testing.T) {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
+	if resp.StatusCode != 503 {
+		t.Errorf("expected ready probe to be responding and not ready, exp=%d got=%d",
+			503, resp.StatusCode)
+	}
+
+	resp, err = http.Get(url + "/live")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
 	if resp.StatusCode != 200 {
-		t.Errorf("expected ready probe to be responding and ready, exp=%d got=%d",
+		t.Errorf("expected live probe to be responding and live, exp=%d got=%d",
 			200, resp.StatusCode)
 	}
+
+	resp, err = http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Errorf("expected metrics to be served, exp=%d got=%d",
+			200, resp.StatusCode)
+	}
+}
+
+func TestCertKeyChecker(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	cert, key, err := certutil.GenerateSelfSignedCertKey("proxy.example.com", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := certutil.GenerateSelfSignedCertKey("other.example.com", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(file string, data []byte) {
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload := func(c *CertKeyChecker) {
+		for _, w := range c.watchers {
+			w.Reload()
+		}
+	}
+
+	write(certFile, cert)
+	write(keyFile, key)
+
+	c := NewCertKeyChecker(certFile, keyFile)
+	if err := c.Check(); err != nil {
+		t.Errorf("expected valid pair to pass, got: %s", err)
+	}
+
+	// A rotated key that does not match the certificate fails the check
+	write(keyFile, otherKey)
+	if err := c.Check(); err != nil {
+		t.Errorf("expected the result to be kept until the files are reloaded, got: %s", err)
+	}
+	reload(c)
+	if err := c.Check(); err == nil {
+		t.Error("expected mismatched pair to fail")
+	}
+
+	write(keyFile, key)
+	reload(c)
+	if err := c.Check(); err != nil {
+		t.Errorf("expected restored pair to pass, got: %s", err)
+	}
+
+	// Missing files fail the check
+	if err := os.Remove(certFile); err != nil {
+		t.Fatal(err)
+	}
+	reload(c)
+	if err := c.Check(); err == nil {
+		t.Error("expected missing certificate to fail")
+	}
 }
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	authuser "k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog/v2"
+
+	"github.com/Improwised/kube-oidc-proxy/constants"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/audit"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/crd"
+)
+
+const (
+	// accessRequestsPath lists and creates access requests. Requests are
+	// approved and denied below it, at <name>/approve and <name>/deny.
+	accessRequestsPath = "/_accessrequests"
+
+	accessRequestApprove = "approve"
+	accessRequestDeny    = "deny"
+
+	// maxAccessRequestBody bounds the request bodies of the access request
+	// endpoints.
+	maxAccessRequestBody = 64 << 10
+)
+
+// AccessRequestList is the response body of the access requests endpoint.
+type AccessRequestList struct {
+	AccessRequests []*crd.AccessRequest `json:"accessRequests"`
+}
+
+// AccessRequestDecision is the optional request body of an approval or
+// denial.
+type AccessRequestDecision struct {
+	Message string `json:"message,omitempty"`
+}
+
+// serveAccessRequests lists the access requests visible to the caller on
+// GET, and creates an access request for the caller on POST.
+func (p *Proxy) serveAccessRequests(rw http.ResponseWriter, req *http.Request) {
+	user, err := p.checkAccessRequestsAccess(req)
+	if err != nil {
+		p.handleError(rw, req, err)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		accessRequests, err := p.config.AccessRequests.List(req.Context())
+		if err != nil {
+			p.handleError(rw, req, err)
+			return
+		}
+
+		// Approvers see every request, other users their own
+		list := AccessRequestList{AccessRequests: []*crd.AccessRequest{}}
+		for _, accessRequest := range accessRequests {
+			if p.isAccessRequestApprover(user) || accessRequest.Spec.User == user.GetName() {
+				list.AccessRequests = append(list.AccessRequests, accessRequest)
+			}
+		}
+
+		writeAccessRequestResponse(rw, http.StatusOK, list)
+
+	case http.MethodPost:
+		var spec crd.AccessRequestSpec
+		if err := decodeAccessRequestBody(req, &spec); err != nil {
+			p.handleError(rw, req, err)
+			return
+		}
+
+		// Access is always requested for the caller
+		spec.User = user.GetName()
+
+		accessRequest, err := p.config.AccessRequests.Create(req.Context(), spec)
+		if err != nil {
+			p.handleError(rw, req, err)
+			return
+		}
+
+		writeAccessRequestResponse(rw, http.StatusCreated, accessRequest)
+
+	default:
+		p.handleError(rw, req, apierrors.NewMethodNotSupported(crd.AccessRequestGVR.GroupResource(), req.Method))
+	}
+}
+
+// serveAccessRequestDecision approves or denies an access request. Only
+// members of the approver groups may decide, and not on their own requests.
+func (p *Proxy) serveAccessRequestDecision(rw http.ResponseWriter, req *http.Request) {
+	user, err := p.checkAccessRequestsAccess(req)
+	if err != nil {
+		p.handleError(rw, req, err)
+		return
+	}
+
+	name, action, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, accessRequestsPath+"/"), "/")
+	if !ok || len(name) == 0 || (action != accessRequestApprove && action != accessRequestDeny) {
+		p.handleError(rw, req, apierrors.NewNotFound(crd.AccessRequestGVR.GroupResource(), name))
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		p.handleError(rw, req, apierrors.NewMethodNotSupported(crd.AccessRequestGVR.GroupResource(), req.Method))
+		return
+	}
+
+	if !p.isAccessRequestApprover(user) {
+		p.handleError(rw, req, newForbidden(fmt.Sprintf("user %q is not allowed to decide access requests", user.GetName())))
+		return
+	}
+
+	accessRequest, err := p.config.AccessRequests.Get(req.Context(), name)
+	if err != nil {
+		p.handleError(rw, req, err)
+		return
+	}
+	if accessRequest.Spec.User == user.GetName() {
+		p.handleError(rw, req, newForbidden(fmt.Sprintf("user %q can't decide their own access request", user.GetName())))
+		return
+	}
+
+	var decision AccessRequestDecision
+	if err := decodeAccessRequestBody(req, &decision); err != nil {
+		p.handleError(rw, req, err)
+		return
+	}
+
+	if action == accessRequestApprove {
+		accessRequest, err = p.config.AccessRequests.Approve(req.Context(), name, user.GetName(), decision.Message)
+	} else {
+		accessRequest, err = p.config.AccessRequests.Deny(req.Context(), name, user.GetName(), decision.Message)
+	}
+	if err != nil {
+		p.handleError(rw, req, err)
+		return
+	}
+
+	writeAccessRequestResponse(rw, http.StatusOK, accessRequest)
+}
+
+// checkAccessRequestsAccess returns the caller, or an error unless access
+// requests are enabled and the caller is authenticated.
+func (p *Proxy) checkAccessRequestsAccess(req *http.Request) (authuser.Info, error) {
+	if p.config.AccessRequests == nil {
+		return nil, &apierrors.StatusError{ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusNotFound,
+			Reason:  metav1.StatusReasonNotFound,
+			Message: "access requests are not enabled",
+		}}
+	}
+
+	user, ok := genericapirequest.UserFrom(req.Context())
+	if !ok || len(user.GetName()) == 0 {
+		return nil, errNoName
+	}
+
+	return user, nil
+}
+
+func (p *Proxy) isAccessRequestApprover(user authuser.Info) bool {
+	return sets.NewString(p.config.AccessRequestApproverGroups...).HasAny(user.GetGroups()...)
+}
+
+// decodeAccessRequestBody decodes the JSON request body into v. An empty body
+// leaves v unchanged.
+func decodeAccessRequestBody(req *http.Request, v interface{}) error {
+	if req.Body == nil {
+		return nil
+	}
+
+	err := json.NewDecoder(io.LimitReader(req.Body, maxAccessRequestBody)).Decode(v)
+	if err != nil && err != io.EOF {
+		return apierrors.NewBadRequest(fmt.Sprintf("invalid request body: %s", err))
+	}
+
+	return nil
+}
+
+func writeAccessRequestResponse(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		klog.Errorf("failed to write access request response: %s", err)
+	}
+}
+
+// AuditAccessRequest sends a state transition of an AccessRequest to the
+// audit webhook.
+func (p *Proxy) AuditAccessRequest(accessRequest *crd.AccessRequest) {
+	log := audit.Log{
+		ClusterName: strings.Join(accessRequest.Spec.TargetClusters, ","),
+		Email:       accessRequest.Spec.User,
+		APIGroup:    constants.Group,
+		APIVersion:  constants.Version,
+		Resource:    constants.AccessRequestKind,
+		Name:        accessRequest.Name,
+		Event:       audit.EventAccessRequestPrefix + accessRequest.Phase(),
+		Reason:      accessRequest.Spec.Reason,
+	}
+
+	// The transition is still audited if the access request can't be encoded
+	body, err := json.Marshal(accessRequest)
+	if err != nil {
+		klog.Errorf("failed to encode access request %q, auditing it without a body: %s", accessRequest.Name, err)
+	} else {
+		log.RequestBody = body
+	}
+
+	p.auditor.SendAuditLog(gocontext.Background(), log)
+}
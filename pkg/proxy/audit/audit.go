@@ -3,21 +3,28 @@ package audit
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/apimachinery/pkg/util/sets"
 	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
 	"k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/apiserver/pkg/server"
 	genericfilters "k8s.io/apiserver/pkg/server/filters"
+	"k8s.io/component-base/tracing"
 	"k8s.io/component-base/version"
 	"k8s.io/klog/v2"
 
 	"github.com/Improwised/kube-oidc-proxy/cmd/app/options"
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/breakglass"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/resolver"
+	"github.com/Improwised/kube-oidc-proxy/pkg/util"
 	"github.com/go-resty/resty/v2"
 )
 
@@ -25,6 +32,7 @@ type Audit struct {
 	opts         *options.AuditOptions
 	serverConfig *server.CompletedConfig
 	client       *resty.Client
+	resolver     resolver.Resolver
 }
 
 type Log struct {
@@ -48,14 +56,51 @@ type Log struct {
 	Parts             []string `json:"parts"`
 	FieldSelector     string   `json:"field_selector"`
 	LabelSelector     string   `json:"label_selector"`
+	// Command is the command of pods/exec requests
+	Command []string `json:"command,omitempty"`
 	// body
 	RequestBody json.RawMessage `json:"request_body"`
+	// denial, only set for requests rejected by the proxy
+	Event  string `json:"event,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Severity is set for events that need attention, e.g. break-glass use
+	Severity string `json:"severity,omitempty"`
 }
 
+// SeverityHigh is the severity of events that should alert someone.
+const SeverityHigh = "high"
+
+// sendTimeout bounds posting a log to the audit webhook.
+const sendTimeout = 10 * time.Second
+
+const (
+	// EventRequiredClaimsDenied is logged when a token does not carry the
+	// claims required by the targeted cluster.
+	EventRequiredClaimsDenied = "RequiredClaimsDenied"
+	// EventExecCommandDenied is logged when the exec policy does not allow
+	// the command of a pods/exec request.
+	EventExecCommandDenied = "ExecCommandDenied"
+	// EventDenyRuleDenied is logged when a deny rule denies a request
+	// before it is authorized by RBAC.
+	EventDenyRuleDenied = "DenyRuleDenied"
+	// EventAccessRequestPrefix prefixes the phase of an AccessRequest in the
+	// events logged on its state transitions, e.g. AccessRequestApproved.
+	EventAccessRequestPrefix = "AccessRequest"
+	// EventBreakGlassActivated is logged when a user starts a break-glass
+	// session.
+	EventBreakGlassActivated = "BreakGlassActivated"
+	// EventBreakGlassRequest is logged for each request of a break-glass
+	// session.
+	EventBreakGlassRequest = "BreakGlassRequest"
+	// EventBreakGlassDenied is logged when a user has started too many
+	// break-glass sessions.
+	EventBreakGlassDenied = "BreakGlassDenied"
+)
+
 // New creates a new Audit struct to handle auditing for proxy requests. This
 // is mostly a wrapper for the apiserver auditing handlers to combine them with
 // the proxy.
-func New(opts *options.AuditOptions, externalAddress string, secureServingInfo *server.SecureServingInfo) (*Audit, error) {
+func New(opts *options.AuditOptions, externalAddress string, secureServingInfo *server.SecureServingInfo, clusterResolver resolver.Resolver) (*Audit, error) {
 	serverConfig := &server.Config{
 		ExternalAddress: externalAddress,
 		SecureServing:   secureServingInfo,
@@ -84,6 +129,7 @@ func New(opts *options.AuditOptions, externalAddress string, secureServingInfo *
 		opts:         opts,
 		serverConfig: &completed,
 		client:       client,
+		resolver:     clusterResolver,
 	}, nil
 }
 
@@ -128,13 +174,12 @@ func (a *Audit) WithUnauthorized(handler http.Handler) http.Handler {
 func (a *Audit) WithCustomAuditLog(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		parts := strings.Split(r.URL.Path, "/")
-		if len(parts) < 2 {
+		clusterName, _ := a.resolver.Resolve(r)
+		if clusterName == "" {
 			klog.V(4).Info("Invalid request: No cluster name in the request")
 			handler.ServeHTTP(w, r)
 			return
 		}
-		clusterName := parts[1]
 
 		requestInfo, found := request.RequestInfoFrom(r.Context())
 		if !found || !requestInfo.IsResourceRequest {
@@ -158,7 +203,7 @@ func (a *Audit) WithCustomAuditLog(handler http.Handler) http.Handler {
 			klog.V(4).Info("No user info found in the request")
 		}
 
-		a.SendAuditLog(Log{
+		log := Log{
 			ClusterName: clusterName,
 			// user info
 			Email:  userInfo.GetName(),
@@ -179,9 +224,20 @@ func (a *Audit) WithCustomAuditLog(handler http.Handler) http.Handler {
 			Parts:             requestInfo.Parts,
 			FieldSelector:     requestInfo.FieldSelector,
 			LabelSelector:     requestInfo.LabelSelector,
+			Command:           ExecCommand(r, requestInfo),
 			// body
 			RequestBody: bodyBytes,
-		})
+		}
+
+		// Requests of break-glass sessions carry their justification. Their
+		// BreakGlassRequest event is sent when the session is used.
+		if ok {
+			if reason := userInfo.GetExtra()[breakglass.ReasonExtra]; len(reason) > 0 {
+				log.Reason = reason[0]
+			}
+		}
+
+		a.SendAuditLog(r.Context(), log)
 
 		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 		handler.ServeHTTP(w, r)
@@ -189,18 +245,41 @@ func (a *Audit) WithCustomAuditLog(handler http.Handler) http.Handler {
 
 }
 
-func (a *Audit) SendAuditLog(log Log) {
-	r, err := a.client.R().SetBody(log).Post("/api/v1/k8s-audit-log/webhook")
+// ExecCommand returns the command of a pods/exec request, or nil for other
+// requests.
+func ExecCommand(r *http.Request, requestInfo *request.RequestInfo) []string {
+	if !requestInfo.IsResourceRequest || requestInfo.Resource != "pods" || requestInfo.Subresource != "exec" {
+		return nil
+	}
+
+	return r.URL.Query()["command"]
+}
+
+// SendAuditLog posts the log to the audit webhook. The post is not cancelled
+// with the given request context, so logs of requests whose client
+// disconnects, such as denials, are still sent.
+func (a *Audit) SendAuditLog(ctx context.Context, log Log) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sendTimeout)
+	defer cancel()
+
+	ctx, span := tracing.Start(ctx, "AuditSend", attribute.String("cluster", log.ClusterName))
+	defer span.End(util.TraceLogThreshold)
+
+	r, err := a.client.R().SetContext(ctx).SetBody(log).Post("/api/v1/k8s-audit-log/webhook")
 	if err != nil {
 		klog.Errorf("Error sending audit log to webhook: %v", err)
+		span.RecordError(err)
+		metrics.AuditSendFailures.Inc()
 		return
 
 	}
 	if r == nil {
 		klog.Errorf("Error sending audit log to webhook: response is nil")
+		metrics.AuditSendFailures.Inc()
 		return
 	}
 	if r.IsError() || r.StatusCode() != http.StatusOK {
 		klog.Errorf("Error sending audit log to webhook: %v", r.String())
+		metrics.AuditSendFailures.Inc()
 	}
 }
@@ -0,0 +1,40 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendAuditLogCancelledRequest(t *testing.T) {
+	logs := make(chan Log, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var log Log
+		if err := json.NewDecoder(req.Body).Decode(&log); err != nil {
+			t.Errorf("failed to decode audit log: %s", err)
+		}
+		logs <- log
+	}))
+	defer server.Close()
+
+	a := &Audit{client: resty.New().SetBaseURL(server.URL)}
+
+	// The client of the audited request has disconnected
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	a.SendAuditLog(ctx, Log{Email: "a-user", Event: EventBreakGlassDenied})
+
+	select {
+	case log := <-logs:
+		assert.Equal(t, "a-user", log.Email)
+		assert.Equal(t, EventBreakGlassDenied, log.Event)
+	default:
+		t.Fatal("audit log was not sent")
+	}
+}
@@ -0,0 +1,173 @@
+// Package breaker implements a circuit breaker that fails requests fast while
+// an upstream is failing.
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of a circuit breaker.
+type State int
+
+const (
+	// Closed lets all requests through.
+	Closed State = iota
+	// Open rejects all requests until the open timeout has passed.
+	Open
+	// HalfOpen lets a limited number of probe requests through. The breaker
+	// closes if a probe succeeds and opens again if one fails.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Config configures a circuit breaker.
+type Config struct {
+	// FailureThreshold is the number of consecutive failures that opens the
+	// breaker. Zero disables the breaker.
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before letting probe
+	// requests through.
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of probe requests let through at a time
+	// while half-open.
+	HalfOpenRequests int
+}
+
+// Enabled returns whether the config enables the breaker.
+func (c Config) Enabled() bool {
+	return c.FailureThreshold > 0
+}
+
+// Breaker is a circuit breaker counting consecutive failures of requests.
+type Breaker struct {
+	config        Config
+	now           func() time.Time
+	onStateChange func(State)
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probes   int
+	// generation is incremented on every state change, so results of
+	// requests let through in an earlier state are ignored.
+	generation uint64
+}
+
+// New returns a closed Breaker. onStateChange, if not nil, is called with the
+// new state on every state change while the breaker is locked, so it must not
+// call back into the breaker.
+func New(config Config, onStateChange func(State)) *Breaker {
+	if config.HalfOpenRequests < 1 {
+		config.HalfOpenRequests = 1
+	}
+
+	return &Breaker{
+		config:        config,
+		now:           time.Now,
+		onStateChange: onStateChange,
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.halfOpenIfExpired(b.now())
+	return b.state
+}
+
+// Allow returns whether a request may be sent. If the breaker is open, the
+// time until probe requests are let through is returned. Otherwise the
+// request must call done with whether it succeeded once its result is known.
+func (b *Breaker) Allow() (done func(success bool), retryAfter time.Duration, ok bool) {
+	now := b.now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.halfOpenIfExpired(now)
+
+	switch b.state {
+	case Open:
+		return nil, b.openedAt.Add(b.config.OpenTimeout).Sub(now), false
+
+	case HalfOpen:
+		if b.probes >= b.config.HalfOpenRequests {
+			// Probes are in flight, retry once they are likely done
+			return nil, time.Second, false
+		}
+		b.probes++
+	}
+
+	generation := b.generation
+	probe := b.state == HalfOpen
+
+	var once sync.Once
+	return func(success bool) {
+		once.Do(func() {
+			b.record(generation, probe, success)
+		})
+	}, 0, true
+}
+
+func (b *Breaker) record(generation uint64, probe, success bool) {
+	now := b.now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	if probe {
+		b.probes--
+	}
+
+	if success {
+		b.failures = 0
+		if b.state == HalfOpen {
+			b.setState(Closed, now)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == HalfOpen || b.failures >= b.config.FailureThreshold {
+		b.setState(Open, now)
+	}
+}
+
+func (b *Breaker) halfOpenIfExpired(now time.Time) {
+	if b.state == Open && !now.Before(b.openedAt.Add(b.config.OpenTimeout)) {
+		b.setState(HalfOpen, now)
+	}
+}
+
+func (b *Breaker) setState(state State, now time.Time) {
+	b.state = state
+	b.generation++
+	b.failures = 0
+	b.probes = 0
+
+	if state == Open {
+		b.openedAt = now
+	}
+
+	if b.onStateChange != nil {
+		b.onStateChange(state)
+	}
+}
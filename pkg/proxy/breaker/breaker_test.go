@@ -0,0 +1,82 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	var states []State
+	b := New(Config{FailureThreshold: 2, OpenTimeout: 10 * time.Second}, func(s State) {
+		states = append(states, s)
+	})
+	b.now = func() time.Time { return now }
+
+	request := func(success bool) {
+		done, _, ok := b.Allow()
+		if !assert.True(t, ok) {
+			return
+		}
+		done(success)
+	}
+
+	// A success resets the consecutive failures
+	request(false)
+	request(true)
+	request(false)
+	assert.Equal(t, Closed, b.State())
+
+	// The breaker opens after consecutive failures
+	request(false)
+	assert.Equal(t, Open, b.State())
+
+	_, retryAfter, ok := b.Allow()
+	assert.False(t, ok)
+	assert.Equal(t, 10*time.Second, retryAfter)
+
+	// A probe is let through once the open timeout has passed
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, HalfOpen, b.State())
+	probeDone, _, ok := b.Allow()
+	assert.True(t, ok)
+	_, _, ok = b.Allow()
+	assert.False(t, ok)
+
+	// A failed probe opens the breaker again
+	probeDone(false)
+	assert.Equal(t, Open, b.State())
+
+	// A successful probe closes the breaker
+	now = now.Add(10 * time.Second)
+	request(true)
+	assert.Equal(t, Closed, b.State())
+
+	assert.Equal(t, []State{Open, HalfOpen, Open, HalfOpen, Closed}, states)
+}
+
+func TestBreakerStaleResults(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	b := New(Config{FailureThreshold: 1, OpenTimeout: time.Second}, nil)
+	b.now = func() time.Time { return now }
+
+	slowDone, _, ok := b.Allow()
+	assert.True(t, ok)
+
+	done, _, _ := b.Allow()
+	done(false)
+	assert.Equal(t, Open, b.State())
+
+	// Results of requests let through before the breaker opened are ignored
+	slowDone(true)
+	assert.Equal(t, Open, b.State())
+
+	// Calling done again has no effect
+	now = now.Add(time.Second)
+	done(false)
+	assert.Equal(t, HalfOpen, b.State())
+}
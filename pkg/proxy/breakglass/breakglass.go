@@ -0,0 +1,191 @@
+// Package breakglass grants the privileges of a break-glass group only to
+// requests carrying a justification, in time-boxed sessions rate limited per
+// user.
+package breakglass
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	// ReasonHeader is the request header carrying the justification.
+	ReasonHeader = "X-Break-Glass-Reason"
+	// ReasonExtra is the user extra carrying the justification. It can be
+	// sent with kubectl --as-user-extra, and is added to the user of
+	// break-glass requests so it reaches the audit logs of the cluster.
+	ReasonExtra = "break-glass-reason"
+)
+
+// Config configures break-glass access.
+type Config struct {
+	// Group is the break-glass group, whose privileges only apply to
+	// requests with a justification.
+	Group string
+	// Duration is how long a session lasts from its first request.
+	Duration time.Duration
+	// MaxSessions is how many sessions a user may start per Window. Zero
+	// means unlimited.
+	MaxSessions int
+	Window      time.Duration
+}
+
+// Session is a period of break-glass access of a user.
+type Session struct {
+	User    string
+	Reason  string
+	Start   time.Time
+	Expires time.Time
+}
+
+// Manager tracks the break-glass sessions of each user.
+type Manager struct {
+	config Config
+	now    func() time.Time
+
+	mu    sync.Mutex
+	users map[string]*userSessions
+}
+
+type userSessions struct {
+	// starts are the start times of the sessions in the window, oldest first
+	starts  []time.Time
+	current Session
+}
+
+// New returns a Manager of break-glass sessions.
+func New(config Config) *Manager {
+	return &Manager{
+		config: config,
+		now:    time.Now,
+		users:  make(map[string]*userSessions),
+	}
+}
+
+// Group returns the break-glass group.
+func (m *Manager) Group() string {
+	return m.config.Group
+}
+
+// IsMember returns whether the user is a member of the break-glass group.
+func (m *Manager) IsMember(u user.Info) bool {
+	for _, group := range u.GetGroups() {
+		if group == m.config.Group {
+			return true
+		}
+	}
+	return false
+}
+
+// WithoutGroup returns the user without the break-glass group.
+func (m *Manager) WithoutGroup(u user.Info) user.Info {
+	groups := make([]string, 0, len(u.GetGroups()))
+	for _, group := range u.GetGroups() {
+		if group != m.config.Group {
+			groups = append(groups, group)
+		}
+	}
+
+	return &user.DefaultInfo{
+		Name:   u.GetName(),
+		UID:    u.GetUID(),
+		Groups: groups,
+		Extra:  u.GetExtra(),
+	}
+}
+
+// WithReason returns the user with the justification in its extra.
+func WithReason(u user.Info, reason string) user.Info {
+	extra := make(map[string][]string, len(u.GetExtra())+1)
+	for k, v := range u.GetExtra() {
+		extra[k] = v
+	}
+	extra[ReasonExtra] = []string{reason}
+
+	return &user.DefaultInfo{
+		Name:   u.GetName(),
+		UID:    u.GetUID(),
+		Groups: u.GetGroups(),
+		Extra:  extra,
+	}
+}
+
+// Use records a break-glass request of the user. It returns the user's
+// session and whether the request started it. If the user has started
+// MaxSessions sessions in the window, ok is false and retryAfter is when the
+// next session can start.
+func (m *Manager) Use(name, reason string) (session Session, started bool, retryAfter time.Duration, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	sessions := m.users[name]
+	if sessions == nil {
+		sessions = new(userSessions)
+		m.users[name] = sessions
+	}
+
+	if now.Before(sessions.current.Expires) {
+		return sessions.current, false, 0, true
+	}
+
+	// Forget the sessions started before the window
+	for len(sessions.starts) > 0 && !now.Before(sessions.starts[0].Add(m.config.Window)) {
+		sessions.starts = sessions.starts[1:]
+	}
+
+	if m.config.MaxSessions > 0 && len(sessions.starts) >= m.config.MaxSessions {
+		return Session{}, false, sessions.starts[0].Add(m.config.Window).Sub(now), false
+	}
+
+	sessions.starts = append(sessions.starts, now)
+	sessions.current = Session{
+		User:    name,
+		Reason:  reason,
+		Start:   now,
+		Expires: now.Add(m.config.Duration),
+	}
+
+	return sessions.current, true, 0, true
+}
+
+// Reason returns the justification of the request for the user, and removes
+// it from the request headers so it is not sent on to the cluster.
+//
+// The justification is read from the ReasonHeader, or from the ReasonExtra
+// impersonation header. As kubectl only sends extras when impersonating, the
+// impersonation of the user by themselves is removed along with it.
+func Reason(req *http.Request, u user.Info) string {
+	reason := strings.TrimSpace(req.Header.Get(ReasonHeader))
+	req.Header.Del(ReasonHeader)
+
+	extraHeader := "Impersonate-Extra-" + url.PathEscape(ReasonExtra)
+	if extra := strings.TrimSpace(req.Header.Get(extraHeader)); len(extra) > 0 {
+		req.Header.Del(extraHeader)
+		if len(reason) == 0 {
+			reason = extra
+		}
+
+		if u != nil && req.Header.Get("Impersonate-User") == u.GetName() && !hasOtherImpersonation(req.Header) {
+			req.Header.Del("Impersonate-User")
+		}
+	}
+
+	return reason
+}
+
+// hasOtherImpersonation returns whether the header impersonates more than a
+// user name.
+func hasOtherImpersonation(header http.Header) bool {
+	for h := range header {
+		if strings.HasPrefix(strings.ToLower(h), "impersonate-") && http.CanonicalHeaderKey(h) != "Impersonate-User" {
+			return true
+		}
+	}
+	return false
+}
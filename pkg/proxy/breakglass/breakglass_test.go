@@ -0,0 +1,148 @@
+package breakglass
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestUse(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	m := New(Config{Group: "break-glass", Duration: time.Hour, MaxSessions: 2, Window: 24 * time.Hour})
+	m.now = func() time.Time { return now }
+
+	// The first request starts a session, later ones use it until it expires
+	session, started, _, ok := m.Use("alice", "incident 1")
+	assert.True(t, ok)
+	assert.True(t, started)
+	assert.Equal(t, now.Add(time.Hour), session.Expires)
+
+	now = now.Add(30 * time.Minute)
+	session, started, _, ok = m.Use("alice", "incident 2")
+	assert.True(t, ok)
+	assert.False(t, started)
+	assert.Equal(t, "incident 1", session.Reason)
+
+	now = now.Add(30 * time.Minute)
+	session, started, _, ok = m.Use("alice", "incident 2")
+	assert.True(t, ok)
+	assert.True(t, started)
+	assert.Equal(t, "incident 2", session.Reason)
+
+	// Sessions are counted per user
+	_, started, _, ok = m.Use("bob", "incident 2")
+	assert.True(t, ok)
+	assert.True(t, started)
+
+	// The limit is reached until the first session leaves the window
+	now = now.Add(time.Hour)
+	_, _, retryAfter, ok := m.Use("alice", "incident 3")
+	assert.False(t, ok)
+	assert.Equal(t, 22*time.Hour, retryAfter)
+
+	now = now.Add(22 * time.Hour)
+	_, started, _, ok = m.Use("alice", "incident 3")
+	assert.True(t, ok)
+	assert.True(t, started)
+}
+
+func TestUseUnlimited(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	m := New(Config{Group: "break-glass", Duration: time.Minute})
+	m.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		_, started, _, ok := m.Use("alice", "incident")
+		assert.True(t, ok)
+		assert.True(t, started)
+		now = now.Add(time.Minute)
+	}
+}
+
+func TestReason(t *testing.T) {
+	alice := &user.DefaultInfo{Name: "alice"}
+
+	tests := map[string]struct {
+		headers    map[string]string
+		expReason  string
+		expHeaders http.Header
+	}{
+		"no reason": {
+			headers:    map[string]string{"Impersonate-User": "alice"},
+			expReason:  "",
+			expHeaders: http.Header{"Impersonate-User": {"alice"}},
+		},
+		"reason header": {
+			headers:    map[string]string{ReasonHeader: " incident 42 "},
+			expReason:  "incident 42",
+			expHeaders: http.Header{},
+		},
+		"reason extra removes self impersonation": {
+			headers: map[string]string{
+				"Impersonate-User":                     "alice",
+				"Impersonate-Extra-break-glass-reason": "incident 42",
+			},
+			expReason:  "incident 42",
+			expHeaders: http.Header{},
+		},
+		"reason extra keeps other impersonation": {
+			headers: map[string]string{
+				"Impersonate-User":                     "alice",
+				"Impersonate-Group":                    "admins",
+				"Impersonate-Extra-break-glass-reason": "incident 42",
+			},
+			expReason: "incident 42",
+			expHeaders: http.Header{
+				"Impersonate-User":  {"alice"},
+				"Impersonate-Group": {"admins"},
+			},
+		},
+		"reason header takes precedence": {
+			headers: map[string]string{
+				ReasonHeader:                           "incident 1",
+				"Impersonate-Extra-break-glass-reason": "incident 2",
+			},
+			expReason:  "incident 1",
+			expHeaders: http.Header{},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api", nil)
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+
+			assert.Equal(t, test.expReason, Reason(req, alice))
+			assert.Equal(t, test.expHeaders, req.Header)
+		})
+	}
+}
+
+func TestGroups(t *testing.T) {
+	m := New(Config{Group: "break-glass"})
+
+	u := &user.DefaultInfo{
+		Name:   "alice",
+		Groups: []string{"dev", "break-glass"},
+		Extra:  map[string][]string{"scopes": {"openid"}},
+	}
+	assert.True(t, m.IsMember(u))
+
+	without := m.WithoutGroup(u)
+	assert.False(t, m.IsMember(without))
+	assert.Equal(t, []string{"dev"}, without.GetGroups())
+	assert.Equal(t, u.Extra, without.GetExtra())
+
+	with := WithReason(u, "incident 42")
+	assert.Equal(t, []string{"incident 42"}, with.GetExtra()[ReasonExtra])
+	assert.Equal(t, []string{"openid"}, with.GetExtra()["scopes"])
+	assert.NotContains(t, u.Extra, ReasonExtra)
+}
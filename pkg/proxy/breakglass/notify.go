@@ -0,0 +1,50 @@
+package breakglass
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// notifyTimeout bounds the requests to the notification webhook.
+const notifyTimeout = time.Second * 10
+
+// Notification is posted to the notification webhook when a break-glass
+// session starts.
+type Notification struct {
+	User        string    `json:"user"`
+	Groups      []string  `json:"groups"`
+	Reason      string    `json:"reason"`
+	ClusterName string    `json:"cluster_name,omitempty"`
+	RequestPath string    `json:"request_path"`
+	Start       time.Time `json:"start"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Notifier posts notifications to a webhook.
+type Notifier struct {
+	url    string
+	client *resty.Client
+}
+
+// NewNotifier returns a Notifier posting to the webhook URL.
+func NewNotifier(url string) *Notifier {
+	return &Notifier{
+		url:    url,
+		client: resty.New().SetTimeout(notifyTimeout),
+	}
+}
+
+// Notify posts the notification to the webhook.
+func (n *Notifier) Notify(ctx context.Context, notification Notification) error {
+	r, err := n.client.R().SetContext(ctx).SetBody(notification).Post(n.url)
+	if err != nil {
+		return err
+	}
+	if r.IsError() {
+		return fmt.Errorf("notification webhook returned %s", r.Status())
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// Package claims enforces per-cluster required token claims.
+package claims
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"sigs.k8s.io/yaml"
+)
+
+// ErrRequiredClaim is returned when a token is missing a claim required by
+// the targeted cluster.
+var ErrRequiredClaim = errors.New("required claim not satisfied")
+
+// Policy is the file format of the per-cluster required claims policy.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule requires claims on tokens used to access matching clusters.
+type Rule struct {
+	// Clusters are glob patterns of the cluster names the rule applies to,
+	// e.g. "prod-*".
+	Clusters []string `json:"clusters"`
+	// RequiredClaims must be present in the token. A string claim must equal
+	// the value, an array claim must contain it.
+	RequiredClaims map[string]string `json:"requiredClaims"`
+	// AllowWithoutToken lets requests authenticated without a token, by a
+	// client certificate or a front proxy, access the matching clusters.
+	// Otherwise they are denied, as they carry no claims to check.
+	AllowWithoutToken bool `json:"allowWithoutToken,omitempty"`
+}
+
+// LoadPolicy reads and validates a required claims policy file.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read required claims policy: %w", err)
+	}
+
+	policy := new(Policy)
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse required claims policy %q: %w", file, err)
+	}
+
+	for i, rule := range policy.Rules {
+		if len(rule.Clusters) == 0 {
+			return nil, fmt.Errorf("rule %d in %q has no clusters", i, file)
+		}
+		for _, pattern := range rule.Clusters {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d in %q has invalid cluster pattern %q: %w", i, file, pattern, err)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// Check returns an error wrapping ErrRequiredClaim if the claims do not
+// satisfy every rule matching the cluster.
+func (p *Policy) Check(clusterName string, claims map[string]interface{}) error {
+	for _, rule := range p.Rules {
+		if !rule.matches(clusterName) {
+			continue
+		}
+
+		names := make([]string, 0, len(rule.RequiredClaims))
+		for name := range rule.RequiredClaims {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			value := rule.RequiredClaims[name]
+			if !hasValue(claims[name], value) {
+				return fmt.Errorf("%w: cluster %q requires claim %q=%q",
+					ErrRequiredClaim, clusterName, name, value)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckWithoutToken returns an error wrapping ErrRequiredClaim if a rule
+// requiring claims matches the cluster and doesn't allow requests without a
+// token.
+func (p *Policy) CheckWithoutToken(clusterName string) error {
+	for _, rule := range p.Rules {
+		if rule.matches(clusterName) && len(rule.RequiredClaims) > 0 && !rule.AllowWithoutToken {
+			return fmt.Errorf("%w: cluster %q requires claims only tokens carry",
+				ErrRequiredClaim, clusterName)
+		}
+	}
+
+	return nil
+}
+
+func (r *Rule) matches(clusterName string) bool {
+	for _, pattern := range r.Clusters {
+		if ok, _ := path.Match(pattern, clusterName); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasValue(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, v := range c {
+			if s, ok := v.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,129 @@
+package claims
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	policy := &Policy{
+		Rules: []Rule{
+			{
+				Clusters:       []string{"prod-*"},
+				RequiredClaims: map[string]string{"acr": "mfa"},
+			},
+			{
+				Clusters:       []string{"prod-eu"},
+				RequiredClaims: map[string]string{"amr": "hwk"},
+			},
+		},
+	}
+
+	tests := map[string]struct {
+		cluster string
+		claims  map[string]interface{}
+		expErr  bool
+	}{
+		"cluster without rules should pass": {
+			cluster: "dev",
+			claims:  map[string]interface{}{},
+		},
+		"matching string claim should pass": {
+			cluster: "prod-us",
+			claims:  map[string]interface{}{"acr": "mfa"},
+		},
+		"missing claim should fail": {
+			cluster: "prod-us",
+			claims:  map[string]interface{}{},
+			expErr:  true,
+		},
+		"wrong claim value should fail": {
+			cluster: "prod-us",
+			claims:  map[string]interface{}{"acr": "pwd"},
+			expErr:  true,
+		},
+		"all matching rules should apply": {
+			cluster: "prod-eu",
+			claims:  map[string]interface{}{"acr": "mfa"},
+			expErr:  true,
+		},
+		"array claim containing value should pass": {
+			cluster: "prod-eu",
+			claims: map[string]interface{}{
+				"acr": "mfa",
+				"amr": []interface{}{"pwd", "hwk"},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := policy.Check(test.cluster, test.claims)
+			if test.expErr {
+				assert.True(t, errors.Is(err, ErrRequiredClaim), "expected ErrRequiredClaim, got %v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckWithoutToken(t *testing.T) {
+	policy := &Policy{
+		Rules: []Rule{
+			{
+				Clusters:       []string{"prod-*"},
+				RequiredClaims: map[string]string{"acr": "mfa"},
+			},
+			{
+				Clusters:          []string{"staging-*"},
+				RequiredClaims:    map[string]string{"acr": "mfa"},
+				AllowWithoutToken: true,
+			},
+		},
+	}
+
+	assert.NoError(t, policy.CheckWithoutToken("dev"))
+	assert.NoError(t, policy.CheckWithoutToken("staging-eu"))
+	assert.ErrorIs(t, policy.CheckWithoutToken("prod-eu"), ErrRequiredClaim)
+
+	// Every matching rule must allow requests without a token
+	policy.Rules[1].Clusters = []string{"*-eu"}
+	assert.ErrorIs(t, policy.CheckWithoutToken("prod-eu"), ErrRequiredClaim)
+	assert.NoError(t, policy.CheckWithoutToken("staging-eu"))
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "valid.yaml")
+	if err := os.WriteFile(valid, []byte(`
+rules:
+- clusters: ["prod-*"]
+  requiredClaims:
+    acr: mfa
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadPolicy(valid)
+	if assert.NoError(t, err) && assert.Len(t, policy.Rules, 1) {
+		assert.Equal(t, map[string]string{"acr": "mfa"}, policy.Rules[0].RequiredClaims)
+	}
+
+	noClusters := filepath.Join(dir, "no-clusters.yaml")
+	if err := os.WriteFile(noClusters, []byte(`
+rules:
+- requiredClaims:
+    acr: mfa
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadPolicy(noClusters)
+	assert.Error(t, err)
+}
@@ -0,0 +1,69 @@
+// Package clientcert authenticates requests by their x509 client
+// certificate, verified against a client CA bundle.
+package clientcert
+
+import (
+	"crypto/x509"
+	"fmt"
+
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	x509request "k8s.io/apiserver/pkg/authentication/request/x509"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+)
+
+const (
+	// UserMappingSubject takes the user name from the subject's common name.
+	UserMappingSubject = "subject"
+	// UserMappingURI takes the user name from the first URI SAN, such as a
+	// SPIFFE ID.
+	UserMappingURI = "uri"
+)
+
+// UserMappings are the supported mappings of certificates to users. Either
+// way, the groups are the subject's organizations.
+var UserMappings = []string{UserMappingSubject, UserMappingURI}
+
+// New returns an authenticator of the requests' client certificates. The
+// certificates are verified against the current bundle of the client CA, and
+// mapped to users by the given user mapping.
+func New(clientCA dynamiccertificates.CAContentProvider, userMapping string) (authenticator.Request, error) {
+	var conversion x509request.UserConversionFunc
+	switch userMapping {
+	case UserMappingSubject:
+		conversion = subjectUser
+	case UserMappingURI:
+		conversion = uriUser
+	default:
+		return nil, fmt.Errorf("unknown client certificate user mapping %q", userMapping)
+	}
+
+	return x509request.NewDynamic(clientCA.VerifyOptions, conversion), nil
+}
+
+// subjectUser maps a certificate to the user named by its common name.
+func subjectUser(chain []*x509.Certificate) (*authenticator.Response, bool, error) {
+	if len(chain[0].Subject.CommonName) == 0 {
+		return nil, false, nil
+	}
+
+	return response(chain[0].Subject.CommonName, chain[0]), true, nil
+}
+
+// uriUser maps a certificate to the user named by its first URI SAN.
+func uriUser(chain []*x509.Certificate) (*authenticator.Response, bool, error) {
+	if len(chain[0].URIs) == 0 {
+		return nil, false, nil
+	}
+
+	return response(chain[0].URIs[0].String(), chain[0]), true, nil
+}
+
+func response(name string, cert *x509.Certificate) *authenticator.Response {
+	return &authenticator.Response{
+		User: &user.DefaultInfo{
+			Name:   name,
+			Groups: cert.Subject.Organization,
+		},
+	}
+}
@@ -0,0 +1,144 @@
+package clientcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	cert, err := certutil.NewSelfSignedCACert(certutil.Config{CommonName: name}, key)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) bundle(t *testing.T) dynamiccertificates.CAContentProvider {
+	provider, err := dynamiccertificates.NewStaticCAContent("client-ca",
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	require.NoError(t, err)
+	return provider
+}
+
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, uris ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		require.NoError(t, err)
+		template.URIs = append(template.URIs, u)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func request(certs ...*x509.Certificate) *http.Request {
+	req := &http.Request{Header: http.Header{}}
+	if len(certs) > 0 {
+		req.TLS = &tls.ConnectionState{PeerCertificates: certs}
+	}
+	return req
+}
+
+func TestAuthenticator(t *testing.T) {
+	ca := newTestCA(t, "client-ca")
+	cert := ca.issue(t, pkix.Name{CommonName: "deployer", Organization: []string{"ci", "bots"}},
+		"spiffe://cluster.local/ns/ci/sa/deployer")
+
+	tests := map[string]struct {
+		userMapping string
+		cert        *x509.Certificate
+		expOK       bool
+		expErr      bool
+		expName     string
+	}{
+		"no certificate": {
+			userMapping: UserMappingSubject,
+		},
+		"subject": {
+			userMapping: UserMappingSubject,
+			cert:        cert,
+			expOK:       true,
+			expName:     "deployer",
+		},
+		"uri": {
+			userMapping: UserMappingURI,
+			cert:        cert,
+			expOK:       true,
+			expName:     "spiffe://cluster.local/ns/ci/sa/deployer",
+		},
+		"no uri": {
+			userMapping: UserMappingURI,
+			cert:        ca.issue(t, pkix.Name{CommonName: "deployer"}),
+		},
+		"untrusted issuer": {
+			userMapping: UserMappingSubject,
+			cert:        newTestCA(t, "other-ca").issue(t, pkix.Name{CommonName: "deployer"}),
+			expErr:      true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			auther, err := New(ca.bundle(t), test.userMapping)
+			require.NoError(t, err)
+
+			var req *http.Request
+			if test.cert != nil {
+				req = request(test.cert)
+			} else {
+				req = request()
+			}
+
+			resp, ok, err := auther.AuthenticateRequest(req)
+			assert.Equal(t, test.expErr, err != nil, "unexpected error: %v", err)
+			assert.Equal(t, test.expOK, ok)
+			if test.expOK {
+				assert.Equal(t, test.expName, resp.User.GetName())
+				assert.Equal(t, []string{"ci", "bots"}, resp.User.GetGroups())
+				assert.Empty(t, resp.User.GetExtra())
+			}
+		})
+	}
+}
+
+func TestUnknownUserMapping(t *testing.T) {
+	_, err := New(newTestCA(t, "client-ca").bundle(t), "email")
+	assert.Error(t, err)
+}
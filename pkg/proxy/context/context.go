@@ -27,6 +27,9 @@ const (
 
 	// bearerTokenKey is the context key for the client address.
 	clientAddressKey
+
+	// requestMetricsKey is the context key for the request metrics labels.
+	requestMetricsKey
 )
 
 type ImpersonationRequest struct {
@@ -72,6 +75,39 @@ func BearerToken(req *http.Request) string {
 	return token
 }
 
+// RequestMetrics holds metrics labels of a request that are only known
+// further down the handler chain. The verb and resource are only set once the
+// request is authorized, so clients can't create new series with arbitrary
+// paths.
+type RequestMetrics struct {
+	AuthPath string
+	Verb     string
+	Resource string
+}
+
+// WithRequestMetrics returns a copy of the request holding the metrics labels,
+// so handlers further down the chain can set them.
+func WithRequestMetrics(req *http.Request, labels *RequestMetrics) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), requestMetricsKey, labels))
+}
+
+// SetAuthPath records the authentication path of the request in its metrics
+// labels, if present.
+func SetAuthPath(req *http.Request, authPath string) {
+	if labels, ok := req.Context().Value(requestMetricsKey).(*RequestMetrics); ok {
+		labels.AuthPath = authPath
+	}
+}
+
+// SetRequestResource records the verb and resource of the request in its
+// metrics labels, if present.
+func SetRequestResource(req *http.Request, verb, resource string) {
+	if labels, ok := req.Context().Value(requestMetricsKey).(*RequestMetrics); ok {
+		labels.Verb = verb
+		labels.Resource = resource
+	}
+}
+
 // RemoteAddress will attempt to return the source client address if available
 // in the request context. If it is not, it will be gathered from the request
 // and entered into the context.
@@ -0,0 +1,406 @@
+package crd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// Phases of an AccessRequest.
+const (
+	AccessRequestPending  = "Pending"
+	AccessRequestApproved = "Approved"
+	AccessRequestDenied   = "Denied"
+	AccessRequestExpired  = "Expired"
+)
+
+// accessRequestBindingPrefix prefixes the name of the bindings materialised
+// for AccessRequests, so they don't replace those of CAPI bindings.
+const accessRequestBindingPrefix = "accessrequest-"
+
+// AccessRequestAuditFunc records a state transition of an AccessRequest.
+type AccessRequestAuditFunc func(accessRequest *AccessRequest)
+
+// Phase returns the phase of the request, which is Pending until it is set.
+func (ar *AccessRequest) Phase() string {
+	if len(ar.Status.Phase) == 0 {
+		return AccessRequestPending
+	}
+	return ar.Status.Phase
+}
+
+// Validate returns an error if the request is incomplete, or requests access
+// for longer than maxDuration.
+func (spec *AccessRequestSpec) Validate(maxDuration time.Duration) error {
+	switch {
+	case len(spec.User) == 0:
+		return errors.New("user is required")
+	case len(spec.Role) == 0:
+		return errors.New("role is required")
+	case len(spec.TargetClusters) == 0:
+		return errors.New("targetClusters are required")
+	case spec.Duration.Duration <= 0:
+		return errors.New("duration must be positive")
+	case maxDuration > 0 && spec.Duration.Duration > maxDuration:
+		return fmt.Errorf("duration must not exceed %s", maxDuration)
+	case len(spec.Reason) == 0:
+		return errors.New("reason is required")
+	}
+	return nil
+}
+
+// grant returns the access granted by the request: the spec it was approved
+// with, so changing the spec after approval grants nothing new. Requests not
+// approved yet grant their current spec once approved.
+func (ar *AccessRequest) grant() *AccessRequestSpec {
+	if ar.Status.ApprovedSpec != nil {
+		return ar.Status.ApprovedSpec
+	}
+	return &ar.Spec
+}
+
+// bindingSpec returns the spec of the binding granted by the request, valid
+// from its approval until it expires.
+func (ar *AccessRequest) bindingSpec() CommonBindingSpec {
+	grant := ar.grant()
+	return CommonBindingSpec{
+		TargetClusters: grant.TargetClusters,
+		Name:           accessRequestBindingPrefix + ar.Name,
+		RoleRef:        []string{grant.Role},
+		Subjects:       []Subject{{User: grant.User}},
+		ValidFrom:      ar.Status.ApprovedAt,
+		ValidUntil:     ar.Status.ExpiresAt,
+	}
+}
+
+// bindings returns the binding granted by the request: a CAPIRoleBinding if
+// it targets namespaces, or a CAPIClusterRoleBinding otherwise.
+func (ar *AccessRequest) bindings() (*CAPIClusterRoleBinding, *CAPIRoleBinding) {
+	meta := metav1.ObjectMeta{Name: accessRequestBindingPrefix + ar.Name}
+
+	if namespaces := ar.grant().TargetNamespaces; len(namespaces) > 0 {
+		return nil, &CAPIRoleBinding{
+			ObjectMeta: meta,
+			Spec: CAPIRoleBindingSpec{
+				TargetNamespaces:  namespaces,
+				CommonBindingSpec: ar.bindingSpec(),
+			},
+		}
+	}
+
+	return &CAPIClusterRoleBinding{
+		ObjectMeta: meta,
+		Spec:       CAPIClusterRoleBindingSpec{CommonBindingSpec: ar.bindingSpec()},
+	}, nil
+}
+
+// WatchAccessRequests materialises the bindings of approved AccessRequests
+// lasting up to maxDuration, and calls audit on each of their state
+// transitions. It returns once the existing AccessRequests are processed.
+func (w *CAPIRbacWatcher) WatchAccessRequests(stopCh <-chan struct{}, maxDuration time.Duration, audit AccessRequestAuditFunc) {
+	w.accessRequestMaxDuration = maxDuration
+	w.accessRequestAudit = audit
+	w.AccessRequestInformer = dynamicinformer.NewFilteredDynamicInformer(w.client, AccessRequestGVR,
+		"", time.Minute, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}, nil).Informer()
+
+	w.AccessRequestInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if !w.accessRequestsSynced.Load() {
+				klog.V(10).Infof("Skipping AccessRequest add event during initial processing")
+				return
+			}
+			accessRequest, err := ConvertUnstructured[AccessRequest](obj)
+			if err != nil {
+				klog.Errorf("Failed to convert AccessRequest: %v", err)
+				return
+			}
+			w.auditAccessRequest(accessRequest)
+			w.ProcessAccessRequest(accessRequest)
+			w.RebuildAllAuthorizers()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldAccessRequest, err := ConvertUnstructured[AccessRequest](oldObj)
+			if err != nil {
+				klog.Errorf("Failed to convert old AccessRequest: %v", err)
+				return
+			}
+			newAccessRequest, err := ConvertUnstructured[AccessRequest](newObj)
+			if err != nil {
+				klog.Errorf("Failed to convert new AccessRequest: %v", err)
+				return
+			}
+			// Resyncs deliver unchanged objects
+			if apiequality.Semantic.DeepEqual(oldAccessRequest, newAccessRequest) {
+				klog.V(5).Infof("AccessRequest is unchanged, skipping update")
+				return
+			}
+			if oldAccessRequest.Phase() != newAccessRequest.Phase() {
+				w.auditAccessRequest(newAccessRequest)
+			}
+			w.DeleteAccessRequest(oldAccessRequest)
+			w.ProcessAccessRequest(newAccessRequest)
+			w.RebuildAllAuthorizers()
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			accessRequest, err := ConvertUnstructured[AccessRequest](obj)
+			if err != nil {
+				klog.Errorf("Failed to convert AccessRequest during deletion: %v", err)
+				return
+			}
+			w.DeleteAccessRequest(accessRequest)
+			w.RebuildAllAuthorizers()
+		},
+	})
+
+	go w.AccessRequestInformer.Run(stopCh)
+	cache.WaitForCacheSync(stopCh, w.AccessRequestInformer.HasSynced)
+
+	for _, obj := range w.AccessRequestInformer.GetStore().List() {
+		accessRequest, err := ConvertUnstructured[AccessRequest](obj)
+		if err != nil {
+			klog.Errorf("Failed to convert AccessRequest: %v", err)
+			continue
+		}
+		w.ProcessAccessRequest(accessRequest)
+	}
+
+	w.RebuildAllAuthorizers()
+	w.accessRequestsSynced.Store(true)
+}
+
+func (w *CAPIRbacWatcher) auditAccessRequest(accessRequest *AccessRequest) {
+	klog.V(2).Infof("AccessRequest %q of user %q is %s", accessRequest.Name, accessRequest.Spec.User, accessRequest.Phase())
+	if w.accessRequestAudit != nil {
+		w.accessRequestAudit(accessRequest)
+	}
+}
+
+// ProcessAccessRequest adds the binding of an approved AccessRequest to its
+// target clusters while it is valid, and expires the request at the end of
+// its duration.
+//
+// Requests approved through the status subresource bypass the approver group
+// checks of the proxy's endpoints, so who may approve them relies on the RBAC
+// of accessrequests/status in the cluster the proxy runs in. Such approvals
+// must still name an approver other than the requesting user.
+//
+// Only the spec the request was approved with is granted, which is recorded
+// in its status when the approval is observed.
+func (ctrl *CAPIRbacWatcher) ProcessAccessRequest(accessRequest *AccessRequest) {
+	if accessRequest.Phase() != AccessRequestApproved {
+		return
+	}
+
+	grant := accessRequest.grant()
+	if err := grant.Validate(ctrl.accessRequestMaxDuration); err != nil {
+		klog.Errorf("Ignoring invalid AccessRequest %q: %v", accessRequest.Name, err)
+		return
+	}
+
+	switch approver := accessRequest.Status.Approver; approver {
+	case "":
+		klog.Errorf("Ignoring AccessRequest %q approved without an approver", accessRequest.Name)
+		return
+	case grant.User:
+		klog.Errorf("Ignoring AccessRequest %q approved by its own user %q", accessRequest.Name, approver)
+		return
+	}
+
+	// The window may be set through the status subresource as well
+	if approvedAt, expiresAt := accessRequest.Status.ApprovedAt, accessRequest.Status.ExpiresAt; approvedAt != nil && expiresAt != nil &&
+		expiresAt.Sub(approvedAt.Time) > grant.Duration.Duration {
+		klog.Errorf("Ignoring AccessRequest %q expiring after its duration", accessRequest.Name)
+		return
+	}
+
+	// Requests approved through the status subresource start when the
+	// approval is observed, and grant the spec observed then
+	status := make(map[string]interface{})
+	if accessRequest.Status.ApprovedAt == nil || accessRequest.Status.ExpiresAt == nil {
+		approvedAt := metav1.NewTime(ctrl.clock())
+		status["approvedAt"] = approvedAt
+		status["expiresAt"] = metav1.NewTime(approvedAt.Add(grant.Duration.Duration))
+	}
+	if accessRequest.Status.ApprovedSpec == nil {
+		status["approvedSpec"] = grant
+	}
+	if len(status) > 0 {
+		ctrl.patchStatus(AccessRequestGVR, accessRequest.ObjectMeta, status)
+		return
+	}
+
+	spec := accessRequest.bindingSpec()
+	if !ctrl.checkValidity(AccessRequestGVR, accessRequest.ObjectMeta, &spec, accessRequest.Status.Conditions) {
+		if !ctrl.clock().Before(accessRequest.Status.ExpiresAt.Time) {
+			ctrl.patchStatus(AccessRequestGVR, accessRequest.ObjectMeta, map[string]interface{}{
+				"phase": AccessRequestExpired,
+			})
+		}
+		return
+	}
+
+	clusterRoleBinding, roleBinding := accessRequest.bindings()
+	if roleBinding != nil {
+		ctrl.applyCAPIRoleBinding(roleBinding)
+	} else {
+		ctrl.applyCAPIClusterRoleBinding(clusterRoleBinding)
+	}
+}
+
+// DeleteAccessRequest removes the binding of an AccessRequest.
+func (ctrl *CAPIRbacWatcher) DeleteAccessRequest(accessRequest *AccessRequest) {
+	clusterRoleBinding, roleBinding := accessRequest.bindings()
+	if roleBinding != nil {
+		ctrl.DeleteCAPIRoleBinding(roleBinding)
+	} else {
+		ctrl.DeleteCAPIClusterRoleBinding(clusterRoleBinding)
+	}
+}
+
+// AccessRequestClient creates AccessRequests and records their approval in
+// the cluster the proxy runs in.
+type AccessRequestClient struct {
+	client      dynamic.Interface
+	maxDuration time.Duration
+	now         func() time.Time
+}
+
+// NewAccessRequestClient returns an AccessRequestClient using the client,
+// creating requests lasting up to maxDuration.
+func NewAccessRequestClient(client dynamic.Interface, maxDuration time.Duration) *AccessRequestClient {
+	return &AccessRequestClient{client: client, maxDuration: maxDuration, now: time.Now}
+}
+
+// AccessRequests returns an AccessRequestClient using the watcher's client.
+func (w *CAPIRbacWatcher) AccessRequests(maxDuration time.Duration) *AccessRequestClient {
+	return NewAccessRequestClient(w.client, maxDuration)
+}
+
+// Create creates a pending AccessRequest with a generated name.
+func (c *AccessRequestClient) Create(ctx context.Context, spec AccessRequestSpec) (*AccessRequest, error) {
+	if err := spec.Validate(c.maxDuration); err != nil {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("invalid access request: %s", err))
+	}
+
+	accessRequest := &AccessRequest{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: AccessRequestGVR.GroupVersion().String(),
+			Kind:       "AccessRequest",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: "access-" + utilrand.String(8)},
+		Spec:       spec,
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(accessRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := c.client.Resource(AccessRequestGVR).Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return ConvertUnstructured[AccessRequest](created)
+}
+
+// Get returns the AccessRequest.
+func (c *AccessRequestClient) Get(ctx context.Context, name string) (*AccessRequest, error) {
+	obj, err := c.client.Resource(AccessRequestGVR).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return ConvertUnstructured[AccessRequest](obj)
+}
+
+// List returns the AccessRequests, most recent first.
+func (c *AccessRequestClient) List(ctx context.Context) ([]*AccessRequest, error) {
+	list, err := c.client.Resource(AccessRequestGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	accessRequests := make([]*AccessRequest, 0, len(list.Items))
+	for i := range list.Items {
+		accessRequest, err := ConvertUnstructured[AccessRequest](&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		accessRequests = append(accessRequests, accessRequest)
+	}
+
+	sort.SliceStable(accessRequests, func(i, j int) bool {
+		return accessRequests[j].CreationTimestamp.Before(&accessRequests[i].CreationTimestamp)
+	})
+
+	return accessRequests, nil
+}
+
+// Approve approves a pending AccessRequest, granting access from now for its
+// duration.
+func (c *AccessRequestClient) Approve(ctx context.Context, name, approver, message string) (*AccessRequest, error) {
+	return c.decide(ctx, name, func(status *AccessRequestStatus, spec *AccessRequestSpec) {
+		approvedAt := metav1.NewTime(c.now())
+		expiresAt := metav1.NewTime(approvedAt.Add(spec.Duration.Duration))
+
+		approvedSpec := *spec
+
+		status.Phase = AccessRequestApproved
+		status.ApprovedAt, status.ExpiresAt = &approvedAt, &expiresAt
+		status.ApprovedSpec = &approvedSpec
+		status.Approver, status.Message = approver, message
+	})
+}
+
+// Deny denies a pending AccessRequest.
+func (c *AccessRequestClient) Deny(ctx context.Context, name, approver, message string) (*AccessRequest, error) {
+	return c.decide(ctx, name, func(status *AccessRequestStatus, _ *AccessRequestSpec) {
+		status.Phase = AccessRequestDenied
+		status.Approver, status.Message = approver, message
+	})
+}
+
+// decide updates the status of a pending AccessRequest. The update fails with
+// a conflict if the request was decided concurrently.
+func (c *AccessRequestClient) decide(ctx context.Context, name string, update func(*AccessRequestStatus, *AccessRequestSpec)) (*AccessRequest, error) {
+	accessRequest, err := c.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if phase := accessRequest.Phase(); phase != AccessRequestPending {
+		return nil, apierrors.NewConflict(AccessRequestGVR.GroupResource(), name,
+			fmt.Errorf("access request is already %s", phase))
+	}
+
+	update(&accessRequest.Status, &accessRequest.Spec)
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(accessRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := c.client.Resource(AccessRequestGVR).UpdateStatus(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return ConvertUnstructured[AccessRequest](updated)
+}
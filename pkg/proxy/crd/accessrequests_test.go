@@ -0,0 +1,290 @@
+package crd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+	"github.com/Improwised/kube-oidc-proxy/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/util/workqueue"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func TestAccessRequestLifecycle(t *testing.T) {
+	clock := testingclock.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{AccessRequestGVR: "AccessRequestList"})
+
+	testCluster := &cluster.Cluster{
+		Name: "cluster1",
+		RBACConfig: &util.RBAC{
+			ClusterRoles: []*v1.ClusterRole{{ObjectMeta: metav1.ObjectMeta{Name: "admin"}}},
+		},
+	}
+	queue := workqueue.NewTypedDelayingQueueWithConfig(workqueue.TypedDelayingQueueConfig[string]{Clock: clock})
+	defer queue.ShutDown()
+
+	watcher := &CAPIRbacWatcher{
+		clusters: []*cluster.Cluster{testCluster},
+		client:   client,
+		queue:    queue,
+		now:      clock.Now,
+	}
+
+	var (
+		mu     sync.Mutex
+		phases []string
+	)
+	audited := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), phases...)
+	}
+	clusterRoleBindings := func() []*v1.ClusterRoleBinding {
+		watcher.mu.RLock()
+		defer watcher.mu.RUnlock()
+		return append([]*v1.ClusterRoleBinding(nil), testCluster.RBACConfig.ClusterRoleBindings...)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	watcher.WatchAccessRequests(stopCh, 8*time.Hour, func(accessRequest *AccessRequest) {
+		mu.Lock()
+		defer mu.Unlock()
+		phases = append(phases, accessRequest.Phase())
+	})
+
+	accessRequests := NewAccessRequestClient(client, 8*time.Hour)
+	accessRequests.now = clock.Now
+
+	_, err := accessRequests.Create(context.TODO(), AccessRequestSpec{User: "alice", Role: "admin"})
+	assert.True(t, apierrors.IsBadRequest(err), "expected bad request, got %v", err)
+
+	_, err = accessRequests.Create(context.TODO(), AccessRequestSpec{
+		User:           "alice",
+		Role:           "admin",
+		TargetClusters: []string{"cluster1"},
+		Duration:       metav1.Duration{Duration: 9 * time.Hour},
+		Reason:         "incident 42",
+	})
+	assert.True(t, apierrors.IsBadRequest(err), "expected bad request, got %v", err)
+
+	accessRequest, err := accessRequests.Create(context.TODO(), AccessRequestSpec{
+		User:           "alice",
+		Role:           "admin",
+		TargetClusters: []string{"cluster1"},
+		Duration:       metav1.Duration{Duration: time.Hour},
+		Reason:         "incident 42",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, AccessRequestPending, accessRequest.Phase())
+	require.Eventually(t, func() bool { return len(audited()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, clusterRoleBindings())
+
+	// Approval grants the role until the request expires
+	accessRequest, err = accessRequests.Approve(context.TODO(), accessRequest.Name, "bob", "ok")
+	require.NoError(t, err)
+	assert.Equal(t, AccessRequestApproved, accessRequest.Phase())
+	assert.Equal(t, "bob", accessRequest.Status.Approver)
+	assert.True(t, clock.Now().Add(time.Hour).Equal(accessRequest.Status.ExpiresAt.Time))
+	assert.Equal(t, &accessRequest.Spec, accessRequest.Status.ApprovedSpec)
+
+	require.Eventually(t, func() bool { return len(clusterRoleBindings()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	binding := clusterRoleBindings()[0]
+	assert.Equal(t, "accessrequest-"+accessRequest.Name+"-admin", binding.Name)
+	assert.Equal(t, "alice", binding.Subjects[0].Name)
+
+	_, err = accessRequests.Deny(context.TODO(), accessRequest.Name, "carol", "")
+	assert.True(t, apierrors.IsConflict(err), "expected conflict, got %v", err)
+
+	// The binding is removed at expiry
+	clock.Step(time.Hour)
+	require.Eventually(t, func() bool { return queue.Len() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, watcher.processNextBinding())
+	assert.Empty(t, clusterRoleBindings())
+
+	require.Eventually(t, func() bool { return len(audited()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{AccessRequestPending, AccessRequestApproved, AccessRequestExpired}, audited())
+
+	accessRequest, err = accessRequests.Get(context.TODO(), accessRequest.Name)
+	require.NoError(t, err)
+	assert.Equal(t, AccessRequestExpired, accessRequest.Phase())
+}
+
+func TestAccessRequestStatusApproval(t *testing.T) {
+	clock := testingclock.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	approvedAt, expiresAt := metav1.NewTime(clock.Now()), metav1.NewTime(clock.Now().Add(time.Hour))
+
+	tests := map[string]struct {
+		approver   string
+		duration   time.Duration
+		expiresAt  metav1.Time
+		expBinding bool
+	}{
+		"approved by another user": {
+			approver:   "bob",
+			duration:   time.Hour,
+			expiresAt:  expiresAt,
+			expBinding: true,
+		},
+		"approved without an approver": {
+			duration:  time.Hour,
+			expiresAt: expiresAt,
+		},
+		"approved by the requesting user": {
+			approver:  "alice",
+			duration:  time.Hour,
+			expiresAt: expiresAt,
+		},
+		"longer than the maximum duration": {
+			approver:  "bob",
+			duration:  9 * time.Hour,
+			expiresAt: metav1.NewTime(clock.Now().Add(9 * time.Hour)),
+		},
+		"expiring after its duration": {
+			approver:  "bob",
+			duration:  time.Hour,
+			expiresAt: metav1.NewTime(clock.Now().Add(2 * time.Hour)),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{AccessRequestGVR: "AccessRequestList"})
+			testCluster := &cluster.Cluster{
+				Name: "cluster1",
+				RBACConfig: &util.RBAC{
+					ClusterRoles: []*v1.ClusterRole{{ObjectMeta: metav1.ObjectMeta{Name: "admin"}}},
+				},
+			}
+			queue := workqueue.NewTypedDelayingQueueWithConfig(workqueue.TypedDelayingQueueConfig[string]{Clock: clock})
+			defer queue.ShutDown()
+
+			watcher := &CAPIRbacWatcher{
+				clusters:                 []*cluster.Cluster{testCluster},
+				client:                   client,
+				queue:                    queue,
+				now:                      clock.Now,
+				accessRequestMaxDuration: 8 * time.Hour,
+			}
+
+			expiresAt := test.expiresAt
+			spec := AccessRequestSpec{
+				User:           "alice",
+				Role:           "admin",
+				TargetClusters: []string{"cluster1"},
+				Duration:       metav1.Duration{Duration: test.duration},
+				Reason:         "incident 42",
+			}
+			watcher.ProcessAccessRequest(&AccessRequest{
+				ObjectMeta: metav1.ObjectMeta{Name: "access-1"},
+				Spec:       spec,
+				Status: AccessRequestStatus{
+					Phase:        AccessRequestApproved,
+					Approver:     test.approver,
+					ApprovedAt:   &approvedAt,
+					ExpiresAt:    &expiresAt,
+					ApprovedSpec: &spec,
+				},
+			})
+
+			if test.expBinding {
+				assert.Len(t, testCluster.RBACConfig.ClusterRoleBindings, 1)
+			} else {
+				assert.Empty(t, testCluster.RBACConfig.ClusterRoleBindings)
+			}
+		})
+	}
+}
+
+func TestAccessRequestSpecChangedAfterApproval(t *testing.T) {
+	clock := testingclock.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	approvedAt, expiresAt := metav1.NewTime(clock.Now()), metav1.NewTime(clock.Now().Add(time.Hour))
+
+	clusters := []*cluster.Cluster{
+		{Name: "dev", RBACConfig: &util.RBAC{}},
+		{Name: "prod", RBACConfig: &util.RBAC{}},
+	}
+	queue := workqueue.NewTypedDelayingQueueWithConfig(workqueue.TypedDelayingQueueConfig[string]{Clock: clock})
+	defer queue.ShutDown()
+
+	watcher := &CAPIRbacWatcher{
+		clusters:                 clusters,
+		queue:                    queue,
+		now:                      clock.Now,
+		accessRequestMaxDuration: 8 * time.Hour,
+	}
+
+	approvedSpec := AccessRequestSpec{
+		User:             "alice",
+		Role:             "view",
+		TargetClusters:   []string{"dev"},
+		TargetNamespaces: []string{"payments"},
+		Duration:         metav1.Duration{Duration: time.Hour},
+		Reason:           "incident 42",
+	}
+
+	// The spec was changed to cluster-admin on all clusters after approval
+	watcher.ProcessAccessRequest(&AccessRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "access-1"},
+		Spec: AccessRequestSpec{
+			User:           "alice",
+			Role:           "cluster-admin",
+			TargetClusters: []string{"*"},
+			Duration:       metav1.Duration{Duration: time.Hour},
+			Reason:         "incident 42",
+		},
+		Status: AccessRequestStatus{
+			Phase:        AccessRequestApproved,
+			Approver:     "bob",
+			ApprovedAt:   &approvedAt,
+			ExpiresAt:    &expiresAt,
+			ApprovedSpec: &approvedSpec,
+		},
+	})
+
+	assert.Empty(t, clusters[0].RBACConfig.ClusterRoleBindings)
+	if assert.Len(t, clusters[0].RBACConfig.RoleBindings, 1) {
+		binding := clusters[0].RBACConfig.RoleBindings[0]
+		assert.Equal(t, "payments", binding.Namespace)
+		assert.Equal(t, "view", binding.RoleRef.Name)
+	}
+	assert.Empty(t, clusters[1].RBACConfig.ClusterRoleBindings)
+	assert.Empty(t, clusters[1].RBACConfig.RoleBindings)
+}
+
+func TestAccessRequestBindings(t *testing.T) {
+	accessRequest := &AccessRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "access-1"},
+		Spec: AccessRequestSpec{
+			User:             "alice",
+			Role:             "edit",
+			TargetClusters:   []string{"cluster1"},
+			TargetNamespaces: []string{"payments"},
+		},
+	}
+
+	clusterRoleBinding, roleBinding := accessRequest.bindings()
+	assert.Nil(t, clusterRoleBinding)
+	if assert.NotNil(t, roleBinding) {
+		assert.Equal(t, "accessrequest-access-1", roleBinding.Name)
+		assert.Equal(t, []string{"payments"}, roleBinding.Spec.TargetNamespaces)
+		assert.Equal(t, []string{"edit"}, roleBinding.Spec.RoleRef)
+	}
+
+	accessRequest.Spec.TargetNamespaces = nil
+	clusterRoleBinding, roleBinding = accessRequest.bindings()
+	assert.Nil(t, roleBinding)
+	assert.NotNil(t, clusterRoleBinding)
+}
@@ -0,0 +1,109 @@
+package crd
+
+import (
+	"time"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/denyrules"
+	"github.com/Improwised/kube-oidc-proxy/pkg/util"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// denyRuleSourcePrefix prefixes the deny rule sources of CAPIDenyRules.
+const denyRuleSourcePrefix = "capidenyrule/"
+
+// DenyRuleWatcher keeps the rules of CAPIDenyRules in a deny rule set.
+type DenyRuleWatcher struct {
+	CAPIDenyRuleInformer cache.SharedIndexInformer
+	rules                *denyrules.Set
+}
+
+// NewDenyRuleWatcher returns a watcher of the CAPIDenyRules of the cluster the
+// proxy runs in, which sets their rules in the set.
+func NewDenyRuleWatcher(rules *denyrules.Set) (*DenyRuleWatcher, error) {
+	clusterConfig, err := util.BuildConfiguration()
+	if err != nil {
+		return nil, err
+	}
+
+	clusterClient, err := dynamic.NewForConfig(clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(clusterClient,
+		time.Minute, "", nil)
+
+	watcher := &DenyRuleWatcher{
+		CAPIDenyRuleInformer: factory.ForResource(CAPIDenyRuleGVR).Informer(),
+		rules:                rules,
+	}
+
+	watcher.RegisterEventHandlers()
+
+	return watcher, nil
+}
+
+// Start runs the informer and waits for its cache to sync, so requests are
+// not served before the deny rules are loaded.
+func (w *DenyRuleWatcher) Start(stopCh <-chan struct{}) {
+	go w.CAPIDenyRuleInformer.Run(stopCh)
+	cache.WaitForCacheSync(stopCh, w.CAPIDenyRuleInformer.HasSynced)
+}
+
+func (w *DenyRuleWatcher) RegisterEventHandlers() {
+	w.CAPIDenyRuleInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			capiDenyRule, err := ConvertUnstructured[CAPIDenyRule](obj)
+			if err != nil {
+				klog.Errorf("Failed to convert CAPIDenyRule: %v", err)
+				return
+			}
+			w.ProcessCAPIDenyRule(capiDenyRule)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			capiDenyRule, err := ConvertUnstructured[CAPIDenyRule](newObj)
+			if err != nil {
+				klog.Errorf("Failed to convert new CAPIDenyRule: %v", err)
+				return
+			}
+			w.ProcessCAPIDenyRule(capiDenyRule)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			capiDenyRule, err := ConvertUnstructured[CAPIDenyRule](obj)
+			if err != nil {
+				klog.Errorf("Failed to convert CAPIDenyRule during deletion: %v", err)
+				return
+			}
+			w.DeleteCAPIDenyRule(capiDenyRule)
+		},
+	})
+}
+
+// ProcessCAPIDenyRule sets the rule of the CAPIDenyRule. If the rule is
+// invalid, its previous version is kept.
+func (w *DenyRuleWatcher) ProcessCAPIDenyRule(capiDenyRule *CAPIDenyRule) {
+	rule := capiDenyRule.Spec.Rule
+	if len(rule.Name) == 0 {
+		rule.Name = capiDenyRule.Name
+	}
+
+	if err := rule.Validate(); err != nil {
+		klog.Errorf("Ignoring invalid CAPIDenyRule %q: %v", capiDenyRule.Name, err)
+		return
+	}
+
+	klog.V(4).Infof("Applying CAPIDenyRule %q", capiDenyRule.Name)
+	w.rules.SetRules(denyRuleSourcePrefix+capiDenyRule.Name, []denyrules.Rule{rule})
+}
+
+// DeleteCAPIDenyRule removes the rule of the CAPIDenyRule.
+func (w *DenyRuleWatcher) DeleteCAPIDenyRule(capiDenyRule *CAPIDenyRule) {
+	klog.V(4).Infof("Removing CAPIDenyRule %q", capiDenyRule.Name)
+	w.rules.DeleteRules(denyRuleSourcePrefix + capiDenyRule.Name)
+}
@@ -0,0 +1,58 @@
+package crd
+
+import (
+	"testing"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/denyrules"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+func TestProcessCAPIDenyRule(t *testing.T) {
+	set := denyrules.NewSet()
+	w := &DenyRuleWatcher{rules: set}
+
+	capiDenyRule := &CAPIDenyRule{
+		ObjectMeta: metav1.ObjectMeta{Name: "no-namespace-deletes"},
+		Spec: CAPIDenyRuleSpec{Rule: denyrules.Rule{
+			Verbs:     []string{"delete"},
+			Resources: []string{"namespaces"},
+		}},
+	}
+
+	// The rule is read from the unstructured object of the informer
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(capiDenyRule)
+	require.NoError(t, err)
+	converted, err := ConvertUnstructured[CAPIDenyRule](&unstructured.Unstructured{Object: obj})
+	require.NoError(t, err)
+
+	attrs := authorizer.AttributesRecord{
+		User:            &user.DefaultInfo{Name: "dev"},
+		Verb:            "delete",
+		Resource:        "namespaces",
+		Name:            "default",
+		ResourceRequest: true,
+	}
+
+	w.ProcessCAPIDenyRule(converted)
+	rule, ok := set.Match("prod", attrs)
+	if assert.True(t, ok) {
+		assert.Equal(t, "no-namespace-deletes", rule.Name)
+	}
+
+	// Invalid updates keep the previous rule
+	invalid := *converted
+	invalid.Spec.Rule.Namespaces = []string{"["}
+	w.ProcessCAPIDenyRule(&invalid)
+	_, ok = set.Match("prod", attrs)
+	assert.True(t, ok)
+
+	w.DeleteCAPIDenyRule(converted)
+	_, ok = set.Match("prod", attrs)
+	assert.False(t, ok)
+}
@@ -2,9 +2,11 @@ package crd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/Improwised/kube-oidc-proxy/constants"
 	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
 	"github.com/Improwised/kube-oidc-proxy/pkg/util"
 	v1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -218,6 +220,17 @@ func (ctrl *CAPIRbacWatcher) ProcessCAPIClusterRole(capiClusterRole *CAPICluster
 }
 
 func (ctrl *CAPIRbacWatcher) ProcessCAPIClusterRoleBinding(capiClusterRoleBinding *CAPIClusterRoleBinding) {
+	if !ctrl.checkValidity(CAPIClusterRoleBindingGVR, capiClusterRoleBinding.ObjectMeta,
+		&capiClusterRoleBinding.Spec.CommonBindingSpec, capiClusterRoleBinding.Status.Conditions) {
+		return
+	}
+
+	ctrl.applyCAPIClusterRoleBinding(capiClusterRoleBinding)
+}
+
+// applyCAPIClusterRoleBinding adds the ClusterRoleBindings of the binding to
+// its target clusters, regardless of its validity window.
+func (ctrl *CAPIRbacWatcher) applyCAPIClusterRoleBinding(capiClusterRoleBinding *CAPIClusterRoleBinding) {
 	targetClusters := determineTargetClusters(capiClusterRoleBinding.Spec.CommonBindingSpec.TargetClusters, ctrl.clusters)
 	if len(targetClusters) < 1 && len(ctrl.clusters) > 0 {
 		klog.Warning("skipping cluster role binding ", capiClusterRoleBinding.Name, " because it doesn't contain target clusters")
@@ -234,6 +247,17 @@ func (ctrl *CAPIRbacWatcher) ProcessCAPIClusterRoleBinding(capiClusterRoleBindin
 }
 
 func (ctrl *CAPIRbacWatcher) ProcessCAPIRoleBinding(capiRoleBinding *CAPIRoleBinding) {
+	if !ctrl.checkValidity(CAPIRoleBindingGVR, capiRoleBinding.ObjectMeta,
+		&capiRoleBinding.Spec.CommonBindingSpec, capiRoleBinding.Status.Conditions) {
+		return
+	}
+
+	ctrl.applyCAPIRoleBinding(capiRoleBinding)
+}
+
+// applyCAPIRoleBinding adds the RoleBindings of the binding to its target
+// clusters, regardless of its validity window.
+func (ctrl *CAPIRbacWatcher) applyCAPIRoleBinding(capiRoleBinding *CAPIRoleBinding) {
 	targetClusters := determineTargetClusters(capiRoleBinding.Spec.CommonBindingSpec.TargetClusters, ctrl.clusters)
 	if len(targetClusters) < 1 && len(ctrl.clusters) > 0 {
 		klog.Warning("skipping role binding ", capiRoleBinding.Name, " because it doesn't contain target clusters")
@@ -376,6 +400,15 @@ func (ctrl *CAPIRbacWatcher) ProcessExistingRBACObjects() {
 
 // rebuildAllAuthorizers updates RBAC authorizers for all clusters.
 func (ctrl *CAPIRbacWatcher) RebuildAllAuthorizers() {
+	start := time.Now()
+	defer func() {
+		metrics.RebuildAuthorizersDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	// Informers and the validity worker rebuild concurrently
+	ctrl.mu.Lock()
+	defer ctrl.mu.Unlock()
+
 	for _, c := range ctrl.clusters {
 		_, staticRoles := rbacvalidation.NewTestRuleResolver(
 			c.RBACConfig.Roles,
@@ -2,6 +2,7 @@ package crd
 
 import (
 	"github.com/Improwised/kube-oidc-proxy/constants"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/denyrules"
 	v1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -25,6 +26,10 @@ type CommonBindingSpec struct {
 	Name           string    `json:"name"`
 	RoleRef        []string  `json:"roleRef"`
 	Subjects       []Subject `json:"subjects"`
+	// ValidFrom and ValidUntil bound the time the binding grants access. The
+	// binding is valid forever if both are unset.
+	ValidFrom  *metav1.Time `json:"validFrom,omitempty"`
+	ValidUntil *metav1.Time `json:"validUntil,omitempty"`
 }
 
 // CAPIClusterRoleSpec defines the desired state of CAPIClusterRole.
@@ -105,6 +110,66 @@ type CAPIRoleBinding struct {
 	Status CAPIRoleBindingStatus `json:"status,omitempty"`
 }
 
+// CAPIDenyRuleSpec defines the requests denied by a CAPIDenyRule.
+type CAPIDenyRuleSpec struct {
+	denyrules.Rule `json:",inline"`
+}
+
+// CAPIDenyRuleStatus defines the observed state of CAPIDenyRule.
+type CAPIDenyRuleStatus struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// CAPIDenyRule is the Schema for the CAPIdenyrules API.
+type CAPIDenyRule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CAPIDenyRuleSpec   `json:"spec,omitempty"`
+	Status CAPIDenyRuleStatus `json:"status,omitempty"`
+}
+
+// AccessRequestSpec defines the access requested by a user.
+type AccessRequestSpec struct {
+	// User is the user requesting access, who the binding is granted to.
+	User string `json:"user"`
+	// Role is the Role or ClusterRole requested.
+	Role           string   `json:"role"`
+	TargetClusters []string `json:"targetClusters"`
+	// TargetNamespaces are the namespaces the role is bound in. The role is
+	// bound cluster-wide if empty.
+	TargetNamespaces []string `json:"targetNamespaces,omitempty"`
+	// Duration is how long access is granted for once approved.
+	Duration metav1.Duration `json:"duration"`
+	Reason   string          `json:"reason"`
+}
+
+// AccessRequestStatus defines the observed state of AccessRequest.
+type AccessRequestStatus struct {
+	// Phase is Pending until the request is Approved or Denied. Approved
+	// requests are Expired at the end of their duration.
+	Phase string `json:"phase,omitempty"`
+	// Approver is the user who approved or denied the request.
+	Approver string `json:"approver,omitempty"`
+	// Message is the approver's comment.
+	Message    string       `json:"message,omitempty"`
+	ApprovedAt *metav1.Time `json:"approvedAt,omitempty"`
+	ExpiresAt  *metav1.Time `json:"expiresAt,omitempty"`
+	// ApprovedSpec is the spec the request was approved with. Only the access
+	// it describes is granted.
+	ApprovedSpec *AccessRequestSpec `json:"approvedSpec,omitempty"`
+	Conditions   []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// AccessRequest is the Schema for the accessrequests API.
+type AccessRequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AccessRequestSpec   `json:"spec,omitempty"`
+	Status AccessRequestStatus `json:"status,omitempty"`
+}
+
 var (
 	CAPIRoleGVR = schema.GroupVersionResource{
 		Group:    constants.Group,
@@ -126,4 +191,14 @@ var (
 		Version:  constants.Version,
 		Resource: constants.CAPIClusterRoleBindingKind,
 	}
+	CAPIDenyRuleGVR = schema.GroupVersionResource{
+		Group:    constants.Group,
+		Version:  constants.Version,
+		Resource: constants.CAPIDenyRuleKind,
+	}
+	AccessRequestGVR = schema.GroupVersionResource{
+		Group:    constants.Group,
+		Version:  constants.Version,
+		Resource: constants.AccessRequestKind,
+	}
 )
@@ -0,0 +1,226 @@
+package crd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// ConditionActive reports whether a binding is within its validity window.
+const ConditionActive = "Active"
+
+// Reasons of the Active condition.
+const (
+	ReasonNotYetValid   = "NotYetValid"
+	ReasonValid         = "Valid"
+	ReasonExpired       = "Expired"
+	ReasonInvalidWindow = "InvalidValidityWindow"
+)
+
+// statusUpdateTimeout bounds the status updates of bindings.
+const statusUpdateTimeout = time.Second * 10
+
+// validity returns whether the binding is valid at now, the Active condition
+// describing it, and the time its validity next changes, or zero if it never
+// does.
+func (spec *CommonBindingSpec) validity(now time.Time) (bool, metav1.Condition, time.Time) {
+	from, until := spec.ValidFrom, spec.ValidUntil
+
+	switch {
+	case from != nil && until != nil && !until.After(from.Time):
+		return false, metav1.Condition{
+			Type:    ConditionActive,
+			Status:  metav1.ConditionFalse,
+			Reason:  ReasonInvalidWindow,
+			Message: fmt.Sprintf("validUntil %s is not after validFrom %s", until.UTC().Format(time.RFC3339), from.UTC().Format(time.RFC3339)),
+		}, time.Time{}
+
+	case from != nil && now.Before(from.Time):
+		return false, metav1.Condition{
+			Type:    ConditionActive,
+			Status:  metav1.ConditionFalse,
+			Reason:  ReasonNotYetValid,
+			Message: fmt.Sprintf("binding is valid from %s", from.UTC().Format(time.RFC3339)),
+		}, from.Time
+
+	case until != nil && !now.Before(until.Time):
+		return false, metav1.Condition{
+			Type:    ConditionActive,
+			Status:  metav1.ConditionFalse,
+			Reason:  ReasonExpired,
+			Message: fmt.Sprintf("binding expired at %s", until.UTC().Format(time.RFC3339)),
+		}, time.Time{}
+
+	case until != nil:
+		return true, metav1.Condition{
+			Type:    ConditionActive,
+			Status:  metav1.ConditionTrue,
+			Reason:  ReasonValid,
+			Message: fmt.Sprintf("binding is valid until %s", until.UTC().Format(time.RFC3339)),
+		}, until.Time
+
+	default:
+		return true, metav1.Condition{
+			Type:    ConditionActive,
+			Status:  metav1.ConditionTrue,
+			Reason:  ReasonValid,
+			Message: "binding does not expire",
+		}, time.Time{}
+	}
+}
+
+// checkValidity returns whether the binding is within its validity window.
+// It reports the window in the binding's conditions and schedules the binding
+// to be processed again when its validity changes.
+func (ctrl *CAPIRbacWatcher) checkValidity(gvr schema.GroupVersionResource, obj metav1.ObjectMeta, spec *CommonBindingSpec, conditions []metav1.Condition) bool {
+	now := ctrl.clock()
+	valid, condition, next := spec.validity(now)
+
+	if !next.IsZero() && ctrl.queue != nil {
+		ctrl.queue.AddAfter(bindingKey(gvr, obj.Namespace, obj.Name), next.Sub(now))
+	}
+
+	// Bindings without a window only report it once they had one
+	if spec.ValidFrom != nil || spec.ValidUntil != nil || apimeta.FindStatusCondition(conditions, ConditionActive) != nil {
+		condition.ObservedGeneration = obj.Generation
+		ctrl.updateCondition(gvr, obj, conditions, condition)
+	}
+
+	if !valid {
+		klog.V(4).Infof("skipping %s %q: %s", gvr.Resource, obj.Name, condition.Message)
+	}
+
+	return valid
+}
+
+// updateCondition sets the condition in the status of the binding, if it
+// changed.
+func (ctrl *CAPIRbacWatcher) updateCondition(gvr schema.GroupVersionResource, obj metav1.ObjectMeta, conditions []metav1.Condition, condition metav1.Condition) {
+	if ctrl.client == nil {
+		return
+	}
+
+	conditions = append([]metav1.Condition(nil), conditions...)
+	if !apimeta.SetStatusCondition(&conditions, condition) {
+		return
+	}
+
+	ctrl.patchStatus(gvr, obj, map[string]interface{}{"conditions": conditions})
+}
+
+// patchStatus merges the fields into the status of the object.
+func (ctrl *CAPIRbacWatcher) patchStatus(gvr schema.GroupVersionResource, obj metav1.ObjectMeta, status map[string]interface{}) {
+	if ctrl.client == nil {
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		klog.Errorf("Failed to encode status of %s %q: %v", gvr.Resource, obj.Name, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusUpdateTimeout)
+	defer cancel()
+
+	_, err = ctrl.client.Resource(gvr).Namespace(obj.Namespace).Patch(ctx, obj.Name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	if err != nil {
+		klog.Errorf("Failed to update status of %s %q: %v", gvr.Resource, obj.Name, err)
+	}
+}
+
+// bindingKey is the work queue key of a binding.
+func bindingKey(gvr schema.GroupVersionResource, namespace, name string) string {
+	if len(namespace) == 0 {
+		return gvr.Resource + "/" + name
+	}
+	return gvr.Resource + "/" + namespace + "/" + name
+}
+
+// runWorker processes bindings whose validity changed until the queue is
+// shut down.
+func (ctrl *CAPIRbacWatcher) runWorker() {
+	for ctrl.processNextBinding() {
+	}
+}
+
+func (ctrl *CAPIRbacWatcher) processNextBinding() bool {
+	key, shutdown := ctrl.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer ctrl.queue.Done(key)
+
+	resource, objKey, _ := strings.Cut(key, "/")
+
+	var informer cache.SharedIndexInformer
+	switch resource {
+	case CAPIRoleBindingGVR.Resource:
+		informer = ctrl.CAPIRoleBindingInformer
+	case CAPIClusterRoleBindingGVR.Resource:
+		informer = ctrl.CAPIClusterRoleBindingInformer
+	case AccessRequestGVR.Resource:
+		informer = ctrl.AccessRequestInformer
+	}
+	if informer == nil {
+		klog.Errorf("Unknown binding key %q", key)
+		return true
+	}
+
+	obj, exists, err := informer.GetStore().GetByKey(objKey)
+	if err != nil || !exists {
+		// Deleted bindings were already removed
+		return true
+	}
+
+	switch resource {
+	case CAPIRoleBindingGVR.Resource:
+		capiRoleBinding, err := ConvertUnstructured[CAPIRoleBinding](obj)
+		if err != nil {
+			klog.Errorf("Failed to convert CAPIRoleBinding: %v", err)
+			return true
+		}
+		ctrl.DeleteCAPIRoleBinding(capiRoleBinding)
+		ctrl.ProcessCAPIRoleBinding(capiRoleBinding)
+
+	case CAPIClusterRoleBindingGVR.Resource:
+		capiClusterRoleBinding, err := ConvertUnstructured[CAPIClusterRoleBinding](obj)
+		if err != nil {
+			klog.Errorf("Failed to convert CAPIClusterRoleBinding: %v", err)
+			return true
+		}
+		ctrl.DeleteCAPIClusterRoleBinding(capiClusterRoleBinding)
+		ctrl.ProcessCAPIClusterRoleBinding(capiClusterRoleBinding)
+
+	case AccessRequestGVR.Resource:
+		accessRequest, err := ConvertUnstructured[AccessRequest](obj)
+		if err != nil {
+			klog.Errorf("Failed to convert AccessRequest: %v", err)
+			return true
+		}
+		ctrl.DeleteAccessRequest(accessRequest)
+		ctrl.ProcessAccessRequest(accessRequest)
+	}
+
+	klog.V(4).Infof("Validity of %s changed", key)
+	ctrl.RebuildAllAuthorizers()
+
+	return true
+}
+
+// clock returns the current time.
+func (ctrl *CAPIRbacWatcher) clock() time.Time {
+	if ctrl.now == nil {
+		return time.Now()
+	}
+	return ctrl.now()
+}
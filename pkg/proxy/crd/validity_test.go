@@ -0,0 +1,199 @@
+package crd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+	"github.com/Improwised/kube-oidc-proxy/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/rbac/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/util/workqueue"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func TestBindingValidity(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *metav1.Time {
+		t := metav1.NewTime(now.Add(d))
+		return &t
+	}
+
+	tests := map[string]struct {
+		from, until *metav1.Time
+		expValid    bool
+		expReason   string
+		expNext     time.Time
+	}{
+		"no window should be valid forever": {
+			expValid:  true,
+			expReason: ReasonValid,
+		},
+		"before window should not be valid": {
+			from:      at(time.Hour),
+			until:     at(2 * time.Hour),
+			expReason: ReasonNotYetValid,
+			expNext:   now.Add(time.Hour),
+		},
+		"inside window should be valid until its end": {
+			from:      at(-time.Hour),
+			until:     at(time.Hour),
+			expValid:  true,
+			expReason: ReasonValid,
+			expNext:   now.Add(time.Hour),
+		},
+		"after window should be expired": {
+			until:     at(-time.Hour),
+			expReason: ReasonExpired,
+		},
+		"end of window should be expired": {
+			until:     at(0),
+			expReason: ReasonExpired,
+		},
+		"window ending before it starts should be invalid": {
+			from:      at(2 * time.Hour),
+			until:     at(time.Hour),
+			expReason: ReasonInvalidWindow,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			spec := &CommonBindingSpec{ValidFrom: test.from, ValidUntil: test.until}
+			valid, condition, next := spec.validity(now)
+			assert.Equal(t, test.expValid, valid)
+			assert.Equal(t, test.expReason, condition.Reason)
+			assert.True(t, test.expNext.Equal(next), "expected next transition %s, got %s", test.expNext, next)
+		})
+	}
+}
+
+func TestExpiringClusterRoleBinding(t *testing.T) {
+	clock := testingclock.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	validFrom, validUntil := metav1.NewTime(clock.Now().Add(time.Hour)), metav1.NewTime(clock.Now().Add(2*time.Hour))
+
+	capiClusterRoleBinding := &CAPIClusterRoleBinding{
+		TypeMeta:   metav1.TypeMeta{APIVersion: CAPIClusterRoleBindingGVR.GroupVersion().String(), Kind: "CAPIClusterRoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{Name: "oncall"},
+		Spec: CAPIClusterRoleBindingSpec{CommonBindingSpec: CommonBindingSpec{
+			TargetClusters: []string{"cluster1"},
+			RoleRef:        []string{"admin"},
+			Subjects:       []Subject{{User: "alice"}},
+			ValidFrom:      &validFrom,
+			ValidUntil:     &validUntil,
+		}},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(capiClusterRoleBinding)
+	require.NoError(t, err)
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{CAPIClusterRoleBindingGVR: "CAPIClusterRoleBindingList"},
+		&unstructured.Unstructured{Object: obj})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer := dynamicinformer.NewDynamicSharedInformerFactory(client, 0).ForResource(CAPIClusterRoleBindingGVR).Informer()
+	go informer.Run(stopCh)
+	require.Eventually(t, informer.HasSynced, 5*time.Second, 10*time.Millisecond)
+
+	testCluster := &cluster.Cluster{
+		Name: "cluster1",
+		RBACConfig: &util.RBAC{
+			ClusterRoles: []*v1.ClusterRole{{ObjectMeta: metav1.ObjectMeta{Name: "admin"}}},
+		},
+	}
+	queue := workqueue.NewTypedDelayingQueueWithConfig(workqueue.TypedDelayingQueueConfig[string]{Clock: clock})
+	defer queue.ShutDown()
+
+	watcher := &CAPIRbacWatcher{
+		CAPIClusterRoleBindingInformer: informer,
+		clusters:                       []*cluster.Cluster{testCluster},
+		client:                         client,
+		queue:                          queue,
+		now:                            clock.Now,
+	}
+
+	condition := func() *metav1.Condition {
+		u, err := client.Resource(CAPIClusterRoleBindingGVR).Get(context.TODO(), "oncall", metav1.GetOptions{})
+		require.NoError(t, err)
+		binding, err := ConvertUnstructured[CAPIClusterRoleBinding](u)
+		require.NoError(t, err)
+		return apimeta.FindStatusCondition(binding.Status.Conditions, ConditionActive)
+	}
+
+	// Not materialised before the window opens
+	watcher.ProcessCAPIClusterRoleBinding(capiClusterRoleBinding)
+	assert.Empty(t, testCluster.RBACConfig.ClusterRoleBindings)
+	if c := condition(); assert.NotNil(t, c) {
+		assert.Equal(t, metav1.ConditionFalse, c.Status)
+		assert.Equal(t, ReasonNotYetValid, c.Reason)
+	}
+
+	// Materialised when the window opens
+	clock.Step(time.Hour)
+	require.Eventually(t, func() bool { return queue.Len() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, watcher.processNextBinding())
+	if assert.Len(t, testCluster.RBACConfig.ClusterRoleBindings, 1) {
+		assert.Equal(t, "oncall-admin", testCluster.RBACConfig.ClusterRoleBindings[0].Name)
+	}
+	assert.NotNil(t, testCluster.Authorizer)
+	if c := condition(); assert.NotNil(t, c) {
+		assert.Equal(t, metav1.ConditionTrue, c.Status)
+		assert.Equal(t, ReasonValid, c.Reason)
+	}
+
+	// Removed at expiry
+	clock.Step(time.Hour)
+	require.Eventually(t, func() bool { return queue.Len() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, watcher.processNextBinding())
+	assert.Empty(t, testCluster.RBACConfig.ClusterRoleBindings)
+	if c := condition(); assert.NotNil(t, c) {
+		assert.Equal(t, metav1.ConditionFalse, c.Status)
+		assert.Equal(t, ReasonExpired, c.Reason)
+	}
+}
+
+func TestConcurrentRebuild(t *testing.T) {
+	testCluster := &cluster.Cluster{
+		Name: "cluster1",
+		RBACConfig: &util.RBAC{
+			ClusterRoles: []*v1.ClusterRole{{ObjectMeta: metav1.ObjectMeta{Name: "admin"}}},
+		},
+	}
+	watcher := &CAPIRbacWatcher{clusters: []*cluster.Cluster{testCluster}}
+
+	// The validity worker rebuilds while the informers update bindings
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			watcher.RebuildAllAuthorizers()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			watcher.addOrUpdateClusterRoleBinding(testCluster, &v1.ClusterRoleBinding{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("binding-%d", i)},
+				RoleRef:    v1.RoleRef{Kind: "ClusterRole", Name: "admin"},
+			})
+			watcher.RebuildAllAuthorizers()
+		}
+	}()
+	wg.Wait()
+
+	assert.Len(t, testCluster.RBACConfig.ClusterRoleBindings, 100)
+	assert.NotNil(t, testCluster.Authorizer)
+}
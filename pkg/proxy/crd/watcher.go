@@ -2,14 +2,17 @@ package crd
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
 	"github.com/Improwised/kube-oidc-proxy/pkg/util"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 )
 
@@ -18,9 +21,23 @@ type CAPIRbacWatcher struct {
 	CAPIRoleInformer               cache.SharedIndexInformer
 	CAPIClusterRoleBindingInformer cache.SharedIndexInformer
 	CAPIRoleBindingInformer        cache.SharedIndexInformer
+	AccessRequestInformer          cache.SharedIndexInformer
 	clusters                       []*cluster.Cluster
 	initialProcessingComplete      bool
 	mu                             sync.RWMutex
+
+	// client updates the status of bindings, and queue processes bindings
+	// again when their validity window opens or closes
+	client dynamic.Interface
+	queue  workqueue.TypedDelayingInterface[string]
+	now    func() time.Time
+
+	// accessRequestAudit is called on each state transition of an
+	// AccessRequest once the existing ones are processed
+	accessRequestAudit AccessRequestAuditFunc
+	// accessRequestsSynced is read by the informer's handlers
+	accessRequestsSynced     atomic.Bool
+	accessRequestMaxDuration time.Duration
 }
 
 func NewCAPIRbacWatcher(clusters []*cluster.Cluster) (*CAPIRbacWatcher, error) {
@@ -49,6 +66,11 @@ func NewCAPIRbacWatcher(clusters []*cluster.Cluster) (*CAPIRbacWatcher, error) {
 		CAPIRoleBindingInformer:        capiRoleBindingInformer,
 		CAPIClusterRoleBindingInformer: capiClusterRoleBindingInformer,
 		clusters:                       clusters,
+		client:                         clusterClient,
+		queue: workqueue.NewTypedDelayingQueueWithConfig(
+			workqueue.TypedDelayingQueueConfig[string]{Name: "capi_binding_validity"},
+		),
+		now: time.Now,
 	}
 
 	watcher.RegisterEventHandlers()
@@ -68,6 +90,12 @@ func (w *CAPIRbacWatcher) Start(stopCh <-chan struct{}) {
 		w.CAPIRoleBindingInformer.HasSynced,
 		w.CAPIClusterRoleBindingInformer.HasSynced,
 	)
+
+	go wait.Until(w.runWorker, time.Second, stopCh)
+	go func() {
+		<-stopCh
+		w.queue.ShutDown()
+	}()
 }
 
 func (w *CAPIRbacWatcher) RegisterEventHandlers() {
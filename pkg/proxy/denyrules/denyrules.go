@@ -0,0 +1,269 @@
+// Package denyrules denies requests matching proxy-level rules before they
+// are authorized by RBAC, which can only allow requests.
+package denyrules
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"sigs.k8s.io/yaml"
+)
+
+// All matches every value of a rule field.
+const All = "*"
+
+// Policy is the file format of the deny rules.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule denies the resource requests it matches. A request matches if it
+// matches every field of the rule. Empty fields match every request.
+type Rule struct {
+	// Name identifies the rule in denial messages.
+	Name string `json:"name,omitempty"`
+	// Clusters are glob patterns of the cluster names the rule applies to,
+	// e.g. "prod-*".
+	Clusters []string `json:"clusters,omitempty"`
+	// Users and Groups restrict the rule to these users and the members of
+	// these groups.
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// ExceptUsers and ExceptGroups are exempt from the rule.
+	ExceptUsers  []string `json:"exceptUsers,omitempty"`
+	ExceptGroups []string `json:"exceptGroups,omitempty"`
+	// Verbs, APIGroups and Resources match like in RBAC policy rules. "" is
+	// the core API group and subresources are matched as "pods/exec".
+	Verbs     []string `json:"verbs,omitempty"`
+	APIGroups []string `json:"apiGroups,omitempty"`
+	Resources []string `json:"resources,omitempty"`
+	// Namespaces are glob patterns of the namespaces the rule applies to.
+	// "" matches cluster-scoped requests.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// ResourceNames are glob patterns of the resource names the rule applies
+	// to.
+	ResourceNames []string `json:"resourceNames,omitempty"`
+}
+
+// LoadPolicy reads and validates a deny rules file.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deny rules: %w", err)
+	}
+
+	return ParsePolicy(data)
+}
+
+// ParsePolicy parses and validates deny rules.
+func ParsePolicy(data []byte) (*Policy, error) {
+	policy := new(Policy)
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse deny rules: %w", err)
+	}
+
+	for i, rule := range policy.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("deny rule %d is invalid: %w", i, err)
+		}
+	}
+
+	return policy, nil
+}
+
+// Validate returns an error if the rule has invalid patterns.
+func (r *Rule) Validate() error {
+	for _, patterns := range [][]string{r.Clusters, r.Namespaces, r.ResourceNames} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Matches returns whether the rule denies the request to the cluster.
+// Non-resource requests never match.
+func (r *Rule) Matches(clusterName string, a authorizer.Attributes) bool {
+	if !a.IsResourceRequest() {
+		return false
+	}
+
+	if len(r.Clusters) > 0 && !matchesPattern(r.Clusters, clusterName) {
+		return false
+	}
+
+	if !r.matchesUser(a.GetUser()) {
+		return false
+	}
+
+	if len(r.Verbs) > 0 && !matchesValue(r.Verbs, a.GetVerb()) {
+		return false
+	}
+
+	if len(r.APIGroups) > 0 && !matchesValue(r.APIGroups, a.GetAPIGroup()) {
+		return false
+	}
+
+	if len(r.Resources) > 0 && !matchesResource(r.Resources, a.GetResource(), a.GetSubresource()) {
+		return false
+	}
+
+	if len(r.Namespaces) > 0 && !matchesPattern(r.Namespaces, a.GetNamespace()) {
+		return false
+	}
+
+	if len(r.ResourceNames) > 0 && !matchesPattern(r.ResourceNames, a.GetName()) {
+		return false
+	}
+
+	return true
+}
+
+func (r *Rule) matchesUser(u user.Info) bool {
+	// Requests without a user can't be exempt
+	if u == nil {
+		return len(r.Users) == 0 && len(r.Groups) == 0
+	}
+
+	if contains(r.ExceptUsers, u.GetName()) || containsAny(r.ExceptGroups, u.GetGroups()) {
+		return false
+	}
+
+	if len(r.Users) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+
+	return contains(r.Users, u.GetName()) || containsAny(r.Groups, u.GetGroups())
+}
+
+// Set holds the deny rules of several sources, such as a file and custom
+// resources. It is safe for concurrent use.
+type Set struct {
+	mu      sync.RWMutex
+	sources map[string][]Rule
+	// order holds the sources sorted by name, so rules are matched in a
+	// stable order
+	order []string
+}
+
+// NewSet returns an empty Set.
+func NewSet() *Set {
+	return &Set{sources: make(map[string][]Rule)}
+}
+
+// SetRules replaces the rules of the source.
+func (s *Set) SetRules(source string, rules []Rule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sources[source]; !ok {
+		s.order = append(s.order, source)
+		sort.Strings(s.order)
+	}
+	s.sources[source] = rules
+}
+
+// DeleteRules removes the rules of the source.
+func (s *Set) DeleteRules(source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sources[source]; !ok {
+		return
+	}
+
+	delete(s.sources, source)
+	for i, name := range s.order {
+		if name == source {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Match returns the first rule denying the request to the cluster.
+func (s *Set) Match(clusterName string, a authorizer.Attributes) (*Rule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, source := range s.order {
+		rules := s.sources[source]
+		for i := range rules {
+			if rules[i].Matches(clusterName, a) {
+				rule := rules[i]
+				return &rule, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Reason returns the denial reason of the rule.
+func Reason(rule *Rule) string {
+	if len(rule.Name) == 0 {
+		return "denied by proxy deny rule"
+	}
+
+	return fmt.Sprintf("denied by proxy deny rule %q", rule.Name)
+}
+
+func matchesPattern(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesValue(values []string, value string) bool {
+	return contains(values, All) || contains(values, value)
+}
+
+func matchesResource(resources []string, resource, subresource string) bool {
+	combined := resource
+	if len(subresource) > 0 {
+		combined = resource + "/" + subresource
+	}
+
+	for _, r := range resources {
+		if r == All || r == combined {
+			return true
+		}
+		if len(subresource) > 0 && (r == resource+"/"+All || r == All+"/"+subresource) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsAny(list, values []string) bool {
+	for _, value := range values {
+		if contains(list, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
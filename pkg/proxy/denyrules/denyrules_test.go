@@ -0,0 +1,195 @@
+package denyrules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+func TestMatches(t *testing.T) {
+	rule := Rule{
+		Name:         "kube-system-secrets",
+		Clusters:     []string{"prod-*"},
+		ExceptGroups: []string{"sre"},
+		Verbs:        []string{"get", "list"},
+		APIGroups:    []string{""},
+		Resources:    []string{"secrets"},
+		Namespaces:   []string{"kube-system"},
+	}
+
+	developer := &user.DefaultInfo{Name: "dev", Groups: []string{"developers"}}
+	sre := &user.DefaultInfo{Name: "sre", Groups: []string{"developers", "sre"}}
+
+	secrets := func(u user.Info, verb, namespace string) authorizer.AttributesRecord {
+		return authorizer.AttributesRecord{
+			User:            u,
+			Verb:            verb,
+			Namespace:       namespace,
+			Resource:        "secrets",
+			ResourceRequest: true,
+		}
+	}
+
+	tests := map[string]struct {
+		cluster string
+		attrs   authorizer.AttributesRecord
+		exp     bool
+	}{
+		"matching request should match": {
+			cluster: "prod-eu",
+			attrs:   secrets(developer, "list", "kube-system"),
+			exp:     true,
+		},
+		"exempt group should not match": {
+			cluster: "prod-eu",
+			attrs:   secrets(sre, "list", "kube-system"),
+		},
+		"other cluster should not match": {
+			cluster: "dev",
+			attrs:   secrets(developer, "list", "kube-system"),
+		},
+		"other verb should not match": {
+			cluster: "prod-eu",
+			attrs:   secrets(developer, "delete", "kube-system"),
+		},
+		"other namespace should not match": {
+			cluster: "prod-eu",
+			attrs:   secrets(developer, "list", "default"),
+		},
+		"request without user should match": {
+			cluster: "prod-eu",
+			attrs:   secrets(nil, "get", "kube-system"),
+			exp:     true,
+		},
+		"subresource should not match resource": {
+			cluster: "prod-eu",
+			attrs: authorizer.AttributesRecord{
+				User:            developer,
+				Verb:            "get",
+				Namespace:       "kube-system",
+				Resource:        "secrets",
+				Subresource:     "status",
+				ResourceRequest: true,
+			},
+		},
+		"non-resource request should not match": {
+			cluster: "prod-eu",
+			attrs: authorizer.AttributesRecord{
+				User: developer,
+				Verb: "get",
+				Path: "/version",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.exp, rule.Matches(test.cluster, test.attrs))
+		})
+	}
+}
+
+func TestMatchesResource(t *testing.T) {
+	tests := map[string]struct {
+		resources   []string
+		resource    string
+		subresource string
+		exp         bool
+	}{
+		"all":                          {[]string{"*"}, "pods", "exec", true},
+		"resource":                     {[]string{"pods"}, "pods", "", true},
+		"resource and subresource":     {[]string{"pods/exec"}, "pods", "exec", true},
+		"resource without subresource": {[]string{"pods"}, "pods", "exec", false},
+		"all subresources":             {[]string{"pods/*"}, "pods", "exec", true},
+		"all subresources of resource": {[]string{"pods/*"}, "pods", "", false},
+		"subresource of all resources": {[]string{"*/exec"}, "pods", "exec", true},
+		"other resource":               {[]string{"secrets"}, "pods", "", false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.exp, matchesResource(test.resources, test.resource, test.subresource))
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	set := NewSet()
+
+	attrs := authorizer.AttributesRecord{
+		User:            &user.DefaultInfo{Name: "dev"},
+		Verb:            "delete",
+		Resource:        "namespaces",
+		Name:            "kube-system",
+		ResourceRequest: true,
+	}
+
+	_, ok := set.Match("prod", attrs)
+	assert.False(t, ok)
+
+	set.SetRules("b", []Rule{{Name: "b", Resources: []string{"namespaces"}}})
+	set.SetRules("a", []Rule{{Name: "a", Verbs: []string{"delete"}, ResourceNames: []string{"kube-*"}}})
+
+	// Sources are matched in order of their names
+	rule, ok := set.Match("prod", attrs)
+	if assert.True(t, ok) {
+		assert.Equal(t, "a", rule.Name)
+		assert.Equal(t, `denied by proxy deny rule "a"`, Reason(rule))
+	}
+
+	set.DeleteRules("a")
+	rule, ok = set.Match("prod", attrs)
+	if assert.True(t, ok) {
+		assert.Equal(t, "b", rule.Name)
+	}
+
+	set.SetRules("b", nil)
+	_, ok = set.Match("prod", attrs)
+	assert.False(t, ok)
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "valid.yaml")
+	if err := os.WriteFile(valid, []byte(`
+rules:
+- name: kube-system-secrets
+  exceptGroups: ["sre"]
+  verbs: ["get", "list"]
+  apiGroups: [""]
+  resources: ["secrets"]
+  namespaces: ["kube-system"]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadPolicy(valid)
+	if assert.NoError(t, err) && assert.Len(t, policy.Rules, 1) {
+		assert.Equal(t, []string{"sre"}, policy.Rules[0].ExceptGroups)
+		assert.Equal(t, []string{""}, policy.Rules[0].APIGroups)
+	}
+
+	for name, data := range map[string]string{
+		"invalid-pattern.yaml": `
+rules:
+- namespaces: ["[kube"]
+`,
+		"unknown-field.yaml": `
+rules:
+- resource: ["secrets"]
+`,
+	} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := LoadPolicy(file)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"k8s.io/klog/v2"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/discoverycache"
+)
+
+// withDiscoveryCache serves discovery and OpenAPI requests from the cache.
+// Stale entries are revalidated with the cluster using their ETag. It runs
+// after authorization, so only authorized requests are served from the cache.
+func (p *Proxy) withDiscoveryCache(handler http.Handler) http.Handler {
+	if p.discoveryCache == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		clusterName, path := p.clusterResolver.Resolve(req)
+		if req.Method != http.MethodGet || !discoverycache.IsDiscoveryPath(path) ||
+			p.clusterManager.GetCluster(clusterName) == nil {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		key := discoverycache.NewKey(clusterName, path, req)
+
+		entry, fresh := p.discoveryCache.Get(key)
+		if fresh {
+			metrics.DiscoveryCacheRequests.WithLabelValues(clusterName, metrics.CacheHit).Inc()
+			serveCacheEntry(rw, req, entry)
+			return
+		}
+
+		// The client's conditions are answered from the cache, so the cluster
+		// is only asked to revalidate the cached entry. Responses are cached
+		// uncompressed, leaving compression to the transport.
+		upstreamReq := req.Clone(req.Context())
+		upstreamReq.Header.Del("If-None-Match")
+		upstreamReq.Header.Del("Accept-Encoding")
+		if entry != nil && len(entry.ETag()) > 0 {
+			upstreamReq.Header.Set("If-None-Match", entry.ETag())
+		}
+
+		rec := &responseBuffer{header: make(http.Header)}
+		handler.ServeHTTP(rec, upstreamReq)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+
+		switch {
+		case rec.code == http.StatusNotModified && entry != nil:
+			metrics.DiscoveryCacheRequests.WithLabelValues(clusterName, metrics.CacheRevalidated).Inc()
+			p.discoveryCache.Refresh(key, entry)
+			serveCacheEntry(rw, req, entry)
+
+		case rec.code == http.StatusOK:
+			metrics.DiscoveryCacheRequests.WithLabelValues(clusterName, metrics.CacheMiss).Inc()
+			entry = p.discoveryCache.Set(key, rec.header, rec.body.Bytes())
+			serveCacheEntry(rw, req, entry)
+
+		// Errors are passed on as is
+		default:
+			metrics.DiscoveryCacheRequests.WithLabelValues(clusterName, metrics.CacheMiss).Inc()
+			for name, values := range rec.header {
+				rw.Header()[name] = values
+			}
+			rw.WriteHeader(rec.code)
+			if _, err := rw.Write(rec.body.Bytes()); err != nil {
+				klog.Errorf("failed to write response: %s", err)
+			}
+		}
+	})
+}
+
+// serveCacheEntry writes the cached response, or Not Modified if the client
+// already has it.
+func serveCacheEntry(rw http.ResponseWriter, req *http.Request, entry *discoverycache.Entry) {
+	for name, values := range entry.Header {
+		rw.Header()[name] = append([]string{}, values...)
+	}
+
+	if etag := entry.ETag(); len(etag) > 0 && req.Header.Get("If-None-Match") == etag {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rw.Header().Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	rw.WriteHeader(http.StatusOK)
+	if _, err := rw.Write(entry.Body); err != nil {
+		klog.Errorf("failed to write cached response: %s", err)
+	}
+}
+
+// responseBuffer buffers a response to be cached.
+type responseBuffer struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *responseBuffer) Header() http.Header {
+	return r.header
+}
+
+func (r *responseBuffer) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *responseBuffer) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+// Flush is a no-op, the response is written once complete.
+func (r *responseBuffer) Flush() {}
@@ -0,0 +1,251 @@
+// Package discoverycache caches the discovery and OpenAPI responses of
+// clusters, which every kubectl invocation requests.
+package discoverycache
+
+import (
+	"container/list"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// gcInterval is how often unused entries are removed.
+	gcInterval = time.Minute
+	// idleTimeout is how long an entry is kept without being served. Expired
+	// entries are kept until then to be revalidated with their ETag.
+	idleTimeout = time.Hour
+	// maxSize is the total size of the cached bodies. The least recently used
+	// entries are evicted beyond it.
+	maxSize = 256 << 20
+)
+
+// cachedQuery are the query parameters that select the response. Others, such
+// as the client's timeout, are not part of the key so that arbitrary queries
+// can't grow the cache.
+var cachedQuery = []string{
+	// Selects the version of an OpenAPI v3 document
+	"hash",
+}
+
+// cachedHeaders are the response headers stored with an entry. Other headers,
+// such as Audit-Id, are specific to the request.
+var cachedHeaders = []string{
+	"Cache-Control",
+	"Content-Type",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Vary",
+}
+
+// IsDiscoveryPath returns whether the path, as forwarded to the cluster, is a
+// discovery or OpenAPI path whose responses can be cached.
+func IsDiscoveryPath(path string) bool {
+	switch path {
+	case "/api", "/apis", "/openapi/v2", "/openapi/v3":
+		return true
+	}
+
+	return strings.HasPrefix(path, "/openapi/v3/")
+}
+
+// Key identifies a cached response. The response content type is negotiated
+// from the Accept header, so responses are cached per Accept header.
+type Key struct {
+	Cluster string
+	// Path includes the cached query parameters only
+	Path   string
+	Accept string
+}
+
+// NewKey returns the key of a request to the cluster for the path.
+func NewKey(cluster, path string, req *http.Request) Key {
+	query := make(url.Values)
+	for _, name := range cachedQuery {
+		if value := req.URL.Query().Get(name); len(value) > 0 {
+			query.Set(name, value)
+		}
+	}
+
+	u := url.URL{Path: path, RawQuery: query.Encode()}
+
+	return Key{
+		Cluster: cluster,
+		Path:    u.RequestURI(),
+		Accept:  normalizeAccept(req.Header.Values("Accept")),
+	}
+}
+
+// normalizeAccept returns the media ranges of the Accept headers, lower-cased
+// and without whitespace or duplicates, so that equivalent headers share an
+// entry.
+func normalizeAccept(accept []string) string {
+	var ranges []string
+	seen := make(map[string]bool)
+	for _, header := range accept {
+		for _, mediaRange := range strings.Split(header, ",") {
+			mediaRange = strings.ToLower(strings.Join(strings.Fields(mediaRange), ""))
+			if len(mediaRange) == 0 || seen[mediaRange] {
+				continue
+			}
+			seen[mediaRange] = true
+			ranges = append(ranges, mediaRange)
+		}
+	}
+
+	return strings.Join(ranges, ",")
+}
+
+// Entry is a cached response. It must not be modified.
+type Entry struct {
+	Header http.Header
+	Body   []byte
+
+	key      Key
+	expires  time.Time
+	lastUsed time.Time
+	element  *list.Element
+}
+
+// ETag returns the ETag of the response, if any.
+func (e *Entry) ETag() string {
+	return e.Header.Get("ETag")
+}
+
+// Cache holds the cached responses of all clusters, up to maxSize bytes.
+type Cache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[Key]*Entry
+	// lru orders the entries from the most to the least recently used
+	lru  *list.List
+	size int
+}
+
+// New returns a Cache whose entries are fresh for the TTL.
+func New(ttl time.Duration) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		now:     time.Now,
+		maxSize: maxSize,
+		entries: make(map[Key]*Entry),
+		lru:     list.New(),
+	}
+}
+
+// Run periodically removes unused entries until stopCh is closed.
+func (c *Cache) Run(stopCh <-chan struct{}) {
+	go wait.Until(c.gc, gcInterval, stopCh)
+}
+
+// Get returns the entry of the key and whether it is fresh. Stale entries
+// must be revalidated before being served.
+func (c *Cache) Get(key Key) (*Entry, bool) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry.lastUsed = now
+	c.lru.MoveToFront(entry.element)
+	return entry, now.Before(entry.expires)
+}
+
+// Set caches a response for the key, evicting the least recently used entries
+// to make room. Responses larger than the cache are returned without being
+// cached.
+func (c *Cache) Set(key Key, header http.Header, body []byte) *Entry {
+	now := c.now()
+
+	entry := &Entry{
+		Header:   make(http.Header),
+		Body:     body,
+		key:      key,
+		expires:  now.Add(c.ttl),
+		lastUsed: now,
+	}
+	for _, name := range cachedHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			entry.Header[http.CanonicalHeaderKey(name)] = append([]string{}, values...)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+
+	if len(body) > c.maxSize {
+		return entry
+	}
+
+	for c.size+len(body) > c.maxSize {
+		c.remove(c.lru.Back().Value.(*Entry))
+	}
+
+	entry.element = c.lru.PushFront(entry)
+	c.entries[key] = entry
+	c.size += len(body)
+
+	return entry
+}
+
+// Refresh makes the entry fresh again after it was revalidated.
+func (c *Cache) Refresh(key Key, entry *Entry) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The entry may have been invalidated during revalidation
+	if c.entries[key] == entry {
+		entry.expires = now.Add(c.ttl)
+	}
+}
+
+// Invalidate removes the entries of the cluster.
+func (c *Cache) Invalidate(cluster string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if key.Cluster == cluster {
+			c.remove(entry)
+		}
+	}
+}
+
+func (c *Cache) gc() {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range c.entries {
+		if now.Sub(entry.lastUsed) > idleTimeout {
+			c.remove(entry)
+		}
+	}
+}
+
+// remove drops the entry from the cache. The caller must hold mu.
+func (c *Cache) remove(entry *Entry) {
+	delete(c.entries, entry.key)
+	c.lru.Remove(entry.element)
+	c.size -= len(entry.Body)
+}
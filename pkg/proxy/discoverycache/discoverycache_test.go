@@ -0,0 +1,134 @@
+package discoverycache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsDiscoveryPath(t *testing.T) {
+	for path, exp := range map[string]bool{
+		"/api":                            true,
+		"/apis":                           true,
+		"/openapi/v2":                     true,
+		"/openapi/v3":                     true,
+		"/openapi/v3/apis/apps/v1":        true,
+		"/api/v1/namespaces":              false,
+		"/apis/apps/v1/deployments":       false,
+		"/version":                        false,
+		"/openapi/v3x":                    false,
+		"/api/v1/namespaces/default/pods": false,
+	} {
+		assert.Equal(t, exp, IsDiscoveryPath(path), path)
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/dev/openapi/v3/apis/apps/v1?hash=abc&timeout=32s&x=random", nil)
+	req.Header.Set("Accept", "Application/JSON; g=apidiscovery.k8s.io , application/json")
+	req.Header.Add("Accept", "application/json")
+
+	assert.Equal(t, Key{
+		Cluster: "dev",
+		Path:    "/openapi/v3/apis/apps/v1?hash=abc",
+		Accept:  "application/json;g=apidiscovery.k8s.io,application/json",
+	}, NewKey("dev", "/openapi/v3/apis/apps/v1", req))
+
+	// Unknown parameters don't create entries
+	req = httptest.NewRequest(http.MethodGet, "/dev/openapi/v2?x=random", nil)
+	assert.Equal(t, Key{Cluster: "dev", Path: "/openapi/v2"}, NewKey("dev", "/openapi/v2", req))
+}
+
+func TestCache(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	c := New(time.Minute)
+	c.now = func() time.Time { return now }
+
+	key := Key{Cluster: "dev", Path: "/api", Accept: "application/json"}
+	other := Key{Cluster: "prod", Path: "/api", Accept: "application/json"}
+
+	entry, fresh := c.Get(key)
+	assert.Nil(t, entry)
+	assert.False(t, fresh)
+
+	header := http.Header{
+		"Content-Type": []string{"application/json"},
+		"Etag":         []string{`"abc"`},
+		"Audit-Id":     []string{"1234"},
+	}
+	set := c.Set(key, header, []byte("{}"))
+	c.Set(other, header, []byte("{}"))
+
+	// Only headers of the response itself are cached
+	assert.Equal(t, `"abc"`, set.ETag())
+	assert.Empty(t, set.Header.Get("Audit-Id"))
+
+	entry, fresh = c.Get(key)
+	assert.Same(t, set, entry)
+	assert.True(t, fresh)
+
+	// Expired entries are kept to be revalidated
+	now = now.Add(time.Minute)
+	entry, fresh = c.Get(key)
+	assert.Same(t, set, entry)
+	assert.False(t, fresh)
+
+	c.Refresh(key, entry)
+	_, fresh = c.Get(key)
+	assert.True(t, fresh)
+
+	// Invalidation drops the entries of the cluster only
+	c.Invalidate("dev")
+	entry, _ = c.Get(key)
+	assert.Nil(t, entry)
+	entry, _ = c.Get(other)
+	assert.NotNil(t, entry)
+
+	// Unused entries are removed
+	now = now.Add(idleTimeout + time.Second)
+	c.gc()
+	assert.Len(t, c.entries, 0)
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := New(time.Minute)
+	c.maxSize = 10
+
+	first := Key{Cluster: "dev", Path: "/api"}
+	second := Key{Cluster: "dev", Path: "/apis"}
+	third := Key{Cluster: "dev", Path: "/openapi/v2"}
+
+	c.Set(first, nil, []byte("1234"))
+	c.Set(second, nil, []byte("1234"))
+
+	// The first entry is used, so the second one is evicted
+	c.Get(first)
+	c.Set(third, nil, []byte("1234"))
+
+	entry, _ := c.Get(second)
+	assert.Nil(t, entry)
+	entry, _ = c.Get(first)
+	assert.NotNil(t, entry)
+	entry, _ = c.Get(third)
+	assert.NotNil(t, entry)
+	assert.Equal(t, 8, c.size)
+
+	// Replacing an entry accounts for its previous size
+	c.Set(third, nil, []byte("12"))
+	assert.Equal(t, 6, c.size)
+
+	// Responses larger than the cache are served but not cached
+	set := c.Set(second, nil, []byte("12345678901"))
+	assert.Equal(t, []byte("12345678901"), set.Body)
+	entry, _ = c.Get(second)
+	assert.Nil(t, entry)
+	assert.Len(t, c.entries, 2)
+
+	c.Invalidate("dev")
+	assert.Equal(t, 0, c.size)
+	assert.Equal(t, 0, c.lru.Len())
+}
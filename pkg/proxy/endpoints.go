@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	authuser "k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog/v2"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+)
+
+const (
+	// clustersPath lists the clusters the caller has access to.
+	clustersPath = "/_clusters"
+
+	clusterTypeStatic  = "static"
+	clusterTypeDynamic = "dynamic"
+)
+
+// ClusterInfo describes a cluster the caller has access to.
+type ClusterInfo struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Health string `json:"health"`
+	Error  string `json:"error,omitempty"`
+	// CircuitBreaker is the state of the cluster's circuit breaker, if
+	// enabled.
+	CircuitBreaker string `json:"circuitBreaker,omitempty"`
+}
+
+// ClusterList is the response body of the cluster discovery endpoint.
+type ClusterList struct {
+	Clusters []ClusterInfo `json:"clusters"`
+}
+
+// withProxyEndpoints serves the proxy's own endpoints to authenticated users.
+// All other requests are passed on to the cluster handler chain.
+func (p *Proxy) withProxyEndpoints(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Fleet requests are limited per cluster they are sent to
+		if isProxyEndpoint(req.URL.Path) && !isFleetPath(req.URL.Path) && !p.allowProxyEndpoint(rw, req) {
+			return
+		}
+
+		switch req.URL.Path {
+		case clustersPath:
+			p.serveClusters(rw, req)
+		case kubeconfigPath:
+			p.serveKubeconfig(rw, req)
+		case recordingsPath:
+			p.serveRecordings(rw, req)
+		case accessRequestsPath:
+			p.serveAccessRequests(rw, req)
+		default:
+			switch {
+			case isFleetPath(req.URL.Path):
+				p.serveFleet(rw, req, handler)
+			case strings.HasPrefix(req.URL.Path, recordingsPath+"/"):
+				p.serveRecording(rw, req)
+			case strings.HasPrefix(req.URL.Path, accessRequestsPath+"/"):
+				p.serveAccessRequestDecision(rw, req)
+			default:
+				handler.ServeHTTP(rw, req)
+			}
+		}
+	})
+}
+
+// isProxyEndpoint returns whether the path is served by the proxy itself
+// rather than a cluster.
+func isProxyEndpoint(path string) bool {
+	switch path {
+	case clustersPath, kubeconfigPath, recordingsPath, accessRequestsPath:
+		return true
+	default:
+		return isFleetPath(path) || strings.HasPrefix(path, recordingsPath+"/") ||
+			strings.HasPrefix(path, accessRequestsPath+"/")
+	}
+}
+
+// serveClusters writes the list of clusters where the caller has at least one
+// matching binding.
+func (p *Proxy) serveClusters(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		p.handleError(rw, req, apierrors.NewMethodNotSupported(schema.GroupResource{Resource: "clusters"}, req.Method))
+		return
+	}
+
+	user, ok := genericapirequest.UserFrom(req.Context())
+	if !ok || len(user.GetName()) == 0 {
+		p.handleError(rw, req, errNoName)
+		return
+	}
+
+	clusters := p.accessibleClusters(req, user)
+
+	infos := make([]ClusterInfo, len(clusters))
+	for i, c := range clusters {
+		infos[i] = clusterInfo(c)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(ClusterList{Clusters: infos}); err != nil {
+		klog.Errorf("failed to write cluster list: %s", err)
+	}
+}
+
+// accessibleClusters returns the clusters, sorted by name, where the user has
+// at least one matching binding in the cluster's RBAC configuration and the
+// token issuer is accepted.
+func (p *Proxy) accessibleClusters(req *http.Request, user authuser.Info) []*cluster.Cluster {
+	// Bindings to system:authenticated apply to every authenticated user.
+	user = &authuser.DefaultInfo{
+		Name:   user.GetName(),
+		Groups: append(append([]string{}, user.GetGroups()...), authuser.AllAuthenticated),
+	}
+
+	var clusters []*cluster.Cluster
+	for _, c := range p.clusterManager.GetAllClusters() {
+		if c.RBACConfig != nil && c.RBACConfig.HasBindingFor(user) && p.issuerAllowsCluster(req, c.Name) {
+			clusters = append(clusters, c)
+		}
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+
+	return clusters
+}
+
+// clusterInfo describes the cluster with the result of its latest background
+// health check, so listing clusters never queries their API servers.
+func clusterInfo(c *cluster.Cluster) ClusterInfo {
+	health := c.Health()
+
+	info := ClusterInfo{
+		Name:   c.Name,
+		Type:   clusterTypeDynamic,
+		Health: string(health.Status),
+	}
+
+	if c.IsStatic {
+		info.Type = clusterTypeStatic
+	}
+
+	if c.Breaker != nil {
+		info.CircuitBreaker = c.Breaker.State().String()
+	}
+
+	if health.Status == cluster.HealthUnhealthy {
+		info.Error = health.LastError
+	}
+
+	return info
+}
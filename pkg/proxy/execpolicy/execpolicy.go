@@ -0,0 +1,196 @@
+// Package execpolicy allows or denies the commands run with pods/exec per
+// group and cluster.
+package execpolicy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"sigs.k8s.io/yaml"
+)
+
+// ErrCommandDenied is returned when the exec policy does not allow a command.
+var ErrCommandDenied = errors.New("command denied by exec policy")
+
+// DefaultWrappers are the executables known to run another command given as
+// one of their arguments.
+var DefaultWrappers = []string{
+	"busybox", "chroot", "doas", "env", "flock", "ionice", "nice", "nohup",
+	"nsenter", "runuser", "setsid", "stdbuf", "strace", "su", "sudo",
+	"taskset", "time", "timeout", "toybox", "unshare", "watch", "xargs",
+}
+
+// Policy is the file format of the exec command policy.
+type Policy struct {
+	// Wrappers are glob patterns of the executables that run another command
+	// given as one of their arguments. If empty, DefaultWrappers are used.
+	Wrappers []string `json:"wrappers,omitempty"`
+	Rules    []Rule   `json:"rules"`
+}
+
+// Rule allows or denies commands. Commands are matched by the base name of
+// the executable, so "sh" matches both "sh" and "/bin/sh".
+//
+// A command is denied if any matching rule denies it. If any matching rule
+// has allowed commands, the command must be allowed by one of them. Commands
+// of requests matching no rules with allowed commands are left to RBAC.
+//
+// The executable of a command can be a wrapper running another command, such
+// as "env sh" or "busybox sh". The arguments of wrappers are matched against
+// denied commands as well, but allowed commands only match the executable, so
+// wrappers are only allowed if named by an allow list. Commands can't be
+// inspected further: any allowed interpreter or shell can run a denied
+// command. Attaching to a container runs no command, so pods/attach requests
+// are denied wherever allowed commands apply.
+type Rule struct {
+	// Clusters are glob patterns of the cluster names the rule applies to,
+	// e.g. "prod-*". If empty, the rule applies to every cluster.
+	Clusters []string `json:"clusters,omitempty"`
+	// Groups restricts the rule to members of these groups. If empty, the
+	// rule applies to every user.
+	Groups []string `json:"groups,omitempty"`
+	// Allow are glob patterns of the commands that may be run.
+	Allow []string `json:"allow,omitempty"`
+	// Deny are glob patterns of the commands that may not be run.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// LoadPolicy reads and validates an exec command policy file.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exec policy: %w", err)
+	}
+
+	policy := new(Policy)
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse exec policy %q: %w", file, err)
+	}
+
+	for _, pattern := range policy.Wrappers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid wrapper pattern %q in %q: %w", pattern, file, err)
+		}
+	}
+
+	for i, rule := range policy.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d in %q is invalid: %w", i, file, err)
+		}
+	}
+
+	return policy, nil
+}
+
+func (r *Rule) validate() error {
+	if len(r.Allow) == 0 && len(r.Deny) == 0 {
+		return errors.New("rule allows or denies no commands")
+	}
+
+	for _, patterns := range [][]string{r.Clusters, r.Allow, r.Deny} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check returns an error wrapping ErrCommandDenied if the policy does not
+// allow the user to run the command in the cluster. The command is empty for
+// pods/attach requests. The user may be nil for requests that were not
+// authenticated by the proxy, which are only subject to rules without groups.
+func (p *Policy) Check(clusterName string, u user.Info, command []string) error {
+	names := p.commandNames(command)
+	name := names[0]
+
+	var allowListed, allowed bool
+	for _, rule := range p.Rules {
+		if !rule.matches(clusterName, u) {
+			continue
+		}
+
+		for _, n := range names {
+			if matchesAny(rule.Deny, n) {
+				return fmt.Errorf("%w: command %q is denied on cluster %q", ErrCommandDenied, n, clusterName)
+			}
+		}
+
+		if len(rule.Allow) > 0 {
+			allowListed = true
+			allowed = allowed || matchesAny(rule.Allow, name)
+		}
+	}
+
+	if allowListed && !allowed {
+		return fmt.Errorf("%w: command %q is not allowed on cluster %q", ErrCommandDenied, name, clusterName)
+	}
+
+	return nil
+}
+
+func (r *Rule) matches(clusterName string, u user.Info) bool {
+	if len(r.Clusters) > 0 && !matchesAny(r.Clusters, clusterName) {
+		return false
+	}
+
+	if len(r.Groups) == 0 {
+		return true
+	}
+
+	if u == nil {
+		return false
+	}
+
+	for _, group := range u.GetGroups() {
+		for _, g := range r.Groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// commandNames returns the base name of the executable of the command. If it
+// is a wrapper, the base names of its arguments follow, as any of them may be
+// the command it runs.
+func (p *Policy) commandNames(command []string) []string {
+	if len(command) == 0 || len(command[0]) == 0 {
+		return []string{""}
+	}
+
+	names := []string{path.Base(command[0])}
+
+	wrappers := p.Wrappers
+	if len(wrappers) == 0 {
+		wrappers = DefaultWrappers
+	}
+	if !matchesAny(wrappers, names[0]) {
+		return names
+	}
+
+	for _, arg := range command[1:] {
+		if len(arg) > 0 {
+			names = append(names, path.Base(arg))
+		}
+	}
+
+	return names
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
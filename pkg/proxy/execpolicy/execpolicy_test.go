@@ -0,0 +1,216 @@
+package execpolicy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestCheck(t *testing.T) {
+	policy := &Policy{
+		Rules: []Rule{
+			{
+				Clusters: []string{"prod-*"},
+				Groups:   []string{"developers"},
+				Allow:    []string{"cat", "ls"},
+			},
+			{
+				Clusters: []string{"prod-*"},
+				Groups:   []string{"oncall"},
+				Allow:    []string{"*"},
+			},
+			{
+				Deny: []string{"*sh"},
+			},
+		},
+	}
+
+	developer := &user.DefaultInfo{Name: "dev", Groups: []string{"developers"}}
+	oncall := &user.DefaultInfo{Name: "sre", Groups: []string{"developers", "oncall"}}
+
+	tests := map[string]struct {
+		policy  *Policy
+		cluster string
+		user    user.Info
+		command []string
+		expErr  bool
+	}{
+		"allowed command should pass": {
+			cluster: "prod-eu",
+			user:    developer,
+			command: []string{"cat", "/etc/hosts"},
+		},
+		"allowed command by path should pass": {
+			cluster: "prod-eu",
+			user:    developer,
+			command: []string{"/bin/ls", "-l"},
+		},
+		"command not allowed should fail": {
+			cluster: "prod-eu",
+			user:    developer,
+			command: []string{"rm", "-rf", "/"},
+			expErr:  true,
+		},
+		"denied command should fail": {
+			cluster: "prod-eu",
+			user:    developer,
+			command: []string{"/bin/bash"},
+			expErr:  true,
+		},
+		"command allowed by any rule should pass": {
+			cluster: "prod-eu",
+			user:    oncall,
+			command: []string{"rm", "-rf", "/tmp/cache"},
+		},
+		"denied command should fail even if allowed": {
+			cluster: "prod-eu",
+			user:    oncall,
+			command: []string{"sh"},
+			expErr:  true,
+		},
+		"cluster without allow rules should pass": {
+			cluster: "dev",
+			user:    developer,
+			command: []string{"rm"},
+		},
+		"denied command should fail on any cluster": {
+			cluster: "dev",
+			user:    developer,
+			command: []string{"zsh"},
+			expErr:  true,
+		},
+		"unauthenticated user should only match rules without groups": {
+			cluster: "prod-eu",
+			command: []string{"rm"},
+		},
+		"empty command should fail when allow listed": {
+			cluster: "prod-eu",
+			user:    developer,
+			expErr:  true,
+		},
+		"wrapped shell should fail when allow listed": {
+			cluster: "prod-eu",
+			user:    developer,
+			command: []string{"env", "sh"},
+			expErr:  true,
+		},
+		"shell wrapped by env should fail when denied": {
+			cluster: "prod-eu",
+			user:    oncall,
+			command: []string{"/usr/bin/env", "FOO=bar", "sh"},
+			expErr:  true,
+		},
+		"shell wrapped by busybox should fail when denied": {
+			cluster: "prod-eu",
+			user:    oncall,
+			command: []string{"busybox", "sh"},
+			expErr:  true,
+		},
+		"shell wrapped by nice should fail when denied": {
+			cluster: "prod-eu",
+			user:    oncall,
+			command: []string{"nice", "-n", "5", "/bin/bash"},
+			expErr:  true,
+		},
+		"shell wrapped by xargs should fail when denied": {
+			cluster: "dev",
+			user:    developer,
+			command: []string{"xargs", "sh"},
+			expErr:  true,
+		},
+		"wrapped command should pass when not denied": {
+			cluster: "prod-eu",
+			user:    oncall,
+			command: []string{"env", "ls"},
+		},
+		"configured wrappers should replace the defaults": {
+			policy: &Policy{
+				Wrappers: []string{"run-as"},
+				Rules:    []Rule{{Deny: []string{"*sh"}}},
+			},
+			cluster: "dev",
+			command: []string{"run-as", "root", "sh"},
+			expErr:  true,
+		},
+		"default wrappers should not apply with configured wrappers": {
+			policy: &Policy{
+				Wrappers: []string{"run-as"},
+				Rules:    []Rule{{Deny: []string{"*sh"}}},
+			},
+			cluster: "dev",
+			command: []string{"env", "sh"},
+		},
+		"arguments of other commands should not be matched": {
+			cluster: "prod-eu",
+			user:    oncall,
+			command: []string{"cat", "/tmp/run.sh"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			policy := policy
+			if test.policy != nil {
+				policy = test.policy
+			}
+
+			err := policy.Check(test.cluster, test.user, test.command)
+			if test.expErr {
+				assert.True(t, errors.Is(err, ErrCommandDenied), "expected ErrCommandDenied, got %v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "valid.yaml")
+	if err := os.WriteFile(valid, []byte(`
+wrappers: ["env", "run-as"]
+rules:
+- clusters: ["prod-*"]
+  groups: ["developers"]
+  allow: ["cat", "ls"]
+- deny: ["sh", "bash"]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadPolicy(valid)
+	if assert.NoError(t, err) && assert.Len(t, policy.Rules, 2) {
+		assert.Equal(t, []string{"env", "run-as"}, policy.Wrappers)
+		assert.Equal(t, []string{"cat", "ls"}, policy.Rules[0].Allow)
+		assert.Equal(t, []string{"sh", "bash"}, policy.Rules[1].Deny)
+	}
+
+	for name, data := range map[string]string{
+		"no-commands.yaml": `
+rules:
+- groups: ["developers"]
+`,
+		"invalid-pattern.yaml": `
+rules:
+- allow: ["[cat"]
+`,
+		"invalid-wrapper.yaml": `
+wrappers: ["[env"]
+rules:
+- deny: ["sh"]
+`,
+	} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := LoadPolicy(file)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,540 @@
+package proxy
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog/v2"
+
+	"github.com/Improwised/kube-oidc-proxy/constants"
+	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/maxinflight"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/resolver"
+)
+
+const (
+	// fleetAllPath sends requests to every cluster the caller has access to,
+	// e.g. /_all/api/v1/pods.
+	fleetAllPath = "/_all"
+	// fleetSelectorPath sends requests to the clusters the caller has access
+	// to whose labels match a selector, e.g. /_fleet/env=prod/api/v1/pods.
+	fleetSelectorPath = "/_fleet"
+
+	// fleetMaxConcurrency is the number of clusters requested at a time.
+	fleetMaxConcurrency = 16
+	// fleetRequestTimeout bounds the request to each cluster, so a slow
+	// cluster can't hold up the response.
+	fleetRequestTimeout = time.Minute
+	// fleetMaxInFlightPerUser is the number of fleet requests a user may
+	// have in flight.
+	fleetMaxInFlightPerUser = 2
+
+	// tableAccept requests the server-side printed Table of resources, as
+	// used by kubectl get.
+	tableAccept = "application/json;as=Table;v=v1;g=meta.k8s.io"
+)
+
+// fleetMaxResponseSize bounds the size of the responses of all clusters of a
+// fleet request, which are buffered to be merged.
+var fleetMaxResponseSize int64 = 64 << 20
+
+// FleetClusterAnnotation is set on every item of a fleet response to the name
+// of the cluster it was read from.
+var FleetClusterAnnotation = constants.Group + "/cluster"
+
+// FleetFailure describes a cluster whose request failed.
+type FleetFailure struct {
+	Cluster string              `json:"cluster"`
+	Code    int32               `json:"code"`
+	Reason  metav1.StatusReason `json:"reason,omitempty"`
+	Message string              `json:"message"`
+}
+
+// fleetList is the response body of a fleet request for a List.
+type fleetList struct {
+	metav1.TypeMeta `json:",inline"`
+	Metadata        metav1.ListMeta          `json:"metadata"`
+	Items           []map[string]interface{} `json:"items"`
+	Failures        []FleetFailure           `json:"failures,omitempty"`
+}
+
+// fleetTable is the response body of a fleet request for a Table.
+type fleetTable struct {
+	metav1.Table `json:",inline"`
+	Failures     []FleetFailure `json:"failures,omitempty"`
+}
+
+// fleetBudget is the response size left to the clusters of a fleet request.
+// Once exceeded, the requests still in flight are cancelled.
+type fleetBudget struct {
+	remaining atomic.Int64
+	exceeded  atomic.Bool
+	cancel    gocontext.CancelFunc
+}
+
+func (b *fleetBudget) take(n int) bool {
+	if b.remaining.Add(-int64(n)) >= 0 {
+		return true
+	}
+
+	if b.exceeded.CompareAndSwap(false, true) {
+		b.cancel()
+	}
+	return false
+}
+
+// fleetBuffer buffers the response of a cluster within the fleet budget.
+type fleetBuffer struct {
+	responseBuffer
+	budget *fleetBudget
+}
+
+func (b *fleetBuffer) Write(data []byte) (int, error) {
+	if !b.budget.take(len(data)) {
+		return 0, errFleetBudgetExceeded
+	}
+	return b.responseBuffer.Write(data)
+}
+
+// errFleetBudgetExceeded is returned once the responses of a fleet request
+// exceed fleetMaxResponseSize.
+var errFleetBudgetExceeded = errors.New("fleet response size exceeded")
+
+// fleetResult is the buffered response of a cluster.
+type fleetResult struct {
+	cluster  string
+	response *responseBuffer
+	// labels are the metrics labels set while serving the cluster's request
+	labels context.RequestMetrics
+}
+
+// clusterColumn is prepended to the columns of merged Tables.
+var clusterColumn = metav1.TableColumnDefinition{
+	Name:        "Cluster",
+	Type:        "string",
+	Description: "The cluster the resource was read from.",
+}
+
+// newFleetInFlight returns the limiter of fleet requests in flight per user.
+func newFleetInFlight() *maxinflight.Limiter {
+	return maxinflight.New(maxinflight.Limits{}, maxinflight.Limits{NonMutating: fleetMaxInFlightPerUser})
+}
+
+// isFleetPath returns whether the path is a fleet request to several
+// clusters.
+func isFleetPath(path string) bool {
+	return path == fleetAllPath ||
+		strings.HasPrefix(path, fleetAllPath+"/") ||
+		strings.HasPrefix(path, fleetSelectorPath+"/")
+}
+
+// parseFleetPath returns the cluster selector of a fleet request and the path
+// to request from each cluster. Label keys may contain a slash, so the
+// selector is taken from the escaped path.
+func parseFleetPath(escapedPath string) (labels.Selector, string, error) {
+	if rest, ok := strings.CutPrefix(escapedPath, fleetAllPath); ok {
+		path, err := url.PathUnescape(rest)
+		return labels.Everything(), path, err
+	}
+
+	rawSelector, rest, _ := strings.Cut(strings.TrimPrefix(escapedPath, fleetSelectorPath+"/"), "/")
+	rawSelector, err := url.PathUnescape(rawSelector)
+	if err != nil {
+		return nil, "", err
+	}
+
+	selector, err := labels.Parse(rawSelector)
+	if err != nil {
+		return nil, "", err
+	}
+
+	path, err := url.PathUnescape("/" + rest)
+	return selector, path, err
+}
+
+// serveFleet sends a get or list request to every cluster the caller has
+// access to that matches the fleet selector, and merges the responses. Each
+// request is passed through the cluster handler chain, so it is authorized
+// by the cluster's own RBAC configuration.
+func (p *Proxy) serveFleet(rw http.ResponseWriter, req *http.Request, handler http.Handler) {
+	user, ok := genericapirequest.UserFrom(req.Context())
+	if !ok || len(user.GetName()) == 0 {
+		p.handleError(rw, req, errNoName)
+		return
+	}
+
+	selector, path, err := parseFleetPath(req.URL.EscapedPath())
+	if err != nil {
+		p.handleError(rw, req, apierrors.NewBadRequest(fmt.Sprintf("invalid fleet path: %s", err)))
+		return
+	}
+
+	infoReq := req.Clone(req.Context())
+	infoReq.URL.Path, infoReq.URL.RawPath = path, ""
+	reqInfo, err := p.requestInfo.NewRequestInfo(infoReq)
+	if err != nil {
+		p.handleError(rw, req, err)
+		return
+	}
+
+	if !reqInfo.IsResourceRequest || len(reqInfo.Subresource) > 0 ||
+		(reqInfo.Verb != "get" && reqInfo.Verb != "list") {
+		p.handleError(rw, req, apierrors.NewBadRequest("fleet requests only support get and list of resources"))
+		return
+	}
+
+	// Pages can't be merged across clusters, so every cluster is listed in
+	// full. The limit is ignored as kubectl sets it by default, but no
+	// continue token is ever returned.
+	if len(req.URL.Query().Get("continue")) > 0 {
+		p.handleError(rw, req, apierrors.NewBadRequest("fleet lists are not paginated, continue is not supported"))
+		return
+	}
+
+	release, ok := p.fleetInFlight.Acquire("", user.GetName(), maxinflight.NonMutating)
+	if !ok {
+		p.handleError(rw, req, apierrors.NewTooManyRequests(
+			"too many fleet requests in flight, please try again later", 1))
+		return
+	}
+	defer release()
+
+	var clusters []*cluster.Cluster
+	for _, c := range p.accessibleClusters(req, user) {
+		if selector.Matches(labels.Set(c.Labels)) {
+			clusters = append(clusters, c)
+		}
+	}
+
+	table := strings.Contains(req.Header.Get("Accept"), "as=Table")
+
+	ctx, cancel := gocontext.WithCancel(req.Context())
+	defer cancel()
+	budget := &fleetBudget{cancel: cancel}
+	budget.remaining.Store(fleetMaxResponseSize)
+
+	results := make([]fleetResult, len(clusters))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, fleetMaxConcurrency)
+	for i, c := range clusters {
+		wg.Add(1)
+		go func(i int, c *cluster.Cluster) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = p.fleetRequest(req.WithContext(ctx), handler, c.Name, path, table, budget)
+		}(i, c)
+	}
+	wg.Wait()
+
+	if budget.exceeded.Load() {
+		p.handleError(rw, req, apierrors.NewBadRequest(fmt.Sprintf(
+			"fleet response exceeds %d bytes; fleet lists are not paginated, so narrow the "+
+				"request with a cluster, namespace, label or field selector", fleetMaxResponseSize)))
+		return
+	}
+
+	if len(results) > 0 {
+		context.SetAuthPath(req, results[0].labels.AuthPath)
+	}
+	// The resource is only labelled if a cluster authorized the request
+	for _, result := range results {
+		if len(result.labels.Verb) > 0 {
+			context.SetRequestResource(req, result.labels.Verb, result.labels.Resource)
+			break
+		}
+	}
+
+	var body interface{}
+	var failures []FleetFailure
+	if table {
+		var merged metav1.Table
+		merged, failures = mergeTables(results)
+		body = &fleetTable{Table: merged, Failures: failures}
+	} else {
+		var items []map[string]interface{}
+		items, failures = mergeLists(results)
+		body = &fleetList{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "List"},
+			Items:    items,
+			Failures: failures,
+		}
+	}
+
+	for _, failure := range failures {
+		warning, err := utilnet.NewWarningHeader(299, "-", failure.Error())
+		if err != nil {
+			klog.Errorf("failed to create warning for cluster %q: %s", failure.Cluster, err)
+			continue
+		}
+		rw.Header().Add("Warning", warning)
+	}
+
+	// The request fails if no cluster could be read
+	if len(clusters) > 0 && len(failures) == len(clusters) {
+		p.handleError(rw, req, failures[0].statusError())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		klog.Errorf("failed to write fleet response: %s", err)
+	}
+}
+
+// fleetRequest sends the request for the path to the cluster through the
+// cluster handler chain and buffers the response within the budget.
+func (p *Proxy) fleetRequest(req *http.Request, handler http.Handler, clusterName, path string, table bool, budget *fleetBudget) (result fleetResult) {
+	reqCtx, cancel := gocontext.WithTimeout(req.Context(), fleetRequestTimeout)
+	defer cancel()
+
+	subReq := req.Clone(reqCtx)
+	if p.config.ClusterRoutingMode == resolver.ModeHost {
+		subReq.Host = resolver.Hostname(p.config.ClusterHostTemplate, clusterName)
+		subReq.URL.Path = path
+	} else {
+		subReq.URL.Path = "/" + clusterName + path
+	}
+	subReq.URL.RawPath = ""
+	subReq.Body, subReq.ContentLength = http.NoBody, 0
+
+	// Pages can't be merged across clusters, so all items are listed at once
+	query := subReq.URL.Query()
+	query.Del("limit")
+	query.Del("continue")
+	subReq.URL.RawQuery = query.Encode()
+	subReq.RequestURI = subReq.URL.RequestURI()
+
+	// Responses are decoded to be merged
+	subReq.Header.Del("Accept-Encoding")
+	subReq.Header.Set("Accept", "application/json")
+	if table {
+		subReq.Header.Set("Accept", tableAccept)
+	}
+
+	requestMetrics := &context.RequestMetrics{AuthPath: metrics.AuthPathNone}
+	subReq = context.WithRequestMetrics(subReq, requestMetrics)
+
+	rec := &fleetBuffer{responseBuffer: responseBuffer{header: make(http.Header)}, budget: budget}
+	result = fleetResult{cluster: clusterName, response: &rec.responseBuffer}
+
+	// The reverse proxy aborts with a panic if it fails to copy the response,
+	// such as on timeout or once the budget is exceeded
+	defer func() {
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			result.response = &responseBuffer{header: make(http.Header)}
+			writeStatus(result.response, subReq, apierrors.NewTimeoutError(
+				fmt.Sprintf("failed to read the response of cluster %q", clusterName), 0))
+		}
+	}()
+
+	user, _ := genericapirequest.UserFrom(req.Context())
+	if err := p.checkClusterAccess(subReq, clusterName, user); err != nil {
+		p.handleError(rec, subReq, err)
+		return result
+	}
+
+	handler.ServeHTTP(rec, subReq)
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+
+	result.labels = *requestMetrics
+	return result
+}
+
+// mergeTables merges the Tables returned by the clusters, prepending a column
+// with the cluster of each row.
+func mergeTables(results []fleetResult) (metav1.Table, []FleetFailure) {
+	merged := metav1.Table{
+		TypeMeta: metav1.TypeMeta{APIVersion: "meta.k8s.io/v1", Kind: "Table"},
+		Rows:     []metav1.TableRow{},
+	}
+
+	var columns []metav1.TableColumnDefinition
+	var failures []FleetFailure
+	for _, result := range results {
+		if result.response.code != http.StatusOK {
+			failures = append(failures, newFleetFailure(result))
+			continue
+		}
+
+		var table metav1.Table
+		if err := json.Unmarshal(result.response.body.Bytes(), &table); err != nil || table.Kind != "Table" {
+			failures = append(failures, invalidFleetResponse(result.cluster, "expected a Table"))
+			continue
+		}
+
+		// Rows can only be merged if the clusters print the same columns
+		if columns == nil {
+			columns = table.ColumnDefinitions
+		} else if !equalColumns(columns, table.ColumnDefinitions) {
+			failures = append(failures, invalidFleetResponse(result.cluster, "the table columns differ from other clusters"))
+			continue
+		}
+
+		for _, row := range table.Rows {
+			row.Cells = append([]interface{}{result.cluster}, row.Cells...)
+			row.Object.Raw = annotateRawObject(row.Object.Raw, result.cluster)
+			merged.Rows = append(merged.Rows, row)
+		}
+	}
+
+	merged.ColumnDefinitions = append([]metav1.TableColumnDefinition{clusterColumn}, columns...)
+	return merged, failures
+}
+
+// mergeLists merges the items of the Lists, or the single objects, returned
+// by the clusters.
+func mergeLists(results []fleetResult) ([]map[string]interface{}, []FleetFailure) {
+	items := []map[string]interface{}{}
+
+	var failures []FleetFailure
+	for _, result := range results {
+		if result.response.code != http.StatusOK {
+			failures = append(failures, newFleetFailure(result))
+			continue
+		}
+
+		var obj map[string]interface{}
+		if err := json.Unmarshal(result.response.body.Bytes(), &obj); err != nil {
+			failures = append(failures, invalidFleetResponse(result.cluster, err.Error()))
+			continue
+		}
+
+		list := unstructured.Unstructured{Object: obj}
+		if !list.IsList() {
+			setClusterAnnotation(obj, result.cluster)
+			items = append(items, obj)
+			continue
+		}
+
+		// Items of typed lists, such as a PodList, have no kind
+		itemKind := strings.TrimSuffix(list.GetKind(), "List")
+		for _, rawItem := range obj["items"].([]interface{}) {
+			item, ok := rawItem.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			if _, ok := item["kind"]; !ok {
+				item["kind"] = itemKind
+				item["apiVersion"] = list.GetAPIVersion()
+			}
+
+			setClusterAnnotation(item, result.cluster)
+			items = append(items, item)
+		}
+	}
+
+	return items, failures
+}
+
+func equalColumns(a, b []metav1.TableColumnDefinition) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Type != b[i].Type {
+			return false
+		}
+	}
+
+	return true
+}
+
+// annotateRawObject sets the cluster annotation on the object of a Table row,
+// if included.
+func annotateRawObject(raw []byte, clusterName string) []byte {
+	if len(raw) == 0 {
+		return raw
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return raw
+	}
+	setClusterAnnotation(obj, clusterName)
+
+	annotated, err := json.Marshal(obj)
+	if err != nil {
+		return raw
+	}
+
+	return annotated
+}
+
+func setClusterAnnotation(obj map[string]interface{}, clusterName string) {
+	u := unstructured.Unstructured{Object: obj}
+
+	annotations := u.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[FleetClusterAnnotation] = clusterName
+
+	u.SetAnnotations(annotations)
+}
+
+// newFleetFailure returns the failure of a cluster's error response.
+func newFleetFailure(result fleetResult) FleetFailure {
+	failure := FleetFailure{
+		Cluster: result.cluster,
+		Code:    int32(result.response.code),
+		Message: http.StatusText(result.response.code),
+	}
+
+	var status metav1.Status
+	if err := json.Unmarshal(result.response.body.Bytes(), &status); err == nil && status.Kind == "Status" {
+		failure.Reason = status.Reason
+		if len(status.Message) > 0 {
+			failure.Message = status.Message
+		}
+	}
+
+	return failure
+}
+
+// invalidFleetResponse returns the failure of a cluster whose response can't
+// be merged.
+func invalidFleetResponse(clusterName, message string) FleetFailure {
+	return FleetFailure{
+		Cluster: clusterName,
+		Code:    http.StatusInternalServerError,
+		Reason:  metav1.StatusReasonInternalError,
+		Message: fmt.Sprintf("invalid response: %s", message),
+	}
+}
+
+func (f FleetFailure) Error() string {
+	return fmt.Sprintf("cluster %q: %s", f.Cluster, f.Message)
+}
+
+func (f FleetFailure) statusError() error {
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    f.Code,
+		Reason:  f.Reason,
+		Message: f.Error(),
+	}}
+}
@@ -2,33 +2,64 @@
 package proxy
 
 import (
+	gocontext "context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
-
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/request/headerrequest"
 	authuser "k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
 	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
 	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	genericfilters "k8s.io/apiserver/pkg/server/filters"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/transport"
+	"k8s.io/component-base/tracing"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/kubeapiserver/admission/exclusion"
 
 	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/audit"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/breakglass"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/claims"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/denyrules"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/execpolicy"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/logging"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/maxinflight"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/ratelimit"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/subjectaccessreview"
+	"github.com/Improwised/kube-oidc-proxy/pkg/util"
 )
 
 func (p *Proxy) withHandlers(handler http.Handler) http.Handler {
 	// Set up proxy handlers
 
+	handler = p.withSessionRecording(handler)
+	handler = p.withDiscoveryCache(handler)
 	handler = p.auditor.WithCustomAuditLog(handler)
 	// handler = p.auditor.WithRequest(handler)
+	handler = p.withExecPolicy(handler)
+	handler = p.withMaxInFlight(handler)
 	handler = p.WithRBACHandler(handler)
 	handler = p.withImpersonateRequest(handler)
+	handler = p.withRateLimit(handler)
+	handler = p.withProxyEndpoints(handler)
+	handler = p.withBreakGlass(handler)
 	handler = p.withAuthenticateRequest(handler)
+	handler = p.withMetrics(handler)
+	handler = tracing.WithTracing(handler, p.tracerProvider(), "KubeOIDCProxy")
 
 	// Add the auditor backend as a shutdown hook
 	p.hooks.AddPreShutdownHook("AuditBackend", p.auditor.Shutdown)
@@ -39,11 +70,10 @@ func (p *Proxy) withHandlers(handler http.Handler) http.Handler {
 func (p *Proxy) WithRBACHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 
-		clusterName := p.GetClusterName(req.URL.Path)
+		clusterName := p.GetClusterName(req)
 		ClusterConfig := p.clusterManager.GetCluster(clusterName)
-		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/"+clusterName)
 
-		reqInfo, err := p.requestInfo.NewRequestInfo(req)
+		reqInfo, err := p.newRequestInfo(req)
 		if err != nil {
 			p.handleError(rw, req, err)
 			return
@@ -58,7 +88,7 @@ func (p *Proxy) WithRBACHandler(handler http.Handler) http.Handler {
 		// Group: "authorization.k8s.io", Resource: "subjectaccessreviews",
 		for _, groupResource := range exclusion.Excluded() {
 			if groupResource.Group == reqInfo.APIGroup && groupResource.Resource == reqInfo.Resource {
-				req.URL.Path = "/" + clusterName + req.URL.Path
+				context.SetRequestResource(req, reqInfo.Verb, reqInfo.Resource)
 				handler.ServeHTTP(rw, req)
 				return
 			}
@@ -69,8 +99,31 @@ func (p *Proxy) WithRBACHandler(handler http.Handler) http.Handler {
 
 		// validate resource request
 		if reqInfo.IsResourceRequest {
-			authHandler := genericapifilters.WithAuthorization(handler, ClusterConfig.Authorizer, scheme.Codecs)
-			req.URL.Path = "/" + clusterName + req.URL.Path
+			authz := authorizer.AuthorizerFunc(func(ctx gocontext.Context, a authorizer.Attributes) (authorizer.Decision, string, error) {
+				ctx, span := tracing.Start(ctx, "RBAC", attribute.String("cluster", clusterName))
+				defer span.End(util.TraceLogThreshold)
+
+				// Deny rules override RBAC
+				if p.denyRules != nil {
+					if rule, ok := p.denyRules.Match(clusterName, a); ok {
+						p.auditDenyRule(ctx, req, clusterName, a, rule)
+						return authorizer.DecisionDeny, denyrules.Reason(rule), nil
+					}
+				}
+
+				decision, reason, err := ClusterConfig.Authorizer.Authorize(ctx, a)
+				if decision != authorizer.DecisionAllow {
+					metrics.AuthorizationFailures.WithLabelValues(clusterName, metrics.ReasonRBAC).Inc()
+					return decision, reason, err
+				}
+
+				// Only authorized resources become metrics labels, so arbitrary
+				// paths can't create new series
+				context.SetRequestResource(req, a.GetVerb(), a.GetResource())
+				return decision, reason, err
+			})
+
+			authHandler := genericapifilters.WithAuthorization(handler, authz, scheme.Codecs)
 			authHandler.ServeHTTP(rw, req)
 			return
 		}
@@ -78,19 +131,56 @@ func (p *Proxy) WithRBACHandler(handler http.Handler) http.Handler {
 		// Eg. non resource request
 		// 		/api
 		//		/version etc..
-		req.URL.Path = "/" + clusterName + req.URL.Path
+		context.SetRequestResource(req, metrics.NonResourceVerb(reqInfo.Verb), "")
 		handler.ServeHTTP(rw, req)
 
 	})
 }
 
+// auditDenyRule records a request denied by a deny rule.
+func (p *Proxy) auditDenyRule(ctx gocontext.Context, req *http.Request, clusterName string, a authorizer.Attributes, rule *denyrules.Rule) {
+	klog.V(2).Infof("request to cluster %q %s (%s)", clusterName, denyrules.Reason(rule), req.RemoteAddr)
+	metrics.AuthorizationFailures.WithLabelValues(clusterName, metrics.ReasonDenyRule).Inc()
+
+	log := audit.Log{
+		ClusterName:       clusterName,
+		IsResourceRequest: true,
+		RequestPath:       req.URL.Path,
+		Verb:              a.GetVerb(),
+		APIGroup:          a.GetAPIGroup(),
+		APIVersion:        a.GetAPIVersion(),
+		Namespace:         a.GetNamespace(),
+		Resource:          a.GetResource(),
+		SubResource:       a.GetSubresource(),
+		Name:              a.GetName(),
+		Event:             audit.EventDenyRuleDenied,
+		Reason:            denyrules.Reason(rule),
+	}
+	if user := a.GetUser(); user != nil {
+		log.Email, log.UID, log.Groups, log.Extra = user.GetName(), user.GetUID(), user.GetGroups(), user.GetExtra()
+	}
+	p.auditor.SendAuditLog(ctx, log)
+}
+
 // withAuthenticateRequest adds the proxy authentication handler to a chain.
 func (p *Proxy) withAuthenticateRequest(handler http.Handler) http.Handler {
 	tokenReviewHandler := p.withTokenReview(handler)
 
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Keep the token as the authenticator removes it from the request
+		req = context.WithBearerToken(req, req.Header)
+
 		// Auth request and handle unauthed
-		info, ok, err := p.oidcRequestAuther.AuthenticateRequest(req)
+		traceCtx, span := tracing.Start(req.Context(), "Authenticate")
+		info, ok, err := p.requestAuther.AuthenticateRequest(req.WithContext(traceCtx))
+		span.End(util.TraceLogThreshold)
+
+		// The front proxy's headers are never forwarded to the clusters
+		if rh := p.config.RequestHeader; rh != nil {
+			headerrequest.ClearAuthenticationHeaders(req.Header,
+				rh.UsernameHeaders, rh.UIDHeaders, rh.GroupHeaders, rh.ExtraHeaderPrefixes)
+		}
+
 		if err != nil {
 			klog.V(5).Infof("Authenticated request failed: %s", err)
 			// Since we have failed OIDC auth, we will try a token review, if enabled.
@@ -104,6 +194,15 @@ func (p *Proxy) withAuthenticateRequest(handler http.Handler) http.Handler {
 			return
 		}
 
+		// Reject requests to unknown clusters, tokens from issuers restricted
+		// to other clusters, or missing claims required by the cluster
+		if !isProxyEndpoint(req.URL.Path) {
+			if err := p.checkClusterAccess(req, p.GetClusterName(req), info.User); err != nil {
+				p.handleError(rw, req, err)
+				return
+			}
+		}
+
 		var remoteAddr string
 		req, remoteAddr = context.RemoteAddr(req)
 
@@ -115,6 +214,335 @@ func (p *Proxy) withAuthenticateRequest(handler http.Handler) http.Handler {
 	})
 }
 
+// checkClusterAccess returns an error if the cluster is unknown, the token
+// issuer is restricted to other clusters or the token is missing claims
+// required by the cluster.
+func (p *Proxy) checkClusterAccess(req *http.Request, clusterName string, user authuser.Info) error {
+	if p.clusterManager.GetCluster(clusterName) == nil {
+		return errClusterNotFound(clusterName)
+	}
+
+	if !p.issuerAllowsCluster(req, clusterName) {
+		klog.V(4).Infof("token issuer is not allowed for cluster %q", clusterName)
+		return errUnauthorized
+	}
+
+	if err := p.checkRequiredClaims(req, clusterName); err != nil {
+		metrics.AuthorizationFailures.WithLabelValues(clusterName, metrics.ReasonRequiredClaims).Inc()
+		p.auditor.SendAuditLog(req.Context(), audit.Log{
+			ClusterName: clusterName,
+			Email:       user.GetName(),
+			UID:         user.GetUID(),
+			Groups:      user.GetGroups(),
+			Extra:       user.GetExtra(),
+			RequestPath: req.URL.Path,
+			Event:       audit.EventRequiredClaimsDenied,
+			Reason:      err.Error(),
+		})
+		return err
+	}
+
+	return nil
+}
+
+// isLongRunning returns whether the request is long-running, such as a watch,
+// exec or following logs.
+var isLongRunning = genericfilters.BasicLongRunningRequestCheck(
+	sets.NewString("watch", "proxy"),
+	sets.NewString("attach", "exec", "proxy", "log", "portforward"),
+)
+
+// nonMutatingVerbs are the verbs of requests that only read resources.
+var nonMutatingVerbs = sets.NewString("get", "list", "watch")
+
+// withMaxInFlight rejects requests once the cluster or the authenticated user
+// has too many requests of the same kind in flight. It uses the request info
+// added by WithRBACHandler.
+func (p *Proxy) withMaxInFlight(handler http.Handler) http.Handler {
+	if p.maxInFlight == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		reqInfo, ok := genericapirequest.RequestInfoFrom(req.Context())
+		if !ok {
+			// Excluded resources are passed on without request info
+			var err error
+			if reqInfo, err = p.newRequestInfo(req); err != nil {
+				p.handleError(rw, req, err)
+				return
+			}
+		}
+
+		kind := maxinflight.NonMutating
+		switch {
+		case isLongRunning(req, reqInfo):
+			kind = maxinflight.LongRunning
+		case !nonMutatingVerbs.Has(reqInfo.Verb):
+			kind = maxinflight.Mutating
+		}
+
+		clusterName := p.GetClusterName(req)
+		release, ok := p.maxInFlight.Acquire(clusterName, inboundUserName(req), kind)
+		if !ok {
+			p.handleError(rw, req, apierrors.NewTooManyRequests(
+				fmt.Sprintf("too many %s requests in flight for cluster %q, please try again later", kind, clusterName), 1))
+			return
+		}
+		defer release()
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// inboundUserName returns the name of the authenticated user, before any
+// impersonation, or an empty string for token passthrough requests.
+func inboundUserName(req *http.Request) string {
+	if conf := context.ImpersonationConfig(req); conf != nil && conf.InboundUser != nil && *conf.InboundUser != nil {
+		return (*conf.InboundUser).GetName()
+	}
+
+	if context.NoImpersonation(req) {
+		if user, ok := genericapirequest.UserFrom(req.Context()); ok {
+			return user.GetName()
+		}
+	}
+
+	return ""
+}
+
+// withRateLimit rejects requests exceeding the rate limits of the
+// authenticated user, their groups or the cluster.
+func (p *Proxy) withRateLimit(handler http.Handler) http.Handler {
+	if p.rateLimiter == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		clusterName := p.GetClusterName(req)
+
+		// Token passthrough requests have no user, so only cluster limits apply
+		user, _ := genericapirequest.UserFrom(req.Context())
+
+		retryAfter, ok := p.rateLimiter.Allow(clusterName, user)
+		if !ok {
+			p.handleError(rw, req, apierrors.NewTooManyRequests(
+				fmt.Sprintf("rate limit exceeded for cluster %q, retry after %s", clusterName, retryAfter),
+				ratelimit.RetryAfterSeconds(retryAfter)))
+			return
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// allowProxyEndpoint applies the user's rate limits to a request to an
+// endpoint of the proxy itself. It writes the error and returns false if the
+// request is rejected.
+func (p *Proxy) allowProxyEndpoint(rw http.ResponseWriter, req *http.Request) bool {
+	if p.rateLimiter == nil {
+		return true
+	}
+
+	user, _ := genericapirequest.UserFrom(req.Context())
+
+	retryAfter, ok := p.rateLimiter.AllowEndpoint(user)
+	if !ok {
+		p.handleError(rw, req, apierrors.NewTooManyRequests(
+			fmt.Sprintf("rate limit exceeded for %s, retry after %s", req.URL.Path, retryAfter),
+			ratelimit.RetryAfterSeconds(retryAfter)))
+		return false
+	}
+
+	return true
+}
+
+// withBreakGlass removes the break-glass group from users whose request has
+// no justification. Justified requests are counted against the user's
+// break-glass sessions, and audited with a high severity.
+func (p *Proxy) withBreakGlass(handler http.Handler) http.Handler {
+	if p.breakGlass == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Token passthrough requests have no user
+		user, ok := genericapirequest.UserFrom(req.Context())
+		if !ok {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		reason := breakglass.Reason(req, user)
+		if !p.breakGlass.IsMember(user) {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		if len(reason) == 0 {
+			req = req.WithContext(genericapirequest.WithUser(req.Context(), p.breakGlass.WithoutGroup(user)))
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		clusterName := p.GetClusterName(req)
+		log := audit.Log{
+			ClusterName: clusterName,
+			Email:       user.GetName(),
+			UID:         user.GetUID(),
+			Groups:      user.GetGroups(),
+			Extra:       user.GetExtra(),
+			RequestPath: req.URL.Path,
+			Reason:      reason,
+			Severity:    audit.SeverityHigh,
+		}
+
+		session, started, retryAfter, ok := p.breakGlass.Use(user.GetName(), reason)
+		if !ok {
+			metrics.AuthorizationFailures.WithLabelValues(p.metricsCluster(req), metrics.ReasonBreakGlass).Inc()
+			log.Event = audit.EventBreakGlassDenied
+			p.auditor.SendAuditLog(req.Context(), log)
+			p.handleError(rw, req, apierrors.NewTooManyRequests(
+				fmt.Sprintf("break-glass session limit reached for user %q, retry after %s", user.GetName(), retryAfter.Round(time.Second)),
+				ratelimit.RetryAfterSeconds(retryAfter)))
+			return
+		}
+
+		if started {
+			klog.Warningf("user %q started a break-glass session until %s: %s",
+				user.GetName(), session.Expires.Format(time.RFC3339), reason)
+			log.Event = audit.EventBreakGlassActivated
+			p.auditor.SendAuditLog(req.Context(), log)
+			p.notifyBreakGlass(req, user, session, clusterName)
+		}
+
+		// Every use of the session is recorded, whether or not the request
+		// is then allowed
+		log.Event = audit.EventBreakGlassRequest
+		p.auditor.SendAuditLog(req.Context(), log)
+
+		req = req.WithContext(genericapirequest.WithUser(req.Context(), breakglass.WithReason(user, reason)))
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// notifyBreakGlass posts the start of a break-glass session to the
+// notification webhook, without delaying the request.
+func (p *Proxy) notifyBreakGlass(req *http.Request, user authuser.Info, session breakglass.Session, clusterName string) {
+	if p.breakGlassNotify == nil {
+		return
+	}
+
+	notification := breakglass.Notification{
+		User:        user.GetName(),
+		Groups:      user.GetGroups(),
+		Reason:      session.Reason,
+		ClusterName: clusterName,
+		RequestPath: req.URL.Path,
+		Start:       session.Start,
+		Expires:     session.Expires,
+	}
+
+	go func() {
+		if err := p.breakGlassNotify.Notify(gocontext.Background(), notification); err != nil {
+			klog.Errorf("failed to send break-glass notification for user %q: %s", notification.User, err)
+		}
+	}()
+}
+
+// withExecPolicy rejects pods/exec and pods/attach requests whose command is
+// not allowed by the exec policy. It uses the request info added by WithRBACHandler, so only
+// requests allowed by RBAC are checked.
+func (p *Proxy) withExecPolicy(handler http.Handler) http.Handler {
+	if p.execPolicy == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		reqInfo, ok := genericapirequest.RequestInfoFrom(req.Context())
+		if !ok {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		if !reqInfo.IsResourceRequest || reqInfo.Resource != "pods" ||
+			(reqInfo.Subresource != "exec" && reqInfo.Subresource != "attach") {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		// Attach requests run no command
+		command := audit.ExecCommand(req, reqInfo)
+
+		clusterName := p.GetClusterName(req)
+
+		// Token passthrough requests have no user, so only rules without
+		// groups apply
+		user, _ := genericapirequest.UserFrom(req.Context())
+
+		if err := p.execPolicy.Check(clusterName, user, command); err != nil {
+			metrics.AuthorizationFailures.WithLabelValues(clusterName, metrics.ReasonExecPolicy).Inc()
+
+			log := audit.Log{
+				ClusterName:       clusterName,
+				IsResourceRequest: true,
+				RequestPath:       req.URL.Path,
+				Verb:              reqInfo.Verb,
+				Namespace:         reqInfo.Namespace,
+				Resource:          reqInfo.Resource,
+				SubResource:       reqInfo.Subresource,
+				Name:              reqInfo.Name,
+				Command:           command,
+				Event:             audit.EventExecCommandDenied,
+				Reason:            err.Error(),
+			}
+			if user != nil {
+				log.Email, log.UID, log.Groups, log.Extra = user.GetName(), user.GetUID(), user.GetGroups(), user.GetExtra()
+			}
+			p.auditor.SendAuditLog(req.Context(), log)
+
+			p.handleError(rw, req, err)
+			return
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// issuerAllowsCluster returns whether the issuer of the request's token is
+// accepted for the given cluster. Requests authenticated by their client
+// certificate carry no token and are not restricted.
+func (p *Proxy) issuerAllowsCluster(req *http.Request, clusterName string) bool {
+	if p.issuers == nil || len(context.BearerToken(req)) == 0 {
+		return true
+	}
+
+	token, _ := util.ParseBearerToken(context.BearerToken(req))
+	return p.issuers.AllowsCluster(token, clusterName)
+}
+
+// checkRequiredClaims ensures the request's token carries the claims required
+// by the cluster policy. Requests without a token, authenticated by a client
+// certificate or a front proxy, have no claims to check and are denied unless
+// the policy allows them.
+func (p *Proxy) checkRequiredClaims(req *http.Request, clusterName string) error {
+	if p.requiredClaims == nil {
+		return nil
+	}
+
+	if len(context.BearerToken(req)) == 0 {
+		return p.requiredClaims.CheckWithoutToken(clusterName)
+	}
+
+	token, _ := util.ParseBearerToken(context.BearerToken(req))
+	tokenClaims, err := util.UnverifiedClaims(token)
+	if err != nil {
+		return fmt.Errorf("%w: %s", claims.ErrRequiredClaim, err)
+	}
+
+	return p.requiredClaims.Check(clusterName, tokenClaims)
+}
+
 // withTokenReview will attempt a token review on the incoming request, if
 // enabled.
 func (p *Proxy) withTokenReview(handler http.Handler) http.Handler {
@@ -134,6 +562,7 @@ func (p *Proxy) withTokenReview(handler http.Handler) http.Handler {
 
 		// Set no impersonation headers and re-add removed headers.
 		req = context.WithNoImpersonation(req)
+		context.SetAuthPath(req, metrics.AuthPathTokenPassthrough)
 
 		handler.ServeHTTP(rw, req)
 	})
@@ -159,6 +588,7 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 			klog.V(2).Infof("passing on request with no impersonation: %s", remoteAddr)
 			// Indicate we need to not use impersonation.
 			req = context.WithNoImpersonation(req)
+			context.SetAuthPath(req, metrics.AuthPathNoImpersonation)
 			handler.ServeHTTP(rw, req)
 			return
 		}
@@ -166,6 +596,7 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 		user, ok := genericapirequest.UserFrom(req.Context())
 		// No name available so reject request
 		if !ok || len(user.GetName()) == 0 {
+			metrics.AuthorizationFailures.WithLabelValues(p.GetClusterName(req), metrics.ReasonNoUsername).Inc()
 			p.handleError(rw, req, errNoName)
 			return
 		}
@@ -175,9 +606,18 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 		if p.hasImpersonation(req.Header) {
 			// if impersonation headers are present, let's check to see
 			// if the user is authorized to perform the impersonation
-			target, err := p.clusterManager.GetCluster(p.GetClusterName(req.URL.Path)).SubjectAccessReviewer.CheckAuthorizedForImpersonation(req, user)
+			traceCtx, span := tracing.Start(req.Context(), "Impersonation")
+			traceReq := req.WithContext(traceCtx)
+			target, err := p.clusterManager.GetCluster(p.GetClusterName(req)).SubjectAccessReviewer.CheckAuthorizedForImpersonation(traceReq, user)
+			span.End(util.TraceLogThreshold)
+
+			// Keep the headers with the impersonation headers removed
+			req.Header = traceReq.Header
 
 			if err != nil {
+				if apierrors.IsForbidden(err) {
+					metrics.AuthorizationFailures.WithLabelValues(p.GetClusterName(req), metrics.ReasonImpersonation).Inc()
+				}
 				p.handleError(rw, req, err)
 				return
 			}
@@ -268,6 +708,7 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 
 		// Add the impersonation configuration to the context.
 		req = context.WithImpersonationConfig(req, conf)
+		context.SetAuthPath(req, metrics.AuthPathOIDC)
 		handler.ServeHTTP(rw, req)
 	})
 }
@@ -277,60 +718,89 @@ func (p *Proxy) newErrorHandler() func(rw http.ResponseWriter, r *http.Request,
 
 	unauthedHandler := audit.NewUnauthenticatedHandler(p.auditor, func(rw http.ResponseWriter, r *http.Request) {
 		klog.V(2).Infof("unauthenticated user request %s", r.RemoteAddr)
-		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		writeStatus(rw, r, apierrors.NewUnauthorized(errUnauthorized.Error()))
 	})
 
 	return func(rw http.ResponseWriter, r *http.Request, err error) {
 
 		if err == nil {
 			klog.Error("error was called with no error")
-			http.Error(rw, "", http.StatusInternalServerError)
+			writeStatus(rw, r, apierrors.NewInternalError(errors.New("unknown error")))
 			return
 		}
 
 		// regardless of reason, log failed auth
 		logging.LogFailedRequest(r)
 
-		switch err {
+		var status apierrors.APIStatus
+
+		switch {
 
 		// Failed auth
-		case errUnauthorized:
+		case errors.Is(err, errUnauthorized):
 			// If Unauthorized then error and report to audit
+			metrics.AuthenticationFailures.WithLabelValues(p.metricsCluster(r)).Inc()
 			unauthedHandler.ServeHTTP(rw, r)
-			return
 
 			// No name given or available in oidc request
-		case errNoName:
+		case errors.Is(err, errNoName):
 			klog.V(2).Infof("no name available in oidc info %s", r.RemoteAddr)
-			http.Error(rw, "Username claim not available in OIDC Issuer response", http.StatusForbidden)
-			return
+			writeStatus(rw, r, newForbidden("Username claim not available in OIDC Issuer response"))
 
 			// No impersonation configuration found in context
-		case cluster.ErrNoImpersonationConfig:
+		case errors.Is(err, cluster.ErrNoImpersonationConfig):
 			klog.Errorf("if you are seeing this, there is likely a bug in the proxy (%s): %s", r.RemoteAddr, err)
-			http.Error(rw, "", http.StatusInternalServerError)
-			return
+			writeStatus(rw, r, apierrors.NewInternalError(err))
 
 			// No impersonation user found
-		case subjectaccessreview.ErrorNoImpersonationUserFound:
-			http.Error(rw, subjectaccessreview.ErrorNoImpersonationUserFound.Error(), http.StatusInternalServerError)
-			return
+		case errors.Is(err, subjectaccessreview.ErrorNoImpersonationUserFound):
+			writeStatus(rw, r, apierrors.NewBadRequest(err.Error()))
 
-			// Server or unknown error
-		default:
+			// Token is missing claims required by the cluster
+		case errors.Is(err, claims.ErrRequiredClaim):
+			klog.V(2).Infof("%s (%s)", err, r.RemoteAddr)
+			writeStatus(rw, r, newForbidden(err.Error()))
 
-			if strings.Contains(err.Error(), "not allowed to impersonate") {
-				klog.V(2).Infof(err.Error(), r.RemoteAddr)
-				http.Error(rw, err.Error(), http.StatusForbidden)
-			} else {
-				klog.Errorf("unknown error (%s): %s", r.RemoteAddr, err)
-				http.Error(rw, err.Error(), http.StatusInternalServerError)
-			}
+			// Command is not allowed by the exec policy
+		case errors.Is(err, execpolicy.ErrCommandDenied):
+			klog.V(2).Infof("%s (%s)", err, r.RemoteAddr)
+			writeStatus(rw, r, newForbidden(err.Error()))
+
+			// Already a status, e.g. unknown cluster or impersonation denied
+		case errors.As(err, &status):
+			klog.V(2).Infof("%s (%s)", err, r.RemoteAddr)
+			writeStatus(rw, r, err)
 
+			// Server or unknown error
+		default:
+			klog.Errorf("unknown error (%s): %s", r.RemoteAddr, err)
+			writeStatus(rw, r, apierrors.NewInternalError(err))
 		}
 	}
 }
 
+// writeStatus writes the error as a metav1.Status, the same way the API
+// server does, so clients render proxy errors like API server errors.
+func writeStatus(rw http.ResponseWriter, r *http.Request, err error) {
+	responsewriters.ErrorNegotiated(err, scheme.Codecs, schema.GroupVersion{}, rw, r)
+}
+
+// newForbidden returns a Forbidden status error that is not specific to a
+// resource.
+func newForbidden(message string) error {
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusForbidden,
+		Reason:  metav1.StatusReasonForbidden,
+		Message: message,
+	}}
+}
+
+// errClusterNotFound returns the NotFound status error for an unknown cluster.
+func errClusterNotFound(clusterName string) error {
+	return apierrors.NewNotFound(schema.GroupResource{Resource: "clusters"}, clusterName)
+}
+
 func (p *Proxy) hasImpersonation(header http.Header) bool {
 	for h := range header {
 		if strings.HasPrefix(strings.ToLower(h), "impersonate-") {
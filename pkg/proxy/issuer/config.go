@@ -0,0 +1,118 @@
+package issuer
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+
+	apiserverv1beta1 "k8s.io/apiserver/pkg/apis/apiserver/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultUsernameClaim = "sub"
+	defaultSigningAlg    = "RS256"
+)
+
+// Config is the file format of the OIDC issuers configuration.
+type Config struct {
+	Issuers []IssuerConfig `json:"issuers"`
+}
+
+// IssuerConfig configures the authentication of tokens from a single OIDC
+// issuer.
+type IssuerConfig struct {
+	// URL of the issuer, which must match the 'iss' claim of its tokens.
+	URL string `json:"url"`
+	// Audiences accepted in the 'aud' claim. At least one is required.
+	Audiences []string `json:"audiences"`
+	// CAFile verifies the issuer's serving certificate. If empty, the host's
+	// root CA set is used.
+	CAFile string `json:"caFile,omitempty"`
+	// JWKSFile is a local JSON Web Key Set used to verify tokens instead of
+	// the keys published by the issuer. Discovery is skipped and the file is
+	// reloaded when it changes.
+	JWKSFile string `json:"jwksFile,omitempty"`
+
+	UsernameClaim  string `json:"usernameClaim,omitempty"`
+	UsernamePrefix string `json:"usernamePrefix,omitempty"`
+	GroupsClaim    string `json:"groupsClaim,omitempty"`
+	GroupsPrefix   string `json:"groupsPrefix,omitempty"`
+
+	SigningAlgs []string `json:"signingAlgs,omitempty"`
+
+	// RequiredClaims must be present in the token with a matching value.
+	RequiredClaims map[string]string `json:"requiredClaims,omitempty"`
+
+	// ClaimMappings may use CEL expressions to map claims to the username,
+	// groups, UID and extra attributes of the user. Each mapping that is set
+	// takes precedence over the claim and prefix fields above.
+	ClaimMappings *apiserverv1beta1.ClaimMappings `json:"claimMappings,omitempty"`
+	// ClaimValidationRules are applied to the token claims before mapping,
+	// e.g. to reject tokens with an unverified email.
+	ClaimValidationRules []apiserverv1beta1.ClaimValidationRule `json:"claimValidationRules,omitempty"`
+	// UserValidationRules are applied to the mapped user.
+	UserValidationRules []apiserverv1beta1.UserValidationRule `json:"userValidationRules,omitempty"`
+
+	// Clusters restricts the issuer to clusters matching one of these glob
+	// patterns, e.g. "prod-*". If empty, the issuer is accepted for every
+	// cluster.
+	Clusters []string `json:"clusters,omitempty"`
+}
+
+// LoadConfig reads and validates an issuers configuration file.
+func LoadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OIDC issuers config: %w", err)
+	}
+
+	config := new(Config)
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse OIDC issuers config %q: %w", file, err)
+	}
+
+	for i := range config.Issuers {
+		config.Issuers[i].setDefaults()
+		if err := config.Issuers[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid issuer %d in %q: %w", i, file, err)
+		}
+	}
+
+	return config, nil
+}
+
+func (i *IssuerConfig) setDefaults() {
+	if len(i.UsernameClaim) == 0 {
+		i.UsernameClaim = defaultUsernameClaim
+	}
+
+	if len(i.SigningAlgs) == 0 {
+		i.SigningAlgs = []string{defaultSigningAlg}
+	}
+}
+
+// Validate ensures the issuer configuration is complete.
+func (i *IssuerConfig) Validate() error {
+	u, err := url.Parse(i.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %w", i.URL, err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("url %q must use the https scheme", i.URL)
+	}
+
+	if len(i.Audiences) == 0 {
+		return errors.New("at least one audience is required")
+	}
+
+	for _, pattern := range i.Clusters {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid cluster pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
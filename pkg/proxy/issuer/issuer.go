@@ -0,0 +1,297 @@
+// Package issuer authenticates OIDC tokens against one of several configured
+// issuers, selected by the token's 'iss' claim.
+package issuer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"k8s.io/apiserver/pkg/apis/apiserver"
+	apiserverv1beta1 "k8s.io/apiserver/pkg/apis/apiserver/v1beta1"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/plugin/pkg/authenticator/token/oidc"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/util"
+)
+
+// issuerTimeout bounds requests to the issuer for discovery and keys.
+const issuerTimeout = time.Second * 30
+
+// Issuer is a token authenticator for a single OIDC issuer.
+type Issuer struct {
+	authenticator.Token
+
+	config IssuerConfig
+
+	// healthCheck returns an error until the authenticator is initialized.
+	healthCheck func() error
+
+	keySet      *jwksKeySet
+	jwksWatcher *util.FileWatcher
+	caWatcher   *util.FileWatcher
+}
+
+// New builds the token authenticator for an issuer.
+func New(ctx context.Context, config IssuerConfig) (*Issuer, error) {
+	usernamePrefix := config.UsernamePrefix
+	groupsPrefix := config.GroupsPrefix
+
+	jwtConfig := apiserver.JWTAuthenticator{
+		Issuer: apiserver.Issuer{
+			URL:                 config.URL,
+			Audiences:           config.Audiences,
+			AudienceMatchPolicy: apiserver.AudienceMatchPolicyMatchAny,
+		},
+
+		ClaimMappings: apiserver.ClaimMappings{
+			Username: apiserver.PrefixedClaimOrExpression{
+				Claim:  config.UsernameClaim,
+				Prefix: &usernamePrefix,
+			},
+			Groups: apiserver.PrefixedClaimOrExpression{
+				Claim:  config.GroupsClaim,
+				Prefix: &groupsPrefix,
+			},
+			UID: apiserver.ClaimOrExpression{
+				Claim: "sub",
+			},
+		},
+	}
+
+	// required claims are checked in a stable order
+	claimNames := make([]string, 0, len(config.RequiredClaims))
+	for claim := range config.RequiredClaims {
+		claimNames = append(claimNames, claim)
+	}
+	sort.Strings(claimNames)
+	for _, claim := range claimNames {
+		jwtConfig.ClaimValidationRules = append(jwtConfig.ClaimValidationRules, apiserver.ClaimValidationRule{
+			Claim:         claim,
+			RequiredValue: config.RequiredClaims[claim],
+		})
+	}
+
+	if err := applyExpressions(&jwtConfig, config); err != nil {
+		return nil, fmt.Errorf("invalid claim mappings for issuer %q: %w", config.URL, err)
+	}
+
+	i := &Issuer{
+		config: config,
+	}
+
+	opts := oidc.Options{
+		SupportedSigningAlgs: config.SigningAlgs,
+		JWTAuthenticator:     jwtConfig,
+	}
+
+	// Without a CA the host's root CA set is used. Otherwise the CA file is
+	// watched and the transport to the issuer replaced when it changes.
+	if len(config.CAFile) > 0 {
+		transport := new(caTransport)
+		i.caWatcher = util.NewFileWatcher(config.CAFile, transport.load)
+		opts.Client = &http.Client{Transport: transport, Timeout: issuerTimeout}
+	}
+
+	// With a local key set the authenticator is initialized synchronously and
+	// never contacts the issuer.
+	if len(config.JWKSFile) > 0 {
+		i.keySet = new(jwksKeySet)
+		i.jwksWatcher = util.NewFileWatcher(config.JWKSFile, i.keySet.load)
+		opts.KeySet = i.keySet
+	}
+
+	tokenAuther, err := oidc.New(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create authenticator for issuer %q: %w", config.URL, err)
+	}
+	i.Token = tokenAuther
+	i.healthCheck = tokenAuther.HealthCheck
+
+	return i, nil
+}
+
+// Run watches the issuer's local files for changes until stopCh is closed.
+func (i *Issuer) Run(stopCh <-chan struct{}) {
+	if i.jwksWatcher != nil {
+		i.jwksWatcher.Run(util.DefaultFileWatchInterval, stopCh)
+	}
+
+	if i.caWatcher != nil {
+		i.caWatcher.Run(util.DefaultFileWatchInterval, stopCh)
+	}
+}
+
+// Ready returns an error if the issuer's CA file failed to load, if it is not
+// able to verify tokens from its local key set, or if discovery of the issuer
+// has not succeeded yet.
+func (i *Issuer) Ready() error {
+	if i.caWatcher != nil {
+		if err := i.caWatcher.Err(); err != nil {
+			return err
+		}
+	}
+
+	if i.keySet != nil {
+		if err := i.keySet.ready(); err != nil {
+			if watchErr := i.jwksWatcher.Err(); watchErr != nil {
+				return watchErr
+			}
+			return err
+		}
+	}
+
+	if i.healthCheck != nil {
+		return i.healthCheck()
+	}
+
+	return nil
+}
+
+// applyExpressions overrides the claim mappings of jwtConfig with those set in
+// the structured claim mappings, and adds the claim and user validation rules.
+func applyExpressions(jwtConfig *apiserver.JWTAuthenticator, config IssuerConfig) error {
+	if config.ClaimMappings != nil {
+		var mappings apiserver.ClaimMappings
+		if err := apiserverv1beta1.Convert_v1beta1_ClaimMappings_To_apiserver_ClaimMappings(config.ClaimMappings, &mappings, nil); err != nil {
+			return err
+		}
+
+		if len(mappings.Username.Claim) > 0 || len(mappings.Username.Expression) > 0 {
+			jwtConfig.ClaimMappings.Username = mappings.Username
+		}
+		if len(mappings.Groups.Claim) > 0 || len(mappings.Groups.Expression) > 0 {
+			jwtConfig.ClaimMappings.Groups = mappings.Groups
+		}
+		if len(mappings.UID.Claim) > 0 || len(mappings.UID.Expression) > 0 {
+			jwtConfig.ClaimMappings.UID = mappings.UID
+		}
+		jwtConfig.ClaimMappings.Extra = mappings.Extra
+	}
+
+	for i := range config.ClaimValidationRules {
+		var rule apiserver.ClaimValidationRule
+		if err := apiserverv1beta1.Convert_v1beta1_ClaimValidationRule_To_apiserver_ClaimValidationRule(&config.ClaimValidationRules[i], &rule, nil); err != nil {
+			return err
+		}
+		jwtConfig.ClaimValidationRules = append(jwtConfig.ClaimValidationRules, rule)
+	}
+
+	for i := range config.UserValidationRules {
+		var rule apiserver.UserValidationRule
+		if err := apiserverv1beta1.Convert_v1beta1_UserValidationRule_To_apiserver_UserValidationRule(&config.UserValidationRules[i], &rule, nil); err != nil {
+			return err
+		}
+		jwtConfig.UserValidationRules = append(jwtConfig.UserValidationRules, rule)
+	}
+
+	return nil
+}
+
+// URL returns the URL of the issuer.
+func (i *Issuer) URL() string {
+	return i.config.URL
+}
+
+// ClientID returns the first audience accepted by the issuer.
+func (i *Issuer) ClientID() string {
+	return i.config.Audiences[0]
+}
+
+// AllowsCluster returns whether tokens of this issuer are accepted for the
+// given cluster.
+func (i *Issuer) AllowsCluster(clusterName string) bool {
+	if len(i.config.Clusters) == 0 {
+		return true
+	}
+
+	for _, pattern := range i.config.Clusters {
+		if ok, _ := path.Match(pattern, clusterName); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Union authenticates tokens using the issuer named in the token's 'iss'
+// claim.
+type Union struct {
+	issuers map[string]*Issuer
+}
+
+var _ authenticator.Token = &Union{}
+
+// NewUnion returns a Union of the given issuers. Issuer URLs must be unique.
+func NewUnion(issuers ...*Issuer) (*Union, error) {
+	u := &Union{
+		issuers: make(map[string]*Issuer, len(issuers)),
+	}
+
+	for _, i := range issuers {
+		if _, ok := u.issuers[i.URL()]; ok {
+			return nil, fmt.Errorf("duplicate OIDC issuer %q", i.URL())
+		}
+		u.issuers[i.URL()] = i
+	}
+
+	return u, nil
+}
+
+// AuthenticateToken authenticates the token against the issuer named in its
+// 'iss' claim. Tokens from unknown issuers return an error so they may be
+// tried against other authentication methods.
+func (u *Union) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	i, err := u.issuerFor(token)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return i.AuthenticateToken(ctx, token)
+}
+
+// AllowsCluster returns whether the token's issuer is accepted for the given
+// cluster. The token is expected to have been authenticated already.
+func (u *Union) AllowsCluster(token, clusterName string) bool {
+	i, err := u.issuerFor(token)
+	if err != nil {
+		return false
+	}
+
+	return i.AllowsCluster(clusterName)
+}
+
+// Run watches the local files of all issuers until stopCh is closed.
+func (u *Union) Run(stopCh <-chan struct{}) {
+	for _, i := range u.issuers {
+		i.Run(stopCh)
+	}
+}
+
+// Ready returns an error if any issuer is not ready.
+func (u *Union) Ready() error {
+	for _, i := range u.issuers {
+		if err := i.Ready(); err != nil {
+			return fmt.Errorf("issuer %q not ready: %w", i.URL(), err)
+		}
+	}
+
+	return nil
+}
+
+func (u *Union) issuerFor(token string) (*Issuer, error) {
+	iss, err := util.UnverifiedIssuer(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	i, ok := u.issuers[iss]
+	if !ok {
+		return nil, fmt.Errorf("no OIDC issuer configured for %q", iss)
+	}
+
+	return i, nil
+}
@@ -0,0 +1,526 @@
+package issuer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/apis/apiserver"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	certutil "k8s.io/client-go/util/cert"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/util"
+)
+
+type fakeToken struct {
+	name string
+}
+
+func (f *fakeToken) AuthenticateToken(context.Context, string) (*authenticator.Response, bool, error) {
+	return &authenticator.Response{User: &user.DefaultInfo{Name: f.name}}, true, nil
+}
+
+func newFakeIssuer(url string, clusters ...string) *Issuer {
+	return &Issuer{
+		Token: &fakeToken{name: url},
+		config: IssuerConfig{
+			URL:       url,
+			Audiences: []string{"client"},
+			Clusters:  clusters,
+		},
+	}
+}
+
+func TestUnion(t *testing.T) {
+	corp := newFakeIssuer("https://corp.example.com")
+	ci := newFakeIssuer("https://ci.example.com", "dev-*", "staging")
+
+	u, err := NewUnion(corp, ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corpToken, err := util.FakeJWT("https://corp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciToken, err := util.FakeJWT("https://ci.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownToken, err := util.FakeJWT("https://unknown.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, ok, err := u.AuthenticateToken(context.TODO(), ciToken)
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, "https://ci.example.com", resp.User.GetName())
+	}
+
+	_, ok, err = u.AuthenticateToken(context.TODO(), unknownToken)
+	assert.Error(t, err)
+	assert.False(t, ok)
+
+	_, _, err = u.AuthenticateToken(context.TODO(), "not-a-jwt")
+	assert.Error(t, err)
+
+	assert.True(t, u.AllowsCluster(corpToken, "prod"))
+	assert.True(t, u.AllowsCluster(ciToken, "dev-eu"))
+	assert.True(t, u.AllowsCluster(ciToken, "staging"))
+	assert.False(t, u.AllowsCluster(ciToken, "prod"))
+	assert.False(t, u.AllowsCluster(unknownToken, "dev-eu"))
+
+	_, err = NewUnion(corp, newFakeIssuer("https://corp.example.com"))
+	assert.Error(t, err)
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := map[string]struct {
+		config string
+		expErr error
+	}{
+		"valid config should load with defaults": {
+			config: `
+issuers:
+- url: https://corp.example.com
+  audiences: [kube]
+- url: https://ci.example.com
+  audiences: [ci]
+  usernamePrefix: "ci:"
+  clusters: ["dev-*"]
+`,
+		},
+		"missing audiences should error": {
+			config: `
+issuers:
+- url: https://corp.example.com
+`,
+			expErr: errors.New("at least one audience is required"),
+		},
+		"non https url should error": {
+			config: `
+issuers:
+- url: http://corp.example.com
+  audiences: [kube]
+`,
+			expErr: errors.New("must use the https scheme"),
+		},
+		"invalid cluster pattern should error": {
+			config: `
+issuers:
+- url: https://corp.example.com
+  audiences: [kube]
+  clusters: ["[dev"]
+`,
+			expErr: errors.New("invalid cluster pattern"),
+		},
+		"unknown fields should error": {
+			config: `
+issuers:
+- url: https://corp.example.com
+  audience: kube
+`,
+			expErr: errors.New("unknown field"),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "issuers.yaml")
+			if err := os.WriteFile(file, []byte(test.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := LoadConfig(file)
+			if test.expErr != nil {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), test.expErr.Error())
+				}
+				return
+			}
+
+			if assert.NoError(t, err) && assert.Len(t, config.Issuers, 2) {
+				assert.Equal(t, "sub", config.Issuers[0].UsernameClaim)
+				assert.Equal(t, []string{"RS256"}, config.Issuers[0].SigningAlgs)
+				assert.Equal(t, "ci:", config.Issuers[1].UsernamePrefix)
+			}
+		})
+	}
+}
+
+func TestApplyExpressions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "issuers.yaml")
+	if err := os.WriteFile(file, []byte(`
+issuers:
+- url: https://corp.example.com
+  audiences: [kube]
+  groupsClaim: groups
+  claimMappings:
+    groups:
+      expression: 'claims.realm_access.roles'
+    extra:
+    - key: example.com/tenant
+      valueExpression: 'claims.tenant'
+  claimValidationRules:
+  - expression: 'claims.email_verified == true'
+    message: email must be verified
+  - claim: hd
+    requiredValue: example.com
+  userValidationRules:
+  - expression: "!user.username.startsWith('system:')"
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := ""
+	jwtConfig := apiserver.JWTAuthenticator{
+		ClaimMappings: apiserver.ClaimMappings{
+			Username: apiserver.PrefixedClaimOrExpression{Claim: "sub", Prefix: &prefix},
+			Groups:   apiserver.PrefixedClaimOrExpression{Claim: "groups", Prefix: &prefix},
+		},
+	}
+
+	if err := applyExpressions(&jwtConfig, config.Issuers[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unset mappings keep the claim based mapping.
+	assert.Equal(t, "sub", jwtConfig.ClaimMappings.Username.Claim)
+	assert.Equal(t, apiserver.PrefixedClaimOrExpression{Expression: "claims.realm_access.roles"},
+		jwtConfig.ClaimMappings.Groups)
+	assert.Equal(t, []apiserver.ExtraMapping{{Key: "example.com/tenant", ValueExpression: "claims.tenant"}},
+		jwtConfig.ClaimMappings.Extra)
+
+	if assert.Len(t, jwtConfig.ClaimValidationRules, 2) {
+		assert.Equal(t, "email must be verified", jwtConfig.ClaimValidationRules[0].Message)
+		assert.Equal(t, "example.com", jwtConfig.ClaimValidationRules[1].RequiredValue)
+	}
+	assert.Len(t, jwtConfig.UserValidationRules, 1)
+}
+
+// newTestIssuerServer serves the discovery document and signing key of an
+// OIDC issuer, returning a signer for its tokens and the file of its CA.
+func newTestIssuerServer(t *testing.T) (*httptest.Server, jose.Signer, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwk := jose.JSONWebKey{Key: key.Public(), KeyID: "test", Algorithm: "RS256", Use: "sig"}
+	mux := http.NewServeMux()
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":   server.URL,
+			"jwks_uri": server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(rw http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(rw).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk}})
+	})
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return server, signer, caFile
+}
+
+func TestAuthenticateExpressions(t *testing.T) {
+	server, signer, caFile := newTestIssuerServer(t)
+
+	file := filepath.Join(t.TempDir(), "issuers.yaml")
+	if err := os.WriteFile(file, []byte(`
+issuers:
+- url: `+server.URL+`
+  audiences: [kube]
+  caFile: `+caFile+`
+  claimMappings:
+    groups:
+      expression: 'claims.realm_access.roles'
+  claimValidationRules:
+  - expression: 'claims.email_verified == true'
+    message: email must be verified
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	i, err := New(ctx, config.Issuers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := func(emailVerified bool) string {
+		now := time.Now()
+		tok, err := jwt.Signed(signer).Claims(jwt.Claims{
+			Issuer:   server.URL,
+			Subject:  "alice",
+			Audience: jwt.Audience{"kube"},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		}).Claims(map[string]interface{}{
+			"email_verified": emailVerified,
+			"realm_access":   map[string]interface{}{"roles": []string{"dev", "ops"}},
+		}).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+
+	// The signing keys are fetched in the background.
+	var resp *authenticator.Response
+	if err := wait.PollUntilContextTimeout(ctx, 50*time.Millisecond, 10*time.Second, true,
+		func(ctx context.Context) (bool, error) {
+			var ok bool
+			resp, ok, err = i.AuthenticateToken(ctx, token(true))
+			return ok, nil
+		}); err != nil {
+		t.Fatalf("failed to authenticate token: %v", err)
+	}
+
+	assert.Equal(t, "alice", resp.User.GetName())
+	assert.Equal(t, []string{"dev", "ops"}, resp.User.GetGroups())
+
+	_, ok, err := i.AuthenticateToken(ctx, token(false))
+	assert.False(t, ok)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "email must be verified")
+	}
+}
+
+func signedToken(t *testing.T, key *rsa.PrivateKey, keyID, issuer string) string {
+	sig, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: keyID}},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Signed(sig).Claims(jwt.Claims{
+		Issuer:   issuer,
+		Subject:  "a-user",
+		Audience: jwt.Audience{"kube"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func writeJWKS(t *testing.T, file string, key *rsa.PrivateKey, keyID string) {
+	data, err := json.Marshal(jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: keyID, Algorithm: "RS256", Use: "sig"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWKSFile(t *testing.T) {
+	const url = "https://unreachable.example.com"
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := New(context.TODO(), IssuerConfig{
+		URL:           url,
+		Audiences:     []string{"kube"},
+		UsernameClaim: "sub",
+		SigningAlgs:   []string{"RS256"},
+		JWKSFile:      jwksFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not ready until the key set has been loaded.
+	assert.Error(t, i.Ready())
+
+	writeJWKS(t, jwksFile, oldKey, "old")
+	i.jwksWatcher.Reload()
+	assert.NoError(t, i.Ready())
+
+	oldToken := signedToken(t, oldKey, "old", url)
+	resp, ok, err := i.AuthenticateToken(context.TODO(), oldToken)
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		assert.Equal(t, "a-user", resp.User.GetName())
+	}
+
+	// Rotated keys replace the old ones.
+	writeJWKS(t, jwksFile, newKey, "new")
+	i.jwksWatcher.Reload()
+
+	_, ok, err = i.AuthenticateToken(context.TODO(), oldToken)
+	assert.Error(t, err)
+	assert.False(t, ok)
+
+	_, ok, err = i.AuthenticateToken(context.TODO(), signedToken(t, newKey, "new", url))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestCATransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	otherCA, _, err := certutil.GenerateSelfSignedCertKey("other", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+
+	i, err := New(context.TODO(), IssuerConfig{
+		URL:           server.URL,
+		Audiences:     []string{"kube"},
+		UsernameClaim: "sub",
+		SigningAlgs:   []string{"RS256"},
+		CAFile:        caFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A missing CA file is surfaced on readiness.
+	assert.Error(t, i.Ready())
+
+	client := &http.Client{Transport: new(caTransport)}
+	_, err = client.Get(server.URL)
+	assert.Error(t, err)
+
+	transport := client.Transport.(*caTransport)
+	watcher := util.NewFileWatcher(caFile, transport.load)
+
+	for _, test := range []struct {
+		ca     []byte
+		expErr bool
+	}{
+		{ca: serverCA},
+		{ca: otherCA, expErr: true},
+		{ca: serverCA},
+	} {
+		if err := os.WriteFile(caFile, test.ca, 0600); err != nil {
+			t.Fatal(err)
+		}
+		watcher.Reload()
+
+		resp, err := client.Get(server.URL)
+		if test.expErr {
+			assert.Error(t, err)
+			continue
+		}
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+	}
+
+	// Once the CA file is loaded, the issuer is not ready until its discovery
+	// succeeds.
+	i.caWatcher.Reload()
+	assert.ErrorContains(t, i.Ready(), "not healthy")
+}
+
+func TestDiscoveryReady(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":   server.URL,
+			"jwks_uri": server.URL + "/keys",
+		})
+	})
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newIssuer := func(url string) *Issuer {
+		i, err := New(context.TODO(), IssuerConfig{
+			URL:           url,
+			Audiences:     []string{"kube"},
+			UsernameClaim: "sub",
+			SigningAlgs:   []string{"RS256"},
+			CAFile:        caFile,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		i.caWatcher.Reload()
+		return i
+	}
+
+	ready := newIssuer(server.URL)
+	if err := wait.PollUntilContextTimeout(context.TODO(), 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		return ready.Ready() == nil, nil
+	}); err != nil {
+		t.Fatalf("issuer did not become ready: %s", ready.Ready())
+	}
+
+	// An issuer whose discovery fails is not ready, and neither is the union
+	// of all issuers.
+	broken := newIssuer(server.URL + "/broken")
+	u, err := NewUnion(ready, broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ErrorContains(t, u.Ready(), server.URL+"/broken")
+}
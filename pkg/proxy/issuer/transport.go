@@ -0,0 +1,50 @@
+package issuer
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+var errNoCA = errors.New("OIDC CA bundle not loaded")
+
+// caTransport is a RoundTripper to the issuer that trusts the most recently
+// loaded CA bundle. Replacing the bundle swaps in a new transport, leaving
+// requests in flight on the previous one to complete.
+type caTransport struct {
+	transport atomic.Pointer[http.Transport]
+}
+
+var _ http.RoundTripper = &caTransport{}
+
+// load parses a PEM encoded CA bundle and atomically replaces the transport.
+func (c *caTransport) load(data []byte) error {
+	roots, err := certutil.NewPoolFromBytes(data)
+	if err != nil {
+		return err
+	}
+
+	// Copied from http.DefaultTransport.
+	transport := utilnet.SetTransportDefaults(&http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	})
+
+	if old := c.transport.Swap(transport); old != nil {
+		old.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+func (c *caTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := c.transport.Load()
+	if transport == nil {
+		return nil, errNoCA
+	}
+
+	return transport.RoundTrip(req)
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/klog/v2"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/resolver"
+)
+
+const (
+	// kubeconfigPath generates a kubeconfig for the clusters the caller has
+	// access to.
+	kubeconfigPath = "/_kubeconfig"
+
+	// kubeconfigUser is the name of the user entry shared by all contexts.
+	kubeconfigUser = "oidc"
+)
+
+// errNoKubeconfigCA is returned when the CA of the serving certificate can't
+// be determined from the served chain.
+var errNoKubeconfigCA = errors.New("the serving certificate chain doesn't include its " +
+	"certificate authority, set --kubeconfig-ca-file")
+
+// serveKubeconfig writes a kubeconfig with one context per cluster the caller
+// has access to. Each context authenticates through the kubelogin exec plugin.
+func (p *Proxy) serveKubeconfig(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		p.handleError(rw, req, apierrors.NewMethodNotSupported(schema.GroupResource{Resource: "kubeconfig"}, req.Method))
+		return
+	}
+
+	user, ok := genericapirequest.UserFrom(req.Context())
+	if !ok || len(user.GetName()) == 0 {
+		p.handleError(rw, req, errNoName)
+		return
+	}
+
+	config, err := p.kubeconfig(req, p.accessibleClusters(req, user))
+	if err != nil {
+		p.handleError(rw, req, fmt.Errorf("failed to generate kubeconfig: %w", err))
+		return
+	}
+
+	data, err := clientcmd.Write(*config)
+	if err != nil {
+		p.handleError(rw, req, fmt.Errorf("failed to encode kubeconfig: %w", err))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/yaml")
+	rw.Header().Set("Content-Disposition", `attachment; filename="kubeconfig"`)
+	if _, err := rw.Write(data); err != nil {
+		klog.Errorf("failed to write kubeconfig: %s", err)
+	}
+}
+
+func (p *Proxy) kubeconfig(req *http.Request, clusters []*cluster.Cluster) (*clientcmdapi.Config, error) {
+	serverURL, err := p.kubeconfigServerURL(req)
+	if err != nil {
+		return nil, err
+	}
+
+	config := clientcmdapi.NewConfig()
+	config.AuthInfos[kubeconfigUser] = &clientcmdapi.AuthInfo{
+		Exec: &clientcmdapi.ExecConfig{
+			APIVersion: "client.authentication.k8s.io/v1beta1",
+			Command:    "kubectl",
+			Args: []string{
+				"oidc-login",
+				"get-token",
+				"--oidc-issuer-url=" + p.oidcIssuerURL,
+				"--oidc-client-id=" + p.oidcClientID,
+			},
+			InteractiveMode: clientcmdapi.IfAvailableExecInteractiveMode,
+		},
+	}
+
+	for _, c := range clusters {
+		server := p.clusterServer(*serverURL, c.Name)
+		caData, err := p.kubeconfigCA(server)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate authority of cluster %q: %w", c.Name, err)
+		}
+
+		config.Clusters[c.Name] = &clientcmdapi.Cluster{
+			Server:                   server,
+			CertificateAuthorityData: caData,
+		}
+		config.Contexts[c.Name] = &clientcmdapi.Context{
+			Cluster:  c.Name,
+			AuthInfo: kubeconfigUser,
+		}
+	}
+
+	if len(clusters) > 0 {
+		config.CurrentContext = clusters[0].Name
+	}
+
+	return config, nil
+}
+
+// kubeconfigServerURL returns the external address of the proxy. If none is
+// configured, the address the request was sent to is used.
+func (p *Proxy) kubeconfigServerURL(req *http.Request) (*url.URL, error) {
+	if len(p.config.KubeconfigServerAddress) > 0 {
+		serverURL, err := url.Parse(p.config.KubeconfigServerAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kubeconfig server address %q: %w",
+				p.config.KubeconfigServerAddress, err)
+		}
+		return serverURL, nil
+	}
+
+	return &url.URL{Scheme: "https", Host: req.Host}, nil
+}
+
+// clusterServer returns the URL of the given cluster behind the proxy for the
+// configured routing mode.
+func (p *Proxy) clusterServer(serverURL url.URL, clusterName string) string {
+	if p.config.ClusterRoutingMode == resolver.ModeHost {
+		host := resolver.Hostname(p.config.ClusterHostTemplate, clusterName)
+		if port := serverURL.Port(); len(port) > 0 {
+			host = net.JoinHostPort(host, port)
+		}
+		serverURL.Host = host
+		return serverURL.String()
+	}
+
+	return serverURL.JoinPath(clusterName).String()
+}
+
+// kubeconfigCA returns the certificate authority embedded in generated
+// kubeconfigs for the given server. Without a configured CA file, the issuing
+// CA of the certificate chain served for the server's host is used: the last
+// certificate of the chain, or the serving certificate itself if it is
+// self-signed.
+func (p *Proxy) kubeconfigCA(server string) ([]byte, error) {
+	if len(p.config.KubeconfigCAFile) > 0 {
+		return os.ReadFile(p.config.KubeconfigCAFile)
+	}
+
+	if p.secureServingInfo == nil || p.secureServingInfo.Cert == nil {
+		return nil, errNoKubeconfigCA
+	}
+
+	var host string
+	if serverURL, err := url.Parse(server); err == nil {
+		host = serverURL.Hostname()
+	}
+
+	chain, _ := p.servingCert(host).CurrentCertKeyContent()
+	certs, err := certutil.ParseCertsPEM(chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse serving certificate: %w", err)
+	}
+
+	ca := certs[len(certs)-1]
+	if len(certs) == 1 && !isSelfSigned(ca) {
+		return nil, errNoKubeconfigCA
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: certutil.CertificateBlockType, Bytes: ca.Raw}), nil
+}
+
+// servingCert returns the certificate served for the given host: the SNI
+// certificate matching the host if any, otherwise the default certificate.
+func (p *Proxy) servingCert(host string) dynamiccertificates.CertKeyContentProvider {
+	host = strings.ToLower(host)
+	for _, sniCert := range p.secureServingInfo.SNICerts {
+		for _, name := range sniNames(sniCert) {
+			if matchesSNIName(host, strings.ToLower(name)) {
+				return sniCert
+			}
+		}
+	}
+
+	return p.secureServingInfo.Cert
+}
+
+// sniNames returns the names an SNI certificate is served for. As for the
+// server, these default to the names of the certificate itself.
+func sniNames(sniCert dynamiccertificates.SNICertKeyContentProvider) []string {
+	if names := sniCert.SNINames(); len(names) > 0 {
+		return names
+	}
+
+	chain, _ := sniCert.CurrentCertKeyContent()
+	certs, err := certutil.ParseCertsPEM(chain)
+	if err != nil {
+		return nil
+	}
+
+	return append([]string{certs[0].Subject.CommonName}, certs[0].DNSNames...)
+}
+
+// matchesSNIName returns whether the host matches the SNI name, which may be a
+// wildcard for a single leading label.
+func matchesSNIName(host, name string) bool {
+	if host == name {
+		return true
+	}
+
+	suffix, ok := strings.CutPrefix(name, "*")
+	if !ok || !strings.HasPrefix(suffix, ".") {
+		return false
+	}
+
+	label, ok := strings.CutSuffix(host, suffix)
+	return ok && len(label) > 0 && !strings.Contains(label, ".")
+}
+
+// isSelfSigned returns whether the certificate is signed by its own key.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
@@ -0,0 +1,127 @@
+// Package maxinflight caps the number of requests in flight per cluster and
+// per user.
+package maxinflight
+
+import (
+	"sync"
+)
+
+// Kind is the class of a request, each with its own in-flight limit.
+type Kind int
+
+const (
+	// NonMutating requests read resources, e.g. get and list.
+	NonMutating Kind = iota
+	// Mutating requests change resources, e.g. create and delete.
+	Mutating
+	// LongRunning requests hold a connection open, e.g. watch, exec,
+	// port-forward and logs.
+	LongRunning
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Mutating:
+		return "mutating"
+	case LongRunning:
+		return "long-running"
+	default:
+		return "non-mutating"
+	}
+}
+
+// Limits are the maximum numbers of requests in flight of each kind. Zero
+// means unlimited.
+type Limits struct {
+	NonMutating int
+	Mutating    int
+	LongRunning int
+}
+
+func (l Limits) of(kind Kind) int {
+	switch kind {
+	case Mutating:
+		return l.Mutating
+	case LongRunning:
+		return l.LongRunning
+	default:
+		return l.NonMutating
+	}
+}
+
+// IsZero returns whether no limits are set.
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Limiter counts requests in flight against per-cluster and per-user limits.
+type Limiter struct {
+	cluster Limits
+	user    Limits
+
+	mu     sync.Mutex
+	counts map[key]int
+}
+
+type key struct {
+	kind    Kind
+	cluster string
+	// user is empty for the cluster wide count
+	user string
+}
+
+// New returns a Limiter with the limits applied to each cluster and to each
+// user of a cluster.
+func New(cluster, user Limits) *Limiter {
+	return &Limiter{
+		cluster: cluster,
+		user:    user,
+		counts:  make(map[key]int),
+	}
+}
+
+// Acquire counts a request of the kind to the cluster by the user as in
+// flight. It returns false if a limit is reached, otherwise the request must
+// call release when done. The user may be empty for requests that were not
+// authenticated by the proxy, which are only subject to cluster limits.
+func (l *Limiter) Acquire(cluster, user string, kind Kind) (release func(), ok bool) {
+	clusterKey := key{kind: kind, cluster: cluster}
+	userKey := key{kind: kind, cluster: cluster, user: user}
+	hasUser := len(user) > 0
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit := l.cluster.of(kind); limit > 0 && l.counts[clusterKey] >= limit {
+		return nil, false
+	}
+
+	if limit := l.user.of(kind); hasUser && limit > 0 && l.counts[userKey] >= limit {
+		return nil, false
+	}
+
+	l.counts[clusterKey]++
+	if hasUser {
+		l.counts[userKey]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.decrement(clusterKey)
+			if hasUser {
+				l.decrement(userKey)
+			}
+		})
+	}, true
+}
+
+func (l *Limiter) decrement(k key) {
+	l.counts[k]--
+	if l.counts[k] <= 0 {
+		delete(l.counts, k)
+	}
+}
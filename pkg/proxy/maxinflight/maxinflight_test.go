@@ -0,0 +1,74 @@
+package maxinflight
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquire(t *testing.T) {
+	l := New(
+		Limits{NonMutating: 3, Mutating: 1},
+		Limits{NonMutating: 2, LongRunning: 1},
+	)
+
+	// Per user limit
+	releaseA1, ok := l.Acquire("dev", "alice", NonMutating)
+	assert.True(t, ok)
+	_, ok = l.Acquire("dev", "alice", NonMutating)
+	assert.True(t, ok)
+	_, ok = l.Acquire("dev", "alice", NonMutating)
+	assert.False(t, ok)
+
+	// Per cluster limit
+	_, ok = l.Acquire("dev", "bob", NonMutating)
+	assert.True(t, ok)
+	_, ok = l.Acquire("dev", "carol", NonMutating)
+	assert.False(t, ok)
+
+	// Requests without a user only count towards the cluster
+	_, ok = l.Acquire("dev", "", NonMutating)
+	assert.False(t, ok)
+
+	// Limits are per cluster
+	_, ok = l.Acquire("prod", "alice", NonMutating)
+	assert.True(t, ok)
+
+	// Releasing frees a slot, once
+	releaseA1()
+	releaseA1()
+	_, ok = l.Acquire("dev", "carol", NonMutating)
+	assert.True(t, ok)
+	_, ok = l.Acquire("dev", "dave", NonMutating)
+	assert.False(t, ok)
+
+	// Kinds are limited separately
+	releaseM, ok := l.Acquire("dev", "alice", Mutating)
+	assert.True(t, ok)
+	_, ok = l.Acquire("dev", "bob", Mutating)
+	assert.False(t, ok)
+	releaseM()
+	_, ok = l.Acquire("dev", "bob", Mutating)
+	assert.True(t, ok)
+
+	// Zero is unlimited
+	_, ok = l.Acquire("dev", "alice", LongRunning)
+	assert.True(t, ok)
+	_, ok = l.Acquire("dev", "alice", LongRunning)
+	assert.False(t, ok)
+	for i := 0; i < 10; i++ {
+		_, ok = l.Acquire("dev", "", LongRunning)
+		assert.True(t, ok)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	l := New(Limits{NonMutating: 1}, Limits{NonMutating: 1})
+
+	release, ok := l.Acquire("dev", "alice", NonMutating)
+	assert.True(t, ok)
+	assert.Len(t, l.counts, 2)
+
+	release()
+	assert.Len(t, l.counts, 0)
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/endpoints/responsewriter"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/context"
+)
+
+// withMetrics records the count and latency of requests. Requests that are not
+// authorized or not proxied to a cluster have empty verb and resource labels.
+func (p *Proxy) withMetrics(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		cluster := p.metricsCluster(req)
+
+		// The request info is only used to exclude long-running requests from
+		// the latency; the verb and resource labels are set once the request is
+		// authorized.
+		reqInfo, _ := p.newRequestInfo(req)
+
+		labels := &context.RequestMetrics{AuthPath: metrics.AuthPathNone}
+		req = context.WithRequestMetrics(req, labels)
+
+		delegate := &statusRecorder{ResponseWriter: rw}
+		handler.ServeHTTP(responsewriter.WrapForHTTP1Or2(delegate), req)
+
+		code := delegate.status
+		if code == 0 {
+			code = http.StatusOK
+			// Upgraded connections are hijacked without writing a header
+			if httpstream.IsUpgradeRequest(req) {
+				code = http.StatusSwitchingProtocols
+			}
+		}
+
+		labelValues := []string{cluster, labels.Verb, labels.Resource, strconv.Itoa(code), labels.AuthPath}
+		metrics.Requests.WithLabelValues(labelValues...).Inc()
+		if reqInfo == nil || !isLongRunning(req, reqInfo) {
+			metrics.RequestDuration.WithLabelValues(labelValues...).Observe(time.Since(start).Seconds())
+		}
+	})
+}
+
+// metricsCluster returns the cluster label of the request. Clusters unknown to
+// the proxy share a label so arbitrary paths can't create new series.
+func (p *Proxy) metricsCluster(req *http.Request) string {
+	clusterName := p.GetClusterName(req)
+	if p.clusterManager.GetCluster(clusterName) == nil {
+		return metrics.UnknownCluster
+	}
+
+	return clusterName
+}
+
+// newRequestInfo builds the request info from the path as forwarded to the
+// cluster.
+func (p *Proxy) newRequestInfo(req *http.Request) (*genericapirequest.RequestInfo, error) {
+	_, path := p.clusterResolver.Resolve(req)
+
+	fullPath := req.URL.Path
+	req.URL.Path = path
+	defer func() { req.URL.Path = fullPath }()
+
+	return p.requestInfo.NewRequestInfo(req)
+}
+
+// statusRecorder records the status code written to the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+var _ responsewriter.UserProvidedDecorator = &statusRecorder{}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
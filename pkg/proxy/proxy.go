@@ -5,7 +5,6 @@ import (
 	ctx "context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -14,25 +13,48 @@ import (
 
 	"github.com/Improwised/kube-oidc-proxy/cmd/app/options"
 	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/audit"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/breaker"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/breakglass"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/claims"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/clientcert"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/crd"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/denyrules"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/discoverycache"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/execpolicy"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/hooks"
-
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/issuer"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/maxinflight"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/ratelimit"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/recording"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/resolver"
+	"github.com/Improwised/kube-oidc-proxy/pkg/util"
+
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"k8s.io/apimachinery/pkg/util/sets"
-	"k8s.io/apiserver/pkg/apis/apiserver"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/authenticatorfactory"
 	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
+	"k8s.io/apiserver/pkg/authentication/request/headerrequest"
+	"k8s.io/apiserver/pkg/authentication/request/union"
 	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/apiserver/pkg/server"
-	"k8s.io/apiserver/plugin/pkg/authenticator/token/oidc"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/transport"
+	"k8s.io/component-base/tracing"
 	"k8s.io/klog/v2"
 )
 
 const (
 	UserHeaderClientIPKey = "Remote-Client-IP"
 	timestampLayout       = "2006-01-02T15:04:05-0700"
+
+	// denyRulesFileSource is the deny rule source of the deny rules file.
+	denyRulesFileSource = "file"
 )
 
 var (
@@ -49,6 +71,81 @@ type Config struct {
 
 	ExtraUserHeaders                map[string][]string
 	ExtraUserHeadersClientIPEnabled bool
+
+	ClusterRoutingMode  string
+	ClusterHostTemplate string
+
+	KubeconfigServerAddress string
+	KubeconfigCAFile        string
+
+	// ClientCA verifies client certificates, which then authenticate requests
+	// along with OIDC tokens. Requests are only authenticated by their token
+	// if nil.
+	ClientCA dynamiccertificates.CAContentProvider
+	// ClientCertUserMapping is how client certificates are mapped to users,
+	// one of clientcert.UserMappings.
+	ClientCertUserMapping string
+	// RequestHeader authenticates requests of a front proxy by their headers,
+	// if the front proxy presents a client certificate of its CA. The headers
+	// are not trusted if nil.
+	RequestHeader *authenticatorfactory.RequestHeaderConfig
+
+	// MaxInFlightPerCluster and MaxInFlightPerUser limit the requests in
+	// flight to each cluster, and by each user to a cluster.
+	MaxInFlightPerCluster maxinflight.Limits
+	MaxInFlightPerUser    maxinflight.Limits
+
+	// CircuitBreaker configures the circuit breaker of each cluster. It is
+	// disabled if the failure threshold is zero.
+	CircuitBreaker breaker.Config
+
+	// DiscoveryCacheTTL is how long discovery and OpenAPI responses are
+	// served from the cache before being revalidated. They are not cached if
+	// zero.
+	DiscoveryCacheTTL time.Duration
+
+	// SessionRecorder records exec and attach sessions. Sessions are not
+	// recorded if nil.
+	SessionRecorder *recording.Recorder
+	// SessionRecordingClusters are the clusters whose sessions are recorded.
+	// Sessions of all clusters are recorded if empty.
+	SessionRecordingClusters []string
+	// SessionRecordingViewerGroups are the groups allowed to list and
+	// download recordings.
+	SessionRecordingViewerGroups []string
+
+	// RateLimitConfig is the path of the rate limit policy. Requests are not
+	// rate limited if empty.
+	RateLimitConfig string
+
+	// DenyRules are the deny rules evaluated before RBAC. Requests are only
+	// authorized by RBAC if nil.
+	DenyRules *denyrules.Set
+	// DenyRulesConfig is the path of a deny rules file, which is watched for
+	// changes and loaded into DenyRules.
+	DenyRulesConfig string
+
+	// AccessRequests creates and decides access requests. The access request
+	// endpoints are disabled if nil.
+	AccessRequests *crd.AccessRequestClient
+	// AccessRequestApproverGroups are the groups allowed to approve and deny
+	// access requests.
+	AccessRequestApproverGroups []string
+
+	// BreakGlass configures the break-glass group. Break-glass access is
+	// disabled if the group is empty.
+	BreakGlass breakglass.Config
+	// BreakGlassNotificationWebhook is the URL notified when a break-glass
+	// session starts. No notifications are sent if empty.
+	BreakGlassNotificationWebhook string
+
+	// ExecPolicyConfig is the path of the exec command policy. Commands are
+	// only subject to RBAC if empty.
+	ExecPolicyConfig string
+
+	// TracerProvider traces requests through the proxy. If nil, trace
+	// context is still propagated but no spans are recorded.
+	TracerProvider oteltrace.TracerProvider
 }
 
 // ClusterManager interface for dependency injection
@@ -62,30 +159,34 @@ type ClusterManager interface {
 type errorHandlerFn func(http.ResponseWriter, *http.Request, error)
 
 type Proxy struct {
-	oidcRequestAuther *bearertoken.Authenticator
+	requestAuther     authenticator.Request
 	tokenAuther       authenticator.Token
+	issuers           *issuer.Union
+	requiredClaims    *claims.Policy
+	rateLimiter       *ratelimit.Limiter
+	execPolicy        *execpolicy.Policy
+	denyRules         *denyrules.Set
+	denyRulesWatcher  *util.FileWatcher
+	breakGlass        *breakglass.Manager
+	breakGlassNotify  *breakglass.Notifier
+	maxInFlight       *maxinflight.Limiter
+	fleetInFlight     *maxinflight.Limiter
+	discoveryCache    *discoverycache.Cache
 	secureServingInfo *server.SecureServingInfo
 	auditor           *audit.Audit
 	clusterManager    ClusterManager
+	clusterResolver   resolver.Resolver
 	config            *Config
 
+	oidcIssuerURL string
+	oidcClientID  string
+
 	hooks       *hooks.Hooks
 	handleError errorHandlerFn
 
 	requestInfo genericapirequest.RequestInfoFactory
 }
 
-// implement oidc.CAContentProvider to load
-// the ca file from the options
-type CAFromFile struct {
-	CAFile string
-}
-
-func (caFromFile CAFromFile) CurrentCABundleContent() []byte {
-	res, _ := ioutil.ReadFile(caFromFile.CAFile)
-	return res
-}
-
 func New(
 	oidcOptions *options.OIDCAuthenticationOptions,
 	auditOptions *options.AuditOptions,
@@ -93,46 +194,91 @@ func New(
 	config *Config,
 	clusterManager ClusterManager) (*Proxy, error) {
 
-	// load the CA from the file listed in the options
-	caFromFile := CAFromFile{
-		CAFile: oidcOptions.CAFile,
+	issuers, err := newIssuers(oidcOptions)
+	if err != nil {
+		return nil, err
 	}
 
-	// setup static JWT Auhenticator
-	jwtConfig := apiserver.JWTAuthenticator{
-		Issuer: apiserver.Issuer{
-			URL:                  oidcOptions.IssuerURL,
-			Audiences:            []string{oidcOptions.ClientID},
-			CertificateAuthority: string(caFromFile.CurrentCABundleContent()),
-		},
+	tokenAuther, err := issuer.NewUnion(issuers...)
+	if err != nil {
+		return nil, err
+	}
 
-		ClaimMappings: apiserver.ClaimMappings{
-			Username: apiserver.PrefixedClaimOrExpression{
-				Claim:  oidcOptions.UsernameClaim,
-				Prefix: &oidcOptions.UsernamePrefix,
-			},
-			Groups: apiserver.PrefixedClaimOrExpression{
-				Claim:  oidcOptions.GroupsClaim,
-				Prefix: &oidcOptions.GroupsPrefix,
-			},
-			UID: apiserver.ClaimOrExpression{
-				Claim: "sub",
-			},
-		},
+	requestAuther, err := newRequestAuthenticator(tokenAuther, config)
+	if err != nil {
+		return nil, err
 	}
 
-	// generate tokenAuther from oidc config
-	tokenAuther, err := oidc.New(ctx.TODO(), oidc.Options{
-		CAContentProvider: caFromFile,
-		//RequiredClaims:       oidcOptions.RequiredClaims,
-		SupportedSigningAlgs: oidcOptions.SigningAlgs,
-		JWTAuthenticator:     jwtConfig,
-	})
+	var requiredClaims *claims.Policy
+	if len(oidcOptions.ClusterRequiredClaimsFile) > 0 {
+		requiredClaims, err = claims.LoadPolicy(oidcOptions.ClusterRequiredClaimsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rateLimiter *ratelimit.Limiter
+	if len(config.RateLimitConfig) > 0 {
+		policy, err := ratelimit.LoadPolicy(config.RateLimitConfig)
+		if err != nil {
+			return nil, err
+		}
+		rateLimiter = ratelimit.New(policy)
+	}
+
+	var execPolicy *execpolicy.Policy
+	if len(config.ExecPolicyConfig) > 0 {
+		execPolicy, err = execpolicy.LoadPolicy(config.ExecPolicyConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	denyRules := config.DenyRules
+	var denyRulesWatcher *util.FileWatcher
+	if len(config.DenyRulesConfig) > 0 {
+		if denyRules == nil {
+			denyRules = denyrules.NewSet()
+		}
+		denyRulesWatcher = util.NewFileWatcher(config.DenyRulesConfig, func(data []byte) error {
+			policy, err := denyrules.ParsePolicy(data)
+			if err != nil {
+				return err
+			}
+			denyRules.SetRules(denyRulesFileSource, policy.Rules)
+			return nil
+		})
+		if err := denyRulesWatcher.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var breakGlass *breakglass.Manager
+	if len(config.BreakGlass.Group) > 0 {
+		breakGlass = breakglass.New(config.BreakGlass)
+	}
+
+	var breakGlassNotify *breakglass.Notifier
+	if len(config.BreakGlassNotificationWebhook) > 0 {
+		breakGlassNotify = breakglass.NewNotifier(config.BreakGlassNotificationWebhook)
+	}
+
+	var maxInFlight *maxinflight.Limiter
+	if !config.MaxInFlightPerCluster.IsZero() || !config.MaxInFlightPerUser.IsZero() {
+		maxInFlight = maxinflight.New(config.MaxInFlightPerCluster, config.MaxInFlightPerUser)
+	}
+
+	var discoveryCache *discoverycache.Cache
+	if config.DiscoveryCacheTTL > 0 {
+		discoveryCache = discoverycache.New(config.DiscoveryCacheTTL)
+	}
+
+	clusterResolver, err := resolver.New(config.ClusterRoutingMode, config.ClusterHostTemplate)
 	if err != nil {
 		return nil, err
 	}
 
-	auditor, err := audit.New(auditOptions, config.ExternalAddress, ssinfo)
+	auditor, err := audit.New(auditOptions, config.ExternalAddress, ssinfo, clusterResolver)
 	if err != nil {
 		return nil, err
 	}
@@ -143,24 +289,147 @@ func New(
 		hooks:             hooks.New(),
 		secureServingInfo: ssinfo,
 		config:            config,
-		oidcRequestAuther: bearertoken.New(tokenAuther),
+		requestAuther:     requestAuther,
 		tokenAuther:       tokenAuther,
+		issuers:           tokenAuther,
+		requiredClaims:    requiredClaims,
+		rateLimiter:       rateLimiter,
+		execPolicy:        execPolicy,
+		denyRules:         denyRules,
+		denyRulesWatcher:  denyRulesWatcher,
+		breakGlass:        breakGlass,
+		breakGlassNotify:  breakGlassNotify,
+		maxInFlight:       maxInFlight,
+		fleetInFlight:     newFleetInFlight(),
+		discoveryCache:    discoveryCache,
 		auditor:           auditor,
 		requestInfo:       requestInfo,
 		clusterManager:    clusterManager,
+		clusterResolver:   clusterResolver,
+		oidcIssuerURL:     issuers[0].URL(),
+		oidcClientID:      issuers[0].ClientID(),
+	}, nil
+}
+
+// newRequestAuthenticator returns the request authenticator. Requests are
+// authenticated by their bearer token, or else by the headers of the front
+// proxy, or else by their client certificate.
+func newRequestAuthenticator(tokenAuther authenticator.Token, config *Config) (authenticator.Request, error) {
+	var authers []authenticator.Request
+
+	if rh := config.RequestHeader; rh != nil {
+		authers = append(authers, headerrequest.NewDynamicVerifyOptionsSecure(rh.CAContentProvider.VerifyOptions,
+			rh.AllowedClientNames, rh.UsernameHeaders, rh.UIDHeaders, rh.GroupHeaders, rh.ExtraHeaderPrefixes))
+	}
+
+	if config.ClientCA != nil {
+		clientCertAuther, err := clientcert.New(config.ClientCA, config.ClientCertUserMapping)
+		if err != nil {
+			return nil, err
+		}
+		authers = append(authers, clientCertAuther)
+	}
+
+	return &bearerOrElse{
+		bearer:   bearertoken.New(tokenAuther),
+		fallback: union.New(authers...),
 	}, nil
 }
 
+// bearerOrElse authenticates requests with an Authorization header by their
+// bearer token only, so that an invalid token is never made up for by other
+// credentials of the request. Other requests are authenticated by fallback.
+type bearerOrElse struct {
+	bearer, fallback authenticator.Request
+}
+
+func (b *bearerOrElse) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	if len(req.Header.Get("Authorization")) > 0 {
+		return b.bearer.AuthenticateRequest(req)
+	}
+
+	return b.fallback.AuthenticateRequest(req)
+}
+
+// newIssuers builds the authenticators of the issuer given by flags, followed
+// by those listed in the issuers config file.
+func newIssuers(oidcOptions *options.OIDCAuthenticationOptions) ([]*issuer.Issuer, error) {
+	var configs []issuer.IssuerConfig
+
+	if len(oidcOptions.IssuerURL) > 0 {
+		configs = append(configs, issuer.IssuerConfig{
+			URL:            oidcOptions.IssuerURL,
+			Audiences:      []string{oidcOptions.ClientID},
+			CAFile:         oidcOptions.CAFile,
+			JWKSFile:       oidcOptions.JWKSFile,
+			UsernameClaim:  oidcOptions.UsernameClaim,
+			UsernamePrefix: oidcOptions.UsernamePrefix,
+			GroupsClaim:    oidcOptions.GroupsClaim,
+			GroupsPrefix:   oidcOptions.GroupsPrefix,
+			SigningAlgs:    oidcOptions.SigningAlgs,
+			RequiredClaims: oidcOptions.RequiredClaims,
+		})
+	}
+
+	if len(oidcOptions.IssuersConfigFile) > 0 {
+		config, err := issuer.LoadConfig(oidcOptions.IssuersConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config.Issuers...)
+	}
+
+	if len(configs) == 0 {
+		return nil, errors.New("no OIDC issuers configured")
+	}
+
+	issuers := make([]*issuer.Issuer, len(configs))
+	for i, config := range configs {
+		iss, err := issuer.New(ctx.TODO(), config)
+		if err != nil {
+			return nil, err
+		}
+		issuers[i] = iss
+	}
+
+	return issuers, nil
+}
+
 func (p *Proxy) Run(stopCh <-chan struct{}) (<-chan struct{}, <-chan struct{}, error) {
 	// standard round tripper for proxy to API Server
 	p.handleError = p.newErrorHandler()
 
+	if p.issuers != nil {
+		p.issuers.Run(stopCh)
+	}
+
+	if p.rateLimiter != nil {
+		p.rateLimiter.Run(stopCh)
+	}
+
+	if p.denyRulesWatcher != nil {
+		p.denyRulesWatcher.Run(util.DefaultFileWatchInterval, stopCh)
+	}
+
+	if p.discoveryCache != nil {
+		p.discoveryCache.Run(stopCh)
+	}
+
+	if p.config.SessionRecorder != nil {
+		p.config.SessionRecorder.Run(stopCh)
+	}
+
 	for _, cluster := range p.clusterManager.GetAllClusters() {
 		if err := p.SetupClusterProxy(cluster); err != nil {
 			return nil, nil, err
 		}
 	}
 
+	// Generated kubeconfigs must be able to verify the proxy
+	if _, err := p.kubeconfigCA(""); err != nil {
+		klog.Warningf("kubeconfigs can't be generated: %s", err)
+	}
+
 	// Set up proxy handler using proxy
 	waitCh, listenerStoppedCh, err := p.serve(http.HandlerFunc(p.httpHandler), stopCh)
 	if err != nil {
@@ -171,11 +440,11 @@ func (p *Proxy) Run(stopCh <-chan struct{}) (<-chan struct{}, <-chan struct{}, e
 }
 
 func (p *Proxy) httpHandler(w http.ResponseWriter, r *http.Request) {
-	clusterName := p.GetClusterName(r.URL.Path)
-	r.URL.Path = strings.TrimPrefix(r.URL.Path, "/"+clusterName)
+	clusterName, path := p.clusterResolver.Resolve(r)
+	r.URL.Path = path
 	cluster := p.clusterManager.GetCluster(clusterName)
 	if cluster == nil {
-		p.handleError(w, r, errUnauthorized)
+		p.handleError(w, r, errClusterNotFound(clusterName))
 		return
 	}
 
@@ -204,14 +473,19 @@ func (p *Proxy) reviewToken(rw http.ResponseWriter, req *http.Request) bool {
 	var remoteAddr string
 	req, remoteAddr = context.RemoteAddr(req)
 
-	clusterName := p.GetClusterName(req.URL.Path)
-	req.URL.Path = strings.TrimPrefix(req.URL.Path, "/"+clusterName)
-	config := p.clusterManager.GetCluster(clusterName)
+	config := p.clusterManager.GetCluster(p.GetClusterName(req))
+	if config == nil || config.TokenReviewer == nil {
+		klog.V(4).Infof("no cluster available to validate a token in request using TokenReview endpoint (%s)",
+			remoteAddr)
+		return false
+	}
 
 	klog.V(4).Infof("attempting to validate a token in request using TokenReview endpoint(%s)",
 		remoteAddr)
 
-	ok, err := config.TokenReviewer.Review(req)
+	traceCtx, span := tracing.Start(req.Context(), "TokenReview")
+	ok, err := config.TokenReviewer.Review(req.WithContext(traceCtx))
+	span.End(util.TraceLogThreshold)
 	if err != nil {
 		klog.Errorf("unable to authenticate the request via TokenReview due to an error (%s): %s",
 			remoteAddr, err)
@@ -262,17 +536,33 @@ func (p *Proxy) OIDCTokenAuthenticator() authenticator.Token {
 	return p.tokenAuther
 }
 
+// OIDCReady returns an error if an OIDC issuer is not ready to verify tokens.
+func (p *Proxy) OIDCReady() error {
+	return p.issuers.Ready()
+}
+
+// OIDCIssuerURL returns the URL of the primary OIDC issuer.
+func (p *Proxy) OIDCIssuerURL() string {
+	return p.oidcIssuerURL
+}
+
 func (p *Proxy) RunPreShutdownHooks() error {
 	return p.hooks.RunPreShutdownHooks()
 }
 
-func (p *Proxy) GetClusterName(path string) string {
-	// validate the length of the path
-	parts := strings.Split(path, "/")
-	if len(parts) < 2 {
-		return ""
+// tracerProvider returns the configured TracerProvider, or a no-op provider.
+func (p *Proxy) tracerProvider() oteltrace.TracerProvider {
+	if p.config.TracerProvider == nil {
+		return noop.NewTracerProvider()
 	}
-	return parts[1]
+
+	return p.config.TracerProvider
+}
+
+// GetClusterName returns the name of the cluster targeted by the request.
+func (p *Proxy) GetClusterName(req *http.Request) string {
+	clusterName, _ := p.clusterResolver.Resolve(req)
+	return clusterName
 }
 
 func (p *Proxy) SetupClusterProxy(cluster *cluster.Cluster) error {
@@ -306,9 +596,51 @@ func (p *Proxy) SetupClusterProxy(cluster *cluster.Cluster) error {
 		cluster.NoAuthClientTransport = noAuthClientRT
 	}
 
+	if p.config.CircuitBreaker.Enabled() {
+		cluster.Breaker = newClusterBreaker(cluster.Name, p.config.CircuitBreaker)
+	}
+
 	proxyHandler.ErrorHandler = p.handleError
 	proxyHandler.FlushInterval = p.config.FlushInterval
 	cluster.ProxyHandler = proxyHandler
 
 	return nil
 }
+
+// newClusterBreaker returns a circuit breaker for the cluster that logs and
+// records its state changes.
+func newClusterBreaker(clusterName string, config breaker.Config) *breaker.Breaker {
+	metrics.CircuitBreakerState.WithLabelValues(clusterName).Set(float64(breaker.Closed))
+
+	return breaker.New(config, func(state breaker.State) {
+		klog.Infof("circuit breaker of cluster %q is %s", clusterName, state)
+		metrics.CircuitBreakerState.WithLabelValues(clusterName).Set(float64(state))
+	})
+}
+
+// InvalidateDiscoveryCache drops the cached discovery and OpenAPI responses
+// of the cluster.
+func (p *Proxy) InvalidateDiscoveryCache(clusterName string) {
+	if p.discoveryCache != nil {
+		p.discoveryCache.Invalidate(clusterName)
+	}
+}
+
+// CircuitBreakersReady returns an error if the circuit breaker of every
+// cluster is open, as the proxy can then serve no requests. Open breakers of
+// some clusters don't affect readiness.
+func (p *Proxy) CircuitBreakersReady() error {
+	var open []string
+	for _, c := range p.clusterManager.GetAllClusters() {
+		if c.Breaker == nil || c.Breaker.State() != breaker.Open {
+			return nil
+		}
+		open = append(open, c.Name)
+	}
+
+	if len(open) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("circuit breakers of all clusters are open: %s", strings.Join(open, ", "))
+}
@@ -2,33 +2,79 @@
 package proxy
 
 import (
-	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/authenticatorfactory"
 	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
+	"k8s.io/apiserver/pkg/authentication/request/headerrequest"
 	"k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/component-base/metrics/testutil"
+	rbacvalidation "k8s.io/kubernetes/pkg/registry/rbac/validation"
 
 	"github.com/Improwised/kube-oidc-proxy/cmd/app/options"
 	"github.com/Improwised/kube-oidc-proxy/pkg/cluster"
+	"github.com/Improwised/kube-oidc-proxy/pkg/metrics"
 	"github.com/Improwised/kube-oidc-proxy/pkg/mocks"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/audit"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/breaker"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/breakglass"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/claims"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/clientcert"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/crd"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/denyrules"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/discoverycache"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/execpolicy"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/hooks"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/issuer"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/logging"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/maxinflight"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/ratelimit"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/recording"
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/resolver"
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/subjectaccessreview"
 	fakesubjectaccessreview "github.com/Improwised/kube-oidc-proxy/pkg/proxy/subjectaccessreview/fake"
 	"github.com/Improwised/kube-oidc-proxy/pkg/util"
@@ -112,6 +158,7 @@ func (f *fakeRW) Header() http.Header {
 func newFakeR() *http.Request {
 	return &http.Request{
 		RemoteAddr: "fakeAddr",
+		URL:        &url.URL{},
 	}
 }
 
@@ -195,8 +242,7 @@ func (f *fakeRT) RoundTrip(h *http.Request) (*http.Response, error) {
 }
 
 func tryError(t *testing.T, expCode int, err error) *fakeRW {
-	p := new(Proxy)
-	p.handleError = p.newErrorHandler()
+	p := newTestProxy(t)
 
 	frw := newFakeRW()
 	fr := newFakeR()
@@ -218,26 +264,66 @@ func tryError(t *testing.T, expCode int, err error) *fakeRW {
 	return frw
 }
 
-func TestError(t *testing.T) {
-	// no error
-	frw := tryError(t, http.StatusInternalServerError, nil)
-	if !bytes.Equal(bytes.TrimSpace(frw.buffer), []byte("")) {
-		t.Errorf("unexpected response, exp='' got='%s'", string(frw.buffer))
+func decodeStatus(t *testing.T, body []byte) *metav1.Status {
+	status := new(metav1.Status)
+	if err := json.Unmarshal(body, status); err != nil {
+		t.Fatalf("failed to decode status %q: %s", body, err)
 	}
 
-	frw = tryError(t, http.StatusUnauthorized, errUnauthorized)
-	if exp := []byte("Unauthorized"); !bytes.Equal(bytes.TrimSpace(frw.buffer), exp) {
-		t.Errorf("unexpected response, exp='%s' got='%s'", exp, frw.buffer)
+	if status.Kind != "Status" || status.APIVersion != "v1" {
+		t.Errorf("unexpected status type, exp=v1/Status got=%s/%s", status.APIVersion, status.Kind)
 	}
 
-	frw = tryError(t, http.StatusForbidden, errNoName)
-	if exp := []byte("Username claim not available in OIDC Issuer response"); !bytes.Equal(bytes.TrimSpace(frw.buffer), exp) {
-		t.Errorf("unexpected response, exp='%s' got='%s'", exp, frw.buffer)
+	return status
+}
+
+func TestError(t *testing.T) {
+	tests := []struct {
+		err        error
+		expCode    int
+		expReason  metav1.StatusReason
+		expMessage string
+	}{
+		{
+			// no error
+			err:        nil,
+			expCode:    http.StatusInternalServerError,
+			expReason:  metav1.StatusReasonInternalError,
+			expMessage: "Internal error occurred: unknown error",
+		},
+		{
+			err:        errUnauthorized,
+			expCode:    http.StatusUnauthorized,
+			expReason:  metav1.StatusReasonUnauthorized,
+			expMessage: "Unauthorized",
+		},
+		{
+			err:        errNoName,
+			expCode:    http.StatusForbidden,
+			expReason:  metav1.StatusReasonForbidden,
+			expMessage: "Username claim not available in OIDC Issuer response",
+		},
+		{
+			err:        errClusterNotFound("foo"),
+			expCode:    http.StatusNotFound,
+			expReason:  metav1.StatusReasonNotFound,
+			expMessage: `clusters "foo" not found`,
+		},
+		{
+			err:        errors.New("foo"),
+			expCode:    http.StatusInternalServerError,
+			expReason:  metav1.StatusReasonInternalError,
+			expMessage: "Internal error occurred: foo",
+		},
 	}
 
-	frw = tryError(t, http.StatusInternalServerError, errors.New("foo"))
-	if exp := []byte("foo"); !bytes.Equal(bytes.TrimSpace(frw.buffer), exp) {
-		t.Errorf("unexpected response, exp='%s' got='%s'", exp, frw.buffer)
+	for _, test := range tests {
+		frw := tryError(t, test.expCode, test.err)
+
+		status := decodeStatus(t, frw.buffer)
+		assert.Equal(t, int32(test.expCode), status.Code)
+		assert.Equal(t, test.expReason, status.Reason)
+		assert.Equal(t, test.expMessage, status.Message)
 	}
 }
 
@@ -354,17 +440,19 @@ func newTestProxy(t *testing.T) *fakeProxy {
 		fakeToken: fakeToken,
 		fakeRT:    fakeRT,
 		Proxy: &Proxy{
-			clusterManager:    clustermanager,
-			oidcRequestAuther: bearertoken.New(fakeToken),
-			config:            new(Config),
-			hooks:             hooks.New(),
+			clusterManager:  clustermanager,
+			clusterResolver: resolver.NewPath(),
+			requestAuther:   bearertoken.New(fakeToken),
+			config:          new(Config),
+			hooks:           hooks.New(),
+			fleetInFlight:   newFleetInFlight(),
 		},
 	}
 	auditOptions := &options.AuditOptions{
 		AuditWebhookServer: "http://localhost:8080",
 	}
 
-	auditor, err := audit.New(auditOptions, "0.0.0.0:1234", new(server.SecureServingInfo))
+	auditor, err := audit.New(auditOptions, "0.0.0.0:1234", new(server.SecureServingInfo), resolver.NewPath())
 	if err != nil {
 		t.Fatalf("failed to create auditor: %s", err)
 	}
@@ -375,6 +463,61 @@ func newTestProxy(t *testing.T) *fakeProxy {
 	return p
 }
 
+// testCA issues client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := certutil.NewSelfSignedCACert(certutil.Config{CommonName: name}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) bundle(t *testing.T) dynamiccertificates.CAContentProvider {
+	provider, err := dynamiccertificates.NewStaticCAContent(ca.cert.Subject.CommonName,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+func (ca *testCA) issue(t *testing.T, subject pkix.Name) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
 func TestHandlers(t *testing.T) {
 	type authResponse struct {
 		resp *authenticator.Response
@@ -648,7 +791,7 @@ func TestHandlers(t *testing.T) {
 				err:  nil,
 			},
 			expCode: http.StatusForbidden,
-			expBody: "mmosley is not allowed to impersonate user 'a-user'",
+			expBody: `users "a-user" is forbidden: User "mmosley" cannot impersonate resource "users" in API group "" at the cluster scope`,
 		},
 		"an authed request with unauthorized impersonation group should error unauthorized": {
 			req: &http.Request{
@@ -670,7 +813,7 @@ func TestHandlers(t *testing.T) {
 				err:  nil,
 			},
 			expCode: http.StatusForbidden,
-			expBody: "mmosley is not allowed to impersonate group 'a-group'",
+			expBody: `groups "a-group" is forbidden: User "mmosley" cannot impersonate resource "groups" in API group "" at the cluster scope`,
 		},
 		"an authed request with unauthorized impersonation extra should error unauthorized": {
 			req: &http.Request{
@@ -692,7 +835,7 @@ func TestHandlers(t *testing.T) {
 				err:  nil,
 			},
 			expCode: http.StatusForbidden,
-			expBody: "mmosley is not allowed to impersonate extra info 'foo'='bar'",
+			expBody: `userextras.authentication.k8s.io "bar" is forbidden: User "mmosley" cannot impersonate resource "userextras/foo" in API group "authentication.k8s.io" at the cluster scope`,
 		},
 		"an authed request with unauthorized impersonation uid should error unauthorized": {
 			req: &http.Request{
@@ -714,7 +857,7 @@ func TestHandlers(t *testing.T) {
 				err:  nil,
 			},
 			expCode: http.StatusForbidden,
-			expBody: "mmosley is not allowed to impersonate uid 'bar'",
+			expBody: `uids "bar" is forbidden: User "mmosley" cannot impersonate resource "uids" in API group "" at the cluster scope`,
 		},
 
 		"an authed request with impersonation groups missing user should fail": {
@@ -735,7 +878,7 @@ func TestHandlers(t *testing.T) {
 				pass: true,
 				err:  nil,
 			},
-			expCode: http.StatusInternalServerError,
+			expCode: http.StatusBadRequest,
 			expBody: "no Impersonation-User header found for request",
 		},
 
@@ -757,7 +900,7 @@ func TestHandlers(t *testing.T) {
 				pass: true,
 				err:  nil,
 			},
-			expCode: http.StatusInternalServerError,
+			expCode: http.StatusBadRequest,
 			expBody: "no Impersonation-User header found for request",
 		},
 
@@ -779,7 +922,7 @@ func TestHandlers(t *testing.T) {
 				pass: true,
 				err:  nil,
 			},
-			expCode: http.StatusInternalServerError,
+			expCode: http.StatusBadRequest,
 			expBody: "no Impersonation-User header found for request",
 		},
 
@@ -802,7 +945,7 @@ func TestHandlers(t *testing.T) {
 				pass: true,
 				err:  nil,
 			},
-			expCode: http.StatusInternalServerError,
+			expCode: http.StatusBadRequest,
 			expBody: "unknown impersonation header 'Impersonate-Not-Real'",
 		},
 
@@ -959,7 +1102,13 @@ func TestHandlers(t *testing.T) {
 				t.FailNow()
 			}
 
-			if test.expBody != strings.TrimSpace(string(body)) {
+			// errors are returned as a Status
+			message := ""
+			if len(body) > 0 {
+				message = decodeStatus(t, body).Message
+			}
+
+			if test.expBody != message {
 				t.Errorf("got unexpected response body, exp=%s got=%s",
 					test.expBody, body)
 			}
@@ -1075,7 +1224,7 @@ func TestHeadersConfig(t *testing.T) {
 }
 
 func TestGetClusterName(t *testing.T) {
-	proxy := &Proxy{}
+	proxy := &Proxy{clusterResolver: resolver.NewPath()}
 
 	tests := []struct {
 		path     string
@@ -1086,7 +1235,1849 @@ func TestGetClusterName(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		clusterName := proxy.GetClusterName(test.path)
+		req := &http.Request{URL: &url.URL{Path: test.path}}
+		clusterName := proxy.GetClusterName(req)
 		assert.Equal(t, test.expected, clusterName, "unexpected cluster name for path: %s", test.path)
 	}
 }
+
+func TestHostRouting(t *testing.T) {
+	p := newTestProxy(t)
+	hostResolver, err := resolver.NewHost("{cluster}.k8s-proxy.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.clusterResolver = hostResolver
+
+	authResponse := &authenticator.Response{
+		User: &user.DefaultInfo{
+			Name: "a-user",
+		},
+	}
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil)
+
+	p.fakeRT.expUser = "a-user"
+	p.fakeRT.expGroup = []string{user.AllAuthenticated}
+
+	var gotPath string
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		gotPath = req.URL.Path
+		if _, err := p.fakeRT.RoundTrip(req); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}))
+
+	req := &http.Request{
+		Host: "test-cluster.k8s-proxy.example.com:6443",
+		Header: http.Header{
+			"Authorization": []string{"bearer fake-token"},
+		},
+		URL: &url.URL{Path: "/version"},
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "/version", gotPath)
+	assert.Equal(t, "test-cluster", p.GetClusterName(req))
+
+	p.ctrl.Finish()
+}
+
+func TestIssuerClusters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	caCert, _, err := certutil.GenerateSelfSignedCertKey("issuer.example.com", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, caCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newIssuer := func(url string, clusters ...string) *issuer.Issuer {
+		i, err := issuer.New(ctx, issuer.IssuerConfig{
+			URL:           url,
+			Audiences:     []string{"kube-oidc-proxy"},
+			CAFile:        caFile,
+			UsernameClaim: "sub",
+			SigningAlgs:   []string{"RS256"},
+			Clusters:      clusters,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+
+	issuers, err := issuer.NewUnion(
+		newIssuer("https://test.example.com", "test-*"),
+		newIssuer("https://prod.example.com", "prod-*"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		issuerURL string
+		expCode   int
+	}{
+		"issuer allowed for the cluster": {
+			issuerURL: "https://test.example.com",
+			expCode:   http.StatusOK,
+		},
+		"issuer restricted to other clusters": {
+			issuerURL: "https://prod.example.com",
+			expCode:   http.StatusUnauthorized,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := newTestProxy(t)
+			p.issuers = issuers
+
+			token, err := util.FakeJWT(test.issuerURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			authResponse := &authenticator.Response{
+				User: &user.DefaultInfo{
+					Name: "a-user",
+				},
+			}
+			p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), token).Return(authResponse, true, nil)
+
+			p.fakeRT.expUser = "a-user"
+			p.fakeRT.expGroup = []string{user.AllAuthenticated}
+
+			handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if _, err := p.fakeRT.RoundTrip(req); err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			}))
+
+			req := &http.Request{
+				Header: http.Header{
+					"Authorization": []string{"bearer " + token},
+				},
+				URL: &url.URL{Path: "/test-cluster/version"},
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expCode, w.Result().StatusCode)
+
+			p.ctrl.Finish()
+		})
+	}
+}
+
+func TestClustersEndpoint(t *testing.T) {
+	p := newTestProxy(t)
+
+	bindings := func(subject rbacv1.Subject) *util.RBAC {
+		return &util.RBAC{
+			ClusterRoleBindings: []*rbacv1.ClusterRoleBinding{
+				{Subjects: []rbacv1.Subject{subject}},
+			},
+		}
+	}
+
+	p.clusterManager.AddOrUpdateCluster(&cluster.Cluster{
+		Name:       "by-group",
+		IsStatic:   true,
+		RBACConfig: bindings(rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "by-group:devops"}),
+	})
+	byUser := &cluster.Cluster{
+		Name:       "by-user",
+		RBACConfig: bindings(rbacv1.Subject{Kind: rbacv1.UserKind, Name: "a-user"}),
+	}
+	byUser.RecordHealth(errors.New("readyz returned status code 500"), time.Millisecond, time.Now())
+	p.clusterManager.AddOrUpdateCluster(byUser)
+	p.clusterManager.AddOrUpdateCluster(&cluster.Cluster{
+		Name:       "no-access",
+		RBACConfig: bindings(rbacv1.Subject{Kind: rbacv1.UserKind, Name: "another-user"}),
+	})
+
+	authResponse := &authenticator.Response{
+		User: &user.DefaultInfo{
+			Name:   "a-user",
+			Groups: []string{"by-group:devops"},
+		},
+	}
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil)
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request passed to the cluster handler: %s", req.URL.Path)
+	}))
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		Header: http.Header{
+			"Authorization": []string{"bearer fake-token"},
+		},
+		URL: &url.URL{Path: "/_clusters"},
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var list ClusterList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode cluster list: %s", err)
+	}
+
+	if assert.Len(t, list.Clusters, 2) {
+		assert.Equal(t, "by-group", list.Clusters[0].Name)
+		assert.Equal(t, clusterTypeStatic, list.Clusters[0].Type)
+		assert.Equal(t, "by-user", list.Clusters[1].Name)
+		assert.Equal(t, clusterTypeDynamic, list.Clusters[1].Type)
+		// Health is taken from the background checks, not queried.
+		assert.Equal(t, string(cluster.HealthUnknown), list.Clusters[0].Health)
+		assert.Equal(t, string(cluster.HealthUnhealthy), list.Clusters[1].Health)
+		assert.Equal(t, "readyz returned status code 500", list.Clusters[1].Error)
+	}
+
+	p.ctrl.Finish()
+}
+
+func TestKubeconfigEndpoint(t *testing.T) {
+	p := newTestProxy(t)
+	p.oidcIssuerURL = "https://issuer.example.com"
+	p.oidcClientID = "kube-oidc-proxy"
+	p.config.KubeconfigServerAddress = "https://proxy.example.com:6443"
+
+	// The serving chain holds the serving certificate and its CA
+	servingChain, servingKey, err := certutil.GenerateSelfSignedCertKey("proxy.example.com", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servingCerts, err := certutil.ParseCertsPEM(servingChain)
+	if err != nil || len(servingCerts) != 2 {
+		t.Fatalf("unexpected serving chain: %v", err)
+	}
+	p.secureServingInfo = &server.SecureServingInfo{Cert: newStaticCertKey(t, servingChain, servingKey)}
+
+	p.clusterManager.AddOrUpdateCluster(&cluster.Cluster{
+		Name: "dev",
+		RBACConfig: &util.RBAC{
+			ClusterRoleBindings: []*rbacv1.ClusterRoleBinding{
+				{Subjects: []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "a-user"}}},
+			},
+		},
+	})
+
+	authResponse := &authenticator.Response{
+		User: &user.DefaultInfo{Name: "a-user"},
+	}
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil)
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request passed to the cluster handler: %s", req.URL.Path)
+	}))
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		Header: http.Header{
+			"Authorization": []string{"bearer fake-token"},
+		},
+		URL: &url.URL{Path: "/_kubeconfig"},
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		t.FailNow()
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read kubeconfig: %s", err)
+	}
+
+	config, err := clientcmd.Load(body)
+	if err != nil {
+		t.Fatalf("failed to decode kubeconfig: %s", err)
+	}
+
+	assert.Equal(t, "dev", config.CurrentContext)
+	assert.Len(t, config.Contexts, 1)
+	if assert.Contains(t, config.Clusters, "dev") {
+		assert.Equal(t, "https://proxy.example.com:6443/dev", config.Clusters["dev"].Server)
+		caCerts, err := certutil.ParseCertsPEM(config.Clusters["dev"].CertificateAuthorityData)
+		if assert.NoError(t, err) && assert.Len(t, caCerts, 1) {
+			assert.Equal(t, servingCerts[1].Raw, caCerts[0].Raw)
+		}
+	}
+
+	authInfo := config.AuthInfos[config.Contexts["dev"].AuthInfo]
+	if assert.NotNil(t, authInfo) && assert.NotNil(t, authInfo.Exec) {
+		assert.Contains(t, authInfo.Exec.Args, "--oidc-issuer-url=https://issuer.example.com")
+		assert.Contains(t, authInfo.Exec.Args, "--oidc-client-id=kube-oidc-proxy")
+	}
+
+	// Host based routing renders the cluster hostname and keeps the port.
+	p.config.ClusterRoutingMode = resolver.ModeHost
+	p.config.ClusterHostTemplate = "{cluster}.proxy.example.com"
+	serverURL, err := p.kubeconfigServerURL(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://dev.proxy.example.com:6443", p.clusterServer(*serverURL, "dev"))
+
+	// Cluster hosts embed the CA of the SNI certificate served for them.
+	sniChain, sniKey, err := certutil.GenerateSelfSignedCertKey("dev.proxy.example.com", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sniCerts, err := certutil.ParseCertsPEM(sniChain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sniCert, err := dynamiccertificates.NewStaticSNICertKeyContent("dev", sniChain, sniKey, "*.proxy.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.secureServingInfo.SNICerts = []dynamiccertificates.SNICertKeyContentProvider{sniCert}
+
+	for server, expCA := range map[string]*x509.Certificate{
+		"https://dev.proxy.example.com:6443":   sniCerts[len(sniCerts)-1],
+		"https://proxy.example.com:6443/dev":   servingCerts[1],
+		"https://a.dev.proxy.example.com:6443": servingCerts[1],
+	} {
+		caData, err := p.kubeconfigCA(server)
+		if assert.NoError(t, err, server) {
+			caCerts, err := certutil.ParseCertsPEM(caData)
+			if assert.NoError(t, err) && assert.Len(t, caCerts, 1) {
+				assert.Equal(t, expCA.Raw, caCerts[0].Raw, server)
+			}
+		}
+	}
+
+	// A serving certificate without its CA requires a CA file.
+	leaf := pem.EncodeToMemory(&pem.Block{Type: certutil.CertificateBlockType, Bytes: servingCerts[0].Raw})
+	p.secureServingInfo = &server.SecureServingInfo{Cert: newStaticCertKey(t, leaf, servingKey)}
+	_, err = p.kubeconfigCA("https://proxy.example.com:6443/dev")
+	assert.ErrorIs(t, err, errNoKubeconfigCA)
+
+	// Only the kubeconfig endpoint fails.
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil)
+	req.Header.Set("Authorization", "bearer fake-token")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, []byte("ca-data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p.config.KubeconfigCAFile = caFile
+	caData, err := p.kubeconfigCA("https://proxy.example.com:6443/dev")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("ca-data"), caData)
+
+	p.ctrl.Finish()
+}
+
+func newStaticCertKey(t *testing.T, cert, key []byte) dynamiccertificates.CertKeyContentProvider {
+	provider, err := dynamiccertificates.NewStaticCertKeyContent("serving", cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+func TestRequiredClaims(t *testing.T) {
+	p := newTestProxy(t)
+	p.requiredClaims = &claims.Policy{
+		Rules: []claims.Rule{{
+			Clusters:       []string{"test-*"},
+			RequiredClaims: map[string]string{"acr": "mfa"},
+		}},
+	}
+
+	token, err := util.FakeJWT("https://issuer.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authResponse := &authenticator.Response{
+		User: &user.DefaultInfo{Name: "a-user"},
+	}
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), token).Return(authResponse, true, nil)
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request passed to the cluster handler: %s", req.URL.Path)
+	}))
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		Header: http.Header{
+			"Authorization": []string{"bearer " + token},
+		},
+		URL: &url.URL{Path: "/test-cluster/api/v1/namespaces"},
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := decodeStatus(t, body)
+	assert.Equal(t, metav1.StatusReasonForbidden, status.Reason)
+	assert.Contains(t, status.Message, `requires claim "acr"="mfa"`)
+
+	p.ctrl.Finish()
+}
+
+func TestUnknownCluster(t *testing.T) {
+	p := newTestProxy(t)
+
+	authResponse := &authenticator.Response{
+		User: &user.DefaultInfo{Name: "a-user"},
+	}
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil)
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request passed to the cluster handler: %s", req.URL.Path)
+	}))
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		Header: http.Header{
+			"Authorization": []string{"bearer fake-token"},
+		},
+		URL: &url.URL{Path: "/not-a-cluster/api/v1/namespaces"},
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := decodeStatus(t, body)
+	assert.Equal(t, metav1.StatusReasonNotFound, status.Reason)
+	if assert.NotNil(t, status.Details) {
+		assert.Equal(t, "not-a-cluster", status.Details.Name)
+		assert.Equal(t, "clusters", status.Details.Kind)
+	}
+
+	p.ctrl.Finish()
+}
+
+func TestMetrics(t *testing.T) {
+	metrics.Register()
+
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+	p.requestInfo = genericapirequest.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	// The user may only list pods
+	clusterRoles := []*rbacv1.ClusterRole{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods"},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"pods"},
+			Verbs:     []string{"list"},
+		}},
+	}}
+	clusterRoleBindings := []*rbacv1.ClusterRoleBinding{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods"},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "a-user"}},
+		RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "pods"},
+	}}
+	_, staticRoles := rbacvalidation.NewTestRuleResolver(nil, nil, clusterRoles, clusterRoleBindings)
+	p.clusterManager.GetCluster("test-cluster").Authorizer = util.NewAuthorizer(staticRoles)
+
+	authResponse := &authenticator.Response{
+		User: &user.DefaultInfo{Name: "a-user"},
+	}
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "bad-token").Return(nil, false, nil).Times(3)
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil).Times(5)
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	for _, test := range []struct {
+		token, path string
+		expCode     int
+	}{
+		{"bad-token", "/test-cluster/api/v1/namespaces", http.StatusUnauthorized},
+		{"fake-token", "/test-cluster/version", http.StatusOK},
+		{"fake-token", "/test-cluster/api/v1/pods", http.StatusOK},
+		{"fake-token", "/not-a-cluster/version", http.StatusNotFound},
+		// Random paths of unauthorized requests don't create new series
+		{"fake-token", "/test-cluster/api/v1/random-c", http.StatusForbidden},
+		{"fake-token", "/test-cluster/api/v1/random-d", http.StatusForbidden},
+		// Random paths of unauthenticated requests don't create new series
+		{"bad-token", "/test-cluster/api/v1/random-a", http.StatusUnauthorized},
+		{"bad-token", "/unknown/api/v1/random-b", http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, &http.Request{
+			Method: http.MethodGet,
+			Header: http.Header{
+				"Authorization": []string{"bearer " + test.token},
+			},
+			URL:  &url.URL{Path: test.path},
+			Body: http.NoBody,
+		})
+		assert.Equal(t, test.expCode, w.Code, test.path)
+	}
+
+	for _, labels := range [][]string{
+		{"test-cluster", "", "", "401", metrics.AuthPathNone},
+		{"test-cluster", "get", "", "200", metrics.AuthPathNoImpersonation},
+		{"test-cluster", "list", "pods", "200", metrics.AuthPathNoImpersonation},
+		{"test-cluster", "", "", "403", metrics.AuthPathNoImpersonation},
+		{metrics.UnknownCluster, "", "", "404", metrics.AuthPathNone},
+		{metrics.UnknownCluster, "", "", "401", metrics.AuthPathNone},
+	} {
+		count, err := testutil.GetCounterMetricValue(metrics.Requests.WithLabelValues(labels...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expCount := float64(1)
+		if labels[0] == "test-cluster" && (labels[3] == "401" || labels[3] == "403") {
+			expCount = 2
+		}
+		assert.Equal(t, expCount, count, labels)
+	}
+
+	failures, err := testutil.GetCounterMetricValue(metrics.AuthenticationFailures.WithLabelValues("test-cluster"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, float64(2), failures)
+
+	p.ctrl.Finish()
+}
+
+type traceRT struct {
+	header http.Header
+}
+
+func (f *traceRT) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.header = req.Header.Clone()
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestTracing(t *testing.T) {
+	p := newTestProxy(t)
+
+	exporter := tracetest.NewInMemoryExporter()
+	p.config.TracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSyncer(exporter),
+	)
+
+	rt := new(traceRT)
+	testCluster := p.clusterManager.GetCluster("test-cluster")
+	testCluster.ClientTransport = rt
+
+	authResponse := &authenticator.Response{
+		User: &user.DefaultInfo{Name: "a-user"},
+	}
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil)
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		resp, err := testCluster.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw.WriteHeader(resp.StatusCode)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, &http.Request{
+		Method: http.MethodGet,
+		Header: http.Header{
+			"Authorization": []string{"bearer fake-token"},
+		},
+		URL: &url.URL{Path: "/test-cluster/version"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	spans := exporter.GetSpans()
+	names := make(map[string]string)
+	for _, span := range spans {
+		names[span.Name] = span.SpanContext.TraceID().String()
+	}
+
+	if assert.Contains(t, names, "KubeOIDCProxy") {
+		traceID := names["KubeOIDCProxy"]
+		for _, name := range []string{"Authenticate", "RoundTrip"} {
+			if assert.Contains(t, names, name) {
+				assert.Equal(t, traceID, names[name], name)
+			}
+		}
+
+		// The trace context is propagated to the API server
+		assert.Contains(t, rt.header.Get("Traceparent"), traceID)
+	}
+
+	p.ctrl.Finish()
+}
+
+func TestRateLimit(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+	p.rateLimiter = ratelimit.New(&ratelimit.Policy{Limits: []ratelimit.Limit{
+		{Key: ratelimit.KeyUser, QPS: 0.1, Burst: 1},
+	}})
+
+	authResponse := &authenticator.Response{
+		User: &user.DefaultInfo{Name: "a-user"},
+	}
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil).Times(4)
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(path string) *http.Response {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, &http.Request{
+			Method: http.MethodGet,
+			Header: http.Header{
+				"Authorization": []string{"bearer fake-token"},
+			},
+			URL: &url.URL{Path: path},
+		})
+		return w.Result()
+	}
+
+	assert.Equal(t, http.StatusOK, serve("/test-cluster/version").StatusCode)
+
+	// The endpoints of the proxy are limited separately from the clusters
+	assert.Equal(t, http.StatusOK, serve("/_clusters").StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, serve("/_clusters").StatusCode)
+
+	resp := serve("/test-cluster/version")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "10", resp.Header.Get("Retry-After"))
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := decodeStatus(t, body)
+	assert.Equal(t, metav1.StatusReasonTooManyRequests, status.Reason)
+	if assert.NotNil(t, status.Details) {
+		assert.Equal(t, int32(10), status.Details.RetryAfterSeconds)
+	}
+
+	p.ctrl.Finish()
+}
+
+func TestMaxInFlight(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+	p.requestInfo = genericapirequest.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+	p.maxInFlight = maxinflight.New(maxinflight.Limits{}, maxinflight.Limits{NonMutating: 1})
+
+	authResponse := &authenticator.Response{
+		User: &user.DefaultInfo{Name: "a-user"},
+	}
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil).Times(3)
+
+	inFlight, unblock := make(chan struct{}), make(chan struct{})
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			close(inFlight)
+			<-unblock
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(method string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, &http.Request{
+			Method: method,
+			Header: http.Header{
+				"Authorization": []string{"bearer fake-token"},
+			},
+			URL: &url.URL{Path: "/test-cluster/version"},
+		})
+		return w.Code
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- serve(http.MethodGet)
+	}()
+	<-inFlight
+
+	// The user's non-mutating request is still in flight
+	assert.Equal(t, http.StatusTooManyRequests, serve(http.MethodGet))
+
+	// Mutating requests are limited separately
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost))
+
+	close(unblock)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	p.ctrl.Finish()
+}
+
+type failingRT struct {
+	calls int
+}
+
+func (f *failingRT) RoundTrip(*http.Request) (*http.Response, error) {
+	f.calls++
+	return nil, errors.New("dial tcp 10.0.0.1:6443: connect: connection refused")
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	metrics.Register()
+
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+
+	rt := new(failingRT)
+	testCluster := p.clusterManager.GetCluster("test-cluster")
+	testCluster.NoAuthClientTransport = rt
+	testCluster.Breaker = newClusterBreaker("test-cluster", breaker.Config{
+		FailureThreshold: 2,
+		OpenTimeout:      30 * time.Second,
+	})
+
+	authResponse := &authenticator.Response{
+		User: &user.DefaultInfo{Name: "a-user"},
+	}
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil).Times(3)
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		resp, err := testCluster.RoundTrip(req)
+		if err != nil {
+			p.handleError(rw, req, err)
+			return
+		}
+		rw.WriteHeader(resp.StatusCode)
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, &http.Request{
+			Method: http.MethodGet,
+			Header: http.Header{
+				"Authorization": []string{"bearer fake-token"},
+			},
+			URL: &url.URL{Path: "/test-cluster/version"},
+		})
+		return w
+	}
+
+	assert.NoError(t, p.CircuitBreakersReady())
+
+	// Consecutive dial failures open the breaker
+	assert.Equal(t, http.StatusInternalServerError, serve().Code)
+	assert.Equal(t, http.StatusInternalServerError, serve().Code)
+	assert.Equal(t, 2, rt.calls)
+
+	// Requests then fail fast without reaching the API server
+	w := serve()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, 2, rt.calls)
+
+	status := decodeStatus(t, w.Body.Bytes())
+	assert.Equal(t, metav1.StatusReasonServiceUnavailable, status.Reason)
+	assert.Contains(t, status.Message, `cluster "test-cluster" is unavailable`)
+
+	state, err := testutil.GetGaugeMetricValue(metrics.CircuitBreakerState.WithLabelValues("test-cluster"))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(breaker.Open), state)
+
+	// The only cluster is failing fast, so the proxy is not ready
+	assert.Error(t, p.CircuitBreakersReady())
+
+	p.ctrl.Finish()
+}
+
+func TestDiscoveryCache(t *testing.T) {
+	tests := map[string]struct {
+		ttl            time.Duration
+		expUpstream    int
+		expRevalidated bool
+	}{
+		"fresh entries are served from the cache": {
+			ttl:         time.Hour,
+			expUpstream: 1,
+		},
+		"stale entries are revalidated with their ETag": {
+			ttl:            time.Nanosecond,
+			expUpstream:    2,
+			expRevalidated: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := newTestProxy(t)
+			p.config.DisableImpersonation = true
+			p.discoveryCache = discoverycache.New(test.ttl)
+
+			authResponse := &authenticator.Response{
+				User: &user.DefaultInfo{Name: "a-user"},
+			}
+			p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil).AnyTimes()
+
+			var upstream int
+			var revalidated bool
+			handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				upstream++
+				rw.Header().Set("ETag", `"v1"`)
+				rw.Header().Set("Audit-Id", strconv.Itoa(upstream))
+				if req.Header.Get("If-None-Match") == `"v1"` {
+					revalidated = true
+					rw.WriteHeader(http.StatusNotModified)
+					return
+				}
+				rw.Header().Set("Content-Type", "application/json")
+				_, _ = rw.Write([]byte(`{"kind":"APIVersions"}`))
+			}))
+
+			serve := func(header http.Header) *httptest.ResponseRecorder {
+				header.Set("Authorization", "bearer fake-token")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, &http.Request{
+					Method: http.MethodGet,
+					Header: header,
+					URL:    &url.URL{Path: "/test-cluster/api"},
+				})
+				return w
+			}
+
+			for i := 0; i < 2; i++ {
+				w := serve(http.Header{"Accept": []string{"application/json"}})
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.Equal(t, `{"kind":"APIVersions"}`, w.Body.String())
+				assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			}
+			assert.Equal(t, test.expUpstream, upstream)
+			assert.Equal(t, test.expRevalidated, revalidated)
+
+			// The client's own ETag is answered from the cache
+			if test.ttl == time.Hour {
+				w := serve(http.Header{
+					"Accept":        []string{"application/json"},
+					"If-None-Match": []string{`"v1"`},
+				})
+				assert.Equal(t, http.StatusNotModified, w.Code)
+				assert.Equal(t, test.expUpstream, upstream)
+			}
+
+			// Responses are cached per Accept header
+			serve(http.Header{"Accept": []string{"application/vnd.kubernetes.protobuf"}})
+			assert.Equal(t, test.expUpstream+1, upstream)
+
+			// Invalidated entries are requested again
+			p.InvalidateDiscoveryCache("test-cluster")
+			revalidated = false
+			serve(http.Header{"Accept": []string{"application/json"}})
+			assert.Equal(t, test.expUpstream+2, upstream)
+			assert.False(t, revalidated)
+
+			p.ctrl.Finish()
+		})
+	}
+}
+
+func TestFleet(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+	p.requestInfo = genericapirequest.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	// Each cluster grants a-user the listed resources
+	addCluster := func(name string, clusterLabels map[string]string, resources ...string) {
+		rbacConfig := &util.RBAC{
+			ClusterRoles: []*rbacv1.ClusterRole{{
+				ObjectMeta: metav1.ObjectMeta{Name: "reader"},
+				Rules: []rbacv1.PolicyRule{{
+					APIGroups: []string{""},
+					Resources: resources,
+					Verbs:     []string{"get", "list"},
+				}},
+			}},
+			ClusterRoleBindings: []*rbacv1.ClusterRoleBinding{{
+				ObjectMeta: metav1.ObjectMeta{Name: "reader"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: "a-user"}},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "reader"},
+			}},
+		}
+		_, staticRoles := rbacvalidation.NewTestRuleResolver(nil, nil, rbacConfig.ClusterRoles, rbacConfig.ClusterRoleBindings)
+
+		p.clusterManager.AddOrUpdateCluster(&cluster.Cluster{
+			Name:       name,
+			Labels:     clusterLabels,
+			RBACConfig: rbacConfig,
+			Authorizer: util.NewAuthorizer(staticRoles),
+		})
+	}
+	addCluster("eu", map[string]string{"env": "prod"}, "pods")
+	addCluster("us", map[string]string{"env": "prod"}, "configmaps")
+	addCluster("dev", map[string]string{"env": "dev"}, "pods")
+
+	authResponse := &authenticator.Response{
+		User: &user.DefaultInfo{Name: "a-user"},
+	}
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(authResponse, true, nil).AnyTimes()
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		clusterName := strings.Split(req.URL.Path, "/")[1]
+		if clusterName == "aborted" {
+			// As the reverse proxy does when it fails to copy the response
+			panic(http.ErrAbortHandler)
+		}
+		assert.Equal(t, "/"+clusterName+"/api/v1/pods", req.URL.Path)
+		assert.Empty(t, req.URL.Query().Get("limit"))
+
+		rw.Header().Set("Content-Type", "application/json")
+		if strings.Contains(req.Header.Get("Accept"), "as=Table") {
+			fmt.Fprintf(rw, `{"kind":"Table","apiVersion":"meta.k8s.io/v1",`+
+				`"columnDefinitions":[{"name":"Name","type":"string","format":"name","description":"","priority":0}],`+
+				`"rows":[{"cells":["pod-%[1]s"],"object":{"kind":"PartialObjectMetadata","apiVersion":"meta.k8s.io/v1","metadata":{"name":"pod-%[1]s"}}}]}`,
+				clusterName)
+			return
+		}
+		fmt.Fprintf(rw, `{"kind":"PodList","apiVersion":"v1","items":[{"metadata":{"name":"pod-%s"}}]}`, clusterName)
+	}))
+
+	serve := func(method, path, query, accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, &http.Request{
+			Method: method,
+			Header: http.Header{
+				"Authorization": []string{"bearer fake-token"},
+				"Accept":        []string{accept},
+			},
+			URL: &url.URL{Path: path, RawQuery: query},
+		})
+		return w
+	}
+
+	// Items are merged from the matching clusters, and clusters denying the
+	// request are reported
+	w := serve(http.MethodGet, "/_fleet/env=prod/api/v1/pods", "limit=500", "application/json")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, w.Header().Values("Warning"), 1)
+
+	var list fleetList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("failed to decode fleet list: %s", err)
+	}
+	assert.Equal(t, "List", list.Kind)
+	if assert.Len(t, list.Items, 1) {
+		item := unstructured.Unstructured{Object: list.Items[0]}
+		assert.Equal(t, "Pod", item.GetKind())
+		assert.Equal(t, "pod-eu", item.GetName())
+		assert.Equal(t, "eu", item.GetAnnotations()[FleetClusterAnnotation])
+	}
+	if assert.Len(t, list.Failures, 1) {
+		assert.Equal(t, "us", list.Failures[0].Cluster)
+		assert.Equal(t, int32(http.StatusForbidden), list.Failures[0].Code)
+	}
+
+	// Tables are merged with a column for the cluster
+	w = serve(http.MethodGet, "/_all/api/v1/pods", "limit=500", tableAccept+",application/json")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var table metav1.Table
+	if err := json.Unmarshal(w.Body.Bytes(), &table); err != nil {
+		t.Fatalf("failed to decode fleet table: %s", err)
+	}
+	if assert.Len(t, table.ColumnDefinitions, 2) {
+		assert.Equal(t, "Cluster", table.ColumnDefinitions[0].Name)
+	}
+	if assert.Len(t, table.Rows, 2) {
+		assert.Equal(t, []interface{}{"dev", "pod-dev"}, table.Rows[0].Cells)
+		assert.Equal(t, []interface{}{"eu", "pod-eu"}, table.Rows[1].Cells)
+		assert.Contains(t, string(table.Rows[1].Object.Raw), FleetClusterAnnotation)
+	}
+
+	// The request fails if every cluster fails
+	w = serve(http.MethodGet, "/_all/api/v1/secrets", "", "application/json")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Only reads are supported
+	w = serve(http.MethodPost, "/_all/api/v1/pods", "", "application/json")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Fleet lists are not paginated
+	w = serve(http.MethodGet, "/_all/api/v1/pods", "limit=500&continue=abc", "application/json")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "continue is not supported")
+
+	// Responses larger than the maximum size fail the request
+	maxResponseSize := fleetMaxResponseSize
+	fleetMaxResponseSize = 100
+	w = serve(http.MethodGet, "/_all/api/v1/pods", "", "application/json")
+	fleetMaxResponseSize = maxResponseSize
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "fleet response exceeds 100 bytes")
+
+	// Aborted responses are failures of their cluster
+	addCluster("aborted", map[string]string{"env": "aborted"}, "pods")
+	w = serve(http.MethodGet, "/_fleet/env=aborted/api/v1/pods", "", "application/json")
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	// Users may only have a few fleet requests in flight
+	for range fleetMaxInFlightPerUser {
+		release, ok := p.fleetInFlight.Acquire("", "a-user", maxinflight.NonMutating)
+		if !ok {
+			t.Fatal("expected to acquire a fleet request")
+		}
+		defer release()
+	}
+	w = serve(http.MethodGet, "/_all/api/v1/pods", "", "application/json")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	p.ctrl.Finish()
+}
+
+func TestParseFleetPath(t *testing.T) {
+	tests := map[string]struct {
+		escapedPath string
+		expSelector string
+		expPath     string
+		expErr      bool
+	}{
+		"all clusters": {
+			escapedPath: "/_all/api/v1/pods",
+			expSelector: "",
+			expPath:     "/api/v1/pods",
+		},
+		"label keys may contain an escaped slash": {
+			escapedPath: "/_fleet/topology.kubernetes.io%2Fregion=eu,env!=dev/apis/apps/v1/deployments",
+			expSelector: "env!=dev,topology.kubernetes.io/region=eu",
+			expPath:     "/apis/apps/v1/deployments",
+		},
+		"invalid selector": {
+			escapedPath: "/_fleet/env in prod/api/v1/pods",
+			expErr:      true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			selector, path, err := parseFleetPath(test.escapedPath)
+			if test.expErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expSelector, selector.String())
+			assert.Equal(t, test.expPath, path)
+		})
+	}
+}
+
+func TestSessionRecording(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+	p.requestInfo = genericapirequest.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+	p.config.SessionRecordingViewerGroups = []string{"auditors"}
+
+	store, err := recording.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.config.SessionRecorder = recording.New(store, recording.Config{})
+
+	clusterRoles := []*rbacv1.ClusterRole{{
+		ObjectMeta: metav1.ObjectMeta{Name: "exec"},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"pods/exec"},
+			Verbs:     []string{"get", "create"},
+		}},
+	}}
+	clusterRoleBindings := []*rbacv1.ClusterRoleBinding{{
+		ObjectMeta: metav1.ObjectMeta{Name: "exec"},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "auditors"}},
+		RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "exec"},
+	}}
+	_, staticRoles := rbacvalidation.NewTestRuleResolver(nil, nil, clusterRoles, clusterRoleBindings)
+	p.clusterManager.AddOrUpdateCluster(&cluster.Cluster{
+		Name:       "prod",
+		RBACConfig: &util.RBAC{ClusterRoles: clusterRoles, ClusterRoleBindings: clusterRoleBindings},
+		Authorizer: util.NewAuthorizer(staticRoles),
+	})
+
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "auditor-token").Return(&authenticator.Response{
+		User: &user.DefaultInfo{Name: "auditor", Groups: []string{"auditors"}},
+	}, true, nil).AnyTimes()
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "other-token").Return(&authenticator.Response{
+		User: &user.DefaultInfo{Name: "other"},
+	}, true, nil).AnyTimes()
+
+	// The cluster upgrades the connection and sends "hello" on stdout
+	server := httptest.NewServer(p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, brw, err := http.NewResponseController(rw).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = brw.Flush()
+		_, _ = conn.Write([]byte{0x82, 6, 1, 'h', 'e', 'l', 'l', 'o'})
+	})))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fmt.Fprintf(conn, "GET /prod/api/v1/namespaces/default/pods/web/exec?container=app&command=sh HTTP/1.1\r\n"+
+		"Host: proxy\r\nAuthorization: Bearer auditor-token\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Contains(t, string(session), "101 Switching Protocols")
+	conn.Close()
+
+	get := func(path, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get("/_recordings", "auditor-token")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var list RecordingList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode recording list: %s", err)
+	}
+	if !assert.Len(t, list.Recordings, 1) {
+		return
+	}
+	meta := list.Recordings[0]
+	assert.Equal(t, "auditor", meta.User)
+	assert.Equal(t, "prod", meta.Cluster)
+	assert.Equal(t, "web", meta.Pod)
+	assert.Equal(t, "app", meta.Container)
+	assert.Equal(t, []string{"sh"}, meta.Command)
+
+	resp = get("/_recordings/"+meta.ID, "auditor-token")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	cast, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(cast), `"o","hello"`)
+
+	// Only viewer groups can access recordings
+	assert.Equal(t, http.StatusForbidden, get("/_recordings", "other-token").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get("/_recordings/unknown", "auditor-token").StatusCode)
+
+	p.ctrl.Finish()
+}
+
+func TestExecPolicy(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+	p.requestInfo = genericapirequest.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+	p.execPolicy = &execpolicy.Policy{Rules: []execpolicy.Rule{{
+		Groups: []string{"developers"},
+		Allow:  []string{"cat", "ls"},
+	}}}
+
+	// Collect the logs sent to the audit webhook
+	var (
+		mu   sync.Mutex
+		logs []audit.Log
+	)
+	webhook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var log audit.Log
+		if assert.NoError(t, json.NewDecoder(req.Body).Decode(&log)) {
+			mu.Lock()
+			logs = append(logs, log)
+			mu.Unlock()
+		}
+	}))
+	defer webhook.Close()
+
+	auditor, err := audit.New(&options.AuditOptions{AuditWebhookServer: webhook.URL},
+		"0.0.0.0:1234", new(server.SecureServingInfo), resolver.NewPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.auditor = auditor
+
+	clusterRoles := []*rbacv1.ClusterRole{{
+		ObjectMeta: metav1.ObjectMeta{Name: "exec"},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"pods/exec", "pods/attach"},
+			Verbs:     []string{"get", "create"},
+		}},
+	}}
+	clusterRoleBindings := []*rbacv1.ClusterRoleBinding{{
+		ObjectMeta: metav1.ObjectMeta{Name: "exec"},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "developers"}},
+		RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "exec"},
+	}}
+	_, staticRoles := rbacvalidation.NewTestRuleResolver(nil, nil, clusterRoles, clusterRoleBindings)
+	p.clusterManager.AddOrUpdateCluster(&cluster.Cluster{
+		Name:       "prod",
+		RBACConfig: &util.RBAC{ClusterRoles: clusterRoles, ClusterRoleBindings: clusterRoleBindings},
+		Authorizer: util.NewAuthorizer(staticRoles),
+	})
+
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(&authenticator.Response{
+		User: &user.DefaultInfo{Name: "dev", Groups: []string{"developers"}},
+	}, true, nil).Times(3)
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(subresource, query string) *http.Response {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, &http.Request{
+			Method: http.MethodGet,
+			Header: http.Header{
+				"Authorization": []string{"bearer fake-token"},
+			},
+			URL:  &url.URL{Path: "/prod/api/v1/namespaces/default/pods/web/" + subresource, RawQuery: query},
+			Body: http.NoBody,
+		})
+		return w.Result()
+	}
+
+	assert.Equal(t, http.StatusOK, serve("exec", "command=cat&command=/etc/hosts").StatusCode)
+
+	resp := serve("exec", "command=sh&command=-c&command=cat")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := decodeStatus(t, body)
+	assert.Equal(t, metav1.StatusReasonForbidden, status.Reason)
+	assert.Contains(t, status.Message, `command "sh" is not allowed on cluster "prod"`)
+
+	// Attaching runs no command, so it is denied by allow lists
+	assert.Equal(t, http.StatusForbidden, serve("attach", "stdin=true").StatusCode)
+
+	mu.Lock()
+	if assert.Len(t, logs, 3) {
+		assert.Equal(t, []string{"cat", "/etc/hosts"}, logs[0].Command)
+		assert.Empty(t, logs[0].Event)
+
+		assert.Equal(t, []string{"sh", "-c", "cat"}, logs[1].Command)
+		assert.Equal(t, audit.EventExecCommandDenied, logs[1].Event)
+		assert.Equal(t, "dev", logs[1].Email)
+
+		assert.Equal(t, "attach", logs[2].SubResource)
+		assert.Equal(t, audit.EventExecCommandDenied, logs[2].Event)
+	}
+
+	p.ctrl.Finish()
+}
+
+func TestDenyRules(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+	p.requestInfo = genericapirequest.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+	p.denyRules = denyrules.NewSet()
+	p.denyRules.SetRules(denyRulesFileSource, []denyrules.Rule{{
+		Name:         "kube-system-secrets",
+		ExceptGroups: []string{"sre"},
+		Verbs:        []string{"get", "list"},
+		APIGroups:    []string{""},
+		Resources:    []string{"secrets"},
+		Namespaces:   []string{"kube-system"},
+	}})
+
+	// RBAC allows everyone to read secrets
+	clusterRoles := []*rbacv1.ClusterRole{{
+		ObjectMeta: metav1.ObjectMeta{Name: "secrets"},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"secrets"},
+			Verbs:     []string{"get", "list"},
+		}},
+	}}
+	clusterRoleBindings := []*rbacv1.ClusterRoleBinding{{
+		ObjectMeta: metav1.ObjectMeta{Name: "secrets"},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "developers"}},
+		RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "secrets"},
+	}}
+	_, staticRoles := rbacvalidation.NewTestRuleResolver(nil, nil, clusterRoles, clusterRoleBindings)
+	p.clusterManager.AddOrUpdateCluster(&cluster.Cluster{
+		Name:       "prod",
+		RBACConfig: &util.RBAC{ClusterRoles: clusterRoles, ClusterRoleBindings: clusterRoleBindings},
+		Authorizer: util.NewAuthorizer(staticRoles),
+	})
+
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "dev-token").Return(&authenticator.Response{
+		User: &user.DefaultInfo{Name: "dev", Groups: []string{"developers"}},
+	}, true, nil).Times(2)
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "sre-token").Return(&authenticator.Response{
+		User: &user.DefaultInfo{Name: "sre", Groups: []string{"developers", "sre"}},
+	}, true, nil)
+
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(token, path string) *http.Response {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, &http.Request{
+			Method: http.MethodGet,
+			Header: http.Header{
+				"Authorization": []string{"bearer " + token},
+			},
+			URL:  &url.URL{Path: path},
+			Body: http.NoBody,
+		})
+		return w.Result()
+	}
+
+	assert.Equal(t, http.StatusOK, serve("dev-token", "/prod/api/v1/namespaces/default/secrets").StatusCode)
+	assert.Equal(t, http.StatusOK, serve("sre-token", "/prod/api/v1/namespaces/kube-system/secrets").StatusCode)
+
+	resp := serve("dev-token", "/prod/api/v1/namespaces/kube-system/secrets/admin")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := decodeStatus(t, body)
+	assert.Equal(t, metav1.StatusReasonForbidden, status.Reason)
+	assert.Contains(t, status.Message, `denied by proxy deny rule "kube-system-secrets"`)
+
+	p.ctrl.Finish()
+}
+
+func TestAccessRequests(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+	p.config.AccessRequestApproverGroups = []string{"approvers"}
+	p.config.AccessRequests = crd.NewAccessRequestClient(dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(), map[schema.GroupVersionResource]string{crd.AccessRequestGVR: "AccessRequestList"}), 8*time.Hour)
+
+	for token, u := range map[string]*user.DefaultInfo{
+		"alice-token": {Name: "alice", Groups: []string{"developers"}},
+		"bob-token":   {Name: "bob", Groups: []string{"developers", "approvers"}},
+		"carol-token": {Name: "carol", Groups: []string{"approvers"}},
+	} {
+		p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), token).Return(&authenticator.Response{User: u}, true, nil).AnyTimes()
+	}
+
+	server := httptest.NewServer(p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request to cluster: %s", req.URL.Path)
+	})))
+	defer server.Close()
+
+	do := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// Access is requested for the caller, whatever user the body names
+	resp := do(http.MethodPost, "/_accessrequests", "alice-token",
+		`{"user":"mallory","role":"admin","targetClusters":["prod"],"duration":"1h","reason":"incident 42"}`)
+	if !assert.Equal(t, http.StatusCreated, resp.StatusCode) {
+		return
+	}
+	var accessRequest crd.AccessRequest
+	if err := json.NewDecoder(resp.Body).Decode(&accessRequest); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "alice", accessRequest.Spec.User)
+	assert.Equal(t, time.Hour, accessRequest.Spec.Duration.Duration)
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/_accessrequests", "alice-token", `{"role":"admin"}`).StatusCode)
+	do(http.MethodPost, "/_accessrequests", "bob-token",
+		`{"role":"admin","targetClusters":["prod"],"duration":"1h","reason":"deploy"}`)
+
+	// Users only see their own requests, approvers see all of them
+	list := func(token string) AccessRequestList {
+		var list AccessRequestList
+		if err := json.NewDecoder(do(http.MethodGet, "/_accessrequests", token, "").Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+	if alice := list("alice-token"); assert.Len(t, alice.AccessRequests, 1) {
+		assert.Equal(t, accessRequest.Name, alice.AccessRequests[0].Name)
+	}
+	assert.Len(t, list("carol-token").AccessRequests, 2)
+
+	approve := "/_accessrequests/" + accessRequest.Name + "/approve"
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, approve, "alice-token", "").StatusCode)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodGet, approve, "carol-token", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/_accessrequests/unknown/approve", "carol-token", "").StatusCode)
+
+	resp = do(http.MethodPost, approve, "carol-token", `{"message":"go ahead"}`)
+	if assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		if err := json.NewDecoder(resp.Body).Decode(&accessRequest); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, crd.AccessRequestApproved, accessRequest.Status.Phase)
+		assert.Equal(t, "carol", accessRequest.Status.Approver)
+		assert.Equal(t, "go ahead", accessRequest.Status.Message)
+		assert.NotNil(t, accessRequest.Status.ExpiresAt)
+	}
+
+	// Decided requests can't be decided again
+	assert.Equal(t, http.StatusConflict,
+		do(http.MethodPost, "/_accessrequests/"+accessRequest.Name+"/deny", "bob-token", "").StatusCode)
+
+	p.ctrl.Finish()
+}
+
+func TestBreakGlass(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+	p.requestInfo = genericapirequest.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+	p.breakGlass = breakglass.New(breakglass.Config{Group: "break-glass", Duration: time.Nanosecond, MaxSessions: 1, Window: time.Hour})
+
+	// Collect the logs sent to the audit webhook and the notifications
+	var (
+		mu            sync.Mutex
+		logs          []audit.Log
+		notifications []breakglass.Notification
+	)
+	webhook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var log audit.Log
+		if assert.NoError(t, json.NewDecoder(req.Body).Decode(&log)) && strings.HasPrefix(log.Event, "BreakGlass") {
+			mu.Lock()
+			logs = append(logs, log)
+			mu.Unlock()
+		}
+	}))
+	defer webhook.Close()
+
+	notifier := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var notification breakglass.Notification
+		if assert.NoError(t, json.NewDecoder(req.Body).Decode(&notification)) {
+			mu.Lock()
+			notifications = append(notifications, notification)
+			mu.Unlock()
+		}
+	}))
+	defer notifier.Close()
+	p.breakGlassNotify = breakglass.NewNotifier(notifier.URL)
+
+	auditor, err := audit.New(&options.AuditOptions{AuditWebhookServer: webhook.URL},
+		"0.0.0.0:1234", new(server.SecureServingInfo), resolver.NewPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.auditor = auditor
+
+	// Only the break-glass group may read secrets
+	clusterRoles := []*rbacv1.ClusterRole{{
+		ObjectMeta: metav1.ObjectMeta{Name: "secrets"},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"secrets"},
+			Verbs:     []string{"get", "list"},
+		}},
+	}}
+	clusterRoleBindings := []*rbacv1.ClusterRoleBinding{{
+		ObjectMeta: metav1.ObjectMeta{Name: "secrets"},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "break-glass"}},
+		RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "secrets"},
+	}}
+	_, staticRoles := rbacvalidation.NewTestRuleResolver(nil, nil, clusterRoles, clusterRoleBindings)
+	p.clusterManager.AddOrUpdateCluster(&cluster.Cluster{
+		Name:       "prod",
+		RBACConfig: &util.RBAC{ClusterRoles: clusterRoles, ClusterRoleBindings: clusterRoleBindings},
+		Authorizer: util.NewAuthorizer(staticRoles),
+	})
+
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(&authenticator.Response{
+		User: &user.DefaultInfo{Name: "sre", Groups: []string{"developers", "break-glass"}},
+	}, true, nil).AnyTimes()
+
+	var reasons []string
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		u, _ := genericapirequest.UserFrom(req.Context())
+		reasons = append(reasons, u.GetExtra()[breakglass.ReasonExtra]...)
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(headers map[string]string) *http.Response {
+		header := http.Header{"Authorization": []string{"bearer fake-token"}}
+		for k, v := range headers {
+			header.Set(k, v)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, &http.Request{
+			Method: http.MethodGet,
+			Header: header,
+			URL:    &url.URL{Path: "/prod/api/v1/namespaces/kube-system/secrets"},
+			Body:   http.NoBody,
+		})
+		return w.Result()
+	}
+
+	// The group's privileges only apply with a justification
+	assert.Equal(t, http.StatusForbidden, serve(nil).StatusCode)
+	assert.Equal(t, http.StatusOK, serve(map[string]string{breakglass.ReasonHeader: "incident 42"}).StatusCode)
+	assert.Equal(t, []string{"incident 42"}, reasons)
+
+	// Another session can't be started within the window
+	resp := serve(map[string]string{
+		"Impersonate-User":                     "sre",
+		"Impersonate-Extra-break-glass-reason": "incident 43",
+	})
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := decodeStatus(t, body)
+	assert.Contains(t, status.Message, `break-glass session limit reached for user "sre"`)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(notifications) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	if assert.Len(t, logs, 3) {
+		assert.Equal(t, audit.EventBreakGlassActivated, logs[0].Event)
+		assert.Equal(t, audit.EventBreakGlassRequest, logs[1].Event)
+		assert.Equal(t, audit.EventBreakGlassDenied, logs[2].Event)
+		assert.Equal(t, "incident 43", logs[2].Reason)
+		for _, log := range logs {
+			assert.Equal(t, audit.SeverityHigh, log.Severity)
+			assert.Equal(t, "sre", log.Email)
+		}
+	}
+	assert.Equal(t, "incident 42", notifications[0].Reason)
+	assert.Equal(t, "prod", notifications[0].ClusterName)
+	logs, notifications = nil, nil
+	mu.Unlock()
+
+	// Each request of a session is audited, including denied ones, while
+	// only its start is notified
+	p.breakGlass = breakglass.New(breakglass.Config{Group: "break-glass", Duration: time.Hour})
+	assert.Equal(t, http.StatusOK, serve(map[string]string{breakglass.ReasonHeader: "incident 44"}).StatusCode)
+	assert.Equal(t, http.StatusOK, serve(map[string]string{breakglass.ReasonHeader: "incident 44"}).StatusCode)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, &http.Request{
+		Method: http.MethodDelete,
+		Header: http.Header{
+			"Authorization":         []string{"bearer fake-token"},
+			breakglass.ReasonHeader: []string{"incident 44"},
+		},
+		URL:  &url.URL{Path: "/prod/api/v1/namespaces/kube-system/secrets/token"},
+		Body: http.NoBody,
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(notifications) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	if assert.Len(t, logs, 4) {
+		assert.Equal(t, audit.EventBreakGlassActivated, logs[0].Event)
+		for _, log := range logs[1:] {
+			assert.Equal(t, audit.EventBreakGlassRequest, log.Event)
+			assert.Equal(t, "incident 44", log.Reason)
+			assert.Equal(t, audit.SeverityHigh, log.Severity)
+		}
+	}
+	mu.Unlock()
+
+	p.ctrl.Finish()
+}
+
+func TestClientCertAuthentication(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+	p.requestInfo = genericapirequest.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	ca := newTestCA(t, "client-ca")
+	p.config.ClientCA = ca.bundle(t)
+	p.config.ClientCertUserMapping = clientcert.UserMappingSubject
+
+	var err error
+	p.requestAuther, err = newRequestAuthenticator(p.fakeToken, p.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusterRoles := []*rbacv1.ClusterRole{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods"},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"pods"},
+			Verbs:     []string{"list"},
+		}},
+	}}
+	clusterRoleBindings := []*rbacv1.ClusterRoleBinding{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods"},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "ci"}},
+		RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "pods"},
+	}}
+	_, staticRoles := rbacvalidation.NewTestRuleResolver(nil, nil, clusterRoles, clusterRoleBindings)
+	p.clusterManager.AddOrUpdateCluster(&cluster.Cluster{
+		Name:       "prod",
+		RBACConfig: &util.RBAC{ClusterRoles: clusterRoles, ClusterRoleBindings: clusterRoleBindings},
+		Authorizer: util.NewAuthorizer(staticRoles),
+	})
+
+	// Humans still authenticate with their token
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(&authenticator.Response{
+		User: &user.DefaultInfo{Name: "alice", Groups: []string{"ci"}},
+	}, true, nil)
+
+	var users []string
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		u, _ := genericapirequest.UserFrom(req.Context())
+		users = append(users, u.GetName())
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(token string, cert *x509.Certificate) int {
+		req := &http.Request{
+			Method: http.MethodGet,
+			Header: http.Header{},
+			URL:    &url.URL{Path: "/prod/api/v1/namespaces/default/pods"},
+			Body:   http.NoBody,
+		}
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "bearer "+token)
+		}
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("fake-token", nil))
+	assert.Equal(t, http.StatusOK, serve("", ca.issue(t, pkix.Name{CommonName: "deployer", Organization: []string{"ci"}})))
+	assert.Equal(t, []string{"alice", "deployer"}, users)
+
+	// An invalid token is not made up for by a valid certificate
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "bad-token").Return(nil, false, nil)
+	assert.Equal(t, http.StatusUnauthorized, serve("bad-token", ca.issue(t, pkix.Name{CommonName: "deployer", Organization: []string{"ci"}})))
+
+	// RBAC applies to certificate users as to any other
+	assert.Equal(t, http.StatusForbidden, serve("", ca.issue(t, pkix.Name{CommonName: "intruder"})))
+
+	otherCA := newTestCA(t, "other-ca")
+	assert.Equal(t, http.StatusUnauthorized, serve("", otherCA.issue(t, pkix.Name{CommonName: "deployer", Organization: []string{"ci"}})))
+	assert.Equal(t, http.StatusUnauthorized, serve("", nil))
+
+	// Certificates carry no claims, so clusters requiring claims deny them
+	// unless the policy allows requests without a token.
+	p.requiredClaims = &claims.Policy{Rules: []claims.Rule{{
+		Clusters:       []string{"prod"},
+		RequiredClaims: map[string]string{"acr": "mfa"},
+	}}}
+	assert.Equal(t, http.StatusForbidden, serve("", ca.issue(t, pkix.Name{CommonName: "deployer", Organization: []string{"ci"}})))
+
+	p.requiredClaims.Rules[0].AllowWithoutToken = true
+	assert.Equal(t, http.StatusOK, serve("", ca.issue(t, pkix.Name{CommonName: "deployer", Organization: []string{"ci"}})))
+
+	p.ctrl.Finish()
+}
+
+func TestRequestHeaderAuthentication(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.DisableImpersonation = true
+	p.requestInfo = genericapirequest.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("api", "apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	}
+
+	frontProxyCA := newTestCA(t, "front-proxy-ca")
+	p.config.RequestHeader = &authenticatorfactory.RequestHeaderConfig{
+		UsernameHeaders:     headerrequest.StaticStringSlice{"X-Remote-User"},
+		UIDHeaders:          headerrequest.StaticStringSlice{},
+		GroupHeaders:        headerrequest.StaticStringSlice{"X-Remote-Group"},
+		ExtraHeaderPrefixes: headerrequest.StaticStringSlice{"X-Remote-Extra-"},
+		CAContentProvider:   frontProxyCA.bundle(t),
+		AllowedClientNames:  headerrequest.StaticStringSlice{"gateway"},
+	}
+
+	var err error
+	p.requestAuther, err = newRequestAuthenticator(p.fakeToken, p.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusterRoles := []*rbacv1.ClusterRole{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods"},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"pods"},
+			Verbs:     []string{"list"},
+		}},
+	}}
+	clusterRoleBindings := []*rbacv1.ClusterRoleBinding{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods"},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "sso-users"}},
+		RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "pods"},
+	}}
+	_, staticRoles := rbacvalidation.NewTestRuleResolver(nil, nil, clusterRoles, clusterRoleBindings)
+	p.clusterManager.AddOrUpdateCluster(&cluster.Cluster{
+		Name:       "prod",
+		RBACConfig: &util.RBAC{ClusterRoles: clusterRoles, ClusterRoleBindings: clusterRoleBindings},
+		Authorizer: util.NewAuthorizer(staticRoles),
+	})
+
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "fake-token").Return(&authenticator.Response{
+		User: &user.DefaultInfo{Name: "bob", Groups: []string{"sso-users"}},
+	}, true, nil)
+
+	var users []user.Info
+	handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		u, _ := genericapirequest.UserFrom(req.Context())
+		users = append(users, u)
+
+		// The headers of the front proxy are not forwarded
+		for h := range req.Header {
+			assert.False(t, strings.HasPrefix(h, "X-Remote-"), "header %q forwarded", h)
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(token string, cert *x509.Certificate) int {
+		req := &http.Request{
+			Method: http.MethodGet,
+			Header: http.Header{},
+			URL:    &url.URL{Path: "/prod/api/v1/namespaces/default/pods"},
+			Body:   http.NoBody,
+		}
+		req.Header.Set("X-Remote-User", "alice")
+		req.Header.Set("X-Remote-Group", "sso-users")
+		req.Header.Set("X-Remote-Extra-Scopes", "openid")
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "bearer "+token)
+		}
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The headers are only trusted from the front proxy
+	assert.Equal(t, http.StatusOK, serve("", frontProxyCA.issue(t, pkix.Name{CommonName: "gateway"})))
+	assert.Equal(t, http.StatusUnauthorized, serve("", nil))
+	assert.Equal(t, http.StatusUnauthorized, serve("", frontProxyCA.issue(t, pkix.Name{CommonName: "intruder"})))
+	assert.Equal(t, http.StatusUnauthorized, serve("", newTestCA(t, "other-ca").issue(t, pkix.Name{CommonName: "gateway"})))
+
+	// Tokens take precedence, and the spoofed headers are dropped
+	assert.Equal(t, http.StatusOK, serve("fake-token", nil))
+
+	// An invalid token is not made up for by the front proxy
+	p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), "bad-token").Return(nil, false, nil)
+	assert.Equal(t, http.StatusUnauthorized, serve("bad-token", frontProxyCA.issue(t, pkix.Name{CommonName: "gateway"})))
+
+	if assert.Len(t, users, 2) {
+		assert.Equal(t, "alice", users[0].GetName())
+		assert.Equal(t, []string{"sso-users"}, users[0].GetGroups())
+		assert.Equal(t, map[string][]string{"scopes": {"openid"}}, users[0].GetExtra())
+
+		assert.Equal(t, "bob", users[1].GetName())
+	}
+
+	// The front proxy's headers carry no claims, so clusters requiring claims
+	// deny them unless the policy allows requests without a token.
+	p.requiredClaims = &claims.Policy{Rules: []claims.Rule{{
+		Clusters:       []string{"prod"},
+		RequiredClaims: map[string]string{"acr": "mfa"},
+	}}}
+	assert.Equal(t, http.StatusForbidden, serve("", frontProxyCA.issue(t, pkix.Name{CommonName: "gateway"})))
+
+	p.requiredClaims.Rules[0].AllowWithoutToken = true
+	assert.Equal(t, http.StatusOK, serve("", frontProxyCA.issue(t, pkix.Name{CommonName: "gateway"})))
+
+	p.ctrl.Finish()
+}
@@ -0,0 +1,289 @@
+// Package ratelimit enforces token bucket rate limits per user, group and
+// cluster.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"sigs.k8s.io/yaml"
+)
+
+// Keys a limit can be enforced by.
+const (
+	// KeyUser gives every user their own bucket.
+	KeyUser = "user"
+	// KeyGroup gives every group a bucket shared by its members.
+	KeyGroup = "group"
+	// KeyCluster gives every cluster a bucket shared by all requests.
+	KeyCluster = "cluster"
+)
+
+// gcInterval is how often idle buckets are removed.
+const gcInterval = time.Minute
+
+// endpointCluster is the cluster of the buckets requests to the endpoints of
+// the proxy itself draw from, which no cluster name can match.
+const endpointCluster = ""
+
+// Policy is the file format of the rate limit policy.
+type Policy struct {
+	Limits []Limit `json:"limits"`
+}
+
+// Limit is a token bucket rate limit. Every limit matching a request must
+// allow it. Limits are enforced separately for each cluster.
+type Limit struct {
+	// Key is what the limit is enforced by: "user", "group" or "cluster".
+	Key string `json:"key"`
+	// Clusters are glob patterns of the cluster names the limit applies to,
+	// e.g. "prod-*". If empty, the limit applies to every cluster.
+	Clusters []string `json:"clusters,omitempty"`
+	// Groups restricts the limit to members of these groups. With the
+	// "group" key, only these groups get a bucket. If empty, the limit applies
+	// to every user and group.
+	Groups []string `json:"groups,omitempty"`
+	// QPS is the rate at which the bucket refills, in requests per second.
+	QPS float64 `json:"qps"`
+	// Burst is the size of the bucket.
+	Burst int `json:"burst"`
+}
+
+// LoadPolicy reads and validates a rate limit policy file.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rate limit policy: %w", err)
+	}
+
+	policy := new(Policy)
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse rate limit policy %q: %w", file, err)
+	}
+
+	for i, limit := range policy.Limits {
+		if err := limit.validate(); err != nil {
+			return nil, fmt.Errorf("limit %d in %q is invalid: %w", i, file, err)
+		}
+	}
+
+	return policy, nil
+}
+
+func (l *Limit) validate() error {
+	switch l.Key {
+	case KeyUser, KeyGroup, KeyCluster:
+	default:
+		return fmt.Errorf("unknown key %q, must be one of %q, %q or %q",
+			l.Key, KeyUser, KeyGroup, KeyCluster)
+	}
+
+	if l.QPS <= 0 {
+		return fmt.Errorf("qps must be greater than 0, got %v", l.QPS)
+	}
+
+	if l.Burst <= 0 {
+		return fmt.Errorf("burst must be greater than 0, got %d", l.Burst)
+	}
+
+	for _, pattern := range l.Clusters {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid cluster pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// Limiter holds the token buckets of a policy.
+type Limiter struct {
+	policy *Policy
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets map[bucketKey]*rate.Limiter
+}
+
+type bucketKey struct {
+	limit   int
+	cluster string
+	name    string
+}
+
+// New returns a Limiter enforcing the policy.
+func New(policy *Policy) *Limiter {
+	return &Limiter{
+		policy:  policy,
+		now:     time.Now,
+		buckets: make(map[bucketKey]*rate.Limiter),
+	}
+}
+
+// Run periodically removes idle buckets until stopCh is closed.
+func (l *Limiter) Run(stopCh <-chan struct{}) {
+	go wait.Until(l.gc, gcInterval, stopCh)
+}
+
+// Allow takes a token from every bucket the request draws from. If any bucket
+// is empty, no tokens are taken and the time until the request would be
+// allowed is returned. The user may be nil for requests that were not
+// authenticated by the proxy, which are only subject to cluster limits.
+func (l *Limiter) Allow(clusterName string, u user.Info) (time.Duration, bool) {
+	return l.allow(l.keys(clusterName, u))
+}
+
+// AllowEndpoint takes a token for a request of the user to an endpoint of the
+// proxy itself, such as /_kubeconfig, which is not sent to a cluster. The user
+// and group limits applying to every cluster are enforced, with buckets
+// separate from those of the clusters.
+func (l *Limiter) AllowEndpoint(u user.Info) (time.Duration, bool) {
+	var keys []bucketKey
+	for _, key := range l.keys(endpointCluster, u) {
+		if l.policy.Limits[key.limit].Key != KeyCluster {
+			keys = append(keys, key)
+		}
+	}
+
+	return l.allow(keys)
+}
+
+func (l *Limiter) allow(keys []bucketKey) (time.Duration, bool) {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var (
+		reservations []*rate.Reservation
+		retryAfter   time.Duration
+	)
+
+	for _, key := range keys {
+		r := l.bucket(key).ReserveN(now, 1)
+		reservations = append(reservations, r)
+
+		if delay := r.DelayFrom(now); delay > retryAfter {
+			retryAfter = delay
+		}
+	}
+
+	if retryAfter == 0 {
+		return 0, true
+	}
+
+	for _, r := range reservations {
+		r.CancelAt(now)
+	}
+
+	return retryAfter, false
+}
+
+// RetryAfterSeconds rounds the delay up to whole seconds, as used by the
+// Retry-After header.
+func RetryAfterSeconds(delay time.Duration) int {
+	return int(math.Ceil(delay.Seconds()))
+}
+
+// keys returns the buckets a request to the cluster by the user draws from.
+func (l *Limiter) keys(clusterName string, u user.Info) []bucketKey {
+	var keys []bucketKey
+
+	for i, limit := range l.policy.Limits {
+		if !matchesCluster(limit.Clusters, clusterName) {
+			continue
+		}
+
+		groups := limit.Groups
+		if len(groups) > 0 && (u == nil || !hasAnyGroup(u, groups)) {
+			continue
+		}
+
+		switch limit.Key {
+		case KeyCluster:
+			keys = append(keys, bucketKey{limit: i, cluster: clusterName})
+
+		case KeyUser:
+			if u != nil {
+				keys = append(keys, bucketKey{limit: i, cluster: clusterName, name: u.GetName()})
+			}
+
+		case KeyGroup:
+			if u == nil {
+				continue
+			}
+			for _, group := range u.GetGroups() {
+				if len(groups) == 0 || contains(groups, group) {
+					keys = append(keys, bucketKey{limit: i, cluster: clusterName, name: group})
+				}
+			}
+		}
+	}
+
+	return keys
+}
+
+func (l *Limiter) bucket(key bucketKey) *rate.Limiter {
+	bucket, ok := l.buckets[key]
+	if !ok {
+		limit := l.policy.Limits[key.limit]
+		bucket = rate.NewLimiter(rate.Limit(limit.QPS), limit.Burst)
+		l.buckets[key] = bucket
+	}
+
+	return bucket
+}
+
+// gc removes full buckets, which are indistinguishable from new ones.
+func (l *Limiter) gc() {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, bucket := range l.buckets {
+		if bucket.TokensAt(now) >= float64(bucket.Burst()) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func matchesCluster(patterns []string, clusterName string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, clusterName); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasAnyGroup(u user.Info, groups []string) bool {
+	for _, group := range u.GetGroups() {
+		if contains(groups, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
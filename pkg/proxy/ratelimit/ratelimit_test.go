@@ -0,0 +1,200 @@
+package ratelimit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	l := New(&Policy{Limits: []Limit{
+		{Key: KeyUser, QPS: 1, Burst: 2},
+		{Key: KeyUser, Groups: []string{"ci"}, Clusters: []string{"prod-*"}, QPS: 0.5, Burst: 1},
+		{Key: KeyCluster, Clusters: []string{"staging"}, QPS: 1, Burst: 3},
+		{Key: KeyGroup, Groups: []string{"team"}, QPS: 1, Burst: 2},
+	}})
+	l.now = func() time.Time { return now }
+
+	alice := &user.DefaultInfo{Name: "alice"}
+	bob := &user.DefaultInfo{Name: "bob"}
+	ci := &user.DefaultInfo{Name: "ci-job", Groups: []string{"ci"}}
+	carol := &user.DefaultInfo{Name: "carol", Groups: []string{"team"}}
+	dave := &user.DefaultInfo{Name: "dave", Groups: []string{"team"}}
+
+	allow := func(clusterName string, u user.Info) bool {
+		_, ok := l.Allow(clusterName, u)
+		return ok
+	}
+
+	// Users have their own buckets
+	assert.True(t, allow("dev", alice))
+	assert.True(t, allow("dev", alice))
+	assert.False(t, allow("dev", alice))
+	assert.True(t, allow("dev", bob))
+
+	// Buckets are per cluster
+	assert.True(t, allow("other", alice))
+
+	// The bucket refills
+	delay, ok := l.Allow("dev", alice)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, delay)
+	now = now.Add(delay)
+	assert.True(t, allow("dev", alice))
+
+	// Group restricted limits only apply to members on matching clusters
+	assert.True(t, allow("prod-eu", ci))
+	delay, ok = l.Allow("prod-eu", ci)
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, delay)
+	assert.Equal(t, 2, RetryAfterSeconds(delay))
+	assert.True(t, allow("dev", ci))
+	assert.True(t, allow("prod-eu", bob))
+	assert.True(t, allow("prod-eu", bob))
+
+	// A rejected request takes no tokens from the other buckets, so the
+	// user limit still allows a request once the group limit refills
+	now = now.Add(2 * time.Second)
+	assert.True(t, allow("prod-eu", ci))
+
+	// Cluster limits are shared by all users, including unauthenticated
+	// token passthrough requests
+	assert.True(t, allow("staging", alice))
+	assert.True(t, allow("staging", bob))
+	assert.True(t, allow("staging", nil))
+	assert.False(t, allow("staging", ci))
+
+	// Group limits are shared by the group's members
+	assert.True(t, allow("dev", carol))
+	assert.True(t, allow("dev", dave))
+	assert.False(t, allow("dev", carol))
+}
+
+func TestAllowEndpoint(t *testing.T) {
+	l := New(&Policy{Limits: []Limit{
+		{Key: KeyUser, QPS: 1, Burst: 1},
+		{Key: KeyUser, Clusters: []string{"prod-*"}, QPS: 1, Burst: 1},
+		{Key: KeyCluster, QPS: 1, Burst: 1},
+	}})
+	l.now = func() time.Time { return time.Unix(0, 0) }
+
+	alice := &user.DefaultInfo{Name: "alice"}
+	bob := &user.DefaultInfo{Name: "bob"}
+
+	// Only user limits applying to every cluster are enforced, by user
+	_, ok := l.AllowEndpoint(alice)
+	assert.True(t, ok)
+	delay, ok := l.AllowEndpoint(alice)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, delay)
+	_, ok = l.AllowEndpoint(bob)
+	assert.True(t, ok)
+
+	// The buckets are separate from those of the clusters
+	_, ok = l.Allow("dev", alice)
+	assert.True(t, ok)
+}
+
+func TestGC(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	l := New(&Policy{Limits: []Limit{{Key: KeyUser, QPS: 1, Burst: 2}}})
+	l.now = func() time.Time { return now }
+
+	l.Allow("dev", &user.DefaultInfo{Name: "alice"})
+	l.gc()
+	assert.Len(t, l.buckets, 1)
+
+	now = now.Add(time.Second)
+	l.gc()
+	assert.Len(t, l.buckets, 0)
+}
+
+func TestLoadPolicy(t *testing.T) {
+	tests := map[string]struct {
+		policy string
+		expErr bool
+	}{
+		"valid": {
+			policy: `
+limits:
+- key: user
+  qps: 20
+  burst: 40
+- key: cluster
+  clusters: ["prod-*"]
+  qps: 200
+  burst: 400
+- key: group
+  groups: [ci]
+  qps: 5
+  burst: 10
+`,
+		},
+		"unknown key": {
+			policy: `
+limits:
+- key: namespace
+  qps: 1
+  burst: 1
+`,
+			expErr: true,
+		},
+		"no qps": {
+			policy: `
+limits:
+- key: user
+  burst: 1
+`,
+			expErr: true,
+		},
+		"no burst": {
+			policy: `
+limits:
+- key: user
+  qps: 1
+`,
+			expErr: true,
+		},
+		"bad cluster pattern": {
+			policy: `
+limits:
+- key: cluster
+  clusters: ["["]
+  qps: 1
+  burst: 1
+`,
+			expErr: true,
+		},
+		"unknown field": {
+			policy: `
+limits:
+- key: user
+  qps: 1
+  burst: 1
+  namespaces: [default]
+`,
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "policy.yaml")
+			if err := os.WriteFile(file, []byte(test.policy), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := LoadPolicy(file)
+			if test.expErr != (err != nil) {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package recording
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	castExtension     = ".cast"
+	metadataExtension = ".json"
+)
+
+// LocalStore stores recordings in a directory on local disk. Each recording
+// is an asciicast file with a JSON file holding its metadata.
+type LocalStore struct {
+	dir string
+}
+
+var _ Store = &LocalStore{}
+
+// NewLocalStore returns a LocalStore in the directory, creating it if needed.
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create session recording directory: %w", err)
+	}
+
+	return &LocalStore{dir: dir}, nil
+}
+
+func (l *LocalStore) Create(meta Metadata) (io.WriteCloser, error) {
+	if !ValidID(meta.ID) {
+		return nil, fmt.Errorf("invalid recording ID %q", meta.ID)
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(l.path(meta.ID, metadataExtension), data, 0o600); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(l.path(meta.ID, castExtension), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+}
+
+func (l *LocalStore) List() ([]Metadata, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var recordings []Metadata
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), metadataExtension)
+		if !ok || !ValidID(id) {
+			continue
+		}
+
+		data, err := os.ReadFile(l.path(id, metadataExtension))
+		if err != nil {
+			// Deleted while listing
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+
+		var meta Metadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("invalid metadata of recording %q: %w", id, err)
+		}
+		recordings = append(recordings, meta)
+	}
+
+	return recordings, nil
+}
+
+func (l *LocalStore) Open(id string) (io.ReadCloser, error) {
+	if !ValidID(id) {
+		return nil, ErrNotFound
+	}
+
+	f, err := os.Open(l.path(id, castExtension))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (l *LocalStore) Delete(id string) error {
+	if !ValidID(id) {
+		return ErrNotFound
+	}
+
+	// The metadata is removed last, so failed deletes are retried
+	for _, ext := range []string{castExtension, metadataExtension} {
+		if err := os.Remove(l.path(id, ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *LocalStore) path(id, ext string) string {
+	return filepath.Join(l.dir, id+ext)
+}
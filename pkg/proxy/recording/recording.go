@@ -0,0 +1,360 @@
+// Package recording records interactive exec and attach sessions as asciicast
+// v2 files.
+package recording
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// gcInterval is how often recordings past their retention are removed.
+	gcInterval = time.Hour
+
+	// Terminal size of recordings whose size is not sent by the client.
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+// ErrNotFound is returned for unknown recordings.
+var ErrNotFound = errors.New("recording not found")
+
+var idPattern = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+
+// ValidID returns whether the ID can be a recording ID, so it is safe to use
+// in file names.
+func ValidID(id string) bool {
+	return idPattern.MatchString(id)
+}
+
+// Metadata describes a recorded session.
+type Metadata struct {
+	ID        string   `json:"id"`
+	User      string   `json:"user"`
+	Groups    []string `json:"groups,omitempty"`
+	Cluster   string   `json:"cluster"`
+	Namespace string   `json:"namespace"`
+	Pod       string   `json:"pod"`
+	Container string   `json:"container,omitempty"`
+	// Subresource is exec or attach
+	Subresource string    `json:"subresource"`
+	Command     []string  `json:"command,omitempty"`
+	Start       time.Time `json:"start"`
+}
+
+// Store stores recordings.
+type Store interface {
+	// Create returns the writer of a new recording.
+	Create(meta Metadata) (io.WriteCloser, error)
+	// List returns the metadata of all recordings.
+	List() ([]Metadata, error)
+	// Open returns the reader of a recording, or ErrNotFound.
+	Open(id string) (io.ReadCloser, error)
+	// Delete removes a recording.
+	Delete(id string) error
+}
+
+// Config configures a Recorder.
+type Config struct {
+	// Retention is how long recordings are kept. They are kept forever if
+	// zero.
+	Retention time.Duration
+	// RecordInput records the input of sessions, which may include
+	// passwords typed without echo.
+	RecordInput bool
+}
+
+// Recorder records sessions to a store.
+type Recorder struct {
+	store  Store
+	config Config
+	now    func() time.Time
+}
+
+// New returns a Recorder recording sessions to the store.
+func New(store Store, config Config) *Recorder {
+	return &Recorder{
+		store:  store,
+		config: config,
+		now:    time.Now,
+	}
+}
+
+// Store returns the store of the recordings.
+func (r *Recorder) Store() Store {
+	return r.store
+}
+
+// Run periodically removes recordings past their retention until stopCh is
+// closed.
+func (r *Recorder) Run(stopCh <-chan struct{}) {
+	if r.config.Retention > 0 {
+		go wait.Until(r.gc, gcInterval, stopCh)
+	}
+}
+
+func (r *Recorder) gc() {
+	recordings, err := r.store.List()
+	if err != nil {
+		klog.Errorf("failed to list session recordings: %s", err)
+		return
+	}
+
+	now := r.now()
+	for _, meta := range recordings {
+		if now.Sub(meta.Start) <= r.config.Retention {
+			continue
+		}
+
+		if err := r.store.Delete(meta.ID); err != nil {
+			klog.Errorf("failed to delete session recording %q: %s", meta.ID, err)
+			continue
+		}
+		klog.V(4).Infof("deleted session recording %q past its retention", meta.ID)
+	}
+}
+
+// Start starts recording a session. The ID and start time of the metadata
+// are set by the recorder.
+func (r *Recorder) Start(meta Metadata) (*Session, error) {
+	meta.Start = r.now()
+	meta.ID = fmt.Sprintf("%s-%s", meta.Start.UTC().Format("20060102T150405Z"), rand.String(8))
+
+	w, err := r.store.Create(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		meta:        meta,
+		w:           w,
+		recordInput: r.config.RecordInput,
+		now:         r.now,
+		pending:     make(map[string][]byte),
+	}, nil
+}
+
+// header is the first line of an asciicast v2 file.
+type header struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+	Command   string `json:"command,omitempty"`
+}
+
+// Event types of asciicast v2 files.
+const (
+	eventOutput = "o"
+	eventInput  = "i"
+	eventResize = "r"
+)
+
+// Session is a session being recorded. It is safe for concurrent use.
+type Session struct {
+	meta        Metadata
+	recordInput bool
+	now         func() time.Time
+
+	mu sync.Mutex
+	w  io.WriteCloser
+	// headerWritten is set once the header is written. It is delayed until
+	// the first event, so the initial terminal size is in the header.
+	headerWritten bool
+	// pending holds the trailing bytes of incomplete UTF-8 characters per
+	// event type.
+	pending map[string][]byte
+	err     error
+	closed  bool
+}
+
+// Metadata returns the metadata of the recording.
+func (s *Session) Metadata() Metadata {
+	return s.meta
+}
+
+// Output records output of the session.
+func (s *Session) Output(data []byte) {
+	s.text(eventOutput, data)
+}
+
+// Input records input to the session, if enabled.
+func (s *Session) Input(data []byte) {
+	if s.recordInput {
+		s.text(eventInput, data)
+	}
+}
+
+// Resize records a change of the terminal size.
+func (s *Session) Resize(width, height int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.headerWritten {
+		s.writeHeader(width, height)
+		return
+	}
+
+	s.writeEvent(eventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+func (s *Session) text(eventType string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Characters may be split across frames
+	data = append(s.pending[eventType], data...)
+	data, s.pending[eventType] = splitIncompleteRune(data)
+	if len(data) == 0 {
+		return
+	}
+
+	if !s.headerWritten {
+		s.writeHeader(defaultWidth, defaultHeight)
+	}
+	s.writeEvent(eventType, string(data))
+}
+
+// Close ends the recording. It may be called more than once.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return s.err
+	}
+	s.closed = true
+
+	if !s.headerWritten {
+		s.writeHeader(defaultWidth, defaultHeight)
+	}
+	for _, eventType := range []string{eventOutput, eventInput} {
+		if len(s.pending[eventType]) > 0 {
+			s.writeEvent(eventType, string(s.pending[eventType]))
+		}
+	}
+
+	if err := s.w.Close(); err != nil && s.err == nil {
+		s.err = err
+	}
+
+	return s.err
+}
+
+func (s *Session) writeHeader(width, height int) {
+	s.headerWritten = true
+
+	title := fmt.Sprintf("%s %s/%s", s.meta.User, s.meta.Namespace, s.meta.Pod)
+	if len(s.meta.Container) > 0 {
+		title += "/" + s.meta.Container
+	}
+	title += " on " + s.meta.Cluster
+
+	s.writeLine(header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: s.meta.Start.Unix(),
+		Title:     title,
+		Command:   strings.Join(s.meta.Command, " "),
+	})
+}
+
+func (s *Session) writeEvent(eventType, data string) {
+	elapsed := s.now().Sub(s.meta.Start).Seconds()
+	s.writeLine([]interface{}{math.Round(elapsed*1e6) / 1e6, eventType, data})
+}
+
+// writeLine writes a line of the recording. Once a write fails, the rest of
+// the session is not recorded.
+func (s *Session) writeLine(v interface{}) {
+	if s.err != nil || s.closed {
+		return
+	}
+
+	line, err := json.Marshal(v)
+	if err == nil {
+		_, err = s.w.Write(append(line, '\n'))
+	}
+	if err != nil {
+		s.err = err
+		klog.Errorf("failed to write session recording %q: %s", s.meta.ID, err)
+	}
+}
+
+// splitIncompleteRune splits an incomplete UTF-8 character from the end of
+// the data.
+func splitIncompleteRune(data []byte) ([]byte, []byte) {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if !utf8.RuneStart(data[len(data)-i]) {
+			continue
+		}
+
+		if utf8.FullRune(data[len(data)-i:]) {
+			break
+		}
+		return data[:len(data)-i], append([]byte{}, data[len(data)-i:]...)
+	}
+
+	return data, nil
+}
+
+// Conn returns the connection of an upgraded exec or attach request, which
+// records the streams of the session as they are copied. upgrade is the
+// Upgrade header of the request, which selects the stream protocol.
+func (s *Session) Conn(conn net.Conn, upgrade string) net.Conn {
+	var d demuxer
+	switch upgrade = strings.ToLower(upgrade); {
+	case upgrade == "websocket":
+		d = newWebSocketDemuxer(s)
+	case strings.HasPrefix(upgrade, "spdy/"):
+		d = newSPDYDemuxer(s)
+	default:
+		klog.Warningf("session recording %q: unsupported stream protocol %q", s.meta.ID, upgrade)
+		return conn
+	}
+
+	return &recordingConn{Conn: conn, demuxer: d, session: s}
+}
+
+// recordingConn is the client connection of a session. Data read from it is
+// sent by the client and data written to it is sent by the server.
+type recordingConn struct {
+	net.Conn
+	demuxer demuxer
+	session *Session
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.demuxer.fromClient(b[:n])
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.demuxer.fromServer(b)
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) Close() error {
+	if err := c.session.Close(); err != nil {
+		klog.Errorf("failed to close session recording %q: %s", c.session.meta.ID, err)
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,135 @@
+package recording
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRecorder(t *testing.T, config Config) (*Recorder, *time.Time) {
+	store, err := NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+
+	now := time.Unix(1000, 0)
+	r := New(store, config)
+	r.now = func() time.Time { return now }
+
+	return r, &now
+}
+
+// readRecording returns the lines of a recording decoded as JSON.
+func readRecording(t *testing.T, r *Recorder, id string) []interface{} {
+	rc, err := r.Store().Open(id)
+	require.NoError(t, err)
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+
+	var lines []interface{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var v interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &v))
+		lines = append(lines, v)
+	}
+
+	return lines
+}
+
+func TestSession(t *testing.T) {
+	r, now := newTestRecorder(t, Config{})
+
+	session, err := r.Start(Metadata{
+		User:      "a-user",
+		Cluster:   "prod",
+		Namespace: "default",
+		Pod:       "web",
+		Container: "app",
+		Command:   []string{"sh", "-c", "top"},
+	})
+	require.NoError(t, err)
+
+	// The initial terminal size is written in the header
+	session.Resize(120, 40)
+	*now = now.Add(time.Second)
+	session.Output([]byte("héllo"[:2]))
+	session.Input([]byte("ls\n"))
+	*now = now.Add(time.Second)
+	session.Output([]byte("héllo"[2:]))
+	session.Resize(100, 30)
+	require.NoError(t, session.Close())
+	require.NoError(t, session.Close())
+
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"version":   2.0,
+			"width":     120.0,
+			"height":    40.0,
+			"timestamp": 1000.0,
+			"title":     "a-user default/web/app on prod",
+			"command":   "sh -c top",
+		},
+		// Characters split across writes are recorded whole, and input is
+		// not recorded by default
+		[]interface{}{1.0, "o", "h"},
+		[]interface{}{2.0, "o", "éllo"},
+		[]interface{}{2.0, "r", "100x30"},
+	}, readRecording(t, r, session.Metadata().ID))
+
+	recordings, err := r.Store().List()
+	require.NoError(t, err)
+	if assert.Len(t, recordings, 1) {
+		assert.Equal(t, session.Metadata().ID, recordings[0].ID)
+		assert.Equal(t, "web", recordings[0].Pod)
+		assert.True(t, recordings[0].Start.Equal(time.Unix(1000, 0)))
+	}
+}
+
+func TestSessionInput(t *testing.T) {
+	r, _ := newTestRecorder(t, Config{RecordInput: true})
+
+	session, err := r.Start(Metadata{})
+	require.NoError(t, err)
+	session.Input([]byte("ls\n"))
+	require.NoError(t, session.Close())
+
+	lines := readRecording(t, r, session.Metadata().ID)
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, 80.0, lines[0].(map[string]interface{})["width"])
+		assert.Equal(t, []interface{}{0.0, "i", "ls\n"}, lines[1])
+	}
+}
+
+func TestRetention(t *testing.T) {
+	r, now := newTestRecorder(t, Config{Retention: time.Hour})
+
+	old, err := r.Start(Metadata{})
+	require.NoError(t, err)
+	require.NoError(t, old.Close())
+
+	*now = now.Add(time.Hour)
+	recent, err := r.Start(Metadata{})
+	require.NoError(t, err)
+	require.NoError(t, recent.Close())
+
+	*now = now.Add(time.Minute)
+	r.gc()
+
+	recordings, err := r.Store().List()
+	require.NoError(t, err)
+	if assert.Len(t, recordings, 1) {
+		assert.Equal(t, recent.Metadata().ID, recordings[0].ID)
+	}
+
+	_, err = r.Store().Open(old.Metadata().ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// IDs can't escape the store
+	_, err = r.Store().Open("../" + recent.Metadata().ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
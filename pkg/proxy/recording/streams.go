@@ -0,0 +1,334 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/moby/spdystream/spdy"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// maxFrameSize bounds the frames buffered while parsing a stream. Larger
+// frames stop the recording of the session, not the session itself.
+const maxFrameSize = 16 << 20
+
+// demuxer records the streams of a session from the bytes sent in each
+// direction of its connection.
+type demuxer interface {
+	fromClient(data []byte)
+	fromServer(data []byte)
+}
+
+// Channels of the Kubernetes WebSocket stream protocols.
+const (
+	channelStdin  = 0
+	channelStdout = 1
+	channelStderr = 2
+	channelResize = 4
+)
+
+// webSocketDemuxer parses the channel.k8s.io and base64.channel.k8s.io
+// WebSocket protocols, whose messages start with the channel number.
+type webSocketDemuxer struct {
+	session *Session
+	client  *webSocketParser
+	server  *webSocketParser
+}
+
+func newWebSocketDemuxer(session *Session) *webSocketDemuxer {
+	d := &webSocketDemuxer{session: session}
+	d.client = &webSocketParser{onMessage: d.message}
+	d.server = &webSocketParser{onMessage: d.message}
+	return d
+}
+
+func (d *webSocketDemuxer) fromClient(data []byte) {
+	d.client.write(d.session, data)
+}
+
+func (d *webSocketDemuxer) fromServer(data []byte) {
+	d.server.write(d.session, data)
+}
+
+func (d *webSocketDemuxer) message(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+
+	channel, data := msg[0], msg[1:]
+
+	// The base64 protocol sends the channel as a digit
+	if channel >= '0' && channel <= '9' {
+		channel -= '0'
+
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return
+		}
+		data = decoded
+	}
+
+	// The first message of each channel is empty
+	if len(data) == 0 {
+		return
+	}
+
+	switch channel {
+	case channelStdin:
+		d.session.Input(data)
+	case channelStdout, channelStderr:
+		d.session.Output(data)
+	case channelResize:
+		resize(d.session, data)
+	}
+}
+
+// webSocketParser parses the WebSocket frames sent in one direction.
+type webSocketParser struct {
+	onMessage func([]byte)
+
+	// mu guards the parser as reads or writes of a connection may be
+	// concurrent
+	mu      sync.Mutex
+	buf     []byte
+	message []byte
+	failed  bool
+}
+
+func (p *webSocketParser) write(session *Session, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.failed {
+		return
+	}
+
+	p.buf = append(p.buf, data...)
+	for {
+		n, err := p.parseFrame()
+		if err != nil {
+			p.failed, p.buf, p.message = true, nil, nil
+			klog.Errorf("session recording %q: failed to parse WebSocket stream: %s", session.meta.ID, err)
+			return
+		}
+		if n == 0 {
+			return
+		}
+		p.buf = append(p.buf[:0], p.buf[n:]...)
+	}
+}
+
+// parseFrame parses the frame at the start of the buffer and returns its
+// length, or zero if it is incomplete.
+func (p *webSocketParser) parseFrame() (int, error) {
+	if len(p.buf) < 2 {
+		return 0, nil
+	}
+
+	fin := p.buf[0]&0x80 != 0
+	opcode := p.buf[0] & 0x0f
+	masked := p.buf[1]&0x80 != 0
+
+	length := uint64(p.buf[1] & 0x7f)
+	offset := 2
+	switch length {
+	case 126:
+		if len(p.buf) < 4 {
+			return 0, nil
+		}
+		length, offset = uint64(binary.BigEndian.Uint16(p.buf[2:4])), 4
+	case 127:
+		if len(p.buf) < 10 {
+			return 0, nil
+		}
+		length, offset = binary.BigEndian.Uint64(p.buf[2:10]), 10
+	}
+	if length > maxFrameSize {
+		return 0, fmt.Errorf("frame of %d bytes exceeds the maximum of %d bytes", length, maxFrameSize)
+	}
+
+	var mask []byte
+	if masked {
+		if len(p.buf) < offset+4 {
+			return 0, nil
+		}
+		mask, offset = p.buf[offset:offset+4], offset+4
+	}
+
+	end := offset + int(length)
+	if len(p.buf) < end {
+		return 0, nil
+	}
+
+	// Control frames may be sent between the frames of a message
+	if opcode >= 0x8 {
+		return end, nil
+	}
+
+	payload := p.buf[offset:end]
+	if opcode != 0 {
+		p.message = p.message[:0]
+	}
+	start := len(p.message)
+	p.message = append(p.message, payload...)
+	if masked {
+		for i := range p.message[start:] {
+			p.message[start+i] ^= mask[i%4]
+		}
+	}
+
+	if fin {
+		p.onMessage(p.message)
+		p.message = p.message[:0]
+	}
+
+	return end, nil
+}
+
+// spdyDemuxer parses the SPDY/3.1 streams of a session. The client creates
+// every stream, naming its type in the stream headers.
+type spdyDemuxer struct {
+	session *Session
+	client  *spdyParser
+	server  *spdyParser
+
+	mu      sync.Mutex
+	streams map[spdy.StreamId]string
+}
+
+func newSPDYDemuxer(session *Session) *spdyDemuxer {
+	d := &spdyDemuxer{
+		session: session,
+		streams: make(map[spdy.StreamId]string),
+	}
+	d.client = newSPDYParser(d)
+	d.server = newSPDYParser(d)
+	return d
+}
+
+func (d *spdyDemuxer) fromClient(data []byte) {
+	d.client.write(data)
+}
+
+func (d *spdyDemuxer) fromServer(data []byte) {
+	d.server.write(data)
+}
+
+func (d *spdyDemuxer) setStreamType(id spdy.StreamId, streamType string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.streams[id] = streamType
+}
+
+func (d *spdyDemuxer) data(id spdy.StreamId, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	streamType := d.streams[id]
+	d.mu.Unlock()
+
+	switch streamType {
+	case corev1.StreamTypeStdin:
+		d.session.Input(data)
+	case corev1.StreamTypeStdout, corev1.StreamTypeStderr:
+		d.session.Output(data)
+	case corev1.StreamTypeResize:
+		resize(d.session, data)
+	}
+}
+
+// spdyParser parses the SPDY frames sent in one direction. Data frames are
+// parsed directly, while control frames are passed to a framer to decompress
+// their headers.
+type spdyParser struct {
+	demuxer *spdyDemuxer
+
+	mu            sync.Mutex
+	buf           []byte
+	controlFrames bytes.Buffer
+	framer        *spdy.Framer
+	failed        bool
+}
+
+func newSPDYParser(d *spdyDemuxer) *spdyParser {
+	p := &spdyParser{demuxer: d}
+
+	framer, err := spdy.NewFramer(io.Discard, &p.controlFrames)
+	if err != nil {
+		klog.Errorf("session recording %q: failed to create SPDY framer: %s", d.session.meta.ID, err)
+		p.failed = true
+	}
+	p.framer = framer
+
+	return p
+}
+
+func (p *spdyParser) write(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.failed {
+		return
+	}
+
+	p.buf = append(p.buf, data...)
+	for len(p.buf) >= 8 {
+		length := int(p.buf[5])<<16 | int(p.buf[6])<<8 | int(p.buf[7])
+		end := 8 + length
+		if len(p.buf) < end {
+			return
+		}
+
+		if err := p.frame(p.buf[:end]); err != nil {
+			p.failed, p.buf = true, nil
+			klog.Errorf("session recording %q: failed to parse SPDY stream: %s", p.demuxer.session.meta.ID, err)
+			return
+		}
+		p.buf = append(p.buf[:0], p.buf[end:]...)
+	}
+}
+
+func (p *spdyParser) frame(frame []byte) error {
+	// Data frames
+	if frame[0]&0x80 == 0 {
+		id := spdy.StreamId(binary.BigEndian.Uint32(frame[:4]) & 0x7fffffff)
+		p.demuxer.data(id, frame[8:])
+		return nil
+	}
+
+	// Only whole frames are buffered, so the framer never blocks
+	p.controlFrames.Write(frame)
+	f, err := p.framer.ReadFrame()
+	if err != nil {
+		return err
+	}
+
+	if syn, ok := f.(*spdy.SynStreamFrame); ok {
+		p.demuxer.setStreamType(syn.StreamId, syn.Headers.Get(corev1.StreamType))
+	}
+
+	return nil
+}
+
+// resize records a terminal size sent on the resize stream.
+func resize(session *Session, data []byte) {
+	var size struct {
+		Width  int
+		Height int
+	}
+
+	// Sizes may be sent back to back on the stream
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.Decode(&size) == nil {
+		session.Resize(size.Width, size.Height)
+	}
+}
@@ -0,0 +1,130 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"testing"
+
+	"github.com/moby/spdystream/spdy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Opcodes of WebSocket data frames.
+const (
+	opContinuation = 0x0
+	opBinary       = 0x2
+)
+
+// webSocketFrame returns a data frame, masked as sent by clients.
+func webSocketFrame(opcode byte, payload []byte, fin, masked bool) []byte {
+	var frame []byte
+
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame = append(frame, b0)
+
+	var b1 byte
+	if masked {
+		b1 = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, b1|byte(len(payload)))
+	default:
+		frame = append(frame, b1|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	return frame
+}
+
+// writeInChunks writes the data a byte at a time, as frames may be split
+// across reads.
+func writeInChunks(write func([]byte), data []byte) {
+	for i := range data {
+		write(data[i : i+1])
+	}
+}
+
+func TestWebSocketDemuxer(t *testing.T) {
+	r, _ := newTestRecorder(t, Config{RecordInput: true})
+	session, err := r.Start(Metadata{})
+	require.NoError(t, err)
+
+	d := newWebSocketDemuxer(session)
+
+	// Channels are initialized with empty messages
+	d.fromServer(webSocketFrame(opBinary, []byte{channelStdout}, true, false))
+	writeInChunks(d.fromClient, webSocketFrame(opBinary, []byte("\x04{\"Width\":100,\"Height\":30}"), true, true))
+	writeInChunks(d.fromClient, webSocketFrame(opBinary, []byte("\x00ls\n"), true, true))
+
+	// Messages may be fragmented
+	output := append([]byte{channelStdout}, bytes.Repeat([]byte("a"), 200)...)
+	d.fromServer(webSocketFrame(opBinary, output[:150], false, false))
+	d.fromServer(webSocketFrame(opContinuation, output[150:], true, false))
+
+	// The base64 protocol sends the channel as a digit
+	d.fromServer(webSocketFrame(opBinary, []byte("2"+base64.StdEncoding.EncodeToString([]byte("error\n"))), true, false))
+
+	require.NoError(t, session.Close())
+
+	lines := readRecording(t, r, session.Metadata().ID)
+	if assert.Len(t, lines, 4) {
+		assert.Equal(t, 100.0, lines[0].(map[string]interface{})["width"])
+		assert.Equal(t, []interface{}{0.0, "i", "ls\n"}, lines[1])
+		assert.Equal(t, []interface{}{0.0, "o", string(output[1:])}, lines[2])
+		assert.Equal(t, []interface{}{0.0, "o", "error\n"}, lines[3])
+	}
+}
+
+func TestSPDYDemuxer(t *testing.T) {
+	r, _ := newTestRecorder(t, Config{})
+	session, err := r.Start(Metadata{})
+	require.NoError(t, err)
+
+	d := newSPDYDemuxer(session)
+
+	// Header compression is stateful, so frames are written by one framer
+	var client bytes.Buffer
+	framer, err := spdy.NewFramer(&client, nil)
+	require.NoError(t, err)
+	for id, streamType := range map[spdy.StreamId]string{1: corev1.StreamTypeStdout, 3: corev1.StreamTypeResize} {
+		require.NoError(t, framer.WriteFrame(&spdy.SynStreamFrame{
+			StreamId: id,
+			Headers:  http.Header{corev1.StreamType: []string{streamType}},
+		}))
+	}
+	require.NoError(t, framer.WriteFrame(&spdy.DataFrame{StreamId: 3, Data: []byte(`{"Width":90,"Height":20}`)}))
+	writeInChunks(d.fromClient, client.Bytes())
+
+	var server bytes.Buffer
+	framer, err = spdy.NewFramer(&server, nil)
+	require.NoError(t, err)
+	require.NoError(t, framer.WriteFrame(&spdy.SynReplyFrame{StreamId: 1, Headers: http.Header{}}))
+	require.NoError(t, framer.WriteFrame(&spdy.DataFrame{StreamId: 1, Data: []byte("hello")}))
+	d.fromServer(server.Bytes())
+
+	require.NoError(t, session.Close())
+
+	lines := readRecording(t, r, session.Metadata().ID)
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, 90.0, lines[0].(map[string]interface{})["width"])
+		assert.Equal(t, []interface{}{0.0, "o", "hello"}, lines[1])
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/sets"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog/v2"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/recording"
+)
+
+// recordingsPath lists the session recordings, and serves each recording
+// below it.
+const recordingsPath = "/_recordings"
+
+// recordedSubresources are the pod subresources of interactive sessions.
+var recordedSubresources = sets.NewString("exec", "attach")
+
+// RecordingList is the response body of the recordings endpoint.
+type RecordingList struct {
+	Recordings []recording.Metadata `json:"recordings"`
+}
+
+// withSessionRecording records the exec and attach sessions of recorded
+// clusters. It uses the request info added by WithRBACHandler, so only
+// authorized sessions are recorded.
+func (p *Proxy) withSessionRecording(handler http.Handler) http.Handler {
+	if p.config.SessionRecorder == nil {
+		return handler
+	}
+
+	recordedClusters := sets.NewString(p.config.SessionRecordingClusters...)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		clusterName := p.GetClusterName(req)
+		reqInfo, ok := genericapirequest.RequestInfoFrom(req.Context())
+		if !ok || !httpstream.IsUpgradeRequest(req) || !reqInfo.IsResourceRequest ||
+			reqInfo.Resource != "pods" || !recordedSubresources.Has(reqInfo.Subresource) ||
+			(recordedClusters.Len() > 0 && !recordedClusters.Has(clusterName)) {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		meta := recording.Metadata{
+			Cluster:     clusterName,
+			Namespace:   reqInfo.Namespace,
+			Pod:         reqInfo.Name,
+			Container:   req.URL.Query().Get("container"),
+			Subresource: reqInfo.Subresource,
+			Command:     req.URL.Query()["command"],
+		}
+		if user, ok := genericapirequest.UserFrom(req.Context()); ok {
+			meta.User, meta.Groups = user.GetName(), user.GetGroups()
+		}
+
+		// Sessions that can't be recorded are rejected rather than let
+		// through unrecorded
+		session, err := p.config.SessionRecorder.Start(meta)
+		if err != nil {
+			klog.Errorf("failed to start session recording: %s", err)
+			p.handleError(rw, req, apierrors.NewInternalError(errors.New("failed to start session recording")))
+			return
+		}
+		defer func() {
+			if err := session.Close(); err != nil {
+				klog.Errorf("failed to close session recording %q: %s", session.Metadata().ID, err)
+			}
+		}()
+
+		klog.V(4).Infof("recording %s session %q of %s/%s in cluster %q",
+			meta.Subresource, session.Metadata().ID, meta.Namespace, meta.Pod, clusterName)
+
+		handler.ServeHTTP(&recordingResponseWriter{
+			ResponseWriter: rw,
+			session:        session,
+			upgrade:        req.Header.Get("Upgrade"),
+		}, req)
+	})
+}
+
+// recordingResponseWriter records the connection hijacked by the reverse
+// proxy to copy the streams of an upgraded request.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	session *recording.Session
+	upgrade string
+}
+
+func (r *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return r.session.Conn(conn, r.upgrade), brw, nil
+}
+
+// serveRecordings lists the session recordings, optionally filtered by the
+// cluster and user query parameters.
+func (p *Proxy) serveRecordings(rw http.ResponseWriter, req *http.Request) {
+	if err := p.checkRecordingsAccess(req); err != nil {
+		p.handleError(rw, req, err)
+		return
+	}
+
+	recordings, err := p.config.SessionRecorder.Store().List()
+	if err != nil {
+		p.handleError(rw, req, apierrors.NewInternalError(fmt.Errorf("failed to list session recordings: %w", err)))
+		return
+	}
+
+	query := req.URL.Query()
+	list := RecordingList{Recordings: []recording.Metadata{}}
+	for _, meta := range recordings {
+		if cluster := query.Get("cluster"); len(cluster) > 0 && meta.Cluster != cluster {
+			continue
+		}
+		if user := query.Get("user"); len(user) > 0 && meta.User != user {
+			continue
+		}
+		list.Recordings = append(list.Recordings, meta)
+	}
+
+	// Most recent first
+	sort.Slice(list.Recordings, func(i, j int) bool {
+		return list.Recordings[i].Start.After(list.Recordings[j].Start)
+	})
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(list); err != nil {
+		klog.Errorf("failed to write session recording list: %s", err)
+	}
+}
+
+// serveRecording writes a session recording as an asciicast file.
+func (p *Proxy) serveRecording(rw http.ResponseWriter, req *http.Request) {
+	if err := p.checkRecordingsAccess(req); err != nil {
+		p.handleError(rw, req, err)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, recordingsPath+"/")
+	rc, err := p.config.SessionRecorder.Store().Open(id)
+	if errors.Is(err, recording.ErrNotFound) {
+		p.handleError(rw, req, apierrors.NewNotFound(schema.GroupResource{Resource: "recordings"}, id))
+		return
+	}
+	if err != nil {
+		p.handleError(rw, req, apierrors.NewInternalError(fmt.Errorf("failed to open session recording: %w", err)))
+		return
+	}
+	defer rc.Close()
+
+	rw.Header().Set("Content-Type", "application/x-asciicast")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".cast"))
+	if _, err := io.Copy(rw, rc); err != nil {
+		klog.Errorf("failed to write session recording %q: %s", id, err)
+	}
+}
+
+// checkRecordingsAccess returns an error unless recording is enabled and the
+// caller is a member of a viewer group.
+func (p *Proxy) checkRecordingsAccess(req *http.Request) error {
+	if p.config.SessionRecorder == nil {
+		return &apierrors.StatusError{ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusNotFound,
+			Reason:  metav1.StatusReasonNotFound,
+			Message: "session recording is not enabled",
+		}}
+	}
+
+	if req.Method != http.MethodGet {
+		return apierrors.NewMethodNotSupported(schema.GroupResource{Resource: "recordings"}, req.Method)
+	}
+
+	user, ok := genericapirequest.UserFrom(req.Context())
+	if !ok || len(user.GetName()) == 0 {
+		return errNoName
+	}
+
+	if !sets.NewString(p.config.SessionRecordingViewerGroups...).HasAny(user.GetGroups()...) {
+		return newForbidden(fmt.Sprintf("user %q is not allowed to view session recordings", user.GetName()))
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+// Package resolver determines which cluster an incoming proxy request targets.
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// ModePath resolves the cluster from the first segment of the request
+	// path, e.g. https://proxy/<cluster>/api/v1/pods.
+	ModePath = "path"
+
+	// ModeHost resolves the cluster from the TLS SNI server name, falling
+	// back to the request Host header, e.g. https://<cluster>.proxy/api/v1/pods.
+	ModeHost = "host"
+
+	// ClusterPlaceholder is substituted with the cluster name in host templates.
+	ClusterPlaceholder = "{cluster}"
+)
+
+// Resolver determines the cluster targeted by a request.
+type Resolver interface {
+	// Resolve returns the name of the cluster targeted by the request and the
+	// request path as it should be forwarded to that cluster. An empty cluster
+	// name is returned if the request does not target any cluster.
+	Resolve(req *http.Request) (clusterName, path string)
+}
+
+// New returns the Resolver for the given routing mode. The host template is
+// only used in host mode.
+func New(mode, hostTemplate string) (Resolver, error) {
+	switch mode {
+	case "", ModePath:
+		return NewPath(), nil
+	case ModeHost:
+		return NewHost(hostTemplate)
+	default:
+		return nil, fmt.Errorf("unknown cluster routing mode %q, must be one of %q or %q",
+			mode, ModePath, ModeHost)
+	}
+}
+
+type pathResolver struct{}
+
+// NewPath returns a Resolver that takes the cluster from the first path
+// segment and strips it from the forwarded path.
+func NewPath() Resolver {
+	return pathResolver{}
+}
+
+func (pathResolver) Resolve(req *http.Request) (string, string) {
+	parts := strings.Split(req.URL.Path, "/")
+	if len(parts) < 2 {
+		return "", req.URL.Path
+	}
+
+	clusterName := parts[1]
+	return clusterName, strings.TrimPrefix(req.URL.Path, "/"+clusterName)
+}
+
+type hostResolver struct {
+	prefix string
+	suffix string
+}
+
+// NewHost returns a Resolver that takes the cluster from the request
+// hostname using a template such as "{cluster}.k8s-proxy.example.com". The
+// request path is forwarded unchanged.
+func NewHost(template string) (Resolver, error) {
+	if err := ValidateHostTemplate(template); err != nil {
+		return nil, err
+	}
+
+	i := strings.Index(template, ClusterPlaceholder)
+	return &hostResolver{
+		prefix: strings.ToLower(template[:i]),
+		suffix: strings.ToLower(template[i+len(ClusterPlaceholder):]),
+	}, nil
+}
+
+// Resolve prefers the TLS SNI server name, as it selected the serving
+// certificate the client verified. Requests whose Host header names a
+// different cluster than the SNI target no cluster.
+func (h *hostResolver) Resolve(req *http.Request) (string, string) {
+	hostCluster := h.clusterFromHost(req.Host)
+	if req.TLS == nil {
+		return hostCluster, req.URL.Path
+	}
+
+	sniCluster := h.clusterFromHost(req.TLS.ServerName)
+	switch {
+	case sniCluster == "":
+		return hostCluster, req.URL.Path
+	case hostCluster != "" && hostCluster != sniCluster:
+		return "", req.URL.Path
+	default:
+		return sniCluster, req.URL.Path
+	}
+}
+
+func (h *hostResolver) clusterFromHost(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+
+	if len(host) <= len(h.prefix)+len(h.suffix) ||
+		!strings.HasPrefix(host, h.prefix) || !strings.HasSuffix(host, h.suffix) {
+		return ""
+	}
+
+	clusterName := host[len(h.prefix) : len(host)-len(h.suffix)]
+	// A cluster name can only ever fill a single DNS label.
+	if strings.Contains(clusterName, ".") {
+		return ""
+	}
+
+	return clusterName
+}
+
+// ValidateHostTemplate ensures the template contains the cluster placeholder
+// exactly once.
+func ValidateHostTemplate(template string) error {
+	if strings.Count(template, ClusterPlaceholder) != 1 {
+		return fmt.Errorf("cluster host template %q must contain %s exactly once",
+			template, ClusterPlaceholder)
+	}
+
+	return nil
+}
+
+// Hostname renders the host template for the given cluster.
+func Hostname(template, clusterName string) string {
+	return strings.Replace(template, ClusterPlaceholder, clusterName, 1)
+}
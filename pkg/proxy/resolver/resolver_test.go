@@ -0,0 +1,136 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathResolver(t *testing.T) {
+	tests := map[string]struct {
+		path       string
+		expCluster string
+		expPath    string
+	}{
+		"cluster prefix is stripped": {
+			path:       "/cluster1/api/v1/pods",
+			expCluster: "cluster1",
+			expPath:    "/api/v1/pods",
+		},
+		"cluster only": {
+			path:       "/cluster1",
+			expCluster: "cluster1",
+			expPath:    "",
+		},
+		"no path": {
+			path:       "",
+			expCluster: "",
+			expPath:    "",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := &http.Request{URL: &url.URL{Path: test.path}}
+			clusterName, path := NewPath().Resolve(req)
+			assert.Equal(t, test.expCluster, clusterName)
+			assert.Equal(t, test.expPath, path)
+		})
+	}
+}
+
+func TestHostResolver(t *testing.T) {
+	r, err := NewHost("{cluster}.k8s-proxy.example.com")
+	assert.NoError(t, err)
+
+	tests := map[string]struct {
+		host       string
+		sni        string
+		expCluster string
+	}{
+		"cluster from host": {
+			host:       "prod.k8s-proxy.example.com",
+			expCluster: "prod",
+		},
+		"cluster from host with port": {
+			host:       "prod.k8s-proxy.example.com:6443",
+			expCluster: "prod",
+		},
+		"host is case insensitive": {
+			host:       "Prod.K8s-Proxy.Example.com",
+			expCluster: "prod",
+		},
+		"cluster from sni when host does not match": {
+			host:       "10.0.0.1:6443",
+			sni:        "staging.k8s-proxy.example.com",
+			expCluster: "staging",
+		},
+		"cluster from sni without host": {
+			sni:        "staging.k8s-proxy.example.com",
+			expCluster: "staging",
+		},
+		"cluster from host when sni does not match": {
+			host:       "prod.k8s-proxy.example.com",
+			sni:        "k8s-proxy.example.com",
+			expCluster: "prod",
+		},
+		"host and sni agree": {
+			host:       "prod.k8s-proxy.example.com:6443",
+			sni:        "prod.k8s-proxy.example.com",
+			expCluster: "prod",
+		},
+		"host and sni disagree": {
+			host:       "prod.k8s-proxy.example.com",
+			sni:        "staging.k8s-proxy.example.com",
+			expCluster: "",
+		},
+		"nested subdomains do not match": {
+			host:       "a.b.k8s-proxy.example.com",
+			expCluster: "",
+		},
+		"bare domain does not match": {
+			host:       "k8s-proxy.example.com",
+			expCluster: "",
+		},
+		"unrelated host does not match": {
+			host:       "prod.example.org",
+			expCluster: "",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := &http.Request{
+				Host: test.host,
+				URL:  &url.URL{Path: "/api/v1/pods"},
+			}
+			if test.sni != "" {
+				req.TLS = &tls.ConnectionState{ServerName: test.sni}
+			}
+
+			clusterName, path := r.Resolve(req)
+			assert.Equal(t, test.expCluster, clusterName)
+			assert.Equal(t, "/api/v1/pods", path)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(ModeHost, "k8s-proxy.example.com")
+	assert.Error(t, err)
+
+	_, err = New(ModeHost, "{cluster}.{cluster}.example.com")
+	assert.Error(t, err)
+
+	_, err = New("sni", "")
+	assert.Error(t, err)
+
+	r, err := New("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, NewPath(), r)
+
+	assert.Equal(t, "prod.k8s-proxy.example.com", Hostname("{cluster}.k8s-proxy.example.com", "prod"))
+}
@@ -8,10 +8,17 @@ import (
 	"net/http"
 	"strings"
 
+	"go.opentelemetry.io/otel/attribute"
 	v1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
 	clientazv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	"k8s.io/component-base/tracing"
+
+	"github.com/Improwised/kube-oidc-proxy/pkg/util"
 )
 
 var (
@@ -63,12 +70,12 @@ func (subjectAccessReview *SubjectAccessReview) CheckAuthorizedForImpersonation(
 			if keyToCheck == "impersonate-user" {
 				userToImpersonate := values[0]
 				if userToImpersonate != "" {
-					result, err := subjectAccessReview.checkRbacImpersonationAuthorization("users", userToImpersonate, requester)
+					result, err := subjectAccessReview.checkRbacImpersonationAuthorization(req.Context(), "users", userToImpersonate, requester)
 					if err != nil {
 						return nil, err
 					} else {
 						if !result {
-							return nil, fmt.Errorf("%s is not allowed to impersonate user '%s'", requester.GetName(), userToImpersonate)
+							return nil, forbidden(requester, "users", userToImpersonate)
 						} else {
 							targetUser.Name = userToImpersonate
 						}
@@ -78,12 +85,12 @@ func (subjectAccessReview *SubjectAccessReview) CheckAuthorizedForImpersonation(
 
 				for i := range values {
 					groupName := values[i]
-					result, err := subjectAccessReview.checkRbacImpersonationAuthorization("groups", groupName, requester)
+					result, err := subjectAccessReview.checkRbacImpersonationAuthorization(req.Context(), "groups", groupName, requester)
 					if err != nil {
 						return nil, err
 					} else {
 						if !result {
-							return nil, fmt.Errorf("%s is not allowed to impersonate group '%s'", requester.GetName(), groupName)
+							return nil, forbidden(requester, "groups", groupName)
 						} else {
 							targetUser.Groups = append(targetUser.Groups, groupName)
 						}
@@ -91,12 +98,12 @@ func (subjectAccessReview *SubjectAccessReview) CheckAuthorizedForImpersonation(
 				}
 			} else if keyToCheck == "impersonate-uid" {
 				uidToImpersonate := values[0]
-				result, err := subjectAccessReview.checkRbacImpersonationAuthorization("uids", uidToImpersonate, requester)
+				result, err := subjectAccessReview.checkRbacImpersonationAuthorization(req.Context(), "uids", uidToImpersonate, requester)
 				if err != nil {
 					return nil, err
 				} else {
 					if !result {
-						return nil, fmt.Errorf("%s is not allowed to impersonate uid '%s'", requester.GetName(), uidToImpersonate)
+						return nil, forbidden(requester, "uids", uidToImpersonate)
 					} else {
 						targetUser.UID = uidToImpersonate
 					}
@@ -106,13 +113,13 @@ func (subjectAccessReview *SubjectAccessReview) CheckAuthorizedForImpersonation(
 				// the extra name MUST be lowercase...so we'll force to lowercase for the rbac check
 				extraName := strings.ToLower(key[18:])
 				for i := range values {
-					result, err := subjectAccessReview.checkRbacImpersonationAuthorization("userextras/"+extraName, values[i], requester)
+					result, err := subjectAccessReview.checkRbacImpersonationAuthorization(req.Context(), "userextras/"+extraName, values[i], requester)
 					if err != nil {
 						return nil, err
 					} else {
 						if !result {
 
-							return nil, fmt.Errorf("%s is not allowed to impersonate extra info '%s'='%s'", requester.GetName(), extraName, values[i])
+							return nil, forbidden(requester, "userextras/"+extraName, values[i])
 						} else {
 							infoVals, ok := targetUser.Extra[extraName]
 
@@ -128,7 +135,7 @@ func (subjectAccessReview *SubjectAccessReview) CheckAuthorizedForImpersonation(
 				}
 			} else if strings.HasPrefix(keyToCheck, "impersonate-") {
 				// unkown impersonation header, fail
-				return nil, fmt.Errorf("unknown impersonation header '%s'", key)
+				return nil, apierrors.NewBadRequest(fmt.Sprintf("unknown impersonation header '%s'", key))
 			}
 
 		}
@@ -158,8 +165,28 @@ func (subjectAccessReview *SubjectAccessReview) CheckAuthorizedForImpersonation(
 	}
 }
 
+// forbidden returns the Forbidden status error for a denied impersonation of
+// the named resource, with the same message the API server would return.
+func forbidden(requester user.Info, resource, name string) error {
+	attributes := authorizer.AttributesRecord{
+		User:            requester,
+		Verb:            "impersonate",
+		Resource:        resource,
+		Name:            name,
+		ResourceRequest: true,
+	}
+
+	if slashIndex := strings.Index(resource, "/"); slashIndex > 0 {
+		attributes.Resource = resource[:slashIndex]
+		attributes.Subresource = resource[slashIndex+1:]
+		attributes.APIGroup = "authentication.k8s.io"
+	}
+
+	return responsewriters.ForbiddenStatusError(attributes, "")
+}
+
 // submit a SubjectAccessReview request to the API server to validate that impersonation can occur
-func (subjectAccessReview *SubjectAccessReview) checkRbacImpersonationAuthorization(resource string, name string, requester user.Info) (bool, error) {
+func (subjectAccessReview *SubjectAccessReview) checkRbacImpersonationAuthorization(ctx context.Context, resource string, name string, requester user.Info) (bool, error) {
 	extras := map[string]v1.ExtraValue{}
 	var group string
 	var subresource string
@@ -193,9 +220,14 @@ func (subjectAccessReview *SubjectAccessReview) checkRbacImpersonationAuthorizat
 		},
 	}
 
-	reviewResult, err := subjectAccessReview.subjectAccessReviewer.Create(context.TODO(), &clusterSubjectAccessReview, metav1.CreateOptions{})
+	ctx, span := tracing.Start(ctx, "SubjectAccessReview",
+		attribute.String("resource", resource), attribute.String("name", name))
+	defer span.End(util.TraceLogThreshold)
+
+	reviewResult, err := subjectAccessReview.subjectAccessReviewer.Create(ctx, &clusterSubjectAccessReview, metav1.CreateOptions{})
 
 	if err != nil {
+		span.RecordError(err)
 		return false, err
 	} else {
 		return reviewResult.Status.Allowed, nil
@@ -10,9 +10,26 @@ import (
 
 	"github.com/Improwised/kube-oidc-proxy/pkg/proxy/subjectaccessreview/fake"
 	v1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apiserver/pkg/authentication/user"
 )
 
+// expForbidden returns the Status error expected for a denied impersonation.
+func expForbidden(group, kind, name, message string) error {
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusForbidden,
+		Reason:  metav1.StatusReasonForbidden,
+		Message: message,
+		Details: &metav1.StatusDetails{
+			Group: group,
+			Kind:  kind,
+			Name:  name,
+		},
+	}}
+}
+
 // stores the context for each test case
 type testT struct {
 	// the already authenticated user
@@ -84,7 +101,7 @@ func TestSubectAccessReview(t *testing.T) {
 
 			expImpersonationHeaders:  true,
 			expAz:                    false,
-			expErr:                   errors.New("mmosley is not allowed to impersonate user 'jjackson-x'"),
+			expErr:                   expForbidden("", "users", "jjackson-x", `users "jjackson-x" is forbidden: User "mmosley" cannot impersonate resource "users" in API group "" at the cluster scope`),
 			expErrorRbac:             nil,
 			extraImpersonationHeader: false,
 		},
@@ -110,7 +127,7 @@ func TestSubectAccessReview(t *testing.T) {
 
 			expImpersonationHeaders:  true,
 			expAz:                    false,
-			expErr:                   errors.New("mmosley is not allowed to impersonate group 'group4'"),
+			expErr:                   expForbidden("", "groups", "group4", `groups "group4" is forbidden: User "mmosley" cannot impersonate resource "groups" in API group "" at the cluster scope`),
 			expErrorRbac:             nil,
 			extraImpersonationHeader: false,
 		},
@@ -136,7 +153,7 @@ func TestSubectAccessReview(t *testing.T) {
 
 			expImpersonationHeaders:  true,
 			expAz:                    false,
-			expErr:                   errors.New("mmosley is not allowed to impersonate extra info 'remoteaddr'='1.2.3.5'"),
+			expErr:                   expForbidden("authentication.k8s.io", "userextras", "1.2.3.5", `userextras.authentication.k8s.io "1.2.3.5" is forbidden: User "mmosley" cannot impersonate resource "userextras/remoteaddr" in API group "authentication.k8s.io" at the cluster scope`),
 			expErrorRbac:             nil,
 			extraImpersonationHeader: false,
 		},
@@ -161,7 +178,7 @@ func TestSubectAccessReview(t *testing.T) {
 
 			expImpersonationHeaders:  true,
 			expAz:                    false,
-			expErr:                   errors.New("mmosley is not allowed to impersonate uid '1-2-3-5'"),
+			expErr:                   expForbidden("", "uids", "1-2-3-5", `uids "1-2-3-5" is forbidden: User "mmosley" cannot impersonate resource "uids" in API group "" at the cluster scope`),
 			expErrorRbac:             nil,
 			extraImpersonationHeader: false,
 		},
@@ -229,7 +246,7 @@ func TestSubectAccessReview(t *testing.T) {
 
 			expImpersonationHeaders:  true,
 			expAz:                    false,
-			expErr:                   errors.New("unknown impersonation header 'Impersonate-doesnotexist'"),
+			expErr:                   apierrors.NewBadRequest("unknown impersonation header 'Impersonate-doesnotexist'"),
 			expErrorRbac:             nil,
 			extraImpersonationHeader: true,
 		},
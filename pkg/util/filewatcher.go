@@ -0,0 +1,95 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// DefaultFileWatchInterval is how often watched files are checked for changes.
+const DefaultFileWatchInterval = time.Second * 30
+
+// FileWatcher polls a file and passes its content to a callback whenever it
+// changes. Polling, rather than inotify, also picks up files replaced through
+// symlink swaps such as mounted ConfigMaps and Secrets.
+type FileWatcher struct {
+	path     string
+	onChange func(data []byte) error
+
+	mu      sync.RWMutex
+	content []byte
+	err     error
+}
+
+// NewFileWatcher returns a watcher for the file and synchronously loads it
+// once. A failed load is recorded and returned by Err rather than failing
+// construction, so the file may appear later.
+func NewFileWatcher(path string, onChange func(data []byte) error) *FileWatcher {
+	w := &FileWatcher{
+		path:     path,
+		onChange: onChange,
+	}
+	w.load()
+
+	return w
+}
+
+// Run polls the file at the given interval until stopCh is closed.
+func (w *FileWatcher) Run(interval time.Duration, stopCh <-chan struct{}) {
+	go wait.Until(w.Reload, interval, stopCh)
+}
+
+// Reload reads the file immediately, calling the callback if it changed.
+func (w *FileWatcher) Reload() {
+	w.load()
+}
+
+// Err returns the error of the last load, or nil if it succeeded.
+func (w *FileWatcher) Err() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.err
+}
+
+func (w *FileWatcher) load() {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		w.setErr(fmt.Errorf("failed to read %q: %w", w.path, err))
+		return
+	}
+
+	w.mu.RLock()
+	unchanged := w.content != nil && bytes.Equal(w.content, data)
+	w.mu.RUnlock()
+	if unchanged {
+		w.setErr(nil)
+		return
+	}
+
+	if err := w.onChange(data); err != nil {
+		w.setErr(fmt.Errorf("failed to load %q: %w", w.path, err))
+		return
+	}
+
+	klog.V(2).Infof("loaded %q", w.path)
+
+	w.mu.Lock()
+	w.content = data
+	w.err = nil
+	w.mu.Unlock()
+}
+
+func (w *FileWatcher) setErr(err error) {
+	if err != nil {
+		klog.Error(err)
+	}
+
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+}
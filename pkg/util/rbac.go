@@ -10,6 +10,7 @@ import (
 	"gopkg.in/yaml.v3"
 	v1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
 )
 
 type Role struct {
@@ -84,6 +85,46 @@ type RBAC struct {
 	ClusterRoleBindings []*v1.ClusterRoleBinding
 }
 
+// HasBindingFor returns true if at least one RoleBinding or ClusterRoleBinding
+// has a User subject matching the user name or a Group subject matching one
+// of the user's groups.
+func (r *RBAC) HasBindingFor(u user.Info) bool {
+	groups := make(map[string]bool, len(u.GetGroups()))
+	for _, group := range u.GetGroups() {
+		groups[group] = true
+	}
+
+	matches := func(subjects []v1.Subject) bool {
+		for _, subject := range subjects {
+			switch subject.Kind {
+			case v1.UserKind:
+				if subject.Name == u.GetName() {
+					return true
+				}
+			case v1.GroupKind:
+				if groups[subject.Name] {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for _, crb := range r.ClusterRoleBindings {
+		if matches(crb.Subjects) {
+			return true
+		}
+	}
+
+	for _, rb := range r.RoleBindings {
+		if matches(rb.Subjects) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func LoadRBACConfig(path string) (map[string]RBAC, error) {
 	var clusterRBACMapper = map[string]RBAC{}
 
@@ -16,7 +16,13 @@ func ParseTokenFromRequest(req *http.Request) (string, bool) {
 		return "", false
 	}
 
-	auth := strings.TrimSpace(req.Header.Get("Authorization"))
+	return ParseBearerToken(req.Header.Get("Authorization"))
+}
+
+// ParseBearerToken returns just the token from an Authorization header value,
+// without 'bearer'.
+func ParseBearerToken(auth string) (string, bool) {
+	auth = strings.TrimSpace(auth)
 	if auth == "" {
 		return "", false
 	}
@@ -36,6 +42,40 @@ func ParseTokenFromRequest(req *http.Request) (string, bool) {
 	return token, true
 }
 
+// UnverifiedIssuer returns the 'iss' claim of a JWT without verifying its
+// signature. The result must only be used to select the authenticator that
+// verifies the token.
+func UnverifiedIssuer(token string) (string, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return "", err
+	}
+
+	var claims jwt.Claims
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return "", err
+	}
+
+	return claims.Issuer, nil
+}
+
+// UnverifiedClaims returns all claims of a JWT without verifying its
+// signature. The token must have been authenticated before its claims are
+// trusted.
+func UnverifiedClaims(token string) (map[string]interface{}, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
 // fakeJWT generates a valid JWT using the passed input parameters which is
 // signed by a generated key. This is useful for checking the status of a
 // signer.
@@ -142,3 +142,22 @@ func TestParseTokenFromHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestUnverifiedIssuer(t *testing.T) {
+	token, err := FakeJWT("https://issuer.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iss, err := UnverifiedIssuer(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if iss != "https://issuer.example.com" {
+		t.Errorf("unexpected issuer, exp=%q got=%q", "https://issuer.example.com", iss)
+	}
+
+	if _, err := UnverifiedIssuer("not-a-jwt"); err == nil {
+		t.Error("expected error parsing invalid token")
+	}
+}
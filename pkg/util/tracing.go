@@ -0,0 +1,7 @@
+package util
+
+import "time"
+
+// TraceLogThreshold is the duration after which a traced stage of a request
+// is logged as slow.
+const TraceLogThreshold = 500 * time.Millisecond